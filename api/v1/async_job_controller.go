@@ -0,0 +1,25 @@
+package v1
+
+import (
+	"github.com/gin-gonic/gin"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/service/job"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/zlog"
+	"net/http"
+)
+
+// GetAsyncJob 轮询异步任务的状态和结果
+func GetAsyncJob(c *gin.Context) {
+	var req request.GetAsyncJobRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, rsp, ret := job.GetJob(req.OwnerId, req.JobId)
+	JsonBack(c, message, ret, rsp)
+}
@@ -0,0 +1,83 @@
+package v1
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/service/gorm"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/zlog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GetAuditLogList 查询审计日志 - 管理员
+func GetAuditLogList(c *gin.Context) {
+	var req request.GetAuditLogListRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, rsp, ret := gorm.AuditLogService.GetAuditLogList(req)
+	JsonBack(c, message, ret, rsp)
+}
+
+// ExportAuditLog 导出审计日志为csv或json文件 - 管理员
+func ExportAuditLog(c *gin.Context) {
+	var req request.ExportAuditLogRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	if req.Format == "" {
+		req.Format = "csv"
+	}
+	if req.Format != "csv" && req.Format != "json" {
+		JsonBack(c, "导出格式只支持csv和json", -2, nil)
+		return
+	}
+	message, logs, ret := gorm.AuditLogService.ExportAuditLogs(req.GetAuditLogListRequest)
+	if ret != 0 {
+		JsonBack(c, message, ret, nil)
+		return
+	}
+	filename := "audit_log_" + time.Now().Format("20060102150405") + "." + req.Format
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	if req.Format == "json" {
+		data, err := json.Marshal(logs)
+		if err != nil {
+			zlog.Error(err.Error())
+			JsonBack(c, constants.SYSTEM_ERROR, -1, nil)
+			return
+		}
+		c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+		return
+	}
+	var buf bytes.Buffer
+	// 带BOM，Excel打开时中文不乱码
+	buf.WriteString("\xEF\xBB\xBF")
+	writer := csv.NewWriter(&buf)
+	_ = writer.Write([]string{"id", "actor_id", "action", "target_id", "before", "after", "ip", "created_at"})
+	for _, log := range logs {
+		_ = writer.Write([]string{strconv.FormatInt(log.Id, 10), log.ActorId, log.Action, log.TargetId,
+			log.Before, log.After, log.Ip, log.CreatedAt})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		zlog.Error(err.Error())
+		JsonBack(c, constants.SYSTEM_ERROR, -1, nil)
+		return
+	}
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
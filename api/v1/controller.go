@@ -2,6 +2,7 @@ package v1
 
 import (
 	"github.com/gin-gonic/gin"
+	"kama_chat_server/internal/service/gorm"
 	"net/http"
 )
 
@@ -24,6 +25,12 @@ func JsonBack(c *gin.Context, message string, ret int, data interface{}) {
 			"code":    400,
 			"message": message,
 		})
+	} else if ret == -3 {
+		// 已登录但没有权限
+		c.JSON(http.StatusOK, gin.H{
+			"code":    403,
+			"message": message,
+		})
 	} else if ret == -1 {
 		c.JSON(http.StatusOK, gin.H{
 			"code":    500,
@@ -31,3 +38,13 @@ func JsonBack(c *gin.Context, message string, ret int, data interface{}) {
 		})
 	}
 }
+
+// adminOperator 管理接口的操作人，身份来自AdminMiddleware校验过的管理令牌
+func adminOperator(c *gin.Context) gorm.Operator {
+	return gorm.Operator{Uuid: c.GetString("admin_id"), Ip: c.ClientIP()}
+}
+
+// userOperator 普通接口的操作人，身份取自请求中的用户id
+func userOperator(c *gin.Context, uuid string) gorm.Operator {
+	return gorm.Operator{Uuid: uuid, Ip: c.ClientIP()}
+}
@@ -0,0 +1,41 @@
+package v1
+
+import (
+	"github.com/gin-gonic/gin"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/service/chat"
+	"kama_chat_server/internal/service/gorm"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/zlog"
+	"net/http"
+)
+
+// GetDeadLetterList 查询处理失败的聊天消息 - 管理员
+func GetDeadLetterList(c *gin.Context) {
+	var req request.GetDeadLetterListRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, rsp, ret := gorm.DeadLetterService.GetDeadLetterList(req)
+	JsonBack(c, message, ret, rsp)
+}
+
+// ReplayDeadLetters 重新投递死信 - 管理员
+func ReplayDeadLetters(c *gin.Context) {
+	var req request.ReplayDeadLettersRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, ret := gorm.DeadLetterService.ReplayDeadLetters(adminOperator(c), req.IdList, chat.ReplayMessage)
+	JsonBack(c, message, ret, nil)
+}
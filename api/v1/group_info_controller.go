@@ -3,6 +3,7 @@ package v1
 import (
 	"github.com/gin-gonic/gin"
 	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/service/chat"
 	"kama_chat_server/internal/service/gorm"
 	"kama_chat_server/pkg/constants"
 	"kama_chat_server/pkg/zlog"
@@ -95,7 +96,10 @@ func DismissGroup(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.GroupInfoService.DismissGroup(req.OwnerId, req.GroupId)
+	message, members, ret := gorm.GroupInfoService.DismissGroup(userOperator(c, req.OwnerId), req.GroupId)
+	if ret == 0 {
+		chat.NotifyGroupDismissed(req.GroupId, members)
+	}
 	JsonBack(c, message, ret, nil)
 }
 
@@ -131,7 +135,7 @@ func DeleteGroups(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.GroupInfoService.DeleteGroups(req.UuidList)
+	message, ret := gorm.GroupInfoService.DeleteGroups(adminOperator(c), req.UuidList)
 	JsonBack(c, message, ret, nil)
 }
 
@@ -146,7 +150,7 @@ func SetGroupsStatus(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.GroupInfoService.SetGroupsStatus(req.UuidList, req.Status)
+	message, ret := gorm.GroupInfoService.SetGroupsStatus(adminOperator(c), req.UuidList, req.Status)
 	JsonBack(c, message, ret, nil)
 }
 
@@ -191,6 +195,9 @@ func RemoveGroupMembers(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.GroupInfoService.RemoveGroupMembers(req)
+	message, ret := gorm.GroupInfoService.RemoveGroupMembers(userOperator(c, req.OwnerId), req)
+	if ret == 0 {
+		chat.NotifyGroupRemoved(req.GroupId, req.UuidList)
+	}
 	JsonBack(c, message, ret, nil)
 }
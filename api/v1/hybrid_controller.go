@@ -0,0 +1,47 @@
+package v1
+
+import (
+	"github.com/gin-gonic/gin"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/service/chat"
+	"kama_chat_server/internal/service/gorm"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/zlog"
+	"net/http"
+)
+
+// GetHybridStatus 查看当前实例的混合模式状态 - 管理员
+func GetHybridStatus(c *gin.Context) {
+	message, rsp, ret := chat.GetHybridStatus()
+	JsonBack(c, message, ret, rsp)
+}
+
+// SetHybridMode 手动指定当前实例的混合模式 - 管理员
+func SetHybridMode(c *gin.Context) {
+	var req request.SetHybridModeRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, ret := gorm.HybridModeService.SetMode(adminOperator(c), req.Mode, req.Reason, chat.ForceHybridMode)
+	JsonBack(c, message, ret, nil)
+}
+
+// GetHybridModeEventList 查询模式切换记录 - 管理员
+func GetHybridModeEventList(c *gin.Context) {
+	var req request.GetHybridModeEventListRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, rsp, ret := gorm.HybridModeService.GetModeEventList(req)
+	JsonBack(c, message, ret, rsp)
+}
@@ -3,13 +3,13 @@ package v1
 import (
 	"github.com/gin-gonic/gin"
 	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/service/chat"
 	"kama_chat_server/internal/service/gorm"
+	"kama_chat_server/internal/service/job"
 	"kama_chat_server/pkg/constants"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
-	"kama_chat_server/internal/config"
 )
 
 // GetMessageList 获取聊天记录
@@ -22,7 +22,10 @@ func GetMessageList(c *gin.Context) {
 		})
 		return
 	}
-	message, rsp, ret := gorm.MessageService.GetMessageList(req.UserOneId, req.UserTwoId)
+	message, rsp, ret := job.Submit(req.UserOneId, job.TaskLoadMessageList, request.MessageListTaskParams{
+		UserOneId: req.UserOneId,
+		UserTwoId: req.UserTwoId,
+	}, "正在加载聊天记录...")
 	JsonBack(c, message, ret, rsp)
 }
 
@@ -36,7 +39,24 @@ func GetGroupMessageList(c *gin.Context) {
 		})
 		return
 	}
-	message, rsp, ret := gorm.MessageService.GetGroupMessageList(req.GroupId)
+	message, rsp, ret := job.Submit(req.OwnerId, job.TaskLoadGroupMessageList, request.GroupMessageListTaskParams{
+		GroupId: req.GroupId,
+		OwnerId: req.OwnerId,
+	}, "正在加载群聊记录...")
+	JsonBack(c, message, ret, rsp)
+}
+
+// GetMessageListBySeq 按序号区间补拉消息
+func GetMessageListBySeq(c *gin.Context) {
+	var req request.GetMessageListBySeqRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, rsp, ret := gorm.MessageService.GetMessageListBySeq(req.OwnerId, req.ReceiveId, req.FromSeq, req.ToSeq)
 	JsonBack(c, message, ret, rsp)
 }
 
@@ -46,13 +66,75 @@ func UploadAvatar(c *gin.Context) {
 	JsonBack(c, message, ret, nil)
 }
 
-// UploadFile 上传头像
+// UploadFile 上传文件
 func UploadFile(c *gin.Context) {
-	message, ret := gorm.MessageService.UploadFile(c)
+	message, rsp, ret := gorm.MessageService.UploadFile(c)
+	JsonBack(c, message, ret, rsp)
+}
+
+// GetFileUrl 获取文件签名下载链接
+func GetFileUrl(c *gin.Context) {
+	var req request.GetFileUrlRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, rsp, ret := gorm.MessageService.GetFileUrl(req.OwnerId, req.MessageId)
+	JsonBack(c, message, ret, rsp)
+}
+
+// MarkVoiceListened 标记语音消息已听
+func MarkVoiceListened(c *gin.Context) {
+	var req request.MarkVoiceListenedRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, ret := gorm.MessageService.MarkVoiceListened(req.OwnerId, req.MessageId)
 	JsonBack(c, message, ret, nil)
 }
 
-// DownloadFile 下载文件
+// AddReaction 添加表情回应
+func AddReaction(c *gin.Context) {
+	var req request.MessageReactionRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, rsp, members, ret := gorm.MessageService.AddReaction(req.OwnerId, req.MessageId, req.Emoji)
+	if ret == 0 {
+		chat.PushToUsers(members, chat.FrameMessageReaction, rsp)
+	}
+	JsonBack(c, message, ret, rsp)
+}
+
+// RemoveReaction 取消表情回应
+func RemoveReaction(c *gin.Context) {
+	var req request.MessageReactionRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, rsp, members, ret := gorm.MessageService.RemoveReaction(req.OwnerId, req.MessageId, req.Emoji)
+	if ret == 0 {
+		chat.PushToUsers(members, chat.FrameMessageReaction, rsp)
+	}
+	JsonBack(c, message, ret, rsp)
+}
+
+// DownloadFile 下载文件，需要携带GetFileUrl签发的签名参数
 func DownloadFile(c *gin.Context) {
 	// 获取文件名参数
 	fileName := c.Param("filename")
@@ -74,9 +156,22 @@ func DownloadFile(c *gin.Context) {
 		return
 	}
 
-	// 构建文件路径
-	filePath := filepath.Join(config.GetConfig().StaticFilePath, decodedFileName)
-	
+	// 校验签名和会话权限，并记录下载日志
+	message, filePath, ret := gorm.MessageService.CheckFileDownload(decodedFileName, c.Query("message_id"), c.Query("owner_id"), c.Query("expires"), c.Query("signature"), c.ClientIP())
+	if ret == -2 {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    403,
+			"message": message,
+		})
+		return
+	} else if ret == -1 {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": message,
+		})
+		return
+	}
+
 	// 检查文件是否存在
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		c.JSON(http.StatusNotFound, gin.H{
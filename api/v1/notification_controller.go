@@ -0,0 +1,40 @@
+package v1
+
+import (
+	"github.com/gin-gonic/gin"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/service/gorm"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/zlog"
+	"net/http"
+)
+
+// GetNotificationSetting 获取离线通知设置
+func GetNotificationSetting(c *gin.Context) {
+	var req request.OwnlistRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, rsp, ret := gorm.NotificationService.GetNotificationSetting(req.OwnerId)
+	JsonBack(c, message, ret, rsp)
+}
+
+// UpdateNotificationSetting 更新离线通知设置
+func UpdateNotificationSetting(c *gin.Context) {
+	var req request.UpdateNotificationSettingRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, ret := gorm.NotificationService.UpdateNotificationSetting(req)
+	JsonBack(c, message, ret, nil)
+}
@@ -69,6 +69,21 @@ func DeleteSession(c *gin.Context) {
 	JsonBack(c, message, ret, nil)
 }
 
+// UpdateSessionPreference 更新会话的免打扰、置顶和归档设置
+func UpdateSessionPreference(c *gin.Context) {
+	var req request.UpdateSessionPreferenceRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, ret := gorm.SessionService.UpdateSessionPreference(req)
+	JsonBack(c, message, ret, nil)
+}
+
 // CheckOpenSessionAllowed 检查是否可以打开会话
 func CheckOpenSessionAllowed(c *gin.Context) {
 	var req request.CreateSessionRequest
@@ -4,6 +4,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"kama_chat_server/internal/dto/request"
 	"kama_chat_server/internal/service/gorm"
+	"kama_chat_server/internal/service/job"
 	"kama_chat_server/pkg/constants"
 	"kama_chat_server/pkg/zlog"
 	"log"
@@ -35,7 +36,9 @@ func LoadMyJoinedGroup(c *gin.Context) {
 		})
 		return
 	}
-	message, groupList, ret := gorm.UserContactService.LoadMyJoinedGroup(loadMyJoinedGroupReq.OwnerId)
+	message, groupList, ret := job.Submit(loadMyJoinedGroupReq.OwnerId, job.TaskLoadJoinedGroupList, request.JoinedGroupListTaskParams{
+		OwnerId: loadMyJoinedGroupReq.OwnerId,
+	}, "正在加载加入的群聊列表...")
 	JsonBack(c, message, ret, groupList)
 }
 
@@ -66,7 +69,7 @@ func DeleteContact(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.UserContactService.DeleteContact(deleteContactReq.OwnerId, deleteContactReq.ContactId)
+	message, ret := gorm.UserContactService.DeleteContact(userOperator(c, deleteContactReq.OwnerId), deleteContactReq.ContactId)
 	JsonBack(c, message, ret, nil)
 }
 
@@ -111,7 +114,7 @@ func PassContactApply(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.UserContactService.PassContactApply(passContactApplyReq.OwnerId, passContactApplyReq.ContactId)
+	message, ret := gorm.UserContactService.PassContactApply(userOperator(c, passContactApplyReq.OwnerId), passContactApplyReq.ContactId)
 	JsonBack(c, message, ret, nil)
 }
 
@@ -126,7 +129,7 @@ func RefuseContactApply(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.UserContactService.RefuseContactApply(passContactApplyReq.OwnerId, passContactApplyReq.ContactId)
+	message, ret := gorm.UserContactService.RefuseContactApply(userOperator(c, passContactApplyReq.OwnerId), passContactApplyReq.ContactId)
 	JsonBack(c, message, ret, nil)
 }
 
@@ -141,7 +144,7 @@ func BlackContact(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.UserContactService.BlackContact(req.OwnerId, req.ContactId)
+	message, ret := gorm.UserContactService.BlackContact(userOperator(c, req.OwnerId), req.ContactId)
 	JsonBack(c, message, ret, nil)
 }
 
@@ -156,7 +159,7 @@ func CancelBlackContact(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.UserContactService.CancelBlackContact(req.OwnerId, req.ContactId)
+	message, ret := gorm.UserContactService.CancelBlackContact(userOperator(c, req.OwnerId), req.ContactId)
 	JsonBack(c, message, ret, nil)
 }
 
@@ -186,6 +189,6 @@ func BlackApply(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.UserContactService.BlackApply(req.OwnerId, req.ContactId)
+	message, ret := gorm.UserContactService.BlackApply(userOperator(c, req.OwnerId), req.ContactId)
 	JsonBack(c, message, ret, nil)
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/service/chat"
 	"kama_chat_server/internal/service/gorm"
 	"kama_chat_server/pkg/constants"
 	"kama_chat_server/pkg/zlog"
@@ -82,7 +83,8 @@ func GetUserInfoList(c *gin.Context) {
 		})
 		return
 	}
-	message, userList, ret := gorm.UserInfoService.GetUserInfoList(req.OwnerId)
+	// 调用方以管理令牌为准，请求中的owner_id只为兼容旧前端保留
+	message, userList, ret := gorm.UserInfoService.GetUserInfoList(c.GetString("admin_id"))
 	JsonBack(c, message, ret, userList)
 }
 
@@ -97,7 +99,7 @@ func AbleUsers(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.UserInfoService.AbleUsers(req.UuidList)
+	message, ret := gorm.UserInfoService.AbleUsers(adminOperator(c), req.UuidList)
 	JsonBack(c, message, ret, nil)
 }
 
@@ -112,7 +114,10 @@ func DisableUsers(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.UserInfoService.DisableUsers(req.UuidList)
+	message, ret := gorm.UserInfoService.DisableUsers(adminOperator(c), req.UuidList)
+	if ret == 0 {
+		chat.DisconnectUsers(req.UuidList, "账号已被禁用")
+	}
 	JsonBack(c, message, ret, nil)
 }
 
@@ -142,7 +147,10 @@ func DeleteUsers(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.UserInfoService.DeleteUsers(req.UuidList)
+	message, ret := gorm.UserInfoService.DeleteUsers(adminOperator(c), req.UuidList)
+	if ret == 0 {
+		chat.DisconnectUsers(req.UuidList, "账号已被删除")
+	}
 	JsonBack(c, message, ret, nil)
 }
 
@@ -157,7 +165,7 @@ func SetAdmin(c *gin.Context) {
 		})
 		return
 	}
-	message, ret := gorm.UserInfoService.SetAdmin(req.UuidList, req.IsAdmin)
+	message, ret := gorm.UserInfoService.SetAdmin(adminOperator(c), req.UuidList, req.IsAdmin)
 	JsonBack(c, message, ret, nil)
 }
 
@@ -175,3 +183,168 @@ func SendSmsCode(c *gin.Context) {
 	message, ret := gorm.UserInfoService.SendSmsCode(req.Telephone)
 	JsonBack(c, message, ret, nil)
 }
+
+// SendEmailVerifyCode 发送邮箱验证码
+func SendEmailVerifyCode(c *gin.Context) {
+	var req request.SendEmailVerifyCodeRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, ret := gorm.UserInfoService.SendEmailVerifyCode(req.Uuid)
+	JsonBack(c, message, ret, nil)
+}
+
+// VerifyEmail 验证邮箱
+func VerifyEmail(c *gin.Context) {
+	var req request.VerifyEmailRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, ret := gorm.UserInfoService.VerifyEmail(req)
+	JsonBack(c, message, ret, nil)
+}
+
+// SendEmailLoginCode 发送邮箱登录验证码
+func SendEmailLoginCode(c *gin.Context) {
+	var req request.SendEmailLoginCodeRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, ret := gorm.UserInfoService.SendEmailLoginCode(req.Email)
+	JsonBack(c, message, ret, nil)
+}
+
+// EmailLogin 邮箱验证码登录
+func EmailLogin(c *gin.Context) {
+	var req request.EmailLoginRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, userInfo, ret := gorm.UserInfoService.EmailLogin(req)
+	JsonBack(c, message, ret, userInfo)
+}
+
+// RequestPasswordReset 申请通过邮箱重置密码
+func RequestPasswordReset(c *gin.Context) {
+	var req request.RequestPasswordResetRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, ret := gorm.UserInfoService.RequestPasswordReset(req.Email)
+	JsonBack(c, message, ret, nil)
+}
+
+// ResetPassword 使用重置链接设置新密码
+func ResetPassword(c *gin.Context) {
+	var req request.ResetPasswordRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, ret := gorm.UserInfoService.ResetPassword(req)
+	JsonBack(c, message, ret, nil)
+}
+
+// SetupTotp 生成二次验证密钥和二维码地址
+func SetupTotp(c *gin.Context) {
+	var req request.TotpSetupRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, data, ret := gorm.UserInfoService.SetupTotp(req)
+	JsonBack(c, message, ret, data)
+}
+
+// EnableTotp 确认开启二次验证
+func EnableTotp(c *gin.Context) {
+	var req request.TotpCodeRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, data, ret := gorm.UserInfoService.EnableTotp(req)
+	JsonBack(c, message, ret, data)
+}
+
+// DisableTotp 关闭二次验证
+func DisableTotp(c *gin.Context) {
+	var req request.TotpCodeRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, ret := gorm.UserInfoService.DisableTotp(req)
+	JsonBack(c, message, ret, nil)
+}
+
+// RegenerateRecoveryCodes 重新生成恢复码
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var req request.TotpCodeRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, data, ret := gorm.UserInfoService.RegenerateRecoveryCodes(req)
+	JsonBack(c, message, ret, data)
+}
+
+// TotpLogin 登录第二步，校验二次验证码
+func TotpLogin(c *gin.Context) {
+	var req request.TotpLoginRequest
+	if err := c.BindJSON(&req); err != nil {
+		zlog.Error(err.Error())
+		c.JSON(http.StatusOK, gin.H{
+			"code":    500,
+			"message": constants.SYSTEM_ERROR,
+		})
+		return
+	}
+	message, userInfo, ret := gorm.UserInfoService.TotpLogin(req)
+	JsonBack(c, message, ret, userInfo)
+}
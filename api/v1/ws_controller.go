@@ -4,6 +4,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"kama_chat_server/internal/dto/request"
 	"kama_chat_server/internal/service/chat"
+	"kama_chat_server/internal/service/gorm"
 	"kama_chat_server/pkg/constants"
 	"kama_chat_server/pkg/zlog"
 	"net/http"
@@ -20,6 +21,11 @@ func WsLogin(c *gin.Context) {
 		})
 		return
 	}
+	// 被禁用、删除的用户不允许建立连接
+	if message, ret := gorm.UserInfoService.CheckUserStatus(clientId); ret != 0 {
+		JsonBack(c, message, ret, nil)
+		return
+	}
 	chat.NewClientInit(c, clientId)
 }
 
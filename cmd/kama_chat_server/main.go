@@ -5,6 +5,7 @@ import (
 	"kama_chat_server/internal/config"
 	"kama_chat_server/internal/https_server"
 	"kama_chat_server/internal/service/chat"
+	"kama_chat_server/internal/service/job"
 	"kama_chat_server/internal/service/kafka"
 	myredis "kama_chat_server/internal/service/redis"
 	"kama_chat_server/pkg/zlog"
@@ -21,7 +22,13 @@ func main() {
 	
 	// 根据消息模式初始化相应的服务
 	if kafkaConfig.MessageMode == "kafka" || kafkaConfig.MessageMode == "hybrid" {
-		kafka.KafkaService.KafkaInit()
+		if err := kafka.KafkaService.KafkaInit(); err != nil {
+			zlog.Fatal(err.Error())
+		}
+		// 加载聊天记录等异步任务的消费者
+		go job.Start()
+		// 聊天消息的死信落表
+		go chat.ConsumeDeadLetters()
 	}
 
 	if kafkaConfig.MessageMode == "channel" {
@@ -68,6 +75,9 @@ func main() {
 		chat.HybridChatServer.Close()
 	}
 
+	// 发出尚在合并窗口内的离线通知
+	chat.Notifier.Flush()
+
 	zlog.Info("关闭服务器...")
 
 	// 删除所有Redis键
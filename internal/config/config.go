@@ -38,7 +38,10 @@ type AuthCodeConfig struct {
 type SmsAuthConfig struct {
 	AccessKeyID     string `toml:"accessKeyID"`
 	AccessKeySecret string `toml:"accessKeySecret"`
-	UseNewService   bool   `toml:"useNewService"` // 是否使用新的号码认证服务
+	UseNewService   bool   `toml:"useNewService"` // 是否使用新的号码认证服务，provider为空时生效
+	Provider        string `toml:"provider"`      // 短信渠道：aliyun_sms、aliyun_auth、webhook、fake
+	WebhookUrl      string `toml:"webhookUrl"`    // webhook渠道的短信网关地址
+	WebhookSecret   string `toml:"webhookSecret"` // webhook渠道的签名密钥
 }
 
 type LogConfig struct {
@@ -51,28 +54,143 @@ type KafkaConfig struct {
 	LoginTopic            string        `toml:"loginTopic"`
 	LogoutTopic           string        `toml:"logoutTopic"`
 	ChatTopic             string        `toml:"chatTopic"`
-	Partition             int           `toml:"partition"`
+	ChatEncoding          string        `toml:"chatEncoding"` // chat topic和转发channel中消息的编码，json or msgpack
+	AsyncTaskTopic        string        `toml:"asyncTaskTopic"`
+	Partition             int           `toml:"partition"`         // topic的分区数，启动时自动创建topic使用
+	ReplicationFactor     int           `toml:"replicationFactor"` // 自动创建topic时的副本数
 	Timeout               time.Duration `toml:"timeout"`
+	RequiredAcks          string        `toml:"requiredAcks"`   // 生产者确认级别 none、one、all
+	BatchSize             int           `toml:"batchSize"`      // 每批最多消息数，0为kafka-go默认的100
+	BatchBytes            int64         `toml:"batchBytes"`     // 每批最大字节数，0为kafka-go默认的1MB
+	BatchTimeoutMs        int           `toml:"batchTimeoutMs"` // 凑批最长等待时间(毫秒)
+	SaslMechanism         string        `toml:"saslMechanism"`  // 为空时不认证，目前支持plain
+	SaslUsername          string        `toml:"saslUsername"`
+	SaslPassword          string        `toml:"saslPassword"`
+	TlsEnable             bool          `toml:"tlsEnable"`
+	TlsCaFile             string        `toml:"tlsCaFile"`             // 为空时使用系统根证书
+	TlsInsecureSkipVerify bool          `toml:"tlsInsecureSkipVerify"` // 不校验服务端证书，仅用于测试环境
 	// 混合模式配置参数
 	HybridThreshold       float64       `toml:"hybridThreshold"`       // 触发切换的阈值比例 (0.0-1.0)
 	HybridMonitorInterval int           `toml:"hybridMonitorInterval"` // 监控间隔时间(秒)
 	HybridSwitchDuration  int           `toml:"hybridSwitchDuration"`  // 持续时间阈值(秒)
+	HybridDownThreshold   float64       `toml:"hybridDownThreshold"`   // 切回channel的阈值比例，低于hybridThreshold，默认为其一半
+	HybridRecoverDuration int           `toml:"hybridRecoverDuration"` // 切回channel前需要持续低于下限的时间(秒)
+	HybridCooldown        int           `toml:"hybridCooldown"`        // 两次自动切换的最小间隔(秒)
+	HybridLatencyMs       int           `toml:"hybridLatencyMs"`       // 单条消息平均处理耗时超过该值(毫秒)也视为超载，0为不检查
+	HybridKafkaLag        int64         `toml:"hybridKafkaLag"`        // kafka积压超过该值时不切回channel
 }
 
 type StaticSrcConfig struct {
-	StaticAvatarPath string `toml:"staticAvatarPath"`
-	StaticFilePath   string `toml:"staticFilePath"`
+	StaticAvatarPath    string `toml:"staticAvatarPath"`
+	StaticFilePath      string `toml:"staticFilePath"`
+	StaticThumbnailPath string `toml:"staticThumbnailPath"`
+	ImageMaxPixels      int64  `toml:"imageMaxPixels"` // 生成缩略图时允许的最大像素数，超过时不解码，0为使用默认值
+}
+
+// 文件下载签名配置
+type FileAccessConfig struct {
+	SignSecret string `toml:"signSecret"` // 下载链接签名密钥
+	UrlTimeout int    `toml:"urlTimeout"` // 下载链接有效期(秒)
+}
+
+// 离线通知配置
+type NotifyConfig struct {
+	CoalesceSeconds int    `toml:"coalesceSeconds"` // 推送合并窗口(秒)
+	DigestMinutes   int    `toml:"digestMinutes"`   // 邮件摘要合并窗口(分钟)
+	UseFakeProvider bool   `toml:"useFakeProvider"` // 本地开发时所有渠道都使用假渠道，只记录不发送
+	VapidSubject    string `toml:"vapidSubject"`
+	VapidPublicKey  string `toml:"vapidPublicKey"`
+	VapidPrivateKey string `toml:"vapidPrivateKey"`
+	WebhookUrl      string `toml:"webhookUrl"` // APNs/FCM推送网关地址
+	WebhookSecret   string `toml:"webhookSecret"`
+	SmtpHost        string `toml:"smtpHost"`
+	SmtpPort        int    `toml:"smtpPort"`
+	SmtpUsername    string `toml:"smtpUsername"`
+	SmtpPassword    string `toml:"smtpPassword"`
+	SmtpFrom        string `toml:"smtpFrom"`
+}
+
+// RateLimitConfig 限流配置，次数为0表示不限制
+type RateLimitConfig struct {
+	IpRate           float64 `toml:"ipRate"`           // 每个IP每秒请求数
+	IpBurst          int     `toml:"ipBurst"`          // 每个IP允许的突发请求数
+	UserRate         float64 `toml:"userRate"`         // 每个管理员每秒请求数，普通接口没有登录态，只按IP限流
+	UserBurst        int     `toml:"userBurst"`        // 每个管理员允许的突发请求数
+	AuthPerMinute    int     `toml:"authPerMinute"`    // 登录、注册、发送验证码接口每个IP每分钟次数
+	SmsPerHour       int     `toml:"smsPerHour"`       // 每个手机号每小时验证码条数
+	SmsPerDay        int     `toml:"smsPerDay"`        // 每个手机号每天验证码条数
+	LoginMaxFailures int     `toml:"loginMaxFailures"` // 锁定前允许的连续登录失败次数
+	LoginLockMinutes int     `toml:"loginLockMinutes"` // 登录失败的统计窗口和锁定时长(分钟)
+	WsMessageRate    float64 `toml:"wsMessageRate"`    // 每个websocket连接每秒消息数
+	WsMessageBurst   int     `toml:"wsMessageBurst"`   // 每个websocket连接允许的突发消息数
+}
+
+// EmailConfig 账号邮件配置，用于邮箱验证、邮箱验证码登录和找回密码
+type EmailConfig struct {
+	UseCaptureSender  bool   `toml:"useCaptureSender"`  // 本地开发只记录邮件不发送
+	SmtpHost          string `toml:"smtpHost"`
+	SmtpPort          int    `toml:"smtpPort"`
+	SmtpUsername      string `toml:"smtpUsername"`
+	SmtpPassword      string `toml:"smtpPassword"`
+	SmtpFrom          string `toml:"smtpFrom"`
+	CodeMinutes       int    `toml:"codeMinutes"`       // 邮箱验证码有效期(分钟)
+	ResetTokenMinutes int    `toml:"resetTokenMinutes"` // 重置密码链接有效期(分钟)
+	ResetUrl          string `toml:"resetUrl"`          // 前端重置密码页面地址，token拼在查询参数中
+}
+
+// TotpConfig TOTP二次验证配置
+type TotpConfig struct {
+	Issuer            string `toml:"issuer"`            // 验证器App中显示的发行方
+	ChallengeMinutes  int    `toml:"challengeMinutes"`  // 第一步登录成功后输入二次验证码的有效期(分钟)
+	AdminSessionHours int    `toml:"adminSessionHours"` // 管理员通过二次验证后管理令牌的有效期(小时)
+}
+
+// AdminConfig 管理员配置
+type AdminConfig struct {
+	SuperAdmins []string `toml:"superAdmins"` // 超级管理员手机号，启动时设为超级管理员，普通管理员不能取消、禁用或删除
+}
+
+// AsyncJobConfig 异步任务配置，kafka和hybrid模式下加载聊天记录等接口走异步任务
+type AsyncJobConfig struct {
+	Workers          int `toml:"workers"`          // 每个实例同时执行的任务数
+	TimeoutSeconds   int `toml:"timeoutSeconds"`   // 单次执行的超时时间(秒)
+	MaxAttempts      int `toml:"maxAttempts"`      // 最多执行次数，包括第一次
+	RetryBackoffMs   int `toml:"retryBackoffMs"`   // 第一次重试前的等待时间(毫秒)，之后每次翻倍
+	ResultTtlMinutes int `toml:"resultTtlMinutes"` // 任务状态和结果在redis中的保留时间(分钟)
+}
+
+// DeadLetterConfig 聊天消息处理失败时的重试和死信配置
+type DeadLetterConfig struct {
+	Topic          string `toml:"topic"`          // kafka和hybrid模式下的死信topic，channel模式直接写入dead_letter表
+	MaxAttempts    int    `toml:"maxAttempts"`    // 消息落库最多尝试次数，包括第一次
+	RetryBackoffMs int    `toml:"retryBackoffMs"` // 第一次重试前的等待时间(毫秒)，之后每次翻倍，重试在后台进行不阻塞消息处理
+}
+
+// BackpressureConfig 连接下行队列和上行拥塞的处理配置
+type BackpressureConfig struct {
+	SendQueueSize      int    `toml:"sendQueueSize"`      // 每个连接的下行队列长度
+	SlowConsumerPolicy string `toml:"slowConsumerPolicy"` // 下行队列满时的处理方式 drop_oldest、disconnect、spill
+	NackRetryAfterMs   int    `toml:"nackRetryAfterMs"`   // 上行拥塞时建议客户端重发的等待时间(毫秒)
 }
 
 type Config struct {
-	MainConfig      `toml:"mainConfig"`
-	MysqlConfig     `toml:"mysqlConfig"`
-	RedisConfig     `toml:"redisConfig"`
-	AuthCodeConfig  `toml:"authCodeConfig"`
-	SmsAuthConfig   `toml:"smsAuthConfig"`   // 新增号码认证服务配置
-	LogConfig       `toml:"logConfig"`
-	KafkaConfig     `toml:"kafkaConfig"`
-	StaticSrcConfig `toml:"staticSrcConfig"`
+	MainConfig         `toml:"mainConfig"`
+	MysqlConfig        `toml:"mysqlConfig"`
+	RedisConfig        `toml:"redisConfig"`
+	AuthCodeConfig     `toml:"authCodeConfig"`
+	SmsAuthConfig      `toml:"smsAuthConfig"` // 新增号码认证服务配置
+	LogConfig          `toml:"logConfig"`
+	KafkaConfig        `toml:"kafkaConfig"`
+	StaticSrcConfig    `toml:"staticSrcConfig"`
+	FileAccessConfig   `toml:"fileAccessConfig"`
+	NotifyConfig       `toml:"notifyConfig"`
+	RateLimitConfig    `toml:"rateLimitConfig"`
+	EmailConfig        `toml:"emailConfig"`
+	TotpConfig         `toml:"totpConfig"`
+	AdminConfig        `toml:"adminConfig"`
+	AsyncJobConfig     `toml:"asyncJobConfig"`
+	DeadLetterConfig   `toml:"deadLetterConfig"`
+	BackpressureConfig `toml:"backpressureConfig"`
 }
 
 var config *Config
@@ -27,8 +27,36 @@ func init() {
 	if err != nil {
 		zlog.Fatal(err.Error())
 	}
-	err = GormDB.AutoMigrate(&model.UserInfo{}, &model.GroupInfo{}, &model.UserContact{}, &model.Session{}, &model.ContactApply{}, &model.Message{}) // 自动迁移，如果没有建表，会自动创建对应的表
+	if err := dedupSessions(); err != nil {
+		zlog.Fatal(err.Error())
+	}
+	err = GormDB.AutoMigrate(&model.UserInfo{}, &model.GroupInfo{}, &model.UserContact{}, &model.Session{}, &model.ContactApply{}, &model.Message{}, &model.FileDownloadLog{}, &model.VoiceListen{}, &model.MessageReaction{}, &model.NotificationSetting{}, &model.UserTotp{}, &model.AuditLog{}, &model.DeadLetter{}, &model.HybridModeEvent{}, &model.FileUpload{}) // 自动迁移，如果没有建表，会自动创建对应的表
 	if err != nil {
 		zlog.Fatal(err.Error())
 	}
+	// 配置中的超级管理员每次启动时恢复
+	if superAdmins := conf.AdminConfig.SuperAdmins; len(superAdmins) > 0 {
+		res := GormDB.Model(&model.UserInfo{}).Where("telephone IN ?", superAdmins).
+			Updates(map[string]interface{}{"is_admin": 1, "is_super_admin": 1})
+		if res.Error != nil {
+			zlog.Error(res.Error.Error())
+		}
+	}
+}
+
+// dedupSessions 会话表加上(send_id, receive_id)唯一索引之前，删除并发创建出的重复会话，每组只保留最早的一条
+func dedupSessions() error {
+	migrator := GormDB.Migrator()
+	if !migrator.HasTable(&model.Session{}) || migrator.HasIndex(&model.Session{}, "idx_session_send_receive") {
+		return nil
+	}
+	res := GormDB.Exec("DELETE s1 FROM session s1 JOIN session s2 " +
+		"ON s1.send_id = s2.send_id AND s1.receive_id = s2.receive_id AND s1.id > s2.id")
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		zlog.Info(fmt.Sprintf("删除重复会话%d条", res.RowsAffected))
+	}
+	return nil
 }
@@ -1,12 +1,14 @@
 package request
 
-// AsyncTaskRequest 异步任务请求结构体
+import "encoding/json"
+
+// AsyncTaskRequest 异步任务请求结构体，写入kafka异步任务topic
 type AsyncTaskRequest struct {
-	TaskType   string      `json:"task_type"`   // 任务类型：load_message_list, load_group_message_list, load_joined_group_list
-	TaskId     string      `json:"task_id"`     // 任务ID，用于追踪
-	ClientId   string      `json:"client_id"`   // WebSocket客户端ID
-	UserId     string      `json:"user_id"`     // 用户ID
-	Parameters interface{} `json:"parameters"`  // 任务参数
+	TaskType   string          `json:"task_type"`  // 任务类型：load_message_list, load_group_message_list, load_joined_group_list
+	TaskId     string          `json:"task_id"`    // 任务ID，轮询和推送结果时使用
+	UserId     string          `json:"user_id"`    // 发起任务的用户，结果只推送给该用户，也只有该用户能查询
+	Parameters json.RawMessage `json:"parameters"` // 任务参数
+	Attempt    int             `json:"attempt"`    // 第几次执行，从1开始
 }
 
 // MessageListTaskParams 聊天记录加载任务参数
@@ -18,9 +20,10 @@ type MessageListTaskParams struct {
 // GroupMessageListTaskParams 群聊记录加载任务参数
 type GroupMessageListTaskParams struct {
 	GroupId string `json:"group_id"`
+	OwnerId string `json:"owner_id"`
 }
 
 // JoinedGroupListTaskParams 加入群聊列表加载任务参数
 type JoinedGroupListTaskParams struct {
 	OwnerId string `json:"owner_id"`
-}
\ No newline at end of file
+}
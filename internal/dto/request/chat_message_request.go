@@ -1,16 +1,22 @@
 package request
 
+import "encoding/json"
+
 type ChatMessageRequest struct {
-	SessionId  string `json:"session_id"`
-	Type       int8   `json:"type"`
-	Content    string `json:"content"`
-	Url        string `json:"url"`
-	SendId     string `json:"send_id"`
-	SendName   string `json:"send_name"`
-	SendAvatar string `json:"send_avatar"`
-	ReceiveId  string `json:"receive_id"`
-	FileSize   string `json:"file_size"`
-	FileType   string `json:"file_type"`
-	FileName   string `json:"file_name"`
-	AVdata     string `json:"av_data"`
+	SessionId  string          `json:"session_id"`
+	Type       int8            `json:"type"`
+	Content    string          `json:"content"`
+	Url        string          `json:"url"`
+	SendId     string          `json:"send_id"`
+	SendName   string          `json:"send_name"`
+	SendAvatar string          `json:"send_avatar"`
+	ReceiveId  string          `json:"receive_id"`
+	FileSize   string          `json:"file_size"`
+	FileType   string          `json:"file_type"`
+	FileName   string          `json:"file_name"`
+	Duration   int             `json:"duration"` // 语音时长(秒)，仅当服务端无法解析时使用
+	AVdata     string          `json:"av_data"`
+	Payload    json.RawMessage `json:"payload,omitempty"`  // 图片、位置、名片、引用回复的结构化内容
+	FrameId    string          `json:"frame_id,omitempty"` // 上行帧id，服务端拒绝消息时带回给发送者
+	Seq        int64           `json:"seq,omitempty"`      // 会话内序号，服务端接收时分配，客户端传入的值会被覆盖
 }
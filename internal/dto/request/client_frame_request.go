@@ -0,0 +1,19 @@
+package request
+
+import "encoding/json"
+
+// ClientFrame 客户端上行的统一信封，没有v字段的按旧协议整体当作ChatMessageRequest处理
+type ClientFrame struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	Id      string          `json:"id"` // 客户端生成，服务端回复的错误帧和pong带回该id
+	Payload json.RawMessage `json:"payload"`
+}
+
+// BinaryClientFrame 二进制编码下的上行帧，payload直接是结构化的消息，不再嵌套一层编码
+type BinaryClientFrame struct {
+	Version int                 `json:"v"`
+	Type    string              `json:"type"`
+	Id      string              `json:"id"`
+	Payload *ChatMessageRequest `json:"payload"`
+}
@@ -0,0 +1,12 @@
+package request
+
+import "time"
+
+// DeadLetterRequest 写入kafka死信topic的内容，由死信消费者落表
+type DeadLetterRequest struct {
+	Source   string    `json:"source"`  // 失败时的消息模式
+	Payload  []byte    `json:"payload"` // 原始消息
+	Reason   string    `json:"reason"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
@@ -0,0 +1,6 @@
+package request
+
+type ExportAuditLogRequest struct {
+	GetAuditLogListRequest
+	Format string `json:"format"` // csv或json，默认csv
+}
@@ -0,0 +1,6 @@
+package request
+
+type GetAsyncJobRequest struct {
+	OwnerId string `json:"owner_id"`
+	JobId   string `json:"job_id"`
+}
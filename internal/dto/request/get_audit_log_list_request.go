@@ -0,0 +1,12 @@
+package request
+
+// GetAuditLogListRequest 审计日志查询条件，为空的条件不过滤，时间格式为2006-01-02 15:04:05
+type GetAuditLogListRequest struct {
+	ActorId   string `json:"actor_id"`
+	Action    string `json:"action"`
+	TargetId  string `json:"target_id"`
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+	Page      int    `json:"page"`
+	PageSize  int    `json:"page_size"`
+}
@@ -0,0 +1,8 @@
+package request
+
+// GetDeadLetterListRequest 死信查询条件，Status为空时不过滤
+type GetDeadLetterListRequest struct {
+	Status   *int8 `json:"status"`
+	Page     int   `json:"page"`
+	PageSize int   `json:"page_size"`
+}
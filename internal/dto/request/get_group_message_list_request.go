@@ -2,4 +2,5 @@ package request
 
 type GetGroupMessageListRequest struct {
 	GroupId string `json:"group_id"`
+	OwnerId string `json:"owner_id"`
 }
@@ -0,0 +1,6 @@
+package request
+
+type GetHybridModeEventListRequest struct {
+	Page     int `json:"page"`
+	PageSize int `json:"page_size"`
+}
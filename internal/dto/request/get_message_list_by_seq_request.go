@@ -0,0 +1,9 @@
+package request
+
+// GetMessageListBySeqRequest 按序号区间补拉消息，receive_id为对方用户id或群id
+type GetMessageListBySeqRequest struct {
+	OwnerId   string `json:"owner_id"`
+	ReceiveId string `json:"receive_id"`
+	FromSeq   int64  `json:"from_seq"`
+	ToSeq     int64  `json:"to_seq"`
+}
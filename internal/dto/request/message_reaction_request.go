@@ -0,0 +1,7 @@
+package request
+
+type MessageReactionRequest struct {
+	OwnerId   string `json:"owner_id"`
+	MessageId string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
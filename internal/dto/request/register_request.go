@@ -5,4 +5,5 @@ type RegisterRequest struct {
 	Password  string `json:"password"`
 	Nickname  string `json:"nickname"`
 	SmsCode   string `json:"sms_code"`
+	Email     string `json:"email"` // 选填，填写后发送验证邮件
 }
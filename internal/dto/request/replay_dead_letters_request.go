@@ -0,0 +1,5 @@
+package request
+
+type ReplayDeadLettersRequest struct {
+	IdList []int64 `json:"id_list"`
+}
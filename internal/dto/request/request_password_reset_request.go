@@ -0,0 +1,5 @@
+package request
+
+type RequestPasswordResetRequest struct {
+	Email string `json:"email"`
+}
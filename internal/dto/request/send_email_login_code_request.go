@@ -0,0 +1,5 @@
+package request
+
+type SendEmailLoginCodeRequest struct {
+	Email string `json:"email"`
+}
@@ -0,0 +1,5 @@
+package request
+
+type SendEmailVerifyCodeRequest struct {
+	Uuid string `json:"uuid"`
+}
@@ -0,0 +1,7 @@
+package request
+
+// SetHybridModeRequest mode为kafka或channel时固定使用该模式，auto恢复自动切换
+type SetHybridModeRequest struct {
+	Mode   string `json:"mode"`
+	Reason string `json:"reason"`
+}
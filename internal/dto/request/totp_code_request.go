@@ -0,0 +1,9 @@
+package request
+
+// TotpCodeRequest 开启、关闭二次验证和重新生成恢复码，Code可以是验证码或恢复码
+// 关闭二次验证和重新生成恢复码时还需要校验Password
+type TotpCodeRequest struct {
+	Uuid     string `json:"uuid"`
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
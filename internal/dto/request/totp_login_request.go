@@ -0,0 +1,6 @@
+package request
+
+type TotpLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
@@ -0,0 +1,6 @@
+package request
+
+type TotpSetupRequest struct {
+	Uuid     string `json:"uuid"`
+	Password string `json:"password"`
+}
@@ -0,0 +1,9 @@
+package request
+
+type UpdateNotificationSettingRequest struct {
+	OwnerId    string `json:"owner_id"`
+	Provider   string `json:"provider"`
+	Target     string `json:"target"`
+	QuietStart string `json:"quiet_start"`
+	QuietEnd   string `json:"quiet_end"`
+}
@@ -0,0 +1,10 @@
+package request
+
+// UpdateSessionPreferenceRequest 更新会话偏好，字段为空表示不修改
+type UpdateSessionPreferenceRequest struct {
+	OwnerId     string `json:"owner_id"`
+	SessionId   string `json:"session_id"`
+	MuteMinutes *int   `json:"mute_minutes"` // 免打扰分钟数，0取消免打扰，-1永久免打扰
+	IsPinned    *bool  `json:"is_pinned"`
+	IsArchived  *bool  `json:"is_archived"`
+}
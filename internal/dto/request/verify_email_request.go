@@ -0,0 +1,6 @@
+package request
+
+type VerifyEmailRequest struct {
+	Uuid string `json:"uuid"`
+	Code string `json:"code"`
+}
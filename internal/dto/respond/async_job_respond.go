@@ -0,0 +1,15 @@
+package respond
+
+import "encoding/json"
+
+// AsyncJobRespond 异步任务状态，轮询接口返回
+type AsyncJobRespond struct {
+	JobId     string          `json:"job_id"`
+	TaskType  string          `json:"task_type"`
+	Status    string          `json:"status"`   // 见async_job_status_enum
+	Attempts  int             `json:"attempts"` // 已执行的次数
+	Message   string          `json:"message"`
+	Result    json.RawMessage `json:"result,omitempty"` // 成功后才有，内容与同步接口的data相同
+	CreatedAt string          `json:"created_at"`
+	UpdatedAt string          `json:"updated_at"`
+}
@@ -0,0 +1,8 @@
+package respond
+
+// ControlEventRespond 控制事件，用户被禁用/删除、被移出群聊或群聊解散时推送给在线用户
+type ControlEventRespond struct {
+	EventType string `json:"event_type"` // force_logout、group_removed、group_dismissed
+	GroupId   string `json:"group_id,omitempty"`
+	Reason    string `json:"reason"`
+}
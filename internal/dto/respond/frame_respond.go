@@ -0,0 +1,16 @@
+package respond
+
+// Frame 服务端下发的统一信封，连接时声明了version的客户端使用
+type Frame struct {
+	Version int         `json:"v"`
+	Type    string      `json:"type"`
+	Id      string      `json:"id,omitempty"`      // 聊天消息为消息uuid，异步任务为任务id，错误帧为出错的上行帧id
+	Payload interface{} `json:"payload,omitempty"` // json编码下为原始json，二进制编码下为结构体本身
+	Error   *FrameError `json:"error,omitempty"`
+}
+
+// FrameError 错误帧的错误信息，Code见message_error_enum
+type FrameError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,17 @@
+package respond
+
+type AuditLogRespond struct {
+	Id        int64  `json:"id"`
+	ActorId   string `json:"actor_id"`
+	Action    string `json:"action"`
+	TargetId  string `json:"target_id"`
+	Before    string `json:"before"`
+	After     string `json:"after"`
+	Ip        string `json:"ip"`
+	CreatedAt string `json:"created_at"`
+}
+
+type GetAuditLogListRespond struct {
+	Total int64             `json:"total"`
+	List  []AuditLogRespond `json:"list"`
+}
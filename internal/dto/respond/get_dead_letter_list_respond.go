@@ -0,0 +1,19 @@
+package respond
+
+type DeadLetterRespond struct {
+	Id         int64  `json:"id"`
+	Source     string `json:"source"`
+	Encoding   string `json:"encoding"` // 原始消息的编码，json、msgpack或unknown
+	Payload    string `json:"payload"`  // msgpack消息转为json展示，无法识别的内容为base64
+	Reason     string `json:"reason"`
+	Attempts   int    `json:"attempts"`
+	Status     int8   `json:"status"`
+	ReplayCnt  int    `json:"replay_cnt"`
+	CreatedAt  string `json:"created_at"`
+	ReplayedAt string `json:"replayed_at"`
+}
+
+type GetDeadLetterListRespond struct {
+	Total int64               `json:"total"`
+	List  []DeadLetterRespond `json:"list"`
+}
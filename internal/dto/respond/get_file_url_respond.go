@@ -0,0 +1,7 @@
+package respond
+
+type GetFileUrlRespond struct {
+	Url          string `json:"url"`
+	ThumbnailUrl string `json:"thumbnail_url"` // 图片缩略图的下载链接，没有缩略图时为空
+	ExpiresAt    string `json:"expires_at"`
+}
@@ -1,15 +1,26 @@
 package respond
 
+import "encoding/json"
+
 type GetGroupMessageListRespond struct {
-	SendId     string `json:"send_id"`
-	SendName   string `json:"send_name"`
-	SendAvatar string `json:"send_avatar"`
-	ReceiveId  string `json:"receive_id"`
-	Type       int8   `json:"type"`
-	Content    string `json:"content"`
-	Url        string `json:"url"`
-	FileType   string `json:"file_type"`
-	FileName   string `json:"file_name"`
-	FileSize   string `json:"file_size"`
-	CreatedAt  string `json:"created_at"` // 先用CreatedAt排序，后面考虑改成SentAt
+	Uuid       string          `json:"uuid"`
+	Seq        int64           `json:"seq"` // 会话内序号，可能不连续，通话记录为0
+	SendId     string          `json:"send_id"`
+	SendName   string          `json:"send_name"`
+	SendAvatar string          `json:"send_avatar"`
+	ReceiveId  string          `json:"receive_id"`
+	Type       int8            `json:"type"`
+	Content    string          `json:"content"`
+	Url        string          `json:"url"`
+	FileType   string          `json:"file_type"`
+	FileName   string          `json:"file_name"`
+	FileSize   string          `json:"file_size"`
+	Thumbnail  string          `json:"thumbnail"`
+	Width      int             `json:"width"`
+	Height     int             `json:"height"`
+	Duration   int             `json:"duration"`
+	Payload    json.RawMessage `json:"payload,omitempty"` // 图片、位置、名片、引用回复的展示数据
+	Listened   bool            `json:"listened"`          // 语音消息当前用户是否已听
+	Reactions  []ReactionCount `json:"reactions,omitempty"`
+	CreatedAt  string          `json:"created_at"` // 先用CreatedAt排序，后面考虑改成SentAt
 }
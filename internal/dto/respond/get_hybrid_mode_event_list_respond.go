@@ -0,0 +1,20 @@
+package respond
+
+type HybridModeEventRespond struct {
+	Id         int64   `json:"id"`
+	Instance   string  `json:"instance"`
+	FromMode   string  `json:"from_mode"`
+	ToMode     string  `json:"to_mode"`
+	Trigger    string  `json:"trigger"`
+	OperatorId string  `json:"operator_id"`
+	Reason     string  `json:"reason"`
+	LoadRatio  float64 `json:"load_ratio"`
+	LatencyMs  int64   `json:"latency_ms"`
+	KafkaLag   int64   `json:"kafka_lag"`
+	CreatedAt  string  `json:"created_at"`
+}
+
+type GetHybridModeEventListRespond struct {
+	Total int64                    `json:"total"`
+	List  []HybridModeEventRespond `json:"list"`
+}
@@ -1,10 +1,11 @@
 package respond
 
 type GetUserListRespond struct {
-	Uuid      string `json:"uuid"`
-	Nickname  string `json:"nickname"`
-	Telephone string `json:"telephone"`
-	Status    int8   `json:"status"`
-	IsAdmin   int8   `json:"is_admin"`
-	IsDeleted bool   `json:"is_deleted"`
+	Uuid         string `json:"uuid"`
+	Nickname     string `json:"nickname"`
+	Telephone    string `json:"telephone"`
+	Status       int8   `json:"status"`
+	IsAdmin      int8   `json:"is_admin"`
+	IsSuperAdmin bool   `json:"is_super_admin"`
+	IsDeleted    bool   `json:"is_deleted"`
 }
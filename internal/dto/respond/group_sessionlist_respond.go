@@ -1,8 +1,13 @@
 package respond
 
 type GroupSessionListRespond struct {
-	SessionId string `json:"session_id"`
-	GroupName string `json:"name"`
-	GroupId   string `json:"group_id"`
-	Avatar    string `json:"avatar"`
+	SessionId     string `json:"session_id"`
+	GroupName     string `json:"name"`
+	GroupId       string `json:"group_id"`
+	Avatar        string `json:"avatar"`
+	LastMessage   string `json:"last_message"`    // 最新消息的摘要
+	LastMessageAt string `json:"last_message_at"` // 最新消息的时间，没有消息时为空
+	IsPinned      bool   `json:"is_pinned"`
+	IsArchived    bool   `json:"is_archived"`
+	MuteUntil     string `json:"mute_until"` // 免打扰截止时间，为空表示未开启
 }
@@ -1,15 +1,20 @@
 package respond
 
 type LoginRespond struct {
-	Uuid      string `json:"uuid"`
-	Nickname  string `json:"nickname"`
-	Telephone string `json:"telephone"`
-	Avatar    string `json:"avatar"`
-	Email     string `json:"email"`
-	Gender    int8   `json:"gender"`
-	Birthday  string `json:"birthday"`
-	Signature string `json:"signature"`
-	CreatedAt string `json:"created_at"`
-	IsAdmin   int8   `json:"is_admin"`
-	Status    int8   `json:"status"`
+	Uuid          string `json:"uuid"`
+	Nickname      string `json:"nickname"`
+	Telephone     string `json:"telephone"`
+	Avatar        string `json:"avatar"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"` // 未验证的邮箱不能用于登录和找回密码
+	Gender        int8   `json:"gender"`
+	Birthday      string `json:"birthday"`
+	Signature     string `json:"signature"`
+	CreatedAt     string `json:"created_at"`
+	IsAdmin       int8   `json:"is_admin"`
+	Status        int8   `json:"status"`
+	// 开启了二次验证时只返回uuid和challenge_token，需要再调用/user/totp/login
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token,omitempty"`
+	AdminToken        string `json:"admin_token,omitempty"` // 管理员通过二次验证后颁发，调用管理接口时放在X-Admin-Token头中
 }
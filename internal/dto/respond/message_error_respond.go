@@ -0,0 +1,10 @@
+package respond
+
+// MessageErrorRespond 消息被服务端拒绝时推送给发送者的错误帧
+type MessageErrorRespond struct {
+	EventType string `json:"event_type"` // 固定为message_error
+	Code      string `json:"code"`       // 见message_error_enum
+	Message   string `json:"message"`
+	SessionId string `json:"session_id"`
+	ReceiveId string `json:"receive_id"`
+}
@@ -0,0 +1,19 @@
+package respond
+
+// ReactionCount 某个表情的回应数
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"` // 当前用户是否回应过，实时推送中恒为false，前端根据operator_id判断
+}
+
+// MessageReactionRespond 表情回应变化，接口返回并通过websocket推送给在线的会话成员
+type MessageReactionRespond struct {
+	EventType  string          `json:"event_type"` // 固定为message_reaction
+	MessageId  string          `json:"message_id"`
+	ReceiveId  string          `json:"receive_id"`
+	OperatorId string          `json:"operator_id"`
+	Emoji      string          `json:"emoji"`
+	Action     string          `json:"action"` // add或remove
+	Reactions  []ReactionCount `json:"reactions"`
+}
@@ -0,0 +1,8 @@
+package respond
+
+type NotificationSettingRespond struct {
+	Provider   string `json:"provider"`
+	Target     string `json:"target"`
+	QuietStart string `json:"quiet_start"`
+	QuietEnd   string `json:"quiet_end"`
+}
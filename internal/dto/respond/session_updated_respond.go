@@ -0,0 +1,12 @@
+package respond
+
+// SessionUpdatedRespond 会话最新消息变化，通过websocket推送给会话所属的在线用户
+type SessionUpdatedRespond struct {
+	EventType     string `json:"event_type"` // 固定为session_updated
+	SessionId     string `json:"session_id"`
+	ReceiveId     string `json:"receive_id"`
+	ReceiveName   string `json:"receive_name"`
+	Avatar        string `json:"avatar"`
+	LastMessage   string `json:"last_message"`
+	LastMessageAt string `json:"last_message_at"`
+}
@@ -0,0 +1,5 @@
+package respond
+
+type TotpRecoveryCodesRespond struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
@@ -0,0 +1,6 @@
+package respond
+
+type TotpSetupRespond struct {
+	Secret     string `json:"secret"`
+	OtpauthUri string `json:"otpauth_uri"`
+}
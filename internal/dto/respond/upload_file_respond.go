@@ -0,0 +1,11 @@
+package respond
+
+type UploadFileRespond struct {
+	FileName  string `json:"file_name"`
+	FileSize  int64  `json:"file_size"`
+	Url       string `json:"url"`
+	Thumbnail string `json:"thumbnail"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Duration  int    `json:"duration"`
+}
@@ -1,8 +1,13 @@
 package respond
 
 type UserSessionListRespond struct {
-	SessionId string `json:"session_id"`
-	Avatar    string `json:"avatar"`
-	UserId    string `json:"user_id"`
-	Username  string `json:"user_name"`
+	SessionId     string `json:"session_id"`
+	Avatar        string `json:"avatar"`
+	UserId        string `json:"user_id"`
+	Username      string `json:"user_name"`
+	LastMessage   string `json:"last_message"`    // 最新消息的摘要
+	LastMessageAt string `json:"last_message_at"` // 最新消息的时间，没有消息时为空
+	IsPinned      bool   `json:"is_pinned"`
+	IsArchived    bool   `json:"is_archived"`
+	MuteUntil     string `json:"mute_until"` // 免打扰截止时间，为空表示未开启
 }
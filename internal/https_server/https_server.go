@@ -15,11 +15,12 @@ func init() {
 	corsConfig := cors.DefaultConfig()
 	corsConfig.AllowOrigins = []string{"*"}
 	corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
-	corsConfig.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
+	corsConfig.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization", "X-Admin-Token"}
 	GE.Use(cors.New(corsConfig))
 	GE.Use(ssl.TlsHandler(config.GetConfig().MainConfig.Host, config.GetConfig().MainConfig.Port)) // 启用HTTPS重定向
+	GE.Use(RateLimitMiddleware())
 	GE.Static("/static/avatars", config.GetConfig().StaticAvatarPath)
-	GE.Static("/static/files", config.GetConfig().StaticFilePath)
+	// 聊天文件和缩略图不再直接静态暴露，需通过/message/getFileUrl获取签名链接后下载
 	
 	// 添加根路径处理
 	GE.GET("/", func(c *gin.Context) {
@@ -30,17 +31,40 @@ func init() {
 		})
 	})
 	
-	GE.POST("/login", v1.Login)
-	GE.POST("/register", v1.Register)
+	authLimit := AuthRateLimit()
+	GE.POST("/login", authLimit, v1.Login)
+	GE.POST("/register", authLimit, v1.Register)
 	GE.POST("/user/updateUserInfo", v1.UpdateUserInfo)
-	GE.POST("/user/getUserInfoList", v1.GetUserInfoList)
-	GE.POST("/user/ableUsers", v1.AbleUsers)
 	GE.POST("/user/getUserInfo", v1.GetUserInfo)
-	GE.POST("/user/disableUsers", v1.DisableUsers)
-	GE.POST("/user/deleteUsers", v1.DeleteUsers)
-	GE.POST("/user/setAdmin", v1.SetAdmin)
-	GE.POST("/user/sendSmsCode", v1.SendSmsCode)
-	GE.POST("/user/smsLogin", v1.SmsLogin)
+	GE.POST("/user/sendSmsCode", authLimit, v1.SendSmsCode)
+	GE.POST("/user/smsLogin", authLimit, v1.SmsLogin)
+	GE.POST("/user/sendEmailVerifyCode", authLimit, v1.SendEmailVerifyCode)
+	GE.POST("/user/verifyEmail", authLimit, v1.VerifyEmail)
+	GE.POST("/user/sendEmailLoginCode", authLimit, v1.SendEmailLoginCode)
+	GE.POST("/user/emailLogin", authLimit, v1.EmailLogin)
+	GE.POST("/user/requestPasswordReset", authLimit, v1.RequestPasswordReset)
+	GE.POST("/user/resetPassword", authLimit, v1.ResetPassword)
+	GE.POST("/user/totp/setup", authLimit, v1.SetupTotp)
+	GE.POST("/user/totp/enable", authLimit, v1.EnableTotp)
+	GE.POST("/user/totp/disable", authLimit, v1.DisableTotp)
+	GE.POST("/user/totp/recoveryCodes", authLimit, v1.RegenerateRecoveryCodes)
+	GE.POST("/user/totp/login", authLimit, v1.TotpLogin)
+	// 管理接口，路径保持不变，统一校验管理员身份
+	admin := GE.Group("/", AdminMiddleware())
+	admin.POST("/user/getUserInfoList", v1.GetUserInfoList)
+	admin.POST("/user/ableUsers", v1.AbleUsers)
+	admin.POST("/user/disableUsers", v1.DisableUsers)
+	admin.POST("/user/deleteUsers", v1.DeleteUsers)
+	admin.POST("/user/setAdmin", v1.SetAdmin)
+	admin.POST("/group/deleteGroups", v1.DeleteGroups)
+	admin.POST("/group/setGroupsStatus", v1.SetGroupsStatus)
+	admin.POST("/audit/getAuditLogList", v1.GetAuditLogList)
+	admin.POST("/audit/exportAuditLog", v1.ExportAuditLog)
+	admin.POST("/deadLetter/getDeadLetterList", v1.GetDeadLetterList)
+	admin.POST("/deadLetter/replayDeadLetters", v1.ReplayDeadLetters)
+	admin.POST("/hybrid/getHybridStatus", v1.GetHybridStatus)
+	admin.POST("/hybrid/setHybridMode", v1.SetHybridMode)
+	admin.POST("/hybrid/getModeEventList", v1.GetHybridModeEventList)
 	GE.POST("/user/wsLogout", v1.WsLogout)
 	GE.POST("/group/createGroup", v1.CreateGroup)
 	GE.POST("/group/loadMyGroup", v1.LoadMyGroup)
@@ -50,8 +74,6 @@ func init() {
 	GE.POST("/group/dismissGroup", v1.DismissGroup)
 	GE.POST("/group/getGroupInfo", v1.GetGroupInfo)
 	GE.POST("/group/getGroupInfoList", v1.GetGroupInfoList)
-	GE.POST("/group/deleteGroups", v1.DeleteGroups)
-	GE.POST("/group/setGroupsStatus", v1.SetGroupsStatus)
 	GE.POST("/group/updateGroupInfo", v1.UpdateGroupInfo)
 	GE.POST("/group/getGroupMemberList", v1.GetGroupMemberList)
 	GE.POST("/group/removeGroupMembers", v1.RemoveGroupMembers)
@@ -59,6 +81,7 @@ func init() {
 	GE.POST("/session/getUserSessionList", v1.GetUserSessionList)
 	GE.POST("/session/getGroupSessionList", v1.GetGroupSessionList)
 	GE.POST("/session/deleteSession", v1.DeleteSession)
+	GE.POST("/session/updateSessionPreference", v1.UpdateSessionPreference)
 	GE.POST("/session/checkOpenSessionAllowed", v1.CheckOpenSessionAllowed)
 	GE.POST("/contact/getUserList", v1.GetUserList)
 	GE.POST("/contact/loadMyJoinedGroup", v1.LoadMyJoinedGroup)
@@ -74,10 +97,18 @@ func init() {
 	GE.POST("/contact/blackApply", v1.BlackApply)
 	GE.POST("/message/getMessageList", v1.GetMessageList)
 	GE.POST("/message/getGroupMessageList", v1.GetGroupMessageList)
+	GE.POST("/message/getMessageListBySeq", v1.GetMessageListBySeq)
 	GE.POST("/message/uploadAvatar", v1.UploadAvatar)
 	GE.POST("/message/uploadFile", v1.UploadFile)
+	GE.POST("/message/getFileUrl", v1.GetFileUrl)
+	GE.POST("/message/markVoiceListened", v1.MarkVoiceListened)
+	GE.POST("/message/addReaction", v1.AddReaction)
+	GE.POST("/message/removeReaction", v1.RemoveReaction)
+	GE.POST("/job/getAsyncJob", v1.GetAsyncJob)
 	GE.GET("/download/file/:filename", v1.DownloadFile)
 	GE.POST("/chatroom/getCurContactListInChatRoom", v1.GetCurContactListInChatRoom)
+	GE.POST("/notification/getSetting", v1.GetNotificationSetting)
+	GE.POST("/notification/updateSetting", v1.UpdateNotificationSetting)
 	GE.GET("/wss", v1.WsLogin)
 
 }
@@ -0,0 +1,113 @@
+package https_server
+
+import (
+	"github.com/gin-gonic/gin"
+	"kama_chat_server/internal/config"
+	"kama_chat_server/internal/service/gorm"
+	myredis "kama_chat_server/internal/service/redis"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/zlog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimitMiddleware 按IP的令牌桶限流，redis异常时拒绝请求，和短信配额一样不放行
+// 接口目前没有登录态，请求体里的用户id可以随意填写，不能作为限流的键，否则可以换id绕过或者替别人耗尽配额
+func RateLimitMiddleware() gin.HandlerFunc {
+	limitConfig := config.GetConfig().RateLimitConfig
+	ipBucket := myredis.TokenBucket{Name: "ip", Rate: limitConfig.IpRate, Burst: limitConfig.IpBurst}
+	return func(c *gin.Context) {
+		allowed, wait, err := ipBucket.Take(c.ClientIP())
+		if err != nil {
+			zlog.Error(err.Error())
+			abortLimiterUnavailable(c)
+			return
+		}
+		if !allowed {
+			abortTooManyRequests(c, wait)
+			return
+		}
+		c.Next()
+	}
+}
+
+// AuthRateLimit 登录、注册、发送验证码这类接口容易被刷，单独按IP做更严格的限制，redis异常时拒绝请求
+func AuthRateLimit() gin.HandlerFunc {
+	limit := myredis.RateLimit{
+		Name:   "auth",
+		Limit:  config.GetConfig().RateLimitConfig.AuthPerMinute,
+		Window: time.Minute,
+	}
+	return func(c *gin.Context) {
+		allowed, wait, err := limit.Allow(c.ClientIP(), c.FullPath())
+		if err != nil {
+			zlog.Error(err.Error())
+			abortLimiterUnavailable(c)
+			return
+		}
+		if !allowed {
+			abortTooManyRequests(c, wait)
+			return
+		}
+		c.Next()
+	}
+}
+
+// AdminMiddleware 管理接口的鉴权，调用方身份来自通过二次验证后颁发的管理令牌(X-Admin-Token头)，
+// 并实时校验UserInfo.IsAdmin，令牌无效返回401，不是管理员或未开启二次验证返回403
+// 管理令牌由服务端颁发，校验通过后按管理员id做每个用户的限流
+func AdminMiddleware() gin.HandlerFunc {
+	limitConfig := config.GetConfig().RateLimitConfig
+	userBucket := myredis.TokenBucket{Name: "user", Rate: limitConfig.UserRate, Burst: limitConfig.UserBurst}
+	return func(c *gin.Context) {
+		message, adminId, ret := gorm.UserInfoService.CheckAdminToken(c.GetHeader("X-Admin-Token"))
+		switch ret {
+		case 0:
+			allowed, wait, err := userBucket.Take(adminId)
+			if err != nil {
+				zlog.Error(err.Error())
+				abortLimiterUnavailable(c)
+				return
+			}
+			if !allowed {
+				abortTooManyRequests(c, wait)
+				return
+			}
+			c.Set("admin_id", adminId)
+			c.Next()
+		case -2:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"code":    401,
+				"message": message,
+			})
+		case -3:
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"code":    403,
+				"message": message,
+			})
+		default:
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"code":    500,
+				"message": message,
+			})
+		}
+	}
+}
+
+// abortLimiterUnavailable 限流依赖的redis不可用时拒绝请求，避免限流失效后被刷
+func abortLimiterUnavailable(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+		"code":    503,
+		"message": constants.SYSTEM_ERROR,
+	})
+}
+
+func abortTooManyRequests(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"code":    429,
+		"message": "请求过于频繁，请稍后再试",
+	})
+}
@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// AuditLog 管理和关系变更的审计日志，只追加不修改，没有软删除字段
+type AuditLog struct {
+	Id        int64     `gorm:"column:id;primaryKey;comment:自增id"`
+	ActorId   string    `gorm:"column:actor_id;index;type:char(20);not null;comment:操作人uuid，群聊申请的操作方为群聊id"`
+	Action    string    `gorm:"column:action;index;type:varchar(32);not null;comment:操作类型"`
+	TargetId  string    `gorm:"column:target_id;index;type:char(20);not null;comment:操作对象uuid"`
+	Before    string    `gorm:"column:before_snapshot;type:TEXT;comment:操作前快照，json"`
+	After     string    `gorm:"column:after_snapshot;type:TEXT;comment:操作后快照，json"`
+	Ip        string    `gorm:"column:ip;type:varchar(64);comment:操作人IP"`
+	CreatedAt time.Time `gorm:"column:created_at;index;type:datetime;not null;comment:操作时间"`
+}
+
+func (AuditLog) TableName() string {
+	return "audit_log"
+}
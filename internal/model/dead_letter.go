@@ -0,0 +1,23 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+)
+
+// DeadLetter 处理失败的聊天消息，保留原始内容，管理员确认原因后可以重新投递
+type DeadLetter struct {
+	Id         int64        `gorm:"column:id;primaryKey;comment:自增id"`
+	Source     string       `gorm:"column:source;type:varchar(16);not null;comment:失败时的消息模式，channel、kafka或hybrid"`
+	Payload    []byte       `gorm:"column:payload;type:blob;not null;comment:原始消息，json或msgpack"`
+	Reason     string       `gorm:"column:reason;type:TEXT;comment:失败原因"`
+	Attempts   int          `gorm:"column:attempts;not null;comment:进入死信前的处理次数"`
+	Status     int8         `gorm:"column:status;index;not null;comment:状态，0.待处理，1.已重新投递"`
+	ReplayCnt  int          `gorm:"column:replay_cnt;not null;default:0;comment:重新投递次数"`
+	CreatedAt  time.Time    `gorm:"column:created_at;index;type:datetime;not null;comment:进入死信的时间"`
+	ReplayedAt sql.NullTime `gorm:"column:replayed_at;type:datetime;comment:最近一次重新投递的时间"`
+}
+
+func (DeadLetter) TableName() string {
+	return "dead_letter"
+}
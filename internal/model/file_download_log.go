@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+type FileDownloadLog struct {
+	Id           int64     `gorm:"column:id;primaryKey;comment:自增id"`
+	MessageId    string    `gorm:"column:message_id;index;type:char(20);not null;comment:文件所属消息uuid"`
+	UserId       string    `gorm:"column:user_id;index;type:char(20);not null;comment:下载者uuid"`
+	FileName     string    `gorm:"column:file_name;type:varchar(50);not null;comment:文件名"`
+	Ip           string    `gorm:"column:ip;type:varchar(64);comment:下载者ip"`
+	DownloadedAt time.Time `gorm:"column:downloaded_at;index;type:datetime;not null;comment:下载时间"`
+}
+
+func (FileDownloadLog) TableName() string {
+	return "file_download_log"
+}
@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+// FileUpload 聊天文件的上传记录，文件按随机生成的StoredName保存，发送文件消息时校验上传者
+// 缩略图、宽高和时长在上传时提取，转发消息时直接读取，不再解析文件
+type FileUpload struct {
+	Id         int64     `gorm:"column:id;primaryKey;comment:自增id"`
+	StoredName string    `gorm:"column:stored_name;uniqueIndex;type:varchar(64);not null;comment:服务端保存的文件名"`
+	OwnerId    string    `gorm:"column:owner_id;index;type:char(20);not null;comment:上传者uuid"`
+	FileName   string    `gorm:"column:file_name;type:varchar(255);not null;comment:原始文件名"`
+	FileSize   int64     `gorm:"column:file_size;not null;comment:文件大小(字节)"`
+	Thumbnail  string    `gorm:"column:thumbnail;type:varchar(255);comment:缩略图url，仅图片"`
+	Width      int       `gorm:"column:width;comment:图片宽度"`
+	Height     int       `gorm:"column:height;comment:图片高度"`
+	Duration   int       `gorm:"column:duration;comment:音频时长(秒)"`
+	CreatedAt  time.Time `gorm:"column:created_at;type:datetime;not null;comment:上传时间"`
+}
+
+func (FileUpload) TableName() string {
+	return "file_upload"
+}
@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+// HybridModeEvent 混合模式的切换记录，保存切换时的负载指标用于事后分析阈值是否合适
+type HybridModeEvent struct {
+	Id         int64     `gorm:"column:id;primaryKey;comment:自增id"`
+	Instance   string    `gorm:"column:instance;type:varchar(64);not null;comment:切换的服务实例，每个实例独立切换"`
+	FromMode   string    `gorm:"column:from_mode;type:varchar(16);not null;comment:切换前的模式，channel或kafka"`
+	ToMode     string    `gorm:"column:to_mode;type:varchar(16);not null;comment:切换后的模式"`
+	Trigger    string    `gorm:"column:trigger_type;type:varchar(16);not null;comment:触发方式，auto或manual"`
+	OperatorId string    `gorm:"column:operator_id;type:char(20);comment:手动切换的管理员uuid"`
+	Reason     string    `gorm:"column:reason;type:varchar(255);comment:切换原因"`
+	LoadRatio  float64   `gorm:"column:load_ratio;not null;comment:切换时channel的占用比例"`
+	LatencyMs  int64     `gorm:"column:latency_ms;not null;comment:切换时单条消息的平均处理耗时(毫秒)"`
+	KafkaLag   int64     `gorm:"column:kafka_lag;not null;comment:切换时kafka的积压消息数"`
+	CreatedAt  time.Time `gorm:"column:created_at;index;type:datetime;not null;comment:切换时间"`
+}
+
+func (HybridModeEvent) TableName() string {
+	return "hybrid_mode_event"
+}
@@ -9,7 +9,8 @@ type Message struct {
 	Id         int64     `gorm:"column:id;primaryKey;comment:自增id"`
 	Uuid       string    `gorm:"column:uuid;uniqueIndex;type:char(20);not null;comment:消息uuid"`
 	SessionId  string    `gorm:"column:session_id;index;type:char(20);not null;comment:会话uuid"`
-	Type       int8      `gorm:"column:type;not null;comment:消息类型，0.文本，1.语音，2.文件，3.通话"` // 通话不用存消息内容或者url
+	Seq        int64     `gorm:"column:seq;index;not null;default:0;comment:会话内序号，单聊两个方向共用，群聊按群，通话信令为0"`
+	Type       int8      `gorm:"column:type;not null;comment:消息类型，0.文本，1.语音，2.文件，3.通话，4.图片，5.位置，6.名片，7.引用回复"` // 通话不用存消息内容或者url
 	Content    string    `gorm:"column:content;type:TEXT;comment:消息内容"`
 	Url        string    `gorm:"column:url;type:char(255);comment:消息url"`
 	SendId     string    `gorm:"column:send_id;index;type:char(20);not null;comment:发送者uuid"`
@@ -19,6 +20,11 @@ type Message struct {
 	FileType   string    `gorm:"column:file_type;type:char(10);comment:文件类型"`
 	FileName   string    `gorm:"column:file_name;type:varchar(50);comment:文件名"`
 	FileSize   string    `gorm:"column:file_size;type:char(20);comment:文件大小"`
+	Thumbnail  string    `gorm:"column:thumbnail;type:varchar(255);comment:图片缩略图url"`
+	Width      int       `gorm:"column:width;default:0;comment:图片宽度"`
+	Height     int       `gorm:"column:height;default:0;comment:图片高度"`
+	Duration   int       `gorm:"column:duration;default:0;comment:音频时长，单位秒"`
+	Payload    string    `gorm:"column:payload;type:TEXT;comment:结构化消息内容(json，带版本号)"`
 	Status     int8      `gorm:"column:status;not null;comment:状态，0.未发送，1.已发送"`
 	CreatedAt  time.Time `gorm:"column:created_at;not null;comment:创建时间"`
 	SendAt     sql.NullTime `gorm:"column:send_at;comment:发送时间"`
@@ -0,0 +1,45 @@
+package model
+
+// MessagePayloadVersion 当前结构化消息内容的版本号，结构不兼容调整时递增
+const MessagePayloadVersion = 1
+
+// MessagePayload 结构化消息内容，以json存在Message.Payload中，按消息类型只填充对应字段
+type MessagePayload struct {
+	Version  int                 `json:"version"`
+	Image    *ImagePayload       `json:"image,omitempty"`
+	Location *LocationPayload    `json:"location,omitempty"`
+	Contact  *ContactCardPayload `json:"contact,omitempty"`
+	Reply    *ReplyPayload       `json:"reply,omitempty"`
+}
+
+// ImagePayload 图片消息，宽高和缩略图由服务端解析
+type ImagePayload struct {
+	Url       string `json:"url"`
+	Thumbnail string `json:"thumbnail"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+}
+
+// LocationPayload 位置消息
+type LocationPayload struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Name      string  `json:"name"`
+	Address   string  `json:"address"`
+}
+
+// ContactCardPayload 名片消息，uuid为用户或群聊，名称头像由服务端填充
+type ContactCardPayload struct {
+	Uuid   string `json:"uuid"`
+	Name   string `json:"name"`
+	Avatar string `json:"avatar"`
+}
+
+// ReplyPayload 引用回复，被引用消息的摘要由服务端填充
+type ReplyPayload struct {
+	MessageId string `json:"message_id"`
+	SendId    string `json:"send_id"`
+	SendName  string `json:"send_name"`
+	Type      int8   `json:"type"`
+	Preview   string `json:"preview"`
+}
@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+// MessageReaction 消息表情回应，同一用户对同一消息的同一表情只记一条
+type MessageReaction struct {
+	Id        int64     `gorm:"column:id;primaryKey;comment:自增id"`
+	MessageId string    `gorm:"column:message_id;uniqueIndex:idx_message_user_emoji;type:char(20);not null;comment:消息uuid"`
+	UserId    string    `gorm:"column:user_id;uniqueIndex:idx_message_user_emoji;type:char(20);not null;comment:回应者uuid"`
+	Emoji     string    `gorm:"column:emoji;uniqueIndex:idx_message_user_emoji;type:varchar(32);not null;comment:表情"`
+	CreatedAt time.Time `gorm:"column:created_at;type:datetime;not null;comment:回应时间"`
+}
+
+func (MessageReaction) TableName() string {
+	return "message_reaction"
+}
@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// NotificationSetting 用户离线通知设置
+type NotificationSetting struct {
+	Id         int64     `gorm:"column:id;primaryKey;comment:自增id"`
+	UserId     string    `gorm:"column:user_id;uniqueIndex;type:char(20);not null;comment:用户uuid"`
+	Provider   string    `gorm:"column:provider;type:varchar(16);comment:通知渠道，webpush/webhook/email，为空不通知"`
+	Target     string    `gorm:"column:target;type:TEXT;comment:推送目标，web push订阅、设备token或邮箱"`
+	QuietStart string    `gorm:"column:quiet_start;type:char(5);comment:免打扰开始时间HH:MM"`
+	QuietEnd   string    `gorm:"column:quiet_end;type:char(5);comment:免打扰结束时间HH:MM"`
+	UpdatedAt  time.Time `gorm:"column:updated_at;type:datetime;comment:更新时间"`
+}
+
+func (NotificationSetting) TableName() string {
+	return "notification_setting"
+}
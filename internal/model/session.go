@@ -6,15 +6,20 @@ import (
 	"time"
 )
 
+// Session 会话，每个用户和同一个对象只有一条记录，删除为软删除，再次发起会话时恢复原记录
 type Session struct {
 	Id            int64          `gorm:"column:id;primaryKey;comment:自增id"`
 	Uuid          string         `gorm:"column:uuid;uniqueIndex;type:char(20);comment:会话uuid"`
-	SendId        string         `gorm:"column:send_id;Index;type:char(20);not null;comment:创建会话人id"`
-	ReceiveId     string         `gorm:"column:receive_id;Index;type:char(20);not null;comment:接受会话人id"`
+	SendId        string         `gorm:"column:send_id;Index;uniqueIndex:idx_session_send_receive,priority:1;type:char(20);not null;comment:创建会话人id"`
+	ReceiveId     string         `gorm:"column:receive_id;Index;uniqueIndex:idx_session_send_receive,priority:2;type:char(20);not null;comment:接受会话人id"`
 	ReceiveName   string         `gorm:"column:receive_name;type:varchar(20);not null;comment:名称"`
 	Avatar        string         `gorm:"column:avatar;type:char(255);default:default_avatar.png;not null;comment:头像"`
 	LastMessage   string         `gorm:"column:last_message;type:TEXT;comment:最新的消息"`
 	LastMessageAt sql.NullTime      `gorm:"column:last_message_at;type:datetime;comment:最近接收时间"`
+	MuteUntil     sql.NullTime   `gorm:"column:mute_until;type:datetime;comment:免打扰截止时间"`
+	IsPinned      int8           `gorm:"column:is_pinned;default:0;not null;comment:是否置顶，0.否，1.是"`
+	PinnedAt      sql.NullTime   `gorm:"column:pinned_at;type:datetime;comment:置顶时间"`
+	IsArchived    int8           `gorm:"column:is_archived;default:0;not null;comment:是否归档隐藏，0.否，1.是"`
 	CreatedAt     time.Time      `gorm:"column:created_at;Index;type:datetime;comment:创建时间"`
 	DeletedAt     gorm.DeletedAt `gorm:"column:deleted_at;Index;type:datetime;comment:删除时间"`
 }
@@ -12,6 +12,7 @@ type UserInfo struct {
 	Nickname      string         `gorm:"column:nickname;type:varchar(20);not null;comment:昵称"`
 	Telephone     string         `gorm:"column:telephone;index;not null;type:char(11);comment:电话"`
 	Email         string         `gorm:"column:email;type:char(30);comment:邮箱"`
+	EmailVerified int8           `gorm:"column:email_verified;not null;default:0;comment:邮箱是否已验证，0.未验证，1.已验证"`
 	Avatar        string         `gorm:"column:avatar;type:char(255);default:https://cube.elemecdn.com/0/88/03b0d39583f48206768a7534e55bcpng.png;not null;comment:头像"`
 	Gender        int8           `gorm:"column:gender;comment:性别，0.男，1.女"`
 	Signature     string         `gorm:"column:signature;type:varchar(100);comment:个性签名"`
@@ -22,6 +23,7 @@ type UserInfo struct {
 	LastOnlineAt  sql.NullTime      `gorm:"column:last_online_at;type:datetime;comment:上次登录时间"`
 	LastOfflineAt sql.NullTime      `gorm:"column:last_offline_at;type:datetime;comment:最近离线时间"`
 	IsAdmin       int8           `gorm:"column:is_admin;not null;comment:是否是管理员，0.不是，1.是"`
+	IsSuperAdmin  int8           `gorm:"column:is_super_admin;not null;default:0;comment:是否是超级管理员，0.不是，1.是，超级管理员同时是管理员"`
 	Status        int8           `gorm:"column:status;index;not null;comment:状态，0.正常，1.禁用"`
 }
 
@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// UserTotp 用户的TOTP二次验证设置
+type UserTotp struct {
+	Id            int64     `gorm:"column:id;primaryKey;comment:自增id"`
+	UserId        string    `gorm:"column:user_id;uniqueIndex;type:char(20);not null;comment:用户uuid"`
+	Secret        string    `gorm:"column:secret;type:varchar(64);not null;comment:base32编码的TOTP密钥"`
+	Status        int8      `gorm:"column:status;not null;default:0;comment:状态，0.待验证，1.已开启"`
+	RecoveryCodes string    `gorm:"column:recovery_codes;type:TEXT;comment:未使用的恢复码sha256，json数组"`
+	LastStep      int64     `gorm:"column:last_step;not null;default:0;comment:最近一次使用的时间步，防止验证码重放"`
+	CreatedAt     time.Time `gorm:"column:created_at;type:datetime;comment:创建时间"`
+	UpdatedAt     time.Time `gorm:"column:updated_at;type:datetime;comment:更新时间"`
+}
+
+func (UserTotp) TableName() string {
+	return "user_totp"
+}
@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// VoiceListen 语音消息的收听记录，每个接收者听过一次后记一条
+type VoiceListen struct {
+	Id         int64     `gorm:"column:id;primaryKey;comment:自增id"`
+	MessageId  string    `gorm:"column:message_id;uniqueIndex:idx_message_user;type:char(20);not null;comment:语音消息uuid"`
+	UserId     string    `gorm:"column:user_id;uniqueIndex:idx_message_user;index;type:char(20);not null;comment:收听者uuid"`
+	ListenedAt time.Time `gorm:"column:listened_at;type:datetime;not null;comment:收听时间"`
+}
+
+func (VoiceListen) TableName() string {
+	return "voice_listen"
+}
@@ -0,0 +1,166 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"kama_chat_server/internal/config"
+	"kama_chat_server/internal/dao"
+	"kama_chat_server/internal/model"
+	"kama_chat_server/pkg/enum/message/message_type_enum"
+	"kama_chat_server/pkg/zlog"
+)
+
+// 下行队列满时的处理方式
+const (
+	policyDropOldest = "drop_oldest" // 丢弃最早的帧，丢掉的聊天消息仍是未发送状态，客户端按序号补拉
+	policyDisconnect = "disconnect"  // 断开连接，客户端重连后补拉
+	policySpill      = "spill"       // 不再放入队列，聊天消息转为离线通知
+)
+
+const (
+	defaultSendQueueSize = 256
+	defaultNackRetryMs   = 1000
+	dropOldestAttempts   = 3 // 多个协程同时推送时，丢弃后可能又被别的协程占满，最多重试的次数
+)
+
+var backpressureConfig = config.GetConfig().BackpressureConfig
+
+// errTransmitFull 转发通道已满，调用方拒收消息让客户端稍后重发
+var errTransmitFull = errors.New("转发通道已满")
+
+// transmitSlots 转发通道的占位，容量和通道相同，放入通道前先占位，消费者取出消息后归还
+// 占到位置后才分配序号，分配了序号的消息放入通道时不会阻塞，被拒收的消息不占用序号
+type transmitSlots chan struct{}
+
+func newTransmitSlots(size int) transmitSlots {
+	return make(transmitSlots, size)
+}
+
+// acquire 占用一个位置，已满时返回false
+func (t transmitSlots) acquire() bool {
+	select {
+	case t <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release 归还一个位置，只能在acquire成功后调用一次
+func (t transmitSlots) release() {
+	<-t
+}
+
+// sendQueueSize 每个连接的下行队列长度
+func sendQueueSize() int {
+	if backpressureConfig.SendQueueSize <= 0 {
+		return defaultSendQueueSize
+	}
+	return backpressureConfig.SendQueueSize
+}
+
+// nackRetryAfterMs 拒收消息时建议客户端重发的等待时间
+func nackRetryAfterMs() int {
+	if backpressureConfig.NackRetryAfterMs <= 0 {
+		return defaultNackRetryMs
+	}
+	return backpressureConfig.NackRetryAfterMs
+}
+
+// enqueue 把下行帧放入连接的发送队列，不会阻塞，一个慢连接不影响其他用户的转发
+// 队列已满时按slowConsumerPolicy处理，返回false表示这一帧没有放入
+func (c *Client) enqueue(messageBack *MessageBack) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.SendBack <- messageBack:
+		return true
+	default:
+	}
+	switch backpressureConfig.SlowConsumerPolicy {
+	case policyDisconnect:
+		zlog.Warn(fmt.Sprintf("用户%s的下行队列已满，断开连接", c.Uuid))
+		c.disconnect(websocket.CloseTryAgainLater, "slow_consumer")
+		return false
+	case policySpill:
+		spillOffline(c.Uuid, messageBack)
+		return false
+	}
+	for i := 0; i < dropOldestAttempts; i++ {
+		select {
+		case dropped := <-c.SendBack:
+			zlog.Warn(fmt.Sprintf("用户%s的下行队列已满，丢弃最早的帧: type=%s, id=%s", c.Uuid, dropped.Type, dropped.Uuid))
+			if dropped.Close {
+				// 丢掉的是强制下线或退出登录帧，直接断开
+				c.disconnect(dropped.closeCode, dropped.closeReason)
+				return false
+			}
+		default:
+		}
+		select {
+		case c.SendBack <- messageBack:
+			return true
+		default:
+		}
+	}
+	zlog.Warn(fmt.Sprintf("用户%s的下行队列已满，丢弃: type=%s, id=%s", c.Uuid, messageBack.Type, messageBack.Uuid))
+	return false
+}
+
+// disconnect 断开连接，从在线列表摘除后新的消息按离线处理
+// 只关闭done，不关闭SendBack，之后的enqueue直接返回false
+func (c *Client) disconnect(code int, reason string) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		// 摘除需要server的锁，调用方可能持有，放到协程里
+		go func() {
+			removeClient(c)
+			c.close(code, reason)
+		}()
+	})
+}
+
+// closeAfter 把最后一帧放入发送队列，Write发送完后断开连接，放不进队列时直接断开
+func (c *Client) closeAfter(messageBack *MessageBack, code int, reason string) {
+	messageBack.Close = true
+	messageBack.closeCode = code
+	messageBack.closeReason = reason
+	if !c.enqueue(messageBack) {
+		c.disconnect(code, reason)
+	}
+}
+
+// spillOffline 推送不出去的聊天消息转为离线通知，消息记录保持未发送状态，其他帧直接丢弃
+func spillOffline(userId string, messageBack *MessageBack) {
+	if messageBack.Uuid == "" {
+		zlog.Warn(fmt.Sprintf("用户%s的下行队列已满，丢弃: type=%s", userId, messageBack.Type))
+		return
+	}
+	go func() {
+		var message model.Message
+		if res := dao.GormDB.Where("uuid = ?", messageBack.Uuid).First(&message); res.Error != nil {
+			zlog.Error(res.Error.Error())
+			return
+		}
+		// 发送者自己的回显和通话信令不需要离线通知
+		if message.SendId == userId || message.Type == message_type_enum.AudioOrVideo {
+			return
+		}
+		notifyOffline(userId, message)
+	}()
+}
+
+// removeClient 按消息模式从对应server的在线列表中摘除连接，用户已经重新连接时不受影响
+func removeClient(client *Client) {
+	if messageMode == "channel" {
+		ChatServer.removeClient(client)
+	} else if messageMode == "hybrid" {
+		HybridChatServer.removeClient(client)
+	} else {
+		KafkaChatServer.removeClient(client)
+	}
+}
@@ -3,37 +3,63 @@ package chat
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/segmentio/kafka-go"
 	"kama_chat_server/internal/config"
 	"kama_chat_server/internal/dao"
 	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/dto/respond"
 	"kama_chat_server/internal/model"
 	myKafka "kama_chat_server/internal/service/kafka"
 	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/enum/message/message_error_enum"
 	"kama_chat_server/pkg/enum/message/message_status_enum"
+	"kama_chat_server/pkg/enum/message/message_type_enum"
+	"kama_chat_server/pkg/util/wire"
 	"kama_chat_server/pkg/zlog"
 	"log"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 )
 
 type MessageBack struct {
-	Message []byte
-	Uuid    string
+	Message []byte // 旧客户端收到的内容，新协议下没有Payload时作为payload
+	Uuid    string // 消息uuid，发送成功后修改消息状态，系统帧为空
+	Close   bool   // 发送完这一帧后关闭连接，用于强制下线和退出登录
+	Type    string // 新协议的帧类型
+	Id      string // 新协议的帧id，为空时取Uuid
+	Payload []byte
+	Error   *respond.FrameError
+	Data    interface{} // 序列化前的结构体，二进制编码时作为payload
+
+	mutex  sync.Mutex
+	frames map[string][]byte // 按编码缓存的新协议信封
+
+	closeCode   int    // Close为true时websocket关闭帧的状态码
+	closeReason string // Close为true时websocket关闭帧的原因
 }
 
 type Client struct {
 	Conn     *websocket.Conn
 	Uuid     string
-	SendTo   chan []byte       // 给server端
 	SendBack chan *MessageBack // 给前端
+	limiter  *tokenBucket      // 连接级别的消息限流
+	version  int               // 连接时声明的信封版本，0为旧客户端
+	codec    wire.Codec        // 协商出的编码，没有协商子协议时为json
+
+	done      chan struct{} // 连接因下行队列满被断开时关闭
+	closeOnce sync.Once
 }
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  2048,
 	WriteBufferSize: 2048,
+	// 客户端通过子协议协商编码，按服务端的顺序优先选择二进制编码
+	Subprotocols: []string{wire.SubprotocolMsgPack, wire.SubprotocolJSON},
 	// 检查连接的Origin头
 	CheckOrigin: func(r *http.Request) bool {
 		return true
@@ -44,6 +70,9 @@ var ctx = context.Background()
 
 var messageMode = config.GetConfig().KafkaConfig.MessageMode
 
+// chatCodec 转发channel和kafka chat topic中消息的编码
+var chatCodec = wire.ByName(config.GetConfig().KafkaConfig.ChatEncoding)
+
 // 读取websocket消息并发送给send通道
 func (c *Client) Read() {
 	zlog.Info("ws read goroutine start")
@@ -54,46 +83,80 @@ func (c *Client) Read() {
 			zlog.Error(err.Error())
 			return // 直接断开websocket
 		} else {
-			var message = request.ChatMessageRequest{}
-			if err := json.Unmarshal(jsonMessage, &message); err != nil {
+			frame, chatMessage, err := c.decodeClientFrame(jsonMessage)
+			if err != nil {
 				zlog.Error(err.Error())
+				c.enqueue(errorBack("", message_error_enum.InvalidMessage, "消息格式错误", []byte("消息发送失败：消息格式错误")))
+				continue
+			}
+			if frame.Type == FramePing {
+				c.enqueue(&MessageBack{Type: FramePong, Id: frame.Id})
+				continue
 			}
+			if frame.Type != FrameChatMessage {
+				c.enqueue(errorBack(frame.Id, message_error_enum.UnknownFrame, "不支持的帧类型："+frame.Type, nil))
+				continue
+			}
+			if !c.limiter.allow() {
+				c.enqueue(errorBack(frame.Id, message_error_enum.RateLimited, "发送过于频繁，请稍后再试",
+					[]byte("消息发送失败：发送过于频繁，请稍后再试")))
+				continue
+			}
+			if chatMessage == nil {
+				c.enqueue(errorBack(frame.Id, message_error_enum.InvalidMessage, "消息格式错误", []byte("消息发送失败：消息格式错误")))
+				continue
+			}
+			message := *chatMessage
 			log.Println("接受到消息为: ", jsonMessage)
-			if messageMode == "channel" {
-				// 如果server的转发channel没满，先把sendto中的给transmit
-				for len(ChatServer.Transmit) < constants.CHANNEL_SIZE && len(c.SendTo) > 0 {
-					sendToMessage := <-c.SendTo
-					ChatServer.SendMessageToTransmit(sendToMessage)
-				}
-				// 如果server没满，sendto空了，直接给server的transmit
-				if len(ChatServer.Transmit) < constants.CHANNEL_SIZE {
-					ChatServer.SendMessageToTransmit(jsonMessage)
-				} else if len(c.SendTo) < constants.CHANNEL_SIZE {
-					// 如果server满了，直接塞sendto
-					c.SendTo <- jsonMessage
-				} else {
-					// 否则考虑加宽channel size，或者使用kafka
-					if err := c.Conn.WriteMessage(websocket.TextMessage, []byte("由于目前同一时间过多用户发送消息，消息发送失败，请稍后重试")); err != nil {
-						zlog.Error(err.Error())
+			// 发送者以当前连接为准，不信任客户端传来的send_id，校验引用等权限前先替换，昵称头像在落库前从服务端查询
+			message.SendId = c.Uuid
+			message.FrameId = frame.Id
+			// 语音和结构化消息在入口统一校验，其他类型清空payload，三种消息模式共用
+			if err := checkChatMessage(&message); err != nil {
+				zlog.Error(err.Error())
+				c.enqueue(errorBack(frame.Id, message_error_enum.InvalidMessage, err.Error(),
+					[]byte("消息发送失败："+err.Error())))
+				continue
+			}
+			// 分配序号并编码，channel和hybrid模式在占到转发通道的位置后才调用，拒收的消息不占用序号
+			build := func() ([]byte, error) {
+				// 通话信令不进入聊天记录，不占用序号
+				message.Seq = 0
+				if message.Type != message_type_enum.AudioOrVideo && message.ReceiveId != "" {
+					seq, err := nextSeq(message)
+					if err != nil {
+						return nil, err
 					}
+					message.Seq = seq
 				}
+				return chatCodec.Marshal(message)
+			}
+			if messageMode == "channel" {
+				err = ChatServer.transmitWith(build)
 			} else if messageMode == "hybrid" {
 				// 混合模式：智能路由消息
-				// 先尝试清空sendto缓冲区
-				for len(c.SendTo) > 0 {
-					sendToMessage := <-c.SendTo
-					HybridChatServer.SendMessageToTransmit(sendToMessage)
-				}
-				// 发送当前消息
-				HybridChatServer.SendMessageToTransmit(jsonMessage)
+				err = HybridChatServer.transmitWith(build)
 			} else {
-				if err := myKafka.KafkaService.ChatWriter.WriteMessages(ctx, kafka.Message{
-					Key:   []byte(strconv.Itoa(config.GetConfig().KafkaConfig.Partition)),
-					Value: jsonMessage,
-				}); err != nil {
-					zlog.Error(err.Error())
+				// kafka写入失败时序号已经分配，接收端等待seqGapWait后跳过
+				if jsonMessage, err = build(); err == nil {
+					if err := myKafka.KafkaService.ChatWriter.WriteMessages(ctx, kafka.Message{
+						Key:   chatMessageKey(message),
+						Value: jsonMessage,
+					}); err != nil {
+						zlog.Error(err.Error())
+						c.enqueue(nackBack(frame.Id, "消息发送失败，请稍后重试"))
+						continue
+					}
+					zlog.Info("已发送消息：" + string(jsonMessage))
 				}
-				zlog.Info("已发送消息：" + string(jsonMessage))
+			}
+			if errors.Is(err, errTransmitFull) {
+				// 转发通道满了直接拒收，让客户端稍后重发
+				c.enqueue(nackBack(frame.Id, "由于目前同一时间过多用户发送消息，消息发送失败，请稍后重试"))
+			} else if err != nil {
+				zlog.Error(err.Error())
+				c.enqueue(errorBack(frame.Id, message_error_enum.SystemError, constants.SYSTEM_ERROR,
+					[]byte("消息发送失败："+constants.SYSTEM_ERROR)))
 			}
 		}
 	}
@@ -102,14 +165,31 @@ func (c *Client) Read() {
 // 从send通道读取消息发送给websocket
 func (c *Client) Write() {
 	zlog.Info("ws write goroutine start")
-	for messageBack := range c.SendBack { // 阻塞状态
+	for {
+		var messageBack *MessageBack
+		select {
+		case back, ok := <-c.SendBack: // 阻塞状态
+			if !ok {
+				return
+			}
+			messageBack = back
+		case <-c.done:
+			return
+		}
 		// 通过 WebSocket 发送消息
-		err := c.Conn.WriteMessage(websocket.TextMessage, messageBack.Message)
-		if err != nil {
+		if err := c.writeNow(messageBack); err != nil {
 			zlog.Error(err.Error())
 			return // 直接断开websocket
 		}
+		if messageBack.Close {
+			c.disconnect(messageBack.closeCode, messageBack.closeReason)
+			return
+		}
 		// log.Println("已发送消息：", messageBack.Message)
+		// 没有uuid的是系统提示，不对应消息记录
+		if messageBack.Uuid == "" {
+			continue
+		}
 		// 说明顺利发送，修改状态为已发送
 		if res := dao.GormDB.Model(&model.Message{}).Where("uuid = ?", messageBack.Uuid).Update("status", message_status_enum.Sent); res.Error != nil {
 			zlog.Error(res.Error.Error())
@@ -117,18 +197,116 @@ func (c *Client) Write() {
 	}
 }
 
+// writeNow 按连接的协议版本编码后直接写入websocket，旧客户端不认识的帧跳过
+func (c *Client) writeNow(messageBack *MessageBack) error {
+	data, err := c.encode(messageBack)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if c.codec.Binary() {
+		return c.Conn.WriteMessage(websocket.BinaryMessage, data)
+	}
+	return c.Conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// PushToUsers 将非聊天消息（如表情回应）推送给在线的用户，离线用户直接跳过
+// frameType为新协议的帧类型，旧客户端收到的仍是data本身
+func PushToUsers(userIds []string, frameType string, data interface{}) {
+	jsonMessage, err := json.Marshal(data)
+	if err != nil {
+		zlog.Error(err.Error())
+		return
+	}
+	// 没有uuid，Write不会修改消息状态
+	pushBack(userIds, &MessageBack{
+		Message: jsonMessage,
+		Uuid:    "",
+		Type:    frameType,
+		Data:    data,
+	})
+}
+
+// PushAsyncResult 把异步任务结果推送给发起任务的用户，帧id为任务id
+// 用户不在本实例在线时结果只能通过轮询获取
+func PushAsyncResult(userId string, rsp respond.AsyncTaskRespond) {
+	jsonMessage, err := json.Marshal(rsp)
+	if err != nil {
+		zlog.Error(err.Error())
+		return
+	}
+	pushBack([]string{userId}, &MessageBack{
+		Message: jsonMessage,
+		Uuid:    "",
+		Type:    FrameAsyncResult,
+		Id:      rsp.TaskId,
+		Data:    rsp,
+	})
+}
+
+// chatMessageKey 聊天消息的kafka分区键，同一会话的消息进入同一分区以保持顺序
+// 单聊两个方向的session不同，和序号一样按conversationKey分区
+func chatMessageKey(message request.ChatMessageRequest) []byte {
+	if message.ReceiveId == "" {
+		return nil
+	}
+	return []byte(conversationKey(message))
+}
+
+// chatMessageKeyOf 从编码后的消息中取分区键，无法解析时返回nil，由kafka-go轮流写入各分区
+func chatMessageKeyOf(data []byte) []byte {
+	var message request.ChatMessageRequest
+	if err := wire.Unmarshal(data, &message); err != nil {
+		return nil
+	}
+	return chatMessageKey(message)
+}
+
+// pushBack 按消息模式交给对应server推送给在线的用户
+func pushBack(userIds []string, messageBack *MessageBack) {
+	if messageMode == "channel" {
+		ChatServer.pushToUsers(userIds, messageBack)
+	} else if messageMode == "hybrid" {
+		HybridChatServer.pushToUsers(userIds, messageBack)
+	} else {
+		KafkaChatServer.pushToUsers(userIds, messageBack)
+	}
+}
+
+// close 发送websocket关闭帧后断开连接，Read协程随之读到错误退出
+func (c *Client) close(code int, reason string) {
+	closeMessage := websocket.FormatCloseMessage(code, reason)
+	if err := c.Conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second)); err != nil {
+		zlog.Error(err.Error())
+	}
+	if err := c.Conn.Close(); err != nil {
+		zlog.Error(err.Error())
+	}
+}
+
 // NewClientInit 当接受到前端有登录消息时，会调用该函数
 func NewClientInit(c *gin.Context, clientId string) {
 	kafkaConfig := config.GetConfig().KafkaConfig
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		zlog.Error(err.Error())
+		return
 	}
 	client := &Client{
 		Conn:     conn,
 		Uuid:     clientId,
-		SendTo:   make(chan []byte, constants.CHANNEL_SIZE),
-		SendBack: make(chan *MessageBack, constants.CHANNEL_SIZE),
+		SendBack: make(chan *MessageBack, sendQueueSize()),
+		limiter:  newMessageLimiter(),
+		version:  clientVersion(c),
+		codec:    wire.JSON,
+		done:     make(chan struct{}),
+	}
+	// 协商了子协议的连接一定使用新协议信封
+	if codec := wire.BySubprotocol(conn.Subprotocol()); codec != nil {
+		client.codec = codec
+		client.version = FrameVersion
 	}
 	if kafkaConfig.MessageMode == "channel" {
 		ChatServer.SendClientToLogin(client)
@@ -142,22 +320,33 @@ func NewClientInit(c *gin.Context, clientId string) {
 	zlog.Info("ws连接成功")
 }
 
+// clientVersion 连接参数version声明的信封版本，未声明或无法识别的按旧客户端处理
+func clientVersion(c *gin.Context) int {
+	version, err := strconv.Atoi(c.Query("version"))
+	if err != nil || version < 0 {
+		return 0
+	}
+	if version > FrameVersion {
+		return FrameVersion
+	}
+	return version
+}
+
 // ClientLogout 当接受到前端有登出消息时，会调用该函数
+// 连接由server摘除后发送退出提示再断开，不关闭SendBack，其他协程可能还在往里放
 func ClientLogout(clientId string) (string, int) {
-	kafkaConfig := config.GetConfig().KafkaConfig
-	client := ChatServer.Clients[clientId]
-	if client != nil {
-		if kafkaConfig.MessageMode == "channel" {
+	if messageMode == "channel" {
+		if client := ChatServer.onlineClients(clientId)[clientId]; client != nil {
 			ChatServer.SendClientToLogout(client)
-		} else {
-			KafkaChatServer.SendClientToLogout(client)
 		}
-		if err := client.Conn.Close(); err != nil {
-			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, -1
+	} else if messageMode == "hybrid" {
+		if client := HybridChatServer.onlineClients(clientId)[clientId]; client != nil {
+			HybridChatServer.SendClientToLogout(client)
+		}
+	} else {
+		if client := KafkaChatServer.onlineClients(clientId)[clientId]; client != nil {
+			KafkaChatServer.SendClientToLogout(client)
 		}
-		close(client.SendTo)
-		close(client.SendBack)
 	}
 	return "退出成功", 0
 }
@@ -0,0 +1,157 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/dto/respond"
+	"kama_chat_server/internal/service/gorm"
+	"kama_chat_server/pkg/enum/contact/contact_status_enum"
+	"kama_chat_server/pkg/enum/message/message_error_enum"
+	"kama_chat_server/pkg/enum/user_info/user_status_enum"
+	"kama_chat_server/pkg/zlog"
+)
+
+// 控制事件类型，管理员禁用/删除用户、群主移除成员或解散群聊成功后由controller触发，
+// 立即作用到在线连接上，不用等客户端下次请求时才发现
+const (
+	EventForceLogout    = "force_logout"
+	EventGroupRemoved   = "group_removed"
+	EventGroupDismissed = "group_dismissed"
+)
+
+// DisconnectUsers 把用户从在线列表中摘除，发送原因帧后关闭连接
+// 摘除之后新的消息不会再推给这些连接，还在转发通道里的消息由checkSender拦下
+func DisconnectUsers(userIds []string, reason string) {
+	event := respond.ControlEventRespond{
+		EventType: EventForceLogout,
+		Reason:    reason,
+	}
+	frame, err := json.Marshal(event)
+	if err != nil {
+		zlog.Error(err.Error())
+		return
+	}
+	for _, client := range detachClients(userIds) {
+		// 原因帧发送后由Write断开，放不进发送队列时直接断开
+		client.closeAfter(&MessageBack{Message: frame, Uuid: "", Type: EventForceLogout, Data: event},
+			websocket.ClosePolicyViolation, EventForceLogout)
+	}
+}
+
+// NotifyGroupRemoved 通知被移出群聊的在线成员，群聊转发每次都读取最新成员，移出后不会再收到该群的消息
+func NotifyGroupRemoved(groupId string, userIds []string) {
+	PushToUsers(userIds, EventGroupRemoved, respond.ControlEventRespond{
+		EventType: EventGroupRemoved,
+		GroupId:   groupId,
+		Reason:    "你已被移出群聊",
+	})
+}
+
+// NotifyGroupDismissed 通知群聊解散前的在线成员
+func NotifyGroupDismissed(groupId string, members []string) {
+	PushToUsers(members, EventGroupDismissed, respond.ControlEventRespond{
+		EventType: EventGroupDismissed,
+		GroupId:   groupId,
+		Reason:    "群聊已解散",
+	})
+}
+
+// detachClients 按消息模式从对应server的在线列表中摘除用户，返回被摘除的连接
+func detachClients(userIds []string) []*Client {
+	if messageMode == "channel" {
+		return ChatServer.detachClients(userIds)
+	} else if messageMode == "hybrid" {
+		return HybridChatServer.detachClients(userIds)
+	}
+	return KafkaChatServer.detachClients(userIds)
+}
+
+// messageError 消息被拒绝的原因，Code见message_error_enum
+type messageError struct {
+	Code    string
+	Message string
+}
+
+func (e *messageError) Error() string {
+	return e.Message
+}
+
+// checkSender 消息落库前重新检查发送者状态，并按服务端数据校验发送权限
+// 发送者的昵称头像以服务端为准，在这里覆盖客户端传来的值
+// 禁用、删除用户或解散群聊之后，已经进入转发通道或kafka的消息也在这里被丢弃
+func checkSender(chatMessageReq *request.ChatMessageRequest) *messageError {
+	message, sender, ret := gorm.UserInfoService.GetUserInfo(chatMessageReq.SendId)
+	if ret != 0 {
+		return &messageError{Code: message_error_enum.SystemError, Message: message}
+	}
+	if sender.Uuid == "" || sender.Status != user_status_enum.NORMAL {
+		return &messageError{Code: message_error_enum.SenderDisabled, Message: "用户不存在或已被禁用"}
+	}
+	chatMessageReq.SendName = sender.Nickname
+	chatMessageReq.SendAvatar = sender.Avatar
+
+	receiveId := chatMessageReq.ReceiveId
+	if receiveId == "" || (receiveId[0] != 'U' && receiveId[0] != 'G') {
+		return &messageError{Code: message_error_enum.InvalidMessage, Message: "接收者不存在"}
+	}
+	if receiveId[0] == 'G' {
+		if message, ret := gorm.GroupInfoService.CheckGroupStatus(receiveId); ret == -1 {
+			return &messageError{Code: message_error_enum.SystemError, Message: message}
+		} else if ret != 0 {
+			return &messageError{Code: message_error_enum.GroupUnavailable, Message: message}
+		}
+	}
+	message, status, ret := gorm.UserContactService.GetContactStatus(chatMessageReq.SendId, receiveId)
+	if ret == -1 {
+		return &messageError{Code: message_error_enum.SystemError, Message: message}
+	}
+	if receiveId[0] == 'G' {
+		if ret != 0 || status == contact_status_enum.QUIT_GROUP || status == contact_status_enum.KICK_OUT_GROUP {
+			return &messageError{Code: message_error_enum.NotGroupMember, Message: "你已不在该群聊中"}
+		}
+		if status == contact_status_enum.SILENCE {
+			return &messageError{Code: message_error_enum.Silence, Message: "你已被禁言"}
+		}
+		return nil
+	}
+	if ret != 0 {
+		return &messageError{Code: message_error_enum.NotContact, Message: "对方不是你的好友"}
+	}
+	switch status {
+	case contact_status_enum.NORMAL:
+		return nil
+	case contact_status_enum.BLACK:
+		return &messageError{Code: message_error_enum.Black, Message: "你已拉黑对方，请先解除拉黑"}
+	case contact_status_enum.BE_BLACK:
+		return &messageError{Code: message_error_enum.BeBlack, Message: "你已被对方拉黑"}
+	default:
+		return &messageError{Code: message_error_enum.NotContact, Message: "对方不是你的好友"}
+	}
+}
+
+// rejectMessage 把消息被拒绝的原因推送给在线的发送者，不能在持有server锁时调用
+func rejectMessage(chatMessageReq request.ChatMessageRequest, err *messageError) {
+	zlog.Info(fmt.Sprintf("消息被拒绝: send_id=%s, receive_id=%s, code=%s", chatMessageReq.SendId, chatMessageReq.ReceiveId, err.Code))
+	pushBack([]string{chatMessageReq.SendId}, messageErrorBack(chatMessageReq, err))
+}
+
+// messageErrorBack 构造错误帧，旧客户端收到的是MessageErrorRespond，新协议下payload同样带上会话信息
+func messageErrorBack(chatMessageReq request.ChatMessageRequest, err *messageError) *MessageBack {
+	rsp := respond.MessageErrorRespond{
+		EventType: "message_error",
+		Code:      err.Code,
+		Message:   err.Message,
+		SessionId: chatMessageReq.SessionId,
+		ReceiveId: chatMessageReq.ReceiveId,
+	}
+	jsonMessage, marshalErr := json.Marshal(rsp)
+	if marshalErr != nil {
+		zlog.Error(marshalErr.Error())
+	}
+	messageBack := errorBack(chatMessageReq.FrameId, err.Code, err.Message, jsonMessage)
+	messageBack.Payload = jsonMessage
+	messageBack.Data = rsp
+	return messageBack
+}
@@ -0,0 +1,154 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"io"
+	"kama_chat_server/internal/config"
+	"kama_chat_server/internal/dao"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/model"
+	"kama_chat_server/internal/service/gorm"
+	myKafka "kama_chat_server/internal/service/kafka"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/zlog"
+	"sync"
+	"time"
+)
+
+// saveRetry 等待重试落库的消息
+type saveRetry struct {
+	message model.Message
+	data    []byte
+}
+
+var (
+	saveRetries    = make(chan saveRetry, constants.CHANNEL_SIZE)
+	saveRetryStart sync.Once
+)
+
+// saveMessage 消息落库，失败时不在处理循环里等待重试，交给后台协程按deadLetterConfig退避重试，重试队列满时直接写入死信
+// 返回false时消息没有保存，调用方不再转发；之后重试成功的消息只能通过拉取历史看到
+func saveMessage(message *model.Message, data []byte) bool {
+	err := dao.GormDB.Create(message).Error
+	if err == nil {
+		return true
+	}
+	zlog.Error(fmt.Sprintf("消息落库失败，第1次: %v", err))
+	if saveMaxAttempts() <= 1 {
+		deadLetter(data, "消息落库失败: "+err.Error(), 1)
+		return false
+	}
+	saveRetryStart.Do(func() {
+		go retrySaveMessages()
+	})
+	select {
+	case saveRetries <- saveRetry{message: *message, data: data}:
+	default:
+		deadLetter(data, "消息落库失败且重试队列已满: "+err.Error(), 1)
+	}
+	return false
+}
+
+// retrySaveMessages 后台重试落库，第attempt次失败后等待RetryBackoffMs<<(attempt-1)，用完次数后写入死信
+func retrySaveMessages() {
+	backoff := time.Duration(config.GetConfig().DeadLetterConfig.RetryBackoffMs) * time.Millisecond
+	for retry := range saveRetries {
+		maxAttempts := saveMaxAttempts()
+		var err error
+		for attempt := 2; attempt <= maxAttempts; attempt++ {
+			time.Sleep(backoff << (attempt - 2))
+			if err = dao.GormDB.Create(&retry.message).Error; err == nil {
+				break
+			}
+			zlog.Error(fmt.Sprintf("消息落库失败，第%d次: %v", attempt, err))
+		}
+		if err != nil {
+			deadLetter(retry.data, "消息落库失败: "+err.Error(), maxAttempts)
+		}
+	}
+}
+
+// saveMaxAttempts 消息落库最多尝试次数，包括第一次
+func saveMaxAttempts() int {
+	if maxAttempts := config.GetConfig().DeadLetterConfig.MaxAttempts; maxAttempts > 0 {
+		return maxAttempts
+	}
+	return 1
+}
+
+// deadLetter 记录处理失败的消息，kafka和hybrid模式写入死信topic，channel模式或写topic失败时直接落表
+func deadLetter(data []byte, reason string, attempts int) {
+	deadLetterReq := request.DeadLetterRequest{
+		Source:   messageMode,
+		Payload:  data,
+		Reason:   reason,
+		Attempts: attempts,
+		FailedAt: time.Now(),
+	}
+	if messageMode == "kafka" || messageMode == "hybrid" {
+		value, err := json.Marshal(deadLetterReq)
+		if err != nil {
+			zlog.Error(err.Error())
+		} else if err := myKafka.KafkaService.DeadLetterWriter.WriteMessages(ctx, kafka.Message{
+			Value: value,
+		}); err != nil {
+			zlog.Error("写入死信topic失败: " + err.Error())
+		} else {
+			return
+		}
+	}
+	if err := gorm.DeadLetterService.Record(deadLetterReq.Source, deadLetterReq.Payload, deadLetterReq.Reason,
+		deadLetterReq.Attempts, deadLetterReq.FailedAt); err != nil {
+		zlog.Error(fmt.Sprintf("写入死信失败，消息丢失: %v, 原因: %s", err, reason))
+	}
+}
+
+// ConsumeDeadLetters 把死信topic中的消息写入dead_letter表供管理员查看，kafka和hybrid模式下由main启动，reader关闭后返回
+func ConsumeDeadLetters() {
+	for {
+		kafkaMessage, err := myKafka.KafkaService.DeadLetterReader.ReadMessage(ctx)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			zlog.Error(err.Error())
+			continue
+		}
+		var deadLetterReq request.DeadLetterRequest
+		if err := json.Unmarshal(kafkaMessage.Value, &deadLetterReq); err != nil {
+			// 死信本身无法解析时原样保存
+			deadLetterReq = request.DeadLetterRequest{
+				Source:   "unknown",
+				Payload:  kafkaMessage.Value,
+				Reason:   "死信格式错误: " + err.Error(),
+				FailedAt: kafkaMessage.Time,
+			}
+		}
+		if err := gorm.DeadLetterService.Record(deadLetterReq.Source, deadLetterReq.Payload, deadLetterReq.Reason,
+			deadLetterReq.Attempts, deadLetterReq.FailedAt); err != nil {
+			zlog.Error(fmt.Sprintf("死信落表失败: %v, offset=%d", err, kafkaMessage.Offset))
+		}
+	}
+}
+
+// ReplayMessage 把死信中的原始消息按当前消息模式重新投递，投递后和新消息一样重新检查发送权限
+func ReplayMessage(data []byte) error {
+	if messageMode == "channel" {
+		if !ChatServer.SendMessageToTransmit(data) {
+			return errors.New("转发通道已满，请稍后重试")
+		}
+		return nil
+	} else if messageMode == "hybrid" {
+		if !HybridChatServer.SendMessageToTransmit(data) {
+			return errors.New("转发通道已满，请稍后重试")
+		}
+		return nil
+	}
+	return myKafka.KafkaService.ChatWriter.WriteMessages(ctx, kafka.Message{
+		Key:   chatMessageKeyOf(data),
+		Value: data,
+	})
+}
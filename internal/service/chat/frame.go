@@ -0,0 +1,173 @@
+package chat
+
+import (
+	"encoding/json"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/dto/respond"
+	"kama_chat_server/pkg/enum/message/message_error_enum"
+	"kama_chat_server/pkg/util/wire"
+	"kama_chat_server/pkg/zlog"
+)
+
+// FrameVersion 当前的信封版本
+// 客户端连接时通过websocket子协议或version参数声明，都没有声明的旧客户端在过渡期内仍按原来的格式下发：
+// 聊天消息和事件直接下发json，系统提示和部分错误直接下发文本
+const FrameVersion = 1
+
+// 下行帧类型，事件类帧（session_updated、message_reaction以及control.go中的控制事件）的类型与event_type一致
+const (
+	FrameChatMessage     = "chat_message" // 聊天消息，id为消息uuid；上行时为客户端发送的消息
+	FrameSessionUpdated  = "session_updated"
+	FrameMessageReaction = "message_reaction"
+	FrameAsyncResult     = "async_result" // 异步任务结果，id为任务id
+	FrameError           = "error"        // 错误，id为出错的上行帧id
+	FrameNack            = "nack"         // 服务端繁忙拒收上行消息，id为被拒收的上行帧id，客户端稍后重发
+	FrameSystem          = "system"       // 系统提示
+	FramePing            = "ping"         // 上行心跳
+	FramePong            = "pong"
+)
+
+// systemPayload 系统提示帧的payload
+type systemPayload struct {
+	Message string `json:"message"`
+}
+
+// nackPayload nack帧的payload
+type nackPayload struct {
+	RetryAfterMs int `json:"retry_after_ms"`
+}
+
+// encode 按连接声明的版本和编码生成下行帧
+func (c *Client) encode(messageBack *MessageBack) ([]byte, error) {
+	if c.version < FrameVersion {
+		return messageBack.Message, nil
+	}
+	return messageBack.frame(c.codec)
+}
+
+// frame 生成新协议的信封，群聊转发时多个连接共用同一个MessageBack，每种编码只序列化一次
+func (m *MessageBack) frame(codec wire.Codec) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if data, ok := m.frames[codec.Name()]; ok {
+		return data, nil
+	}
+	id := m.Id
+	if id == "" {
+		id = m.Uuid
+	}
+	frame := respond.Frame{
+		Version: FrameVersion,
+		Type:    m.Type,
+		Id:      id,
+		Error:   m.Error,
+	}
+	if codec.Binary() && m.Data != nil {
+		frame.Payload = m.Data
+	} else if m.Payload != nil {
+		frame.Payload = json.RawMessage(m.Payload)
+	} else if m.Error == nil && m.Message != nil {
+		frame.Payload = json.RawMessage(m.Message)
+	}
+	data, err := codec.Marshal(frame)
+	if err != nil {
+		return nil, err
+	}
+	if m.frames == nil {
+		m.frames = make(map[string][]byte)
+	}
+	m.frames[codec.Name()] = data
+	return data, nil
+}
+
+// decodeClientFrame 按连接的编码解析上行帧，聊天消息的payload一并解析
+func (c *Client) decodeClientFrame(data []byte) (request.ClientFrame, *request.ChatMessageRequest, error) {
+	if c.codec.Binary() {
+		var frame request.BinaryClientFrame
+		if err := c.codec.Unmarshal(data, &frame); err != nil {
+			return request.ClientFrame{}, nil, err
+		}
+		return request.ClientFrame{Version: frame.Version, Type: frame.Type, Id: frame.Id}, frame.Payload, nil
+	}
+	frame, err := decodeJSONClientFrame(data)
+	if err != nil || frame.Type != FrameChatMessage {
+		return frame, nil, err
+	}
+	var message request.ChatMessageRequest
+	if err := json.Unmarshal(frame.Payload, &message); err != nil {
+		return frame, nil, err
+	}
+	return frame, &message, nil
+}
+
+// decodeJSONClientFrame 解析json上行帧，没有v字段的旧格式整体作为聊天消息的payload
+// 旧格式的聊天消息本身也有type、payload字段（类型不同），所以只能靠v区分
+func decodeJSONClientFrame(data []byte) (request.ClientFrame, error) {
+	var probe struct {
+		Version int `json:"v"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return request.ClientFrame{}, err
+	}
+	if probe.Version < FrameVersion {
+		return request.ClientFrame{
+			Type:    FrameChatMessage,
+			Payload: data,
+		}, nil
+	}
+	var frame request.ClientFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return frame, err
+	}
+	return frame, nil
+}
+
+// systemBack 系统提示，旧客户端收到的是原来的文本
+func systemBack(text string) *MessageBack {
+	payload, err := json.Marshal(systemPayload{Message: text})
+	if err != nil {
+		zlog.Error(err.Error())
+	}
+	return &MessageBack{
+		Message: []byte(text),
+		Uuid:    "",
+		Type:    FrameSystem,
+		Payload: payload,
+		Data:    systemPayload{Message: text},
+	}
+}
+
+// errorBack 错误帧，legacy为旧客户端收到的内容
+func errorBack(frameId, code, message string, legacy []byte) *MessageBack {
+	return &MessageBack{
+		Message: legacy,
+		Uuid:    "",
+		Type:    FrameError,
+		Id:      frameId,
+		Error: &respond.FrameError{
+			Code:    code,
+			Message: message,
+		},
+	}
+}
+
+// nackBack 拒收帧，旧客户端收到的仍是原来的提示文本
+func nackBack(frameId, message string) *MessageBack {
+	data := nackPayload{RetryAfterMs: nackRetryAfterMs()}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		zlog.Error(err.Error())
+	}
+	return &MessageBack{
+		Message: []byte(message),
+		Uuid:    "",
+		Type:    FrameNack,
+		Id:      frameId,
+		Payload: payload,
+		Data:    data,
+		Error: &respond.FrameError{
+			Code:    message_error_enum.ServerBusy,
+			Message: message,
+		},
+	}
+}
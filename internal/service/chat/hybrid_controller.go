@@ -0,0 +1,305 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"kama_chat_server/internal/config"
+	"kama_chat_server/internal/model"
+	"kama_chat_server/internal/service/gorm"
+	myKafka "kama_chat_server/internal/service/kafka"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/enum/hybrid_mode/hybrid_mode_trigger_enum"
+	"kama_chat_server/pkg/zlog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	modeChannel = "channel"
+	modeKafka   = "kafka"
+	modeAuto    = "auto" // 管理员取消指定，恢复自动切换
+
+	latencyWeight = 0.2 // 处理耗时滑动平均中新样本的权重
+)
+
+// instanceName 模式切换记录中的实例名，每个实例独立切换
+var instanceName = func() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}()
+
+// ChannelMonitor 混合模式的切换控制器
+// 超载（channel占用达到上限或处理耗时超过阈值）持续overloadDuration后切到kafka；
+// 恢复（channel占用不超过下限、处理耗时低于阈值的一半、kafka积压不超过上限）持续recoverDuration后切回channel。
+// 两次自动切换至少间隔cooldown，避免负载在阈值附近时来回切换
+type ChannelMonitor struct {
+	latency        int64 // 单条消息处理耗时的滑动平均(纳秒)，原子读写，放在开头保证64位对齐
+	latencySamples int64 // 上次检查以来处理的消息数
+
+	upThreshold      float64       // 切到kafka的channel占用比例
+	downThreshold    float64       // 切回channel的channel占用比例
+	latencyThreshold time.Duration // 处理耗时阈值，为0时不检查
+	lagThreshold     int64         // 切回channel时允许的kafka积压
+	checkInterval    time.Duration // 检查间隔
+	overloadDuration time.Duration // 持续超载时间阈值
+	recoverDuration  time.Duration // 持续恢复时间阈值
+	cooldown         time.Duration // 两次自动切换的最小间隔
+
+	overloadStartTime *time.Time    // 开始超载的时间
+	recoverStartTime  *time.Time    // 开始恢复的时间
+	isOverloaded      bool          // 当前是否超载
+	lastSwitchTime    time.Time     // 最近一次切换的时间
+	forcedMode        string        // 管理员指定的模式，为空时自动切换
+	metrics           hybridMetrics // 最近一次检查时的指标
+	mutex             *sync.RWMutex
+}
+
+// hybridMetrics 切换控制器的输入
+type hybridMetrics struct {
+	loadRatio float64       // channel占用比例
+	latency   time.Duration // 单条消息的平均处理耗时
+	kafkaLag  int64         // kafka中还没有消费的消息数
+}
+
+func (m hybridMetrics) String() string {
+	return fmt.Sprintf("占用%.0f%%，处理耗时%v，kafka积压%d", m.loadRatio*100, m.latency, m.kafkaLag)
+}
+
+func newChannelMonitor(kafkaConfig config.KafkaConfig) *ChannelMonitor {
+	checkInterval := time.Duration(kafkaConfig.HybridMonitorInterval) * time.Second
+	if checkInterval <= 0 {
+		checkInterval = time.Second
+	}
+	// 下限必须低于上限，否则负载在阈值附近时会反复切换
+	downThreshold := kafkaConfig.HybridDownThreshold
+	if downThreshold <= 0 || downThreshold >= kafkaConfig.HybridThreshold {
+		downThreshold = kafkaConfig.HybridThreshold / 2
+	}
+	recoverDuration := kafkaConfig.HybridRecoverDuration
+	if recoverDuration <= 0 {
+		recoverDuration = kafkaConfig.HybridSwitchDuration
+	}
+	return &ChannelMonitor{
+		upThreshold:      kafkaConfig.HybridThreshold,
+		downThreshold:    downThreshold,
+		latencyThreshold: time.Duration(kafkaConfig.HybridLatencyMs) * time.Millisecond,
+		lagThreshold:     kafkaConfig.HybridKafkaLag,
+		checkInterval:    checkInterval,
+		overloadDuration: time.Duration(kafkaConfig.HybridSwitchDuration) * time.Second,
+		recoverDuration:  time.Duration(recoverDuration) * time.Second,
+		cooldown:         time.Duration(kafkaConfig.HybridCooldown) * time.Second,
+		mutex:            &sync.RWMutex{},
+	}
+}
+
+// observeLatency 记录一条消息从开始处理到转发完成的耗时
+func (m *ChannelMonitor) observeLatency(start time.Time) {
+	sample := int64(time.Since(start))
+	for {
+		old := atomic.LoadInt64(&m.latency)
+		next := sample
+		if old > 0 {
+			next = int64(float64(old)*(1-latencyWeight) + float64(sample)*latencyWeight)
+		}
+		if atomic.CompareAndSwapInt64(&m.latency, old, next) {
+			break
+		}
+	}
+	atomic.AddInt64(&m.latencySamples, 1)
+}
+
+// startChannelMonitor 启动channel监控
+func (h *HybridServer) startChannelMonitor() {
+	ticker := time.NewTicker(h.channelMonitor.checkInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.checkChannelLoad()
+	}
+}
+
+// collectMetrics 采集当前的负载指标
+func (h *HybridServer) collectMetrics() hybridMetrics {
+	m := h.channelMonitor
+	// 一个检查周期内没有消息时耗时归零，否则空闲后会一直停留在最后的平均值
+	if atomic.SwapInt64(&m.latencySamples, 0) == 0 {
+		atomic.StoreInt64(&m.latency, 0)
+	}
+	metrics := hybridMetrics{
+		loadRatio: float64(len(h.Transmit)) / float64(constants.CHANNEL_SIZE),
+		latency:   time.Duration(atomic.LoadInt64(&m.latency)),
+	}
+	if myKafka.KafkaService.ChatReader != nil {
+		// 最近一次拉取的分区中还没有消费的消息数，是近似值
+		metrics.kafkaLag = myKafka.KafkaService.ChatReader.Stats().Lag
+	}
+	return metrics
+}
+
+// checkChannelLoad 检查负载，按上下限和冷却时间决定是否切换
+func (h *HybridServer) checkChannelLoad() {
+	metrics := h.collectMetrics()
+	m := h.channelMonitor
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.metrics = metrics
+	now := time.Now()
+
+	overloaded := metrics.loadRatio >= m.upThreshold ||
+		(m.latencyThreshold > 0 && metrics.latency >= m.latencyThreshold)
+	if overloaded && !m.isOverloaded {
+		m.overloadStartTime = &now
+		zlog.Info("Channel开始超载: " + metrics.String())
+	} else if !overloaded && m.isOverloaded {
+		m.overloadStartTime = nil
+		zlog.Info("Channel负载恢复正常: " + metrics.String())
+	}
+	m.isOverloaded = overloaded
+
+	recovered := metrics.loadRatio <= m.downThreshold &&
+		(m.latencyThreshold <= 0 || metrics.latency < m.latencyThreshold/2) &&
+		metrics.kafkaLag <= m.lagThreshold
+	if !recovered {
+		m.recoverStartTime = nil
+	} else if m.recoverStartTime == nil {
+		m.recoverStartTime = &now
+	}
+
+	if m.forcedMode != "" || now.Sub(m.lastSwitchTime) < m.cooldown {
+		return
+	}
+	if h.GetCurrentMode() == modeChannel {
+		if overloaded && now.Sub(*m.overloadStartTime) >= m.overloadDuration {
+			h.switchMode(modeKafka, hybrid_mode_trigger_enum.AUTO, "",
+				fmt.Sprintf("持续超载%v: %s", m.overloadDuration, metrics))
+		}
+	} else if recovered && now.Sub(*m.recoverStartTime) >= m.recoverDuration {
+		h.switchMode(modeChannel, hybrid_mode_trigger_enum.AUTO, "",
+			fmt.Sprintf("持续低于下限%v: %s", m.recoverDuration, metrics))
+	}
+}
+
+// switchMode 切换模式并记录切换事件，调用时持有channelMonitor的锁
+func (h *HybridServer) switchMode(toMode, trigger, operatorId, reason string) {
+	h.modeMutex.Lock()
+	fromMode := modeChannel
+	if h.useKafka {
+		fromMode = modeKafka
+	}
+	if fromMode == toMode {
+		h.modeMutex.Unlock()
+		return
+	}
+	h.useKafka = toMode == modeKafka
+	h.modeMutex.Unlock()
+
+	m := h.channelMonitor
+	m.lastSwitchTime = time.Now()
+	// 切换后重新计算恢复时间，kafka模式下至少运行recoverDuration才会切回
+	m.recoverStartTime = nil
+	zlog.Info(fmt.Sprintf("混合模式从%s切换到%s(%s): %s", fromMode, toMode, trigger, reason))
+	if toMode == modeKafka {
+		// 将channel中积压的消息转移到kafka
+		go h.drainChannelToKafka()
+	}
+
+	event := &model.HybridModeEvent{
+		Instance:   instanceName,
+		FromMode:   fromMode,
+		ToMode:     toMode,
+		Trigger:    trigger,
+		OperatorId: operatorId,
+		Reason:     reason,
+		LoadRatio:  m.metrics.loadRatio,
+		LatencyMs:  m.metrics.latency.Milliseconds(),
+		KafkaLag:   m.metrics.kafkaLag,
+		CreatedAt:  m.lastSwitchTime,
+	}
+	go func() {
+		if err := gorm.HybridModeService.RecordModeChange(event); err != nil {
+			zlog.Error("记录模式切换失败: " + err.Error())
+		}
+	}()
+}
+
+// GetChannelStatus 获取切换控制器的状态
+func (h *HybridServer) GetChannelStatus() map[string]interface{} {
+	m := h.channelMonitor
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	forcedMode := m.forcedMode
+	if forcedMode == "" {
+		forcedMode = modeAuto
+	}
+	status := map[string]interface{}{
+		"instance":             instanceName,
+		"current_load":         len(h.Transmit),
+		"max_capacity":         constants.CHANNEL_SIZE,
+		"load_percentage":      float64(len(h.Transmit)) / float64(constants.CHANNEL_SIZE) * 100,
+		"is_overloaded":        m.isOverloaded,
+		"threshold_ratio":      m.upThreshold,
+		"down_threshold_ratio": m.downThreshold,
+		"latency_ms":           m.metrics.latency.Milliseconds(),
+		"latency_threshold_ms": m.latencyThreshold.Milliseconds(),
+		"kafka_lag":            m.metrics.kafkaLag,
+		"kafka_lag_threshold":  m.lagThreshold,
+		"cooldown_seconds":     m.cooldown.Seconds(),
+		"current_mode":         h.GetCurrentMode(),
+		"forced_mode":          forcedMode,
+	}
+
+	if m.overloadStartTime != nil {
+		status["overload_duration"] = time.Since(*m.overloadStartTime).Seconds()
+	}
+	if m.recoverStartTime != nil {
+		status["recover_duration"] = time.Since(*m.recoverStartTime).Seconds()
+	}
+	if !m.lastSwitchTime.IsZero() {
+		status["last_switch_at"] = m.lastSwitchTime.Format("2006-01-02 15:04:05")
+		if remaining := m.cooldown - time.Since(m.lastSwitchTime); remaining > 0 {
+			status["cooldown_remaining"] = remaining.Seconds()
+		}
+	}
+	return status
+}
+
+// GetHybridStatus 查看当前实例的混合模式状态 - 管理员
+func GetHybridStatus() (string, map[string]interface{}, int) {
+	if messageMode != "hybrid" {
+		return "当前不是hybrid模式", nil, -2
+	}
+	return "获取成功", HybridChatServer.GetChannelStatus(), 0
+}
+
+// ForceHybridMode 管理员指定当前实例使用的模式，mode为auto时恢复自动切换，返回修改前的设置
+func ForceHybridMode(mode, operatorId, reason string) (string, error) {
+	if messageMode != "hybrid" {
+		return "", errors.New("当前不是hybrid模式")
+	}
+	if mode != modeChannel && mode != modeKafka && mode != modeAuto {
+		return "", errors.New("mode只能是channel、kafka或auto")
+	}
+	h := HybridChatServer
+	m := h.channelMonitor
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	before := m.forcedMode
+	if before == "" {
+		before = modeAuto
+	}
+	if mode == modeAuto {
+		m.forcedMode = ""
+		zlog.Info("混合模式恢复自动切换")
+		return before, nil
+	}
+	m.forcedMode = mode
+	h.switchMode(mode, hybrid_mode_trigger_enum.MANUAL, operatorId, reason)
+	return before, nil
+}
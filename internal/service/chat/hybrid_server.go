@@ -3,9 +3,7 @@ package chat
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/websocket"
 	"github.com/segmentio/kafka-go"
 	"kama_chat_server/internal/config"
@@ -14,13 +12,12 @@ import (
 	"kama_chat_server/internal/dto/respond"
 	"kama_chat_server/internal/model"
 	myKafka "kama_chat_server/internal/service/kafka"
-	myredis "kama_chat_server/internal/service/redis"
 	"kama_chat_server/pkg/constants"
 	"kama_chat_server/pkg/enum/message/message_status_enum"
 	"kama_chat_server/pkg/enum/message/message_type_enum"
 	"kama_chat_server/pkg/util/random"
+	"kama_chat_server/pkg/util/wire"
 	"kama_chat_server/pkg/zlog"
-	"strconv"
 	"sync"
 	"time"
 )
@@ -37,16 +34,8 @@ type HybridServer struct {
 	channelMonitor  *ChannelMonitor
 	useKafka        bool // 当前是否使用kafka模式
 	modeMutex       *sync.RWMutex
-}
-
-// ChannelMonitor channel监控器
-type ChannelMonitor struct {
-	thresholdRatio    float64       // 阈值比例
-	checkInterval     time.Duration // 检查间隔
-	overloadDuration  time.Duration // 持续超载时间阈值
-	overloadStartTime *time.Time    // 开始超载的时间
-	isOverloaded      bool          // 当前是否超载
-	mutex             *sync.RWMutex
+	sequencer       *sequencer // 模式切换时两条路径同时消费，按会话序号排序后处理
+	slots           transmitSlots // Transmit的占位，所有放入Transmit的消息都要先占位
 }
 
 var HybridChatServer *HybridServer
@@ -62,14 +51,11 @@ func init() {
 			Login:    make(chan *Client, constants.CHANNEL_SIZE),
 			Logout:   make(chan *Client, constants.CHANNEL_SIZE),
 			
-			channelMonitor: &ChannelMonitor{
-				thresholdRatio:   kafkaConfig.HybridThreshold,
-				checkInterval:    time.Duration(kafkaConfig.HybridMonitorInterval) * time.Second,
-				overloadDuration: time.Duration(kafkaConfig.HybridSwitchDuration) * time.Second,
-				mutex:           &sync.RWMutex{},
-			},
+			channelMonitor: newChannelMonitor(kafkaConfig),
 			useKafka:  false,
 			modeMutex: &sync.RWMutex{},
+			sequencer: newSequencer(),
+			slots:     newTransmitSlots(constants.CHANNEL_SIZE),
 		}
 	}
 }
@@ -103,25 +89,19 @@ func (h *HybridServer) Start() {
 				h.Clients[client.Uuid] = client
 				h.mutex.Unlock()
 				zlog.Debug(fmt.Sprintf("欢迎来到kama聊天服务器，亲爱的用户%s\n", client.Uuid))
-				err := client.Conn.WriteMessage(websocket.TextMessage, []byte("欢迎来到kama聊天服务器"))
-				if err != nil {
-					zlog.Error(err.Error())
-				}
+				client.enqueue(systemBack("欢迎来到kama聊天服务器"))
 			}
 
 		case client := <-h.Logout:
 			{
-				h.mutex.Lock()
-				delete(h.Clients, client.Uuid)
-				h.mutex.Unlock()
+				h.removeClient(client)
 				zlog.Info(fmt.Sprintf("用户%s退出登录\n", client.Uuid))
-				if err := client.Conn.WriteMessage(websocket.TextMessage, []byte("已退出登录")); err != nil {
-					zlog.Error(err.Error())
-				}
+				client.closeAfter(systemBack("已退出登录"), websocket.CloseNormalClosure, "logout")
 			}
 
 		case data := <-h.Transmit:
 			{
+				h.slots.release()
 				// 处理channel模式的消息
 				h.processMessage(data)
 			}
@@ -129,82 +109,6 @@ func (h *HybridServer) Start() {
 	}
 }
 
-// startChannelMonitor 启动channel监控
-func (h *HybridServer) startChannelMonitor() {
-	ticker := time.NewTicker(h.channelMonitor.checkInterval)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		h.checkChannelLoad()
-	}
-}
-
-// checkChannelLoad 检查channel负载
-func (h *HybridServer) checkChannelLoad() {
-	currentLoad := len(h.Transmit)
-	threshold := int(float64(constants.CHANNEL_SIZE) * h.channelMonitor.thresholdRatio)
-	
-	h.channelMonitor.mutex.Lock()
-	defer h.channelMonitor.mutex.Unlock()
-	
-	if currentLoad >= threshold {
-		// 超过阈值
-		if !h.channelMonitor.isOverloaded {
-			// 刚开始超载
-			now := time.Now()
-			h.channelMonitor.overloadStartTime = &now
-			h.channelMonitor.isOverloaded = true
-			zlog.Info(fmt.Sprintf("Channel开始超载: %d/%d (阈值: %d)", currentLoad, constants.CHANNEL_SIZE, threshold))
-		} else {
-			// 持续超载，检查是否需要切换到kafka
-			if time.Since(*h.channelMonitor.overloadStartTime) >= h.channelMonitor.overloadDuration {
-				h.switchToKafka()
-			}
-		}
-	} else {
-		// 负载正常
-		if h.channelMonitor.isOverloaded {
-			h.channelMonitor.isOverloaded = false
-			h.channelMonitor.overloadStartTime = nil
-			zlog.Info(fmt.Sprintf("Channel负载恢复正常: %d/%d", currentLoad, constants.CHANNEL_SIZE))
-			
-			// 如果当前使用kafka且负载恢复，可以考虑切回channel
-			h.modeMutex.RLock()
-			usingKafka := h.useKafka
-			h.modeMutex.RUnlock()
-			
-			if usingKafka {
-				h.switchToChannel()
-			}
-		}
-	}
-}
-
-// switchToKafka 切换到kafka模式
-func (h *HybridServer) switchToKafka() {
-	h.modeMutex.Lock()
-	defer h.modeMutex.Unlock()
-	
-	if !h.useKafka {
-		h.useKafka = true
-		zlog.Info("切换到Kafka模式处理消息")
-		
-		// 将channel中积压的消息转移到kafka
-		go h.drainChannelToKafka()
-	}
-}
-
-// switchToChannel 切换到channel模式
-func (h *HybridServer) switchToChannel() {
-	h.modeMutex.Lock()
-	defer h.modeMutex.Unlock()
-	
-	if h.useKafka {
-		h.useKafka = false
-		zlog.Info("切换回Channel模式处理消息")
-	}
-}
-
 // drainChannelToKafka 将channel中的消息转移到kafka
 func (h *HybridServer) drainChannelToKafka() {
 	ctx := context.Background()
@@ -213,17 +117,19 @@ func (h *HybridServer) drainChannelToKafka() {
 	for {
 		select {
 		case data := <-h.Transmit:
+			h.slots.release()
 			// 发送到kafka
 			if err := myKafka.KafkaService.ChatWriter.WriteMessages(ctx, kafka.Message{
-				Key:   []byte(strconv.Itoa(config.GetConfig().KafkaConfig.Partition)),
+				Key:   chatMessageKeyOf(data),
 				Value: data,
 			}); err != nil {
 				zlog.Error(fmt.Sprintf("转移消息到Kafka失败: %v", err))
 				// 如果kafka发送失败，重新放回channel
-				select {
-				case h.Transmit <- data:
-				default:
-					zlog.Error("Channel已满，消息丢失")
+				if h.slots.acquire() {
+					h.Transmit <- data
+				} else {
+					zlog.Error("Channel已满，消息转入死信")
+					deadLetter(data, fmt.Sprintf("转移到Kafka失败且Channel已满: %v", err), 1)
 				}
 			} else {
 				drained++
@@ -238,39 +144,57 @@ func (h *HybridServer) drainChannelToKafka() {
 	}
 }
 
-// SendMessageToTransmit 发送消息到传输通道（支持动态路由）
-func (h *HybridServer) SendMessageToTransmit(message []byte) {
+// SendMessageToTransmit 发送消息到传输通道（支持动态路由），返回false表示拥塞未被接收，由调用方通知发送者重发
+func (h *HybridServer) SendMessageToTransmit(message []byte) bool {
+	return h.transmitWith(func() ([]byte, error) {
+		return message, nil
+	}) == nil
+}
+
+// transmitWith 按当前模式投递build生成的消息，channel模式先占用通道位置再调用build，通道已满时返回errTransmitFull
+// 新消息在build中分配序号，channel拒收的消息不会占用序号；kafka写入失败时序号已经分配，回退到channel仍然失败的序号会被跳过
+func (h *HybridServer) transmitWith(build func() ([]byte, error)) error {
 	h.modeMutex.RLock()
 	usingKafka := h.useKafka
 	h.modeMutex.RUnlock()
 	
 	if usingKafka {
+		message, err := build()
+		if err != nil {
+			return err
+		}
 		// 使用kafka发送
 		ctx := context.Background()
 		if err := myKafka.KafkaService.ChatWriter.WriteMessages(ctx, kafka.Message{
-			Key:   []byte(strconv.Itoa(config.GetConfig().KafkaConfig.Partition)),
+			Key:   chatMessageKeyOf(message),
 			Value: message,
 		}); err != nil {
 			zlog.Error(fmt.Sprintf("Kafka发送失败，回退到Channel: %v", err))
 			// kafka发送失败，回退到channel
-			select {
-			case h.Transmit <- message:
-				zlog.Info("消息已回退到Channel")
-			default:
-				zlog.Error("Channel已满，消息发送失败")
+			if !h.slots.acquire() {
+				zlog.Error("Kafka发送失败且Channel已满，拒收消息")
+				return errTransmitFull
 			}
+			h.Transmit <- message
+			zlog.Info("消息已回退到Channel")
 		} else {
 			zlog.Debug("消息已通过Kafka发送")
 		}
-	} else {
-		// 使用channel发送
-		select {
-		case h.Transmit <- message:
-			zlog.Debug("消息已通过Channel发送")
-		default:
-			zlog.Error("Channel已满，消息发送失败")
-		}
+		return nil
+	}
+	// 使用channel发送
+	if !h.slots.acquire() {
+		zlog.Error("Channel已满，拒收消息")
+		return errTransmitFull
+	}
+	message, err := build()
+	if err != nil {
+		h.slots.release()
+		return err
 	}
+	h.Transmit <- message
+	zlog.Debug("消息已通过Channel发送")
+	return nil
 }
 
 // startKafkaMessageReader 启动kafka消息读取
@@ -299,27 +223,45 @@ func (h *HybridServer) startKafkaMessageReader() {
 // processMessage 处理消息（统一的消息处理逻辑）
 func (h *HybridServer) processMessage(data []byte) {
 	var chatMessageReq request.ChatMessageRequest
-	if err := json.Unmarshal(data, &chatMessageReq); err != nil {
+	if err := wire.Unmarshal(data, &chatMessageReq); err != nil {
 		zlog.Error(err.Error())
+		deadLetter(data, "消息解析失败: "+err.Error(), 1)
+		return
+	}
+	h.sequencer.submit(chatMessageReq, func() {
+		h.handleMessage(chatMessageReq, data)
+	})
+}
+
+// handleMessage 按会话序号依次处理
+func (h *HybridServer) handleMessage(chatMessageReq request.ChatMessageRequest, data []byte) {
+	defer h.channelMonitor.observeLatency(time.Now())
+	// 落库前重新检查发送者状态和发送权限，不通过的消息直接丢弃
+	if err := checkSender(&chatMessageReq); err != nil {
+		rejectMessage(chatMessageReq, err)
 		return
 	}
 
 	// 这里复用原有的消息处理逻辑
-	if chatMessageReq.Type == message_type_enum.Text {
-		h.processTextMessage(chatMessageReq)
-	} else if chatMessageReq.Type == message_type_enum.File {
-		h.processFileMessage(chatMessageReq)
+	if chatMessageReq.Type == message_type_enum.Text || chatMessageReq.Type == message_type_enum.Location ||
+		chatMessageReq.Type == message_type_enum.ContactCard || chatMessageReq.Type == message_type_enum.Reply {
+		h.processTextMessage(chatMessageReq, data)
+	} else if chatMessageReq.Type == message_type_enum.File || chatMessageReq.Type == message_type_enum.Voice ||
+		chatMessageReq.Type == message_type_enum.Image {
+		// 语音与文件的存储、转发逻辑一致
+		h.processFileMessage(chatMessageReq, data)
 	} else if chatMessageReq.Type == message_type_enum.AudioOrVideo {
-		h.processAVMessage(chatMessageReq)
+		h.processAVMessage(chatMessageReq, data)
 	}
 }
 
 // processTextMessage 处理文本消息
-func (h *HybridServer) processTextMessage(chatMessageReq request.ChatMessageRequest) {
+func (h *HybridServer) processTextMessage(chatMessageReq request.ChatMessageRequest, data []byte) {
 	// 存储消息到数据库
 	message := model.Message{
 		Uuid:       fmt.Sprintf("M%s", random.GetNowAndLenRandomString(11)),
 		SessionId:  chatMessageReq.SessionId,
+		Seq:        chatMessageReq.Seq,
 		Type:       chatMessageReq.Type,
 		Content:    chatMessageReq.Content,
 		Url:        "",
@@ -333,13 +275,13 @@ func (h *HybridServer) processTextMessage(chatMessageReq request.ChatMessageRequ
 		Status:     message_status_enum.Unsent,
 		CreatedAt:  time.Now(),
 		AVdata:     "",
+		Payload:    storedPayload(chatMessageReq),
 	}
 	
 	// 标准化头像路径
 	message.SendAvatar = normalizePath(message.SendAvatar)
 	
-	if res := dao.GormDB.Create(&message); res.Error != nil {
-		zlog.Error(res.Error.Error())
+	if !saveMessage(&message, data) {
 		return
 	}
 
@@ -352,11 +294,18 @@ func (h *HybridServer) processTextMessage(chatMessageReq request.ChatMessageRequ
 }
 
 // processFileMessage 处理文件消息
-func (h *HybridServer) processFileMessage(chatMessageReq request.ChatMessageRequest) {
+func (h *HybridServer) processFileMessage(chatMessageReq request.ChatMessageRequest, data []byte) {
 	// 类似processTextMessage的逻辑，但处理文件相关字段
+	// 图片缩略图、宽高和音频时长在上传时由服务端提取，不信任前端传值
+	meta := uploadMeta(chatMessageReq.Url)
+	if chatMessageReq.Type == message_type_enum.Voice && meta.Duration == 0 {
+		// 语音时长已在Client.Read中校验
+		meta.Duration = chatMessageReq.Duration
+	}
 	message := model.Message{
 		Uuid:       fmt.Sprintf("M%s", random.GetNowAndLenRandomString(11)),
 		SessionId:  chatMessageReq.SessionId,
+		Seq:        chatMessageReq.Seq,
 		Type:       chatMessageReq.Type,
 		Content:    "",
 		Url:        chatMessageReq.Url,
@@ -367,15 +316,19 @@ func (h *HybridServer) processFileMessage(chatMessageReq request.ChatMessageRequ
 		FileSize:   chatMessageReq.FileSize,
 		FileType:   chatMessageReq.FileType,
 		FileName:   chatMessageReq.FileName,
+		Thumbnail:  meta.ThumbnailUrl,
+		Width:      meta.Width,
+		Height:     meta.Height,
+		Duration:   meta.Duration,
 		Status:     message_status_enum.Unsent,
 		CreatedAt:  time.Now(),
 		AVdata:     "",
+		Payload:    storedPayload(chatMessageReq),
 	}
 	
 	message.SendAvatar = normalizePath(message.SendAvatar)
 	
-	if res := dao.GormDB.Create(&message); res.Error != nil {
-		zlog.Error(res.Error.Error())
+	if !saveMessage(&message, data) {
 		return
 	}
 
@@ -387,7 +340,7 @@ func (h *HybridServer) processFileMessage(chatMessageReq request.ChatMessageRequ
 }
 
 // processAVMessage 处理音视频消息
-func (h *HybridServer) processAVMessage(chatMessageReq request.ChatMessageRequest) {
+func (h *HybridServer) processAVMessage(chatMessageReq request.ChatMessageRequest, data []byte) {
 	var avData request.AVData
 	if err := json.Unmarshal([]byte(chatMessageReq.AVdata), &avData); err != nil {
 		zlog.Error(err.Error())
@@ -397,6 +350,7 @@ func (h *HybridServer) processAVMessage(chatMessageReq request.ChatMessageReques
 	message := model.Message{
 		Uuid:       fmt.Sprintf("M%s", random.GetNowAndLenRandomString(11)),
 		SessionId:  chatMessageReq.SessionId,
+		Seq:        chatMessageReq.Seq,
 		Type:       chatMessageReq.Type,
 		Content:    "",
 		Url:        "",
@@ -414,8 +368,8 @@ func (h *HybridServer) processAVMessage(chatMessageReq request.ChatMessageReques
 
 	if avData.MessageId == "PROXY" && (avData.Type == "start_call" || avData.Type == "receive_call" || avData.Type == "reject_call") {
 		message.SendAvatar = normalizePath(message.SendAvatar)
-		if res := dao.GormDB.Create(&message); res.Error != nil {
-			zlog.Error(res.Error.Error())
+		if !saveMessage(&message, data) {
+			return
 		}
 	}
 
@@ -427,6 +381,8 @@ func (h *HybridServer) processAVMessage(chatMessageReq request.ChatMessageReques
 // sendToUser 发送消息给用户
 func (h *HybridServer) sendToUser(message model.Message, chatMessageReq request.ChatMessageRequest) {
 	messageRsp := respond.GetMessageListRespond{
+		Uuid:       message.Uuid,
+		Seq:        message.Seq,
 		SendId:     message.SendId,
 		SendName:   message.SendName,
 		SendAvatar: chatMessageReq.SendAvatar,
@@ -437,6 +393,11 @@ func (h *HybridServer) sendToUser(message model.Message, chatMessageReq request.
 		FileSize:   message.FileSize,
 		FileName:   message.FileName,
 		FileType:   message.FileType,
+		Thumbnail:  message.Thumbnail,
+		Width:      message.Width,
+		Height:     message.Height,
+		Duration:   message.Duration,
+		Payload:    json.RawMessage(message.Payload),
 		CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
 	}
 	
@@ -449,24 +410,27 @@ func (h *HybridServer) sendToUser(message model.Message, chatMessageReq request.
 	messageBack := &MessageBack{
 		Message: jsonMessage,
 		Uuid:    message.Uuid,
+		Type:    FrameChatMessage,
+		Data:    messageRsp,
 	}
 	
-	h.mutex.Lock()
-	if receiveClient, ok := h.Clients[message.ReceiveId]; ok {
-		receiveClient.SendBack <- messageBack
+	clients := h.onlineClients(message.ReceiveId, message.SendId)
+	if receiveClient, ok := clients[message.ReceiveId]; ok {
+		receiveClient.enqueue(messageBack)
+	} else {
+		notifyOffline(message.ReceiveId, message)
 	}
-	if sendClient, ok := h.Clients[message.SendId]; ok {
-		sendClient.SendBack <- messageBack
+	if sendClient, ok := clients[message.SendId]; ok {
+		sendClient.enqueue(messageBack)
 	}
-	h.mutex.Unlock()
-
-	// 更新Redis缓存
-	h.updateRedisCache("message_list_"+message.SendId+"_"+message.ReceiveId, messageRsp)
+	queueSessionUpdate(message, []string{message.SendId, message.ReceiveId})
 }
 
 // sendToGroup 发送消息给群组
 func (h *HybridServer) sendToGroup(message model.Message, chatMessageReq request.ChatMessageRequest) {
 	messageRsp := respond.GetGroupMessageListRespond{
+		Uuid:       message.Uuid,
+		Seq:        message.Seq,
 		SendId:     message.SendId,
 		SendName:   message.SendName,
 		SendAvatar: chatMessageReq.SendAvatar,
@@ -477,6 +441,11 @@ func (h *HybridServer) sendToGroup(message model.Message, chatMessageReq request
 		FileSize:   message.FileSize,
 		FileName:   message.FileName,
 		FileType:   message.FileType,
+		Thumbnail:  message.Thumbnail,
+		Width:      message.Width,
+		Height:     message.Height,
+		Duration:   message.Duration,
+		Payload:    json.RawMessage(message.Payload),
 		CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
 	}
 	
@@ -489,6 +458,8 @@ func (h *HybridServer) sendToGroup(message model.Message, chatMessageReq request
 	messageBack := &MessageBack{
 		Message: jsonMessage,
 		Uuid:    message.Uuid,
+		Type:    FrameChatMessage,
+		Data:    messageRsp,
 	}
 	
 	// 获取群组成员
@@ -504,16 +475,15 @@ func (h *HybridServer) sendToGroup(message model.Message, chatMessageReq request
 		return
 	}
 	
-	h.mutex.Lock()
+	clients := h.onlineClients(members...)
 	for _, member := range members {
-		if client, ok := h.Clients[member]; ok {
-			client.SendBack <- messageBack
+		if client, ok := clients[member]; ok {
+			client.enqueue(messageBack)
+		} else if member != message.SendId {
+			notifyOffline(member, message)
 		}
 	}
-	h.mutex.Unlock()
-
-	// 更新Redis缓存
-	h.updateRedisCache("group_messagelist_"+message.ReceiveId, messageRsp)
+	queueSessionUpdate(message, members)
 }
 
 // sendAVToUser 发送音视频消息给用户
@@ -542,38 +512,12 @@ func (h *HybridServer) sendAVToUser(message model.Message, chatMessageReq reques
 	messageBack := &MessageBack{
 		Message: jsonMessage,
 		Uuid:    message.Uuid,
+		Type:    FrameChatMessage,
+		Data:    messageRsp,
 	}
 	
-	h.mutex.Lock()
-	if receiveClient, ok := h.Clients[message.ReceiveId]; ok {
-		receiveClient.SendBack <- messageBack
-	}
-	h.mutex.Unlock()
-}
-
-// updateRedisCache 更新Redis缓存
-func (h *HybridServer) updateRedisCache(key string, messageRsp interface{}) {
-	rspString, err := myredis.GetKeyNilIsErr(key)
-	if err == nil {
-		// 缓存存在，更新
-		var rsp []interface{}
-		if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
-			zlog.Error(err.Error())
-			return
-		}
-		rsp = append(rsp, messageRsp)
-		rspByte, err := json.Marshal(rsp)
-		if err != nil {
-			zlog.Error(err.Error())
-			return
-		}
-		if err := myredis.SetKeyEx(key, string(rspByte), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-			zlog.Error(err.Error())
-		}
-	} else {
-		if !errors.Is(err, redis.Nil) {
-			zlog.Error(err.Error())
-		}
+	if receiveClient, ok := h.onlineClients(message.ReceiveId)[message.ReceiveId]; ok {
+		receiveClient.enqueue(messageBack)
 	}
 }
 
@@ -588,27 +532,6 @@ func (h *HybridServer) GetCurrentMode() string {
 	return "channel"
 }
 
-// GetChannelStatus 获取channel状态信息
-func (h *HybridServer) GetChannelStatus() map[string]interface{} {
-	h.channelMonitor.mutex.RLock()
-	defer h.channelMonitor.mutex.RUnlock()
-	
-	status := map[string]interface{}{
-		"current_load":      len(h.Transmit),
-		"max_capacity":      constants.CHANNEL_SIZE,
-		"load_percentage":   float64(len(h.Transmit)) / float64(constants.CHANNEL_SIZE) * 100,
-		"is_overloaded":     h.channelMonitor.isOverloaded,
-		"threshold_ratio":   h.channelMonitor.thresholdRatio,
-		"current_mode":      h.GetCurrentMode(),
-	}
-	
-	if h.channelMonitor.overloadStartTime != nil {
-		status["overload_duration"] = time.Since(*h.channelMonitor.overloadStartTime).Seconds()
-	}
-	
-	return status
-}
-
 // Close 关闭混合服务器
 func (h *HybridServer) Close() {
 	zlog.Info("正在关闭混合服务器...")
@@ -622,4 +545,47 @@ func (h *HybridServer) SendClientToLogin(client *Client) {
 // SendClientToLogout 发送客户端到登出通道
 func (h *HybridServer) SendClientToLogout(client *Client) {
 	h.Logout <- client
-}
\ No newline at end of file
+}
+
+// pushToUsers 向在线的用户推送
+func (h *HybridServer) pushToUsers(userIds []string, messageBack *MessageBack) {
+	for _, client := range h.onlineClients(userIds...) {
+		client.enqueue(messageBack)
+	}
+}
+
+// onlineClients 在锁内取出在线的连接，推送在锁外进行
+func (h *HybridServer) onlineClients(userIds ...string) map[string]*Client {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	clients := make(map[string]*Client, len(userIds))
+	for _, userId := range userIds {
+		if client, ok := h.Clients[userId]; ok {
+			clients[userId] = client
+		}
+	}
+	return clients
+}
+
+// removeClient 摘除断开的连接，用户已经用新连接登录时不受影响
+func (h *HybridServer) removeClient(client *Client) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.Clients[client.Uuid] == client {
+		delete(h.Clients, client.Uuid)
+	}
+}
+
+// detachClients 从在线列表中摘除用户并返回对应的连接
+func (h *HybridServer) detachClients(userIds []string) []*Client {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var clients []*Client
+	for _, userId := range userIds {
+		if client, ok := h.Clients[userId]; ok {
+			delete(h.Clients, userId)
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
@@ -0,0 +1,170 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"gorm.io/gorm"
+	"kama_chat_server/internal/dao"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/model"
+	"kama_chat_server/internal/service/media"
+	"kama_chat_server/internal/service/payload"
+	"kama_chat_server/pkg/enum/message/message_type_enum"
+	"kama_chat_server/pkg/zlog"
+	"path/filepath"
+)
+
+// isPayloadType 判断消息类型是否携带结构化内容
+func isPayloadType(messageType int8) bool {
+	return payload.IsPayloadType(messageType)
+}
+
+// checkChatMessage 消息进入转发管道前的校验，语音校验编码和时长，结构化消息校验并补全payload
+// 校验通过时会直接修改message，调用前SendId必须已经替换为连接的用户id
+func checkChatMessage(message *request.ChatMessageRequest) error {
+	var upload *model.FileUpload
+	if message.Type == message_type_enum.File || message.Type == message_type_enum.Voice ||
+		message.Type == message_type_enum.Image {
+		var err error
+		if upload, err = checkUploadOwner(message.SendId, message.Url); err != nil {
+			return err
+		}
+	}
+	if message.Type == message_type_enum.Voice {
+		duration, err := media.CheckVoice(message.Url, upload.Duration, message.Duration)
+		if err != nil {
+			return err
+		}
+		message.Duration = duration
+		message.Payload = nil
+		return nil
+	}
+	if !isPayloadType(message.Type) {
+		// 文本等类型不带结构化内容，客户端传来的payload直接丢弃，避免伪造引用或名片
+		message.Payload = nil
+		return nil
+	}
+	messagePayload, err := payload.Build(payloadStore{}, *message)
+	if err != nil {
+		return err
+	}
+	payloadBytes, err := json.Marshal(messagePayload)
+	if err != nil {
+		zlog.Error(err.Error())
+		return errors.New("消息内容序列化失败")
+	}
+	message.Payload = payloadBytes
+	return nil
+}
+
+// checkUploadOwner 文件、语音和图片消息只能使用发送者自己上传的文件，防止通过猜测文件名获取他人文件的下载链接
+func checkUploadOwner(sendId, fileUrl string) (*model.FileUpload, error) {
+	upload, err := findUpload(fileUrl)
+	if err != nil {
+		return nil, err
+	}
+	if upload.OwnerId != sendId {
+		return nil, errors.New("只能发送自己上传的文件")
+	}
+	return upload, nil
+}
+
+// findUpload 根据消息中的文件url查询上传记录
+func findUpload(fileUrl string) (*model.FileUpload, error) {
+	storedName := filepath.Base(media.LocalFilePath(fileUrl))
+	var upload model.FileUpload
+	if res := dao.GormDB.First(&upload, "stored_name = ?", storedName); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return nil, errors.New("文件不存在，请重新上传")
+		}
+		zlog.Error(res.Error.Error())
+		return nil, errors.New("查询文件失败")
+	}
+	return &upload, nil
+}
+
+// uploadMeta 读取上传时保存的元数据，查询失败时返回空元数据
+// 转发消息时调用，不解析文件，避免阻塞消息处理
+func uploadMeta(fileUrl string) media.FileMeta {
+	upload, err := findUpload(fileUrl)
+	if err != nil {
+		zlog.Error(err.Error())
+		return media.FileMeta{}
+	}
+	return media.FileMeta{
+		ThumbnailUrl: upload.Thumbnail,
+		Width:        upload.Width,
+		Height:       upload.Height,
+		Duration:     upload.Duration,
+	}
+}
+
+// storedPayload 落库的payload，只保留结构化消息在入口补全过的内容
+func storedPayload(chatMessageReq request.ChatMessageRequest) string {
+	if !isPayloadType(chatMessageReq.Type) {
+		return ""
+	}
+	return string(chatMessageReq.Payload)
+}
+
+// payloadStore 补全结构化消息所需的数据，从数据库和本地文件读取
+type payloadStore struct{}
+
+func (payloadStore) Image(url string) (*model.ImagePayload, error) {
+	if !media.IsImage(url) {
+		return nil, errors.New("图片格式不支持")
+	}
+	meta := uploadMeta(url)
+	if meta.Width == 0 || meta.Height == 0 {
+		return nil, errors.New("图片解析失败")
+	}
+	return &model.ImagePayload{
+		Url:       url,
+		Thumbnail: meta.ThumbnailUrl,
+		Width:     meta.Width,
+		Height:    meta.Height,
+	}, nil
+}
+
+// ContactCard 根据uuid查询用户或群聊，填充名片的名称和头像
+func (payloadStore) ContactCard(uuid string) (*model.ContactCardPayload, error) {
+	if uuid[0] == 'U' {
+		var user model.UserInfo
+		if res := dao.GormDB.First(&user, "uuid = ?", uuid); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				return nil, errors.New("名片用户不存在")
+			}
+			zlog.Error(res.Error.Error())
+			return nil, errors.New("查询名片用户失败")
+		}
+		return &model.ContactCardPayload{Uuid: user.Uuid, Name: user.Nickname, Avatar: user.Avatar}, nil
+	} else if uuid[0] == 'G' {
+		var group model.GroupInfo
+		if res := dao.GormDB.First(&group, "uuid = ?", uuid); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				return nil, errors.New("名片群聊不存在")
+			}
+			zlog.Error(res.Error.Error())
+			return nil, errors.New("查询名片群聊失败")
+		}
+		return &model.ContactCardPayload{Uuid: group.Uuid, Name: group.Name, Avatar: group.Avatar}, nil
+	}
+	return nil, errors.New("名片uuid不合法")
+}
+
+func (payloadStore) Message(uuid string) (*model.Message, error) {
+	var message model.Message
+	if res := dao.GormDB.First(&message, "uuid = ?", uuid); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		zlog.Error(res.Error.Error())
+		return nil, errors.New("查询引用的消息失败")
+	}
+	return &message, nil
+}
+
+// messagePreview 生成消息的文字摘要，用于会话列表和离线通知
+func messagePreview(message model.Message) string {
+	return payload.Preview(message)
+}
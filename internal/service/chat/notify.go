@@ -0,0 +1,69 @@
+package chat
+
+import (
+	"kama_chat_server/internal/config"
+	"kama_chat_server/internal/model"
+	"kama_chat_server/internal/service/gorm"
+	"kama_chat_server/internal/service/notify"
+	"kama_chat_server/pkg/zlog"
+	"time"
+)
+
+// Notifier 离线通知分发器，接收者不在Clients中时通过它发送推送
+var Notifier = newNotifier()
+
+func newNotifier() *notify.Dispatcher {
+	notifyConfig := config.GetConfig().NotifyConfig
+	var providers []notify.Provider
+	if notifyConfig.UseFakeProvider {
+		for _, name := range []string{notify.ProviderWebPush, notify.ProviderWebhook, notify.ProviderEmail} {
+			providers = append(providers, notify.NewFakeProvider(name))
+		}
+	} else {
+		if notifyConfig.VapidPrivateKey != "" {
+			providers = append(providers, &notify.WebPushProvider{
+				Subject:    notifyConfig.VapidSubject,
+				PublicKey:  notifyConfig.VapidPublicKey,
+				PrivateKey: notifyConfig.VapidPrivateKey,
+				TTL:        24 * 60 * 60,
+			})
+		}
+		if notifyConfig.WebhookUrl != "" {
+			providers = append(providers, &notify.WebhookProvider{
+				Url:    notifyConfig.WebhookUrl,
+				Secret: notifyConfig.WebhookSecret,
+			})
+		}
+		if notifyConfig.SmtpHost != "" {
+			providers = append(providers, &notify.EmailDigestProvider{
+				Host:     notifyConfig.SmtpHost,
+				Port:     notifyConfig.SmtpPort,
+				Username: notifyConfig.SmtpUsername,
+				Password: notifyConfig.SmtpPassword,
+				From:     notifyConfig.SmtpFrom,
+			})
+		}
+	}
+	return notify.NewDispatcher(gorm.NotificationService, providers, notify.Options{
+		CoalesceWindow: time.Duration(notifyConfig.CoalesceSeconds) * time.Second,
+		DigestWindow:   time.Duration(notifyConfig.DigestMinutes) * time.Minute,
+		ErrorLog: func(msg string) {
+			zlog.Error(msg)
+		},
+	})
+}
+
+// notifyOffline 给不在线的接收者发送离线通知，查询设置需要访问数据库，放到协程中避免阻塞转发
+func notifyOffline(userId string, message model.Message) {
+	targetId := message.SendId
+	if message.ReceiveId[0] == 'G' {
+		targetId = message.ReceiveId
+	}
+	item := notify.Item{
+		TargetId:  targetId,
+		SendName:  message.SendName,
+		Preview:   messagePreview(message),
+		CreatedAt: message.CreatedAt,
+	}
+	go Notifier.Enqueue(userId, item)
+}
@@ -0,0 +1,43 @@
+package chat
+
+import (
+	"kama_chat_server/internal/config"
+	"time"
+)
+
+// tokenBucket 单个websocket连接的消息限流，只在该连接的Read协程中使用，不需要加锁
+// 每条消息都走redis代价太高，连接级别的限流放在内存里
+type tokenBucket struct {
+	rate   float64 // 每秒补充的令牌数
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newMessageLimiter() *tokenBucket {
+	limitConfig := config.GetConfig().RateLimitConfig
+	return &tokenBucket{
+		rate:   limitConfig.WsMessageRate,
+		burst:  float64(limitConfig.WsMessageBurst),
+		tokens: float64(limitConfig.WsMessageBurst),
+		last:   time.Now(),
+	}
+}
+
+// allow 取一个令牌，rate为0时不限制
+func (b *tokenBucket) allow() bool {
+	if b.rate <= 0 || b.burst <= 0 {
+		return true
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
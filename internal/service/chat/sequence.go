@@ -0,0 +1,173 @@
+package chat
+
+import (
+	"fmt"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/service/gorm"
+	myredis "kama_chat_server/internal/service/redis"
+	"kama_chat_server/pkg/zlog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	seqGapWait    = 500 * time.Millisecond // 等待缺失序号的最长时间，超时后跳过，缺失的消息可能写入kafka失败或在重启前丢失
+	seqStreamIdle = 10 * time.Minute       // 会话超过该时长没有消息时释放排序状态
+)
+
+// conversationKey 会话标识，序号和kafka分区都按它划分
+// 群聊按群id；单聊两个方向的session不同，按两个用户id排序后拼接，使两个方向共用一个序号
+func conversationKey(message request.ChatMessageRequest) string {
+	if len(message.ReceiveId) > 0 && message.ReceiveId[0] == 'G' {
+		return message.ReceiveId
+	}
+	if message.SendId < message.ReceiveId {
+		return message.SendId + "_" + message.ReceiveId
+	}
+	return message.ReceiveId + "_" + message.SendId
+}
+
+// nextSeq 在消息被转发管道接收时分配会话内序号，计数器丢失时从数据库中的最大序号恢复
+func nextSeq(message request.ChatMessageRequest) (int64, error) {
+	return myredis.NextSeq(conversationKey(message), func() (int64, error) {
+		return gorm.MessageService.MaxSeq(message.SendId, message.ReceiveId)
+	})
+}
+
+// sequencer 按会话序号顺序处理消息，三种消息模式共用
+// 不同连接的Read协程分配序号后放入转发通道或写入kafka的顺序不固定，hybrid模式切换时channel和kafka两条路径还会同时消费，
+// 同一会话中序号大的消息可能先到，先缓存等待前面的消息
+type sequencer struct {
+	mutex   sync.Mutex
+	streams map[string]*seqStream
+	once    sync.Once
+}
+
+type seqStream struct {
+	next       int64 // 下一个应处理的序号，新建时为数据库中的最大序号+1
+	pending    map[int64]func()
+	running    bool // 是否有协程正在按顺序处理，同一会话同时只有一个协程处理
+	timer      *time.Timer
+	lastActive time.Time
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{streams: make(map[string]*seqStream)}
+}
+
+// submit 按序号处理消息，没有序号的消息（旧客户端或通话信令）、已经跳过或已经落库的序号直接处理
+func (s *sequencer) submit(message request.ChatMessageRequest, process func()) {
+	seq := message.Seq
+	if seq <= 0 {
+		process()
+		return
+	}
+	s.once.Do(func() {
+		go s.cleanup()
+	})
+	key := conversationKey(message)
+	s.mutex.Lock()
+	stream, ok := s.streams[key]
+	if !ok {
+		// 查库时不持有锁，其他会话的消息不受影响
+		s.mutex.Unlock()
+		next := seedSeq(message)
+		s.mutex.Lock()
+		if stream, ok = s.streams[key]; !ok {
+			stream = &seqStream{next: next, pending: make(map[int64]func())}
+			s.streams[key] = stream
+		}
+	}
+	stream.lastActive = time.Now()
+	if seq < stream.next {
+		s.mutex.Unlock()
+		zlog.Info(fmt.Sprintf("会话%s的消息%d晚于等待时间到达", key, seq))
+		process()
+		return
+	}
+	stream.pending[seq] = process
+	if stream.running {
+		s.mutex.Unlock()
+		return
+	}
+	stream.running = true
+	s.drain(key, stream)
+}
+
+// seedSeq 新建排序状态时的起始序号，从数据库中的最大序号继续，重启或模式切换后晚到的小序号不会被当作起点
+// 查询失败时退回到当前消息的序号
+func seedSeq(message request.ChatMessageRequest) int64 {
+	maxSeq, err := gorm.MessageService.MaxSeq(message.SendId, message.ReceiveId)
+	if err != nil {
+		zlog.Error(err.Error())
+		return message.Seq
+	}
+	return maxSeq + 1
+}
+
+// drain 依次处理连续的序号，调用时持有锁，返回时释放锁
+func (s *sequencer) drain(key string, stream *seqStream) {
+	for {
+		process, ok := stream.pending[stream.next]
+		if !ok {
+			break
+		}
+		delete(stream.pending, stream.next)
+		stream.next++
+		s.mutex.Unlock()
+		process()
+		s.mutex.Lock()
+	}
+	stream.running = false
+	if len(stream.pending) == 0 {
+		if stream.timer != nil {
+			stream.timer.Stop()
+			stream.timer = nil
+		}
+	} else if stream.timer == nil {
+		stream.timer = time.AfterFunc(seqGapWait, func() {
+			s.skipGap(key)
+		})
+	}
+	s.mutex.Unlock()
+}
+
+// skipGap 缺失的序号等待超时，从缓存中最小的序号继续处理
+func (s *sequencer) skipGap(key string) {
+	s.mutex.Lock()
+	stream, ok := s.streams[key]
+	if !ok {
+		s.mutex.Unlock()
+		return
+	}
+	stream.timer = nil
+	if stream.running || len(stream.pending) == 0 {
+		s.mutex.Unlock()
+		return
+	}
+	seqs := make([]int64, 0, len(stream.pending))
+	for seq := range stream.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	zlog.Warn(fmt.Sprintf("会话%s缺少序号%d-%d，跳过", key, stream.next, seqs[0]-1))
+	stream.next = seqs[0]
+	stream.running = true
+	s.drain(key, stream)
+}
+
+// cleanup 定期释放长时间没有消息的会话
+func (s *sequencer) cleanup() {
+	ticker := time.NewTicker(seqStreamIdle)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mutex.Lock()
+		for key, stream := range s.streams {
+			if !stream.running && len(stream.pending) == 0 && time.Since(stream.lastActive) > seqStreamIdle {
+				delete(s.streams, key)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
@@ -2,19 +2,17 @@ package chat
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/websocket"
 	"kama_chat_server/internal/dao"
 	"kama_chat_server/internal/dto/request"
 	"kama_chat_server/internal/dto/respond"
 	"kama_chat_server/internal/model"
-	myredis "kama_chat_server/internal/service/redis"
 	"kama_chat_server/pkg/constants"
 	"kama_chat_server/pkg/enum/message/message_status_enum"
 	"kama_chat_server/pkg/enum/message/message_type_enum"
 	"kama_chat_server/pkg/util/random"
+	"kama_chat_server/pkg/util/wire"
 	"kama_chat_server/pkg/zlog"
 	"log"
 	"strings"
@@ -28,6 +26,9 @@ type Server struct {
 	Transmit chan []byte  // 转发通道
 	Login    chan *Client // 登录通道
 	Logout   chan *Client // 退出登录通道
+
+	slots     transmitSlots // 转发通道的占位，所有放入Transmit的消息都要先占位
+	sequencer *sequencer    // 同一会话的消息可能由不同连接的Read协程乱序放入转发通道，按序号排序后处理
 }
 
 var ChatServer *Server
@@ -40,6 +41,9 @@ func init() {
 			Transmit: make(chan []byte, constants.CHANNEL_SIZE),
 			Login:    make(chan *Client, constants.CHANNEL_SIZE),
 			Logout:   make(chan *Client, constants.CHANNEL_SIZE),
+
+			slots:     newTransmitSlots(constants.CHANNEL_SIZE),
+			sequencer: newSequencer(),
 		}
 	}
 }
@@ -74,405 +78,385 @@ func (s *Server) Start() {
 				s.Clients[client.Uuid] = client
 				s.mutex.Unlock()
 				zlog.Debug(fmt.Sprintf("欢迎来到kama聊天服务器，亲爱的用户%s\n", client.Uuid))
-				err := client.Conn.WriteMessage(websocket.TextMessage, []byte("欢迎来到kama聊天服务器"))
-				if err != nil {
-					zlog.Error(err.Error())
-				}
+				client.enqueue(systemBack("欢迎来到kama聊天服务器"))
 			}
 
 		case client := <-s.Logout:
 			{
-				s.mutex.Lock()
-				delete(s.Clients, client.Uuid)
-				s.mutex.Unlock()
+				s.removeClient(client)
 				zlog.Info(fmt.Sprintf("用户%s退出登录\n", client.Uuid))
-				if err := client.Conn.WriteMessage(websocket.TextMessage, []byte("已退出登录")); err != nil {
-					zlog.Error(err.Error())
-				}
+				client.closeAfter(systemBack("已退出登录"), websocket.CloseNormalClosure, "logout")
 			}
 
 		case data := <-s.Transmit:
 			{
+				s.slots.release()
 				var chatMessageReq request.ChatMessageRequest
-				if err := json.Unmarshal(data, &chatMessageReq); err != nil {
+				if err := wire.Unmarshal(data, &chatMessageReq); err != nil {
 					zlog.Error(err.Error())
+					deadLetter(data, "消息解析失败: "+err.Error(), 1)
+					continue
 				}
-				// log.Println("原消息为：", data, "反序列化后为：", chatMessageReq)
-				if chatMessageReq.Type == message_type_enum.Text {
-					// 存message
-					message := model.Message{
-						Uuid:       fmt.Sprintf("M%s", random.GetNowAndLenRandomString(11)),
-						SessionId:  chatMessageReq.SessionId,
-						Type:       chatMessageReq.Type,
-						Content:    chatMessageReq.Content,
-						Url:        "",
-						SendId:     chatMessageReq.SendId,
-						SendName:   chatMessageReq.SendName,
-						SendAvatar: chatMessageReq.SendAvatar,
-						ReceiveId:  chatMessageReq.ReceiveId,
-						FileSize:   "0B",
-						FileType:   "",
-						FileName:   "",
-						Status:     message_status_enum.Unsent,
-						CreatedAt:  time.Now(),
-						AVdata:     "",
-					}
-					// 对SendAvatar去除前面/static之前的所有内容，防止ip前缀引入
-					message.SendAvatar = normalizePath(message.SendAvatar)
-					if res := dao.GormDB.Create(&message); res.Error != nil {
-						zlog.Error(res.Error.Error())
-					}
-					if message.ReceiveId[0] == 'U' { // 发送给User
-						// 如果能找到ReceiveId，说明在线，可以发送，否则存表后跳过
-						// 因为在线的时候是通过websocket更新消息记录的，离线后通过存表，登录时只调用一次数据库操作
-						// 切换chat对象后，前端的messageList也会改变，获取messageList从第二次就是从redis中获取
-						messageRsp := respond.GetMessageListRespond{
-							SendId:     message.SendId,
-							SendName:   message.SendName,
-							SendAvatar: chatMessageReq.SendAvatar,
-							ReceiveId:  message.ReceiveId,
-							Type:       message.Type,
-							Content:    message.Content,
-							Url:        message.Url,
-							FileSize:   message.FileSize,
-							FileName:   message.FileName,
-							FileType:   message.FileType,
-							CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
-						}
-						jsonMessage, err := json.Marshal(messageRsp)
-						if err != nil {
-							zlog.Error(err.Error())
-						}
-						log.Println("返回的消息为：", messageRsp, "序列化后为：", jsonMessage)
-						var messageBack = &MessageBack{
-							Message: jsonMessage,
-							Uuid:    message.Uuid,
-						}
-						s.mutex.Lock()
-						if receiveClient, ok := s.Clients[message.ReceiveId]; ok {
-							//messageBack.Message = jsonMessage
-							//messageBack.Uuid = message.Uuid
-							receiveClient.SendBack <- messageBack // 向client.Send发送
-						}
-						// 因为send_id肯定在线，所以这里在后端进行在线回显message，其实优化的话前端可以直接回显
-						// 问题在于前后端的req和rsp结构不同，前端存储message的messageList不能存req，只能存rsp
-						// 所以这里后端进行回显，前端不回显
-						sendClient := s.Clients[message.SendId]
-						sendClient.SendBack <- messageBack
-						s.mutex.Unlock()
-
-						// redis
-						var rspString string
-						rspString, err = myredis.GetKeyNilIsErr("message_list_" + message.SendId + "_" + message.ReceiveId)
-						if err == nil {
-							var rsp []respond.GetMessageListRespond
-							if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
-								zlog.Error(err.Error())
-							}
-							rsp = append(rsp, messageRsp)
-							rspByte, err := json.Marshal(rsp)
-							if err != nil {
-								zlog.Error(err.Error())
-							}
-							if err := myredis.SetKeyEx("message_list_"+message.SendId+"_"+message.ReceiveId, string(rspByte), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-								zlog.Error(err.Error())
-							}
-						} else {
-							if !errors.Is(err, redis.Nil) {
-								zlog.Error(err.Error())
-							}
-						}
-
-					} else if message.ReceiveId[0] == 'G' { // 发送给Group
-						messageRsp := respond.GetGroupMessageListRespond{
-							SendId:     message.SendId,
-							SendName:   message.SendName,
-							SendAvatar: chatMessageReq.SendAvatar,
-							ReceiveId:  message.ReceiveId,
-							Type:       message.Type,
-							Content:    message.Content,
-							Url:        message.Url,
-							FileSize:   message.FileSize,
-							FileName:   message.FileName,
-							FileType:   message.FileType,
-							CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
-						}
-						jsonMessage, err := json.Marshal(messageRsp)
-						if err != nil {
-							zlog.Error(err.Error())
-						}
-						log.Println("返回的消息为：", messageRsp, "序列化后为：", jsonMessage)
-						var messageBack = &MessageBack{
-							Message: jsonMessage,
-							Uuid:    message.Uuid,
-						}
-						var group model.GroupInfo
-						if res := dao.GormDB.Where("uuid = ?", message.ReceiveId).First(&group); res.Error != nil {
-							zlog.Error(res.Error.Error())
-						}
-						var members []string
-						if err := json.Unmarshal(group.Members, &members); err != nil {
-							zlog.Error(err.Error())
-						}
-						s.mutex.Lock()
-						for _, member := range members {
-							if member != message.SendId {
-								if receiveClient, ok := s.Clients[member]; ok {
-									receiveClient.SendBack <- messageBack
-								}
-							} else {
-								sendClient := s.Clients[message.SendId]
-								sendClient.SendBack <- messageBack
-							}
-						}
-						s.mutex.Unlock()
-
-						// redis
-						var rspString string
-						rspString, err = myredis.GetKeyNilIsErr("group_messagelist_" + message.ReceiveId)
-						if err == nil {
-							var rsp []respond.GetGroupMessageListRespond
-							if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
-								zlog.Error(err.Error())
-							}
-							rsp = append(rsp, messageRsp)
-							rspByte, err := json.Marshal(rsp)
-							if err != nil {
-								zlog.Error(err.Error())
-							}
-							if err := myredis.SetKeyEx("group_messagelist_"+message.ReceiveId, string(rspByte), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-								zlog.Error(err.Error())
-							}
-						} else {
-							if !errors.Is(err, redis.Nil) {
-								zlog.Error(err.Error())
-							}
-						}
-					}
-				} else if chatMessageReq.Type == message_type_enum.File {
-					// 存message
-					message := model.Message{
-						Uuid:       fmt.Sprintf("M%s", random.GetNowAndLenRandomString(11)),
-						SessionId:  chatMessageReq.SessionId,
-						Type:       chatMessageReq.Type,
-						Content:    "",
-						Url:        chatMessageReq.Url,
-						SendId:     chatMessageReq.SendId,
-						SendName:   chatMessageReq.SendName,
-						SendAvatar: chatMessageReq.SendAvatar,
-						ReceiveId:  chatMessageReq.ReceiveId,
-						FileSize:   chatMessageReq.FileSize,
-						FileType:   chatMessageReq.FileType,
-						FileName:   chatMessageReq.FileName,
-						Status:     message_status_enum.Unsent,
-						CreatedAt:  time.Now(),
-						AVdata:     "",
-					}
-					// 对SendAvatar去除前面/static之前的所有内容，防止ip前缀引入
-					message.SendAvatar = normalizePath(message.SendAvatar)
-					if res := dao.GormDB.Create(&message); res.Error != nil {
-						zlog.Error(res.Error.Error())
-					}
-					if message.ReceiveId[0] == 'U' { // 发送给User
-						// 如果能找到ReceiveId，说明在线，可以发送，否则存表后跳过
-						// 因为在线的时候是通过websocket更新消息记录的，离线后通过存表，登录时只调用一次数据库操作
-						// 切换chat对象后，前端的messageList也会改变，获取messageList从第二次就是从redis中获取
-						messageRsp := respond.GetMessageListRespond{
-							SendId:     message.SendId,
-							SendName:   message.SendName,
-							SendAvatar: chatMessageReq.SendAvatar,
-							ReceiveId:  message.ReceiveId,
-							Type:       message.Type,
-							Content:    message.Content,
-							Url:        message.Url,
-							FileSize:   message.FileSize,
-							FileName:   message.FileName,
-							FileType:   message.FileType,
-							CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
-						}
-						jsonMessage, err := json.Marshal(messageRsp)
-						if err != nil {
-							zlog.Error(err.Error())
-						}
-						log.Println("返回的消息为：", messageRsp, "序列化后为：", jsonMessage)
-						var messageBack = &MessageBack{
-							Message: jsonMessage,
-							Uuid:    message.Uuid,
-						}
-						s.mutex.Lock()
-						if receiveClient, ok := s.Clients[message.ReceiveId]; ok {
-							//messageBack.Message = jsonMessage
-							//messageBack.Uuid = message.Uuid
-							receiveClient.SendBack <- messageBack // 向client.Send发送
-						}
-						// 因为send_id肯定在线，所以这里在后端进行在线回显message，其实优化的话前端可以直接回显
-						// 问题在于前后端的req和rsp结构不同，前端存储message的messageList不能存req，只能存rsp
-						// 所以这里后端进行回显，前端不回显
-						sendClient := s.Clients[message.SendId]
-						sendClient.SendBack <- messageBack
-						s.mutex.Unlock()
+				s.sequencer.submit(chatMessageReq, func() {
+					s.handleMessage(chatMessageReq, data)
+				})
+			}
+		}
+	}
+}
 
-						// redis
-						var rspString string
-						rspString, err = myredis.GetKeyNilIsErr("message_list_" + message.SendId + "_" + message.ReceiveId)
-						if err == nil {
-							var rsp []respond.GetMessageListRespond
-							if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
-								zlog.Error(err.Error())
-							}
-							rsp = append(rsp, messageRsp)
-							rspByte, err := json.Marshal(rsp)
-							if err != nil {
-								zlog.Error(err.Error())
-							}
-							if err := myredis.SetKeyEx("message_list_"+message.SendId+"_"+message.ReceiveId, string(rspByte), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-								zlog.Error(err.Error())
-							}
-						} else {
-							if !errors.Is(err, redis.Nil) {
-								zlog.Error(err.Error())
-							}
-						}
+// handleMessage 落库并转发，同一会话按序号依次调用
+func (s *Server) handleMessage(chatMessageReq request.ChatMessageRequest, data []byte) {
+	// 落库前重新检查发送者状态和发送权限，不通过的消息直接丢弃
+	if err := checkSender(&chatMessageReq); err != nil {
+		rejectMessage(chatMessageReq, err)
+		return
+	}
+	// log.Println("原消息为：", data, "反序列化后为：", chatMessageReq)
+	if chatMessageReq.Type == message_type_enum.Text || chatMessageReq.Type == message_type_enum.Location ||
+		chatMessageReq.Type == message_type_enum.ContactCard || chatMessageReq.Type == message_type_enum.Reply {
+		// 存message
+		message := model.Message{
+			Uuid:       fmt.Sprintf("M%s", random.GetNowAndLenRandomString(11)),
+			SessionId:  chatMessageReq.SessionId,
+			Seq:        chatMessageReq.Seq,
+			Type:       chatMessageReq.Type,
+			Content:    chatMessageReq.Content,
+			Url:        "",
+			SendId:     chatMessageReq.SendId,
+			SendName:   chatMessageReq.SendName,
+			SendAvatar: chatMessageReq.SendAvatar,
+			ReceiveId:  chatMessageReq.ReceiveId,
+			FileSize:   "0B",
+			FileType:   "",
+			FileName:   "",
+			Status:     message_status_enum.Unsent,
+			CreatedAt:  time.Now(),
+			AVdata:     "",
+			Payload:    storedPayload(chatMessageReq),
+		}
+		// 对SendAvatar去除前面/static之前的所有内容，防止ip前缀引入
+		message.SendAvatar = normalizePath(message.SendAvatar)
+		if !saveMessage(&message, data) {
+			return
+		}
+		if message.ReceiveId[0] == 'U' { // 发送给User
+			// 如果能找到ReceiveId，说明在线，可以发送，否则存表后跳过
+			// 因为在线的时候是通过websocket更新消息记录的，离线后通过存表，登录时只调用一次数据库操作
+			// 切换chat对象后，前端的messageList也会改变，获取messageList从第二次就是从redis中获取
+			messageRsp := respond.GetMessageListRespond{
+				Uuid:       message.Uuid,
+				Seq:        message.Seq,
+				SendId:     message.SendId,
+				SendName:   message.SendName,
+				SendAvatar: chatMessageReq.SendAvatar,
+				ReceiveId:  message.ReceiveId,
+				Type:       message.Type,
+				Content:    message.Content,
+				Url:        message.Url,
+				FileSize:   message.FileSize,
+				FileName:   message.FileName,
+				FileType:   message.FileType,
+				Payload:    json.RawMessage(message.Payload),
+				CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
+			}
+			jsonMessage, err := json.Marshal(messageRsp)
+			if err != nil {
+				zlog.Error(err.Error())
+			}
+			log.Println("返回的消息为：", messageRsp, "序列化后为：", jsonMessage)
+			var messageBack = &MessageBack{
+				Message: jsonMessage,
+				Uuid:    message.Uuid,
+				Type:    FrameChatMessage,
+				Data:    messageRsp,
+			}
+			clients := s.onlineClients(message.ReceiveId, message.SendId)
+			if receiveClient, ok := clients[message.ReceiveId]; ok {
+				//messageBack.Message = jsonMessage
+				//messageBack.Uuid = message.Uuid
+				receiveClient.enqueue(messageBack) // 向client.Send发送
+			} else {
+				notifyOffline(message.ReceiveId, message)
+			}
+			// 因为send_id肯定在线，所以这里在后端进行在线回显message，其实优化的话前端可以直接回显
+			// 问题在于前后端的req和rsp结构不同，前端存储message的messageList不能存req，只能存rsp
+			// 所以这里后端进行回显，前端不回显
+			// 发送者可能刚被强制下线
+			if sendClient, ok := clients[message.SendId]; ok {
+				sendClient.enqueue(messageBack)
+			}
+			queueSessionUpdate(message, []string{message.SendId, message.ReceiveId})
+		} else if message.ReceiveId[0] == 'G' { // 发送给Group
+			messageRsp := respond.GetGroupMessageListRespond{
+				Uuid:       message.Uuid,
+				Seq:        message.Seq,
+				SendId:     message.SendId,
+				SendName:   message.SendName,
+				SendAvatar: chatMessageReq.SendAvatar,
+				ReceiveId:  message.ReceiveId,
+				Type:       message.Type,
+				Content:    message.Content,
+				Url:        message.Url,
+				FileSize:   message.FileSize,
+				FileName:   message.FileName,
+				FileType:   message.FileType,
+				Payload:    json.RawMessage(message.Payload),
+				CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
+			}
+			jsonMessage, err := json.Marshal(messageRsp)
+			if err != nil {
+				zlog.Error(err.Error())
+			}
+			log.Println("返回的消息为：", messageRsp, "序列化后为：", jsonMessage)
+			var messageBack = &MessageBack{
+				Message: jsonMessage,
+				Uuid:    message.Uuid,
+				Type:    FrameChatMessage,
+				Data:    messageRsp,
+			}
+			var group model.GroupInfo
+			if res := dao.GormDB.Where("uuid = ?", message.ReceiveId).First(&group); res.Error != nil {
+				zlog.Error(res.Error.Error())
+			}
+			var members []string
+			if err := json.Unmarshal(group.Members, &members); err != nil {
+				zlog.Error(err.Error())
+			}
+			clients := s.onlineClients(members...)
+			for _, member := range members {
+				if member != message.SendId {
+					if receiveClient, ok := clients[member]; ok {
+						receiveClient.enqueue(messageBack)
 					} else {
-						messageRsp := respond.GetGroupMessageListRespond{
-							SendId:     message.SendId,
-							SendName:   message.SendName,
-							SendAvatar: chatMessageReq.SendAvatar,
-							ReceiveId:  message.ReceiveId,
-							Type:       message.Type,
-							Content:    message.Content,
-							Url:        message.Url,
-							FileSize:   message.FileSize,
-							FileName:   message.FileName,
-							FileType:   message.FileType,
-							CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
-						}
-						jsonMessage, err := json.Marshal(messageRsp)
-						if err != nil {
-							zlog.Error(err.Error())
-						}
-						log.Println("返回的消息为：", messageRsp, "序列化后为：", jsonMessage)
-						var messageBack = &MessageBack{
-							Message: jsonMessage,
-							Uuid:    message.Uuid,
-						}
-						var group model.GroupInfo
-						if res := dao.GormDB.Where("uuid = ?", message.ReceiveId).First(&group); res.Error != nil {
-							zlog.Error(res.Error.Error())
-						}
-						var members []string
-						if err := json.Unmarshal(group.Members, &members); err != nil {
-							zlog.Error(err.Error())
-						}
-						s.mutex.Lock()
-						for _, member := range members {
-							if member != message.SendId {
-								if receiveClient, ok := s.Clients[member]; ok {
-									receiveClient.SendBack <- messageBack
-								}
-							} else {
-								sendClient := s.Clients[message.SendId]
-								sendClient.SendBack <- messageBack
-							}
-						}
-						s.mutex.Unlock()
-
-						// redis
-						var rspString string
-						rspString, err = myredis.GetKeyNilIsErr("group_messagelist_" + message.ReceiveId)
-						if err == nil {
-							var rsp []respond.GetGroupMessageListRespond
-							if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
-								zlog.Error(err.Error())
-							}
-							rsp = append(rsp, messageRsp)
-							rspByte, err := json.Marshal(rsp)
-							if err != nil {
-								zlog.Error(err.Error())
-							}
-							if err := myredis.SetKeyEx("group_messagelist_"+message.ReceiveId, string(rspByte), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-								zlog.Error(err.Error())
-							}
-						} else {
-							if !errors.Is(err, redis.Nil) {
-								zlog.Error(err.Error())
-							}
-						}
+						notifyOffline(member, message)
 					}
-				} else if chatMessageReq.Type == message_type_enum.AudioOrVideo {
-					var avData request.AVData
-					if err := json.Unmarshal([]byte(chatMessageReq.AVdata), &avData); err != nil {
-						zlog.Error(err.Error())
+				} else {
+					// 发送者可能刚被强制下线
+					if sendClient, ok := clients[message.SendId]; ok {
+						sendClient.enqueue(messageBack)
 					}
-					//log.Println(avData)
-					message := model.Message{
-						Uuid:       fmt.Sprintf("M%s", random.GetNowAndLenRandomString(11)),
-						SessionId:  chatMessageReq.SessionId,
-						Type:       chatMessageReq.Type,
-						Content:    "",
-						Url:        "",
-						SendId:     chatMessageReq.SendId,
-						SendName:   chatMessageReq.SendName,
-						SendAvatar: chatMessageReq.SendAvatar,
-						ReceiveId:  chatMessageReq.ReceiveId,
-						FileSize:   "",
-						FileType:   "",
-						FileName:   "",
-						Status:     message_status_enum.Unsent,
-						CreatedAt:  time.Now(),
-						AVdata:     chatMessageReq.AVdata,
-					}
-					if avData.MessageId == "PROXY" && (avData.Type == "start_call" || avData.Type == "receive_call" || avData.Type == "reject_call") {
-						// 存message
-						// 对SendAvatar去除前面/static之前的所有内容，防止ip前缀引入
-						message.SendAvatar = normalizePath(message.SendAvatar)
-						if res := dao.GormDB.Create(&message); res.Error != nil {
-							zlog.Error(res.Error.Error())
-						}
+				}
+			}
+			queueSessionUpdate(message, members)
+		}
+	} else if chatMessageReq.Type == message_type_enum.File || chatMessageReq.Type == message_type_enum.Voice ||
+		chatMessageReq.Type == message_type_enum.Image {
+		// 图片缩略图、宽高和音频时长在上传时由服务端提取，不信任前端传值
+		meta := uploadMeta(chatMessageReq.Url)
+		if chatMessageReq.Type == message_type_enum.Voice && meta.Duration == 0 {
+			// 语音时长已在Client.Read中校验
+			meta.Duration = chatMessageReq.Duration
+		}
+		// 存message
+		message := model.Message{
+			Uuid:       fmt.Sprintf("M%s", random.GetNowAndLenRandomString(11)),
+			SessionId:  chatMessageReq.SessionId,
+			Seq:        chatMessageReq.Seq,
+			Type:       chatMessageReq.Type,
+			Content:    "",
+			Url:        chatMessageReq.Url,
+			SendId:     chatMessageReq.SendId,
+			SendName:   chatMessageReq.SendName,
+			SendAvatar: chatMessageReq.SendAvatar,
+			ReceiveId:  chatMessageReq.ReceiveId,
+			FileSize:   chatMessageReq.FileSize,
+			FileType:   chatMessageReq.FileType,
+			FileName:   chatMessageReq.FileName,
+			Thumbnail:  meta.ThumbnailUrl,
+			Width:      meta.Width,
+			Height:     meta.Height,
+			Duration:   meta.Duration,
+			Status:     message_status_enum.Unsent,
+			CreatedAt:  time.Now(),
+			AVdata:     "",
+			Payload:    storedPayload(chatMessageReq),
+		}
+		// 对SendAvatar去除前面/static之前的所有内容，防止ip前缀引入
+		message.SendAvatar = normalizePath(message.SendAvatar)
+		if !saveMessage(&message, data) {
+			return
+		}
+		if message.ReceiveId[0] == 'U' { // 发送给User
+			// 如果能找到ReceiveId，说明在线，可以发送，否则存表后跳过
+			// 因为在线的时候是通过websocket更新消息记录的，离线后通过存表，登录时只调用一次数据库操作
+			// 切换chat对象后，前端的messageList也会改变，获取messageList从第二次就是从redis中获取
+			messageRsp := respond.GetMessageListRespond{
+				Uuid:       message.Uuid,
+				Seq:        message.Seq,
+				SendId:     message.SendId,
+				SendName:   message.SendName,
+				SendAvatar: chatMessageReq.SendAvatar,
+				ReceiveId:  message.ReceiveId,
+				Type:       message.Type,
+				Content:    message.Content,
+				Url:        message.Url,
+				FileSize:   message.FileSize,
+				FileName:   message.FileName,
+				FileType:   message.FileType,
+				Thumbnail:  message.Thumbnail,
+				Width:      message.Width,
+				Height:     message.Height,
+				Duration:   message.Duration,
+				Payload:    json.RawMessage(message.Payload),
+				CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
+			}
+			jsonMessage, err := json.Marshal(messageRsp)
+			if err != nil {
+				zlog.Error(err.Error())
+			}
+			log.Println("返回的消息为：", messageRsp, "序列化后为：", jsonMessage)
+			var messageBack = &MessageBack{
+				Message: jsonMessage,
+				Uuid:    message.Uuid,
+				Type:    FrameChatMessage,
+				Data:    messageRsp,
+			}
+			clients := s.onlineClients(message.ReceiveId, message.SendId)
+			if receiveClient, ok := clients[message.ReceiveId]; ok {
+				//messageBack.Message = jsonMessage
+				//messageBack.Uuid = message.Uuid
+				receiveClient.enqueue(messageBack) // 向client.Send发送
+			} else {
+				notifyOffline(message.ReceiveId, message)
+			}
+			// 因为send_id肯定在线，所以这里在后端进行在线回显message，其实优化的话前端可以直接回显
+			// 问题在于前后端的req和rsp结构不同，前端存储message的messageList不能存req，只能存rsp
+			// 所以这里后端进行回显，前端不回显
+			// 发送者可能刚被强制下线
+			if sendClient, ok := clients[message.SendId]; ok {
+				sendClient.enqueue(messageBack)
+			}
+			queueSessionUpdate(message, []string{message.SendId, message.ReceiveId})
+		} else {
+			messageRsp := respond.GetGroupMessageListRespond{
+				Uuid:       message.Uuid,
+				Seq:        message.Seq,
+				SendId:     message.SendId,
+				SendName:   message.SendName,
+				SendAvatar: chatMessageReq.SendAvatar,
+				ReceiveId:  message.ReceiveId,
+				Type:       message.Type,
+				Content:    message.Content,
+				Url:        message.Url,
+				FileSize:   message.FileSize,
+				FileName:   message.FileName,
+				FileType:   message.FileType,
+				Thumbnail:  message.Thumbnail,
+				Width:      message.Width,
+				Height:     message.Height,
+				Duration:   message.Duration,
+				Payload:    json.RawMessage(message.Payload),
+				CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
+			}
+			jsonMessage, err := json.Marshal(messageRsp)
+			if err != nil {
+				zlog.Error(err.Error())
+			}
+			log.Println("返回的消息为：", messageRsp, "序列化后为：", jsonMessage)
+			var messageBack = &MessageBack{
+				Message: jsonMessage,
+				Uuid:    message.Uuid,
+				Type:    FrameChatMessage,
+				Data:    messageRsp,
+			}
+			var group model.GroupInfo
+			if res := dao.GormDB.Where("uuid = ?", message.ReceiveId).First(&group); res.Error != nil {
+				zlog.Error(res.Error.Error())
+			}
+			var members []string
+			if err := json.Unmarshal(group.Members, &members); err != nil {
+				zlog.Error(err.Error())
+			}
+			clients := s.onlineClients(members...)
+			for _, member := range members {
+				if member != message.SendId {
+					if receiveClient, ok := clients[member]; ok {
+						receiveClient.enqueue(messageBack)
+					} else {
+						notifyOffline(member, message)
 					}
-
-					if chatMessageReq.ReceiveId[0] == 'U' { // 发送给User
-						// 如果能找到ReceiveId，说明在线，可以发送，否则存表后跳过
-						// 因为在线的时候是通过websocket更新消息记录的，离线后通过存表，登录时只调用一次数据库操作
-						// 切换chat对象后，前端的messageList也会改变，获取messageList从第二次就是从redis中获取
-						messageRsp := respond.AVMessageRespond{
-							SendId:     message.SendId,
-							SendName:   message.SendName,
-							SendAvatar: message.SendAvatar,
-							ReceiveId:  message.ReceiveId,
-							Type:       message.Type,
-							Content:    message.Content,
-							Url:        message.Url,
-							FileSize:   message.FileSize,
-							FileName:   message.FileName,
-							FileType:   message.FileType,
-							CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
-							AVdata:     message.AVdata,
-						}
-						jsonMessage, err := json.Marshal(messageRsp)
-						if err != nil {
-							zlog.Error(err.Error())
-						}
-						// log.Println("返回的消息为：", messageRsp, "序列化后为：", jsonMessage)
-						log.Println("返回的消息为：", messageRsp)
-						var messageBack = &MessageBack{
-							Message: jsonMessage,
-							Uuid:    message.Uuid,
-						}
-						s.mutex.Lock()
-						if receiveClient, ok := s.Clients[message.ReceiveId]; ok {
-							//messageBack.Message = jsonMessage
-							//messageBack.Uuid = message.Uuid
-							receiveClient.SendBack <- messageBack // 向client.Send发送
-						}
-						// 通话这不能回显，发回去的话就会出现两个start_call。
-						//sendClient := s.Clients[message.SendId]
-						//sendClient.SendBack <- messageBack
-						s.mutex.Unlock()
+				} else {
+					// 发送者可能刚被强制下线
+					if sendClient, ok := clients[message.SendId]; ok {
+						sendClient.enqueue(messageBack)
 					}
 				}
+			}
+			queueSessionUpdate(message, members)
+		}
+	} else if chatMessageReq.Type == message_type_enum.AudioOrVideo {
+		var avData request.AVData
+		if err := json.Unmarshal([]byte(chatMessageReq.AVdata), &avData); err != nil {
+			zlog.Error(err.Error())
+		}
+		//log.Println(avData)
+		message := model.Message{
+			Uuid:       fmt.Sprintf("M%s", random.GetNowAndLenRandomString(11)),
+			SessionId:  chatMessageReq.SessionId,
+			Seq:        chatMessageReq.Seq,
+			Type:       chatMessageReq.Type,
+			Content:    "",
+			Url:        "",
+			SendId:     chatMessageReq.SendId,
+			SendName:   chatMessageReq.SendName,
+			SendAvatar: chatMessageReq.SendAvatar,
+			ReceiveId:  chatMessageReq.ReceiveId,
+			FileSize:   "",
+			FileType:   "",
+			FileName:   "",
+			Status:     message_status_enum.Unsent,
+			CreatedAt:  time.Now(),
+			AVdata:     chatMessageReq.AVdata,
+		}
+		if avData.MessageId == "PROXY" && (avData.Type == "start_call" || avData.Type == "receive_call" || avData.Type == "reject_call") {
+			// 存message
+			// 对SendAvatar去除前面/static之前的所有内容，防止ip前缀引入
+			message.SendAvatar = normalizePath(message.SendAvatar)
+			if !saveMessage(&message, data) {
+				return
+			}
+		}
 
+		if chatMessageReq.ReceiveId[0] == 'U' { // 发送给User
+			// 如果能找到ReceiveId，说明在线，可以发送，否则存表后跳过
+			// 因为在线的时候是通过websocket更新消息记录的，离线后通过存表，登录时只调用一次数据库操作
+			// 切换chat对象后，前端的messageList也会改变，获取messageList从第二次就是从redis中获取
+			messageRsp := respond.AVMessageRespond{
+				SendId:     message.SendId,
+				SendName:   message.SendName,
+				SendAvatar: message.SendAvatar,
+				ReceiveId:  message.ReceiveId,
+				Type:       message.Type,
+				Content:    message.Content,
+				Url:        message.Url,
+				FileSize:   message.FileSize,
+				FileName:   message.FileName,
+				FileType:   message.FileType,
+				CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
+				AVdata:     message.AVdata,
+			}
+			jsonMessage, err := json.Marshal(messageRsp)
+			if err != nil {
+				zlog.Error(err.Error())
+			}
+			// log.Println("返回的消息为：", messageRsp, "序列化后为：", jsonMessage)
+			log.Println("返回的消息为：", messageRsp)
+			var messageBack = &MessageBack{
+				Message: jsonMessage,
+				Uuid:    message.Uuid,
+				Type:    FrameChatMessage,
+				Data:    messageRsp,
+			}
+			clients := s.onlineClients(message.ReceiveId, message.SendId)
+			if receiveClient, ok := clients[message.ReceiveId]; ok {
+				//messageBack.Message = jsonMessage
+				//messageBack.Uuid = message.Uuid
+				receiveClient.enqueue(messageBack) // 向client.Send发送
 			}
+			// 通话这不能回显，发回去的话就会出现两个start_call。
+			//sendClient := s.Clients[message.SendId]
+			//sendClient.SendBack <- messageBack
 		}
 	}
 }
@@ -483,22 +467,36 @@ func (s *Server) Close() {
 	close(s.Transmit)
 }
 
+// channel本身是并发安全的，发送时不持有s.mutex，否则通道满时会和需要锁的转发互相等待
 func (s *Server) SendClientToLogin(client *Client) {
-	s.mutex.Lock()
 	s.Login <- client
-	s.mutex.Unlock()
 }
 
 func (s *Server) SendClientToLogout(client *Client) {
-	s.mutex.Lock()
 	s.Logout <- client
-	s.mutex.Unlock()
 }
 
-func (s *Server) SendMessageToTransmit(message []byte) {
-	s.mutex.Lock()
-	s.Transmit <- message
-	s.mutex.Unlock()
+// SendMessageToTransmit 放入转发通道，通道已满时不阻塞，返回false由调用方拒收
+func (s *Server) SendMessageToTransmit(message []byte) bool {
+	return s.transmitWith(func() ([]byte, error) {
+		return message, nil
+	}) == nil
+}
+
+// transmitWith 先占用转发通道的位置，再调用build生成消息并放入通道，通道已满时不调用build，返回errTransmitFull
+// 新消息在build中分配序号，拒收的消息不会占用序号
+func (s *Server) transmitWith(build func() ([]byte, error)) error {
+	if !s.slots.acquire() {
+		zlog.Error("Channel已满，拒收消息")
+		return errTransmitFull
+	}
+	data, err := build()
+	if err != nil {
+		s.slots.release()
+		return err
+	}
+	s.Transmit <- data
+	return nil
 }
 
 func (s *Server) RemoveClient(uuid string) {
@@ -506,3 +504,46 @@ func (s *Server) RemoveClient(uuid string) {
 	delete(s.Clients, uuid)
 	s.mutex.Unlock()
 }
+
+// pushToUsers 向在线的用户推送
+func (s *Server) pushToUsers(userIds []string, messageBack *MessageBack) {
+	for _, client := range s.onlineClients(userIds...) {
+		client.enqueue(messageBack)
+	}
+}
+
+// onlineClients 在锁内取出在线的连接，推送在锁外进行，一个慢连接不会阻塞其他用户
+func (s *Server) onlineClients(userIds ...string) map[string]*Client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	clients := make(map[string]*Client, len(userIds))
+	for _, userId := range userIds {
+		if client, ok := s.Clients[userId]; ok {
+			clients[userId] = client
+		}
+	}
+	return clients
+}
+
+// removeClient 摘除断开的连接，用户已经用新连接登录时不受影响
+func (s *Server) removeClient(client *Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.Clients[client.Uuid] == client {
+		delete(s.Clients, client.Uuid)
+	}
+}
+
+// detachClients 从在线列表中摘除用户并返回对应的连接
+func (s *Server) detachClients(userIds []string) []*Client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var clients []*Client
+	for _, userId := range userIds {
+		if client, ok := s.Clients[userId]; ok {
+			delete(s.Clients, userId)
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
@@ -0,0 +1,64 @@
+package chat
+
+import (
+	"hash/fnv"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/dto/respond"
+	"kama_chat_server/internal/model"
+	"kama_chat_server/internal/service/gorm"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/zlog"
+	"sync"
+)
+
+const sessionUpdateWorkers = 16 // 更新会话的协程数，同一会话固定由一个协程处理
+
+// sessionUpdate 等待更新的会话
+type sessionUpdate struct {
+	message      model.Message
+	participants []string
+}
+
+var (
+	sessionUpdateQueues [sessionUpdateWorkers]chan sessionUpdate
+	sessionUpdateStart  sync.Once
+)
+
+// queueSessionUpdate 把会话更新交给后台协程，按会话哈希分配，同一会话按转发顺序依次更新，协程数固定
+// 队列满时阻塞调用方，数据库变慢时转发跟着变慢，不会无限堆积协程
+func queueSessionUpdate(message model.Message, participants []string) {
+	sessionUpdateStart.Do(func() {
+		for i := range sessionUpdateQueues {
+			sessionUpdateQueues[i] = make(chan sessionUpdate, constants.CHANNEL_SIZE)
+			go func(queue chan sessionUpdate) {
+				for update := range queue {
+					updateSessions(update.message, update.participants)
+				}
+			}(sessionUpdateQueues[i])
+		}
+	})
+	hash := fnv.New32a()
+	hash.Write([]byte(conversationKey(request.ChatMessageRequest{SendId: message.SendId, ReceiveId: message.ReceiveId})))
+	sessionUpdateQueues[hash.Sum32()%sessionUpdateWorkers] <- sessionUpdate{message: message, participants: participants}
+}
+
+// updateSessions 消息转发后更新参与者的会话最新消息，并推送给在线的参与者
+// 会访问数据库并加server锁推送，只在queueSessionUpdate的后台协程中调用
+func updateSessions(message model.Message, participants []string) {
+	sessions, err := gorm.SessionService.UpdateLastMessage(message, participants, messagePreview(message))
+	if err != nil {
+		zlog.Error(err.Error())
+		return
+	}
+	for userId, session := range sessions {
+		PushToUsers([]string{userId}, FrameSessionUpdated, respond.SessionUpdatedRespond{
+			EventType:     "session_updated",
+			SessionId:     session.Uuid,
+			ReceiveId:     session.ReceiveId,
+			ReceiveName:   session.ReceiveName,
+			Avatar:        session.Avatar,
+			LastMessage:   session.LastMessage,
+			LastMessageAt: session.LastMessageAt.Time.Format("2006-01-02 15:04:05"),
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package email
+
+import (
+	"context"
+	"sync"
+)
+
+// CaptureSender 本地捕获渠道，只记录邮件不真正发送，用于测试和本地开发
+type CaptureSender struct {
+	mutex sync.Mutex
+	sent  []Mail
+}
+
+func NewCaptureSender() *CaptureSender {
+	return &CaptureSender{}
+}
+
+func (c *CaptureSender) Send(ctx context.Context, mail Mail) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sent = append(c.sent, mail)
+	return nil
+}
+
+// Last 返回最近一封发给该地址的邮件
+func (c *CaptureSender) Last(to string) (Mail, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := len(c.sent) - 1; i >= 0; i-- {
+		if c.sent[i].To == to {
+			return c.sent[i], true
+		}
+	}
+	return Mail{}, false
+}
+
+// Sent 返回已记录的邮件
+func (c *CaptureSender) Sent() []Mail {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	sent := make([]Mail, len(c.sent))
+	copy(sent, c.sent)
+	return sent
+}
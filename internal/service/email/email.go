@@ -0,0 +1,17 @@
+package email
+
+import (
+	"context"
+)
+
+// Mail 一封纯文本邮件
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender 邮件发送渠道
+type Sender interface {
+	Send(ctx context.Context, mail Mail) error
+}
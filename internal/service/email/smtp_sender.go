@@ -0,0 +1,42 @@
+package email
+
+import (
+	"context"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+)
+
+// SmtpSender 通过SMTP发送邮件，Username为空时不做认证
+type SmtpSender struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SmtpSender) Send(ctx context.Context, mail Mail) error {
+	message := "From: " + s.From + "\r\n" +
+		"To: " + mail.To + "\r\n" +
+		"Subject: " + mime.BEncoding.Encode("UTF-8", mail.Subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\n" +
+		mail.Body
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	// net/smtp不支持context，超时后直接返回，发送协程自行结束
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(net.JoinHostPort(s.Host, strconv.Itoa(s.Port)), auth, s.From, []string{mail.To}, []byte(message))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
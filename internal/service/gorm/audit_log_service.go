@@ -0,0 +1,183 @@
+package gorm
+
+import (
+	"encoding/json"
+	"gorm.io/gorm"
+	"kama_chat_server/internal/dao"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/dto/respond"
+	"kama_chat_server/internal/model"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/zlog"
+	"time"
+)
+
+const (
+	auditTimeLayout      = "2006-01-02 15:04:05"
+	auditDefaultPageSize = 20
+	auditMaxPageSize     = 100
+	auditExportLimit     = 10000 // 单次导出的最大条数，更多的记录请缩小时间范围分批导出
+)
+
+type auditLogService struct {
+}
+
+var AuditLogService = new(auditLogService)
+
+// Operator 执行操作的人和来源IP，写审计日志用
+type Operator struct {
+	Uuid string
+	Ip   string
+}
+
+// recordAudit 追加一条审计日志，before、after序列化为json，为nil时留空
+// 业务操作已经完成，写日志失败只记录错误，不影响返回结果
+func recordAudit(op Operator, action, targetId string, before, after interface{}) {
+	log := model.AuditLog{
+		ActorId:   op.Uuid,
+		Action:    action,
+		TargetId:  targetId,
+		Before:    auditSnapshot(before),
+		After:     auditSnapshot(after),
+		Ip:        op.Ip,
+		CreatedAt: time.Now(),
+	}
+	if res := dao.GormDB.Create(&log); res.Error != nil {
+		zlog.Error("写入审计日志失败: " + res.Error.Error())
+	}
+}
+
+func auditSnapshot(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		zlog.Error(err.Error())
+		return ""
+	}
+	return string(data)
+}
+
+// userSnapshot 审计日志中用户的快照，不包含密码
+func userSnapshot(user model.UserInfo) map[string]interface{} {
+	return map[string]interface{}{
+		"uuid":           user.Uuid,
+		"nickname":       user.Nickname,
+		"telephone":      user.Telephone,
+		"status":         user.Status,
+		"is_admin":       user.IsAdmin,
+		"is_super_admin": user.IsSuperAdmin,
+	}
+}
+
+// groupSnapshot 审计日志中群聊的快照
+func groupSnapshot(group model.GroupInfo) map[string]interface{} {
+	return map[string]interface{}{
+		"uuid":       group.Uuid,
+		"name":       group.Name,
+		"owner_id":   group.OwnerId,
+		"status":     group.Status,
+		"member_cnt": group.MemberCnt,
+		"members":    group.Members,
+	}
+}
+
+// filterAuditLogs 按查询条件拼接where，返回的查询可以重复使用，先Count再Find
+func (a *auditLogService) filterAuditLogs(req request.GetAuditLogListRequest) (*gorm.DB, string) {
+	query := dao.GormDB.Model(&model.AuditLog{})
+	if req.ActorId != "" {
+		query = query.Where("actor_id = ?", req.ActorId)
+	}
+	if req.Action != "" {
+		query = query.Where("action = ?", req.Action)
+	}
+	if req.TargetId != "" {
+		query = query.Where("target_id = ?", req.TargetId)
+	}
+	if req.StartTime != "" {
+		start, err := time.ParseInLocation(auditTimeLayout, req.StartTime, time.Local)
+		if err != nil {
+			return nil, "开始时间格式错误"
+		}
+		query = query.Where("created_at >= ?", start)
+	}
+	if req.EndTime != "" {
+		end, err := time.ParseInLocation(auditTimeLayout, req.EndTime, time.Local)
+		if err != nil {
+			return nil, "结束时间格式错误"
+		}
+		query = query.Where("created_at <= ?", end)
+	}
+	return query.Session(&gorm.Session{}), ""
+}
+
+func toAuditLogRespond(logs []model.AuditLog) []respond.AuditLogRespond {
+	rsp := make([]respond.AuditLogRespond, 0, len(logs))
+	for _, log := range logs {
+		rsp = append(rsp, respond.AuditLogRespond{
+			Id:        log.Id,
+			ActorId:   log.ActorId,
+			Action:    log.Action,
+			TargetId:  log.TargetId,
+			Before:    log.Before,
+			After:     log.After,
+			Ip:        log.Ip,
+			CreatedAt: log.CreatedAt.Format(auditTimeLayout),
+		})
+	}
+	return rsp
+}
+
+// GetAuditLogList 分页查询审计日志 - 管理员
+func (a *auditLogService) GetAuditLogList(req request.GetAuditLogListRequest) (string, *respond.GetAuditLogListRespond, int) {
+	query, message := a.filterAuditLogs(req)
+	if query == nil {
+		return message, nil, -2
+	}
+	if req.Page <= 0 {
+		req.Page = 1
+	}
+	if req.PageSize <= 0 {
+		req.PageSize = auditDefaultPageSize
+	}
+	if req.PageSize > auditMaxPageSize {
+		req.PageSize = auditMaxPageSize
+	}
+	var total int64
+	if res := query.Count(&total); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	var logs []model.AuditLog
+	if res := query.Order("id DESC").Offset((req.Page - 1) * req.PageSize).Limit(req.PageSize).Find(&logs); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	return "获取审计日志成功", &respond.GetAuditLogListRespond{
+		Total: total,
+		List:  toAuditLogRespond(logs),
+	}, 0
+}
+
+// ExportAuditLogs 按条件导出审计日志，按时间正序，最多auditExportLimit条 - 管理员
+func (a *auditLogService) ExportAuditLogs(req request.GetAuditLogListRequest) (string, []respond.AuditLogRespond, int) {
+	query, message := a.filterAuditLogs(req)
+	if query == nil {
+		return message, nil, -2
+	}
+	var total int64
+	if res := query.Count(&total); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if total > auditExportLimit {
+		return "导出条数过多，请缩小时间范围后分批导出", nil, -2
+	}
+	var logs []model.AuditLog
+	if res := query.Order("id ASC").Find(&logs); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	return "导出审计日志成功", toAuditLogRespond(logs), 0
+}
@@ -0,0 +1,145 @@
+package gorm
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"kama_chat_server/internal/dao"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/dto/respond"
+	"kama_chat_server/internal/model"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/enum/audit_log/audit_action_enum"
+	"kama_chat_server/pkg/enum/dead_letter/dead_letter_status_enum"
+	"kama_chat_server/pkg/util/wire"
+	"kama_chat_server/pkg/zlog"
+	"strconv"
+	"time"
+)
+
+const (
+	deadLetterDefaultPageSize = 20
+	deadLetterMaxPageSize     = 100
+)
+
+type deadLetterService struct {
+}
+
+var DeadLetterService = new(deadLetterService)
+
+// Record 记录一条死信
+func (d *deadLetterService) Record(source string, payload []byte, reason string, attempts int, failedAt time.Time) error {
+	deadLetter := model.DeadLetter{
+		Source:    source,
+		Payload:   payload,
+		Reason:    reason,
+		Attempts:  attempts,
+		Status:    dead_letter_status_enum.PENDING,
+		CreatedAt: failedAt,
+	}
+	return dao.GormDB.Create(&deadLetter).Error
+}
+
+// deadLetterPayload 把原始消息转成便于查看的文本
+func deadLetterPayload(payload []byte) (string, string) {
+	codec, err := wire.Detect(payload)
+	if err != nil {
+		return "unknown", base64.StdEncoding.EncodeToString(payload)
+	}
+	if codec.Name() == wire.NameJSON {
+		return codec.Name(), string(payload)
+	}
+	var chatMessageReq request.ChatMessageRequest
+	if err := codec.Unmarshal(payload, &chatMessageReq); err != nil {
+		return codec.Name(), base64.StdEncoding.EncodeToString(payload)
+	}
+	data, err := json.Marshal(chatMessageReq)
+	if err != nil {
+		return codec.Name(), base64.StdEncoding.EncodeToString(payload)
+	}
+	return codec.Name(), string(data)
+}
+
+// GetDeadLetterList 分页查询死信，新的在前 - 管理员
+func (d *deadLetterService) GetDeadLetterList(req request.GetDeadLetterListRequest) (string, *respond.GetDeadLetterListRespond, int) {
+	if req.Page <= 0 {
+		req.Page = 1
+	}
+	if req.PageSize <= 0 {
+		req.PageSize = deadLetterDefaultPageSize
+	}
+	if req.PageSize > deadLetterMaxPageSize {
+		req.PageSize = deadLetterMaxPageSize
+	}
+	query := dao.GormDB.Model(&model.DeadLetter{})
+	if req.Status != nil {
+		query = query.Where("status = ?", *req.Status)
+	}
+	var total int64
+	if res := query.Count(&total); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	var deadLetters []model.DeadLetter
+	if res := query.Order("id DESC").Offset((req.Page - 1) * req.PageSize).Limit(req.PageSize).Find(&deadLetters); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	list := make([]respond.DeadLetterRespond, 0, len(deadLetters))
+	for _, deadLetter := range deadLetters {
+		encoding, payload := deadLetterPayload(deadLetter.Payload)
+		rsp := respond.DeadLetterRespond{
+			Id:        deadLetter.Id,
+			Source:    deadLetter.Source,
+			Encoding:  encoding,
+			Payload:   payload,
+			Reason:    deadLetter.Reason,
+			Attempts:  deadLetter.Attempts,
+			Status:    deadLetter.Status,
+			ReplayCnt: deadLetter.ReplayCnt,
+			CreatedAt: deadLetter.CreatedAt.Format("2006-01-02 15:04:05"),
+		}
+		if deadLetter.ReplayedAt.Valid {
+			rsp.ReplayedAt = deadLetter.ReplayedAt.Time.Format("2006-01-02 15:04:05")
+		}
+		list = append(list, rsp)
+	}
+	return "获取死信成功", &respond.GetDeadLetterListRespond{
+		Total: total,
+		List:  list,
+	}, 0
+}
+
+// ReplayDeadLetters 重新投递死信，replay由调用方按当前消息模式投递原始消息 - 管理员
+// 已投递过的死信也可以再次投递，投递后仍失败会产生新的死信
+func (d *deadLetterService) ReplayDeadLetters(op Operator, idList []int64, replay func(payload []byte) error) (string, int) {
+	if len(idList) == 0 {
+		return "请选择要重新投递的死信", -2
+	}
+	var deadLetters []model.DeadLetter
+	if res := dao.GormDB.Where("id in (?)", idList).Find(&deadLetters); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if len(deadLetters) != len(idList) {
+		return "死信不存在", -2
+	}
+	for _, deadLetter := range deadLetters {
+		if err := replay(deadLetter.Payload); err != nil {
+			zlog.Error(err.Error())
+			return fmt.Sprintf("死信%d重新投递失败", deadLetter.Id), -1
+		}
+		before := deadLetter.Status
+		deadLetter.Status = dead_letter_status_enum.REPLAYED
+		deadLetter.ReplayCnt++
+		deadLetter.ReplayedAt.Time = time.Now()
+		deadLetter.ReplayedAt.Valid = true
+		if res := dao.GormDB.Save(&deadLetter); res.Error != nil {
+			zlog.Error(res.Error.Error())
+			return constants.SYSTEM_ERROR, -1
+		}
+		recordAudit(op, audit_action_enum.REPLAY_DEAD_LETTER, strconv.FormatInt(deadLetter.Id, 10),
+			map[string]interface{}{"status": before}, map[string]interface{}{"status": deadLetter.Status, "replay_cnt": deadLetter.ReplayCnt})
+	}
+	return "重新投递成功", 0
+}
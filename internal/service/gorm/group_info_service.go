@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/go-redis/redis/v8"
 	"gorm.io/gorm"
 	"kama_chat_server/internal/dao"
 	"kama_chat_server/internal/dto/request"
@@ -12,6 +11,7 @@ import (
 	"kama_chat_server/internal/model"
 	myredis "kama_chat_server/internal/service/redis"
 	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/enum/audit_log/audit_action_enum"
 	"kama_chat_server/pkg/enum/contact/contact_status_enum"
 	"kama_chat_server/pkg/enum/contact/contact_type_enum"
 	"kama_chat_server/pkg/enum/group_info/group_status_enum"
@@ -107,7 +107,7 @@ func (g *groupInfoService) CreateGroup(groupReq request.CreateGroupRequest) (str
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
-	if err := myredis.DelKeysWithPattern("contact_mygroup_list_" + groupReq.OwnerId); err != nil {
+	if err := myredis.Invalidate(myredis.MyGroupListCache.Key(groupReq.OwnerId)); err != nil {
 		zlog.Error(err.Error())
 	}
 
@@ -138,83 +138,54 @@ func (g *groupInfoService) CreateGroup(groupReq request.CreateGroupRequest) (str
 
 // LoadMyGroup 获取我创建的群聊
 func (g *groupInfoService) LoadMyGroup(ownerId string) (string, []respond.LoadMyGroupRespond, int) {
-	rspString, err := myredis.GetKeyNilIsErr("contact_mygroup_list_" + ownerId)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			var groupList []model.GroupInfo
-			if res := dao.GormDB.Order("created_at DESC").Where("owner_id = ?", ownerId).Find(&groupList); res.Error != nil {
-				zlog.Error(res.Error.Error())
-				return constants.SYSTEM_ERROR, nil, -1
-			}
-			var groupListRsp []respond.LoadMyGroupRespond
-			for _, group := range groupList {
-				groupListRsp = append(groupListRsp, respond.LoadMyGroupRespond{
-					GroupId:   group.Uuid,
-					GroupName: group.Name,
-					Avatar:    group.Avatar,
-				})
-			}
-			rspString, err := json.Marshal(groupListRsp)
-			if err != nil {
-				zlog.Error(err.Error())
-			}
-			if err := myredis.SetKeyEx("contact_mygroup_list_"+ownerId, string(rspString), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-				zlog.Error(err.Error())
-			}
-			return "获取成功", groupListRsp, 0
-		} else {
-			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, nil, -1
-		}
-	}
 	var groupListRsp []respond.LoadMyGroupRespond
-	if err := json.Unmarshal([]byte(rspString), &groupListRsp); err != nil {
+	err := myredis.GetOrLoad(myredis.MyGroupListCache, myredis.MyGroupListCache.Key(ownerId), &groupListRsp, func() (interface{}, []string, error) {
+		var groupList []model.GroupInfo
+		if res := dao.GormDB.Order("created_at DESC").Where("owner_id = ?", ownerId).Find(&groupList); res.Error != nil {
+			return nil, nil, res.Error
+		}
+		var rsp []respond.LoadMyGroupRespond
+		tags := []string{myredis.UserTag(ownerId)}
+		for _, group := range groupList {
+			tags = append(tags, myredis.GroupTag(group.Uuid))
+			rsp = append(rsp, respond.LoadMyGroupRespond{
+				GroupId:   group.Uuid,
+				GroupName: group.Name,
+				Avatar:    group.Avatar,
+			})
+		}
+		return rsp, tags, nil
+	})
+	if err != nil {
 		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
 	}
 	return "获取成功", groupListRsp, 0
 }
 
 // GetGroupInfo 获取群聊详情
 func (g *groupInfoService) GetGroupInfo(groupId string) (string, *respond.GetGroupInfoRespond, int) {
-	rspString, err := myredis.GetKeyNilIsErr("group_info_" + groupId)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			var group model.GroupInfo
-			if res := dao.GormDB.First(&group, "uuid = ?", groupId); res.Error != nil {
-				zlog.Error(res.Error.Error())
-				return constants.SYSTEM_ERROR, nil, -1
-			}
-			rsp := &respond.GetGroupInfoRespond{
-				Uuid:      group.Uuid,
-				Name:      group.Name,
-				Notice:    group.Notice,
-				Avatar:    group.Avatar,
-				MemberCnt: group.MemberCnt,
-				OwnerId:   group.OwnerId,
-				AddMode:   group.AddMode,
-				Status:    group.Status,
-			}
-			if group.DeletedAt.Valid {
-				rsp.IsDeleted = true
-			} else {
-				rsp.IsDeleted = false
-			}
-			//rspString, err := json.Marshal(rsp)
-			//if err != nil {
-			//	zlog.Error(err.Error())
-			//}
-			//if err := myredis.SetKeyEx("group_info_"+groupId, string(rspString), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-			//	zlog.Error(err.Error())
-			//}
-			return "获取成功", rsp, 0
-		} else {
-			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, nil, -1
-		}
-	}
 	var rsp *respond.GetGroupInfoRespond
-	if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
+	err := myredis.GetOrLoad(myredis.GroupInfoCache, myredis.GroupInfoCache.Key(groupId), &rsp, func() (interface{}, []string, error) {
+		var group model.GroupInfo
+		if res := dao.GormDB.First(&group, "uuid = ?", groupId); res.Error != nil {
+			return nil, nil, res.Error
+		}
+		return &respond.GetGroupInfoRespond{
+			Uuid:      group.Uuid,
+			Name:      group.Name,
+			Notice:    group.Notice,
+			Avatar:    group.Avatar,
+			MemberCnt: group.MemberCnt,
+			OwnerId:   group.OwnerId,
+			AddMode:   group.AddMode,
+			Status:    group.Status,
+			IsDeleted: group.DeletedAt.Valid,
+		}, []string{myredis.GroupTag(groupId)}, nil
+	})
+	if err != nil {
 		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
 	}
 	return "获取成功", rsp, 0
 }
@@ -303,26 +274,27 @@ func (g *groupInfoService) LeaveGroup(userId string, groupId string) (string, in
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
-	//if err := myredis.DelKeysWithPattern("group_info_" + groupId); err != nil {
-	//	zlog.Error(err.Error())
-	//}
-	//if err := myredis.DelKeysWithPattern("groupmember_list_" + groupId); err != nil {
-	//	zlog.Error(err.Error())
-	//}
-	if err := myredis.DelKeysWithPattern("group_session_list_" + userId); err != nil {
-		zlog.Error(err.Error())
-	}
-	if err := myredis.DelKeysWithPattern("my_joined_group_list_ " + userId); err != nil {
-		zlog.Error(err.Error())
-	}
-	//if err := myredis.DelKeysWithPattern("session_" + userId + "_" + groupId); err != nil {
-	//	zlog.Error(err.Error())
-	//}
+	// 退群者的会话列表和加入的群聊列表都打了该群的标签，随群一起失效
+	invalidateGroups(groupId)
 	return "退群成功", 0
 }
 
 // DismissGroup 解散群聊
-func (g *groupInfoService) DismissGroup(ownerId, groupId string) (string, int) {
+func (g *groupInfoService) DismissGroup(op Operator, groupId string) (string, []string, int) {
+	var group model.GroupInfo
+	if res := dao.GormDB.First(&group, "uuid = ?", groupId); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "群聊不存在", nil, -2
+		}
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	// 解散前的成员，返回给调用方推送解散事件
+	var members []string
+	if err := json.Unmarshal(group.Members, &members); err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
 	var deletedAt gorm.DeletedAt
 	deletedAt.Time = time.Now()
 	deletedAt.Valid = true
@@ -332,13 +304,14 @@ func (g *groupInfoService) DismissGroup(ownerId, groupId string) (string, int) {
 			"updated_at": deletedAt.Time,
 		}); res.Error != nil {
 		zlog.Error(res.Error.Error())
-		return constants.SYSTEM_ERROR, -1
+		return constants.SYSTEM_ERROR, nil, -1
 	}
+	recordAudit(op, audit_action_enum.DISMISS_GROUP, groupId, groupSnapshot(group), nil)
 
 	var sessionList []model.Session
 	if res := dao.GormDB.Model(&model.Session{}).Where("receive_id = ?", groupId).Find(&sessionList); res.Error != nil {
 		zlog.Error(res.Error.Error())
-		return constants.SYSTEM_ERROR, -1
+		return constants.SYSTEM_ERROR, nil, -1
 	}
 	for _, session := range sessionList {
 		if res := dao.GormDB.Model(&session).Updates(
@@ -346,20 +319,20 @@ func (g *groupInfoService) DismissGroup(ownerId, groupId string) (string, int) {
 				"deleted_at": deletedAt,
 			}); res.Error != nil {
 			zlog.Error(res.Error.Error())
-			return constants.SYSTEM_ERROR, -1
+			return constants.SYSTEM_ERROR, nil, -1
 		}
 	}
 
 	var userContactList []model.UserContact
 	if res := dao.GormDB.Model(&model.UserContact{}).Where("contact_id = ?", groupId).Find(&userContactList); res.Error != nil {
 		zlog.Error(res.Error.Error())
-		return constants.SYSTEM_ERROR, -1
+		return constants.SYSTEM_ERROR, nil, -1
 	}
 
 	for _, userContact := range userContactList {
 		if res := dao.GormDB.Model(&userContact).Update("deleted_at", deletedAt); res.Error != nil {
 			zlog.Error(res.Error.Error())
-			return constants.SYSTEM_ERROR, -1
+			return constants.SYSTEM_ERROR, nil, -1
 		}
 	}
 
@@ -367,38 +340,32 @@ func (g *groupInfoService) DismissGroup(ownerId, groupId string) (string, int) {
 	if res := dao.GormDB.Model(&contactApplys).Where("contact_id = ?", groupId).Find(&contactApplys); res.Error != nil {
 		if res.Error != gorm.ErrRecordNotFound {
 			zlog.Info(res.Error.Error())
-			return "无响应的申请记录需要删除", 0
+			return "无响应的申请记录需要删除", members, 0
 		}
 		zlog.Error(res.Error.Error())
-		return constants.SYSTEM_ERROR, -1
+		return constants.SYSTEM_ERROR, nil, -1
 	}
 	for _, contactApply := range contactApplys {
 		if res := dao.GormDB.Model(&contactApply).Update("deleted_at", deletedAt); res.Error != nil {
 			zlog.Error(res.Error.Error())
-			return constants.SYSTEM_ERROR, -1
+			return constants.SYSTEM_ERROR, nil, -1
 		}
 	}
-	//if err := myredis.DelKeysWithPattern("group_info_" + groupId); err != nil {
-	//	zlog.Error(err.Error())
-	//}
-	//if err := myredis.DelKeysWithPattern("groupmember_list_" + groupId); err != nil {
-	//	zlog.Error(err.Error())
-	//}
-	if err := myredis.DelKeysWithPattern("contact_mygroup_list_" + ownerId); err != nil {
-		zlog.Error(err.Error())
-	}
-	if err := myredis.DelKeysWithPattern("group_session_list_" + ownerId); err != nil {
-		zlog.Error(err.Error())
-	}
-	if err := myredis.DelKeysWithPrefix("my_joined_group_list"); err != nil {
-		zlog.Error(err.Error())
-	}
-	return "解散群聊成功", 0
+	invalidateGroups(groupId)
+	return "解散群聊成功", members, 0
 }
 
 // DeleteGroups 删除列表中群聊 - 管理员
-func (g *groupInfoService) DeleteGroups(uuidList []string) (string, int) {
+func (g *groupInfoService) DeleteGroups(op Operator, uuidList []string) (string, int) {
 	for _, uuid := range uuidList {
+		var group model.GroupInfo
+		if res := dao.GormDB.First(&group, "uuid = ?", uuid); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				continue
+			}
+			zlog.Error(res.Error.Error())
+			return constants.SYSTEM_ERROR, -1
+		}
 		var deletedAt gorm.DeletedAt
 		deletedAt.Time = time.Now()
 		deletedAt.Valid = true
@@ -406,6 +373,7 @@ func (g *groupInfoService) DeleteGroups(uuidList []string) (string, int) {
 			zlog.Error(res.Error.Error())
 			return constants.SYSTEM_ERROR, -1
 		}
+		recordAudit(op, audit_action_enum.DELETE_GROUP, uuid, groupSnapshot(group), nil)
 		// 删除会话
 		var sessionList []model.Session
 		if res := dao.GormDB.Model(&model.Session{}).Where("receive_id = ?", uuid).Find(&sessionList); res.Error != nil {
@@ -448,45 +416,31 @@ func (g *groupInfoService) DeleteGroups(uuidList []string) (string, int) {
 			}
 		}
 	}
-	//for _, uuid := range uuidList {
-	//	if err := myredis.DelKeysWithPattern("group_info_" + uuid); err != nil {
-	//		zlog.Error(err.Error())
-	//	}
-	//	if err := myredis.DelKeysWithPattern("groupmember_list_" + uuid); err != nil {
-	//		zlog.Error(err.Error())
-	//	}
-	//}
-	if err := myredis.DelKeysWithPrefix("contact_mygroup_list"); err != nil {
-		zlog.Error(err.Error())
-	}
-	if err := myredis.DelKeysWithPrefix("group_session_list"); err != nil {
-		zlog.Error(err.Error())
+	invalidateGroups(uuidList...)
+	return "解散/删除群聊成功", 0
+}
+
+// CheckGroupStatus 检查群聊存在且未被禁用，群聊消息落库前调用，解散后仍在路上的消息在这里拦下
+func (g *groupInfoService) CheckGroupStatus(groupId string) (string, int) {
+	var group model.GroupInfo
+	if res := dao.GormDB.Select("uuid", "status").First(&group, "uuid = ?", groupId); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "群聊不存在或已解散", -2
+		}
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
 	}
-	if err := myredis.DelKeysWithPrefix("group_session_list"); err != nil {
-		zlog.Error(err.Error())
+	if group.Status != group_status_enum.NORMAL {
+		return "群聊已被禁用", -2
 	}
-	return "解散/删除群聊成功", 0
+	return "群聊状态正常", 0
 }
 
 // CheckGroupAddMode 检查群聊加群方式
 func (g *groupInfoService) CheckGroupAddMode(groupId string) (string, int8, int) {
-	rspString, err := myredis.GetKeyNilIsErr("group_info_" + groupId)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			var group model.GroupInfo
-			if res := dao.GormDB.First(&group, "uuid = ?", groupId); res.Error != nil {
-				zlog.Error(res.Error.Error())
-				return constants.SYSTEM_ERROR, -1, -1
-			}
-			return "加群方式获取成功", group.AddMode, 0
-		} else {
-			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, -1, -1
-		}
-	}
-	var rsp respond.GetGroupInfoRespond
-	if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
-		zlog.Error(err.Error())
+	message, rsp, ret := g.GetGroupInfo(groupId)
+	if ret != 0 {
+		return message, -1, ret
 	}
 	return "加群方式获取成功", rsp.AddMode, 0
 }
@@ -528,34 +482,35 @@ func (g *groupInfoService) EnterGroupDirectly(ownerId, contactId string) (string
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
-	//if err := myredis.DelKeysWithPattern("group_info_" + contactId); err != nil {
-	//	zlog.Error(err.Error())
-	//}
-	//if err := myredis.DelKeysWithPattern("groupmember_list_" + contactId); err != nil {
-	//	zlog.Error(err.Error())
-	//}
-	if err := myredis.DelKeysWithPattern("group_session_list_" + ownerId); err != nil {
-		zlog.Error(err.Error())
-	}
-	if err := myredis.DelKeysWithPattern("my_joined_group_list_" + ownerId); err != nil {
+	// 新成员的列表里还没有该群，不带群标签，需要单独删除
+	invalidateGroups(ownerId)
+	if err := myredis.Invalidate(myredis.MyJoinedGroupListCache.Key(contactId)); err != nil {
 		zlog.Error(err.Error())
 	}
-	//if err := myredis.DelKeysWithPattern("session_" + ownerId + "_" + contactId); err != nil {
-	//	zlog.Error(err.Error())
-	//}
+	invalidateSessionLists(contactId)
 	return "进群成功", 0
 }
 
 // SetGroupsStatus 设置群聊是否启用
-func (g *groupInfoService) SetGroupsStatus(uuidList []string, status int8) (string, int) {
+func (g *groupInfoService) SetGroupsStatus(op Operator, uuidList []string, status int8) (string, int) {
 	var deletedAt gorm.DeletedAt
 	deletedAt.Time = time.Now()
 	deletedAt.Valid = true
 	for _, uuid := range uuidList {
+		var group model.GroupInfo
+		if res := dao.GormDB.First(&group, "uuid = ?", uuid); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				continue
+			}
+			zlog.Error(res.Error.Error())
+			return constants.SYSTEM_ERROR, -1
+		}
 		if res := dao.GormDB.Model(&model.GroupInfo{}).Where("uuid = ?", uuid).Update("status", status); res.Error != nil {
 			zlog.Error(res.Error.Error())
 			return constants.SYSTEM_ERROR, -1
 		}
+		recordAudit(op, audit_action_enum.SET_GROUP_STATUS, uuid,
+			map[string]interface{}{"status": group.Status}, map[string]interface{}{"status": status})
 		if status == group_status_enum.DISABLE {
 			var sessionList []model.Session
 			if res := dao.GormDB.Model(&sessionList).Where("receive_id = ?", uuid).Find(&sessionList); res.Error != nil {
@@ -570,11 +525,7 @@ func (g *groupInfoService) SetGroupsStatus(uuidList []string, status int8) (stri
 			}
 		}
 	}
-	//for _, uuid := range uuidList {
-	//	if err := myredis.DelKeysWithPattern("group_info_" + uuid); err != nil {
-	//		zlog.Error(err.Error())
-	//	}
-	//}
+	invalidateGroups(uuidList...)
 	return "设置成功", 0
 }
 
@@ -617,65 +568,48 @@ func (g *groupInfoService) UpdateGroupInfo(req request.UpdateGroupInfoRequest) (
 		}
 	}
 
-	//if err := myredis.DelKeysWithPattern("group_info_" + req.Uuid); err != nil {
-	//	zlog.Error(err.Error())
-	//}
-	//if err := myredis.SetKeyEx("contact_mygroup_list_"+ req.OwnerId, string(rspString), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-	//	zlog.Error(err.Error())
-	//}
+	invalidateGroups(req.Uuid)
 	return "更新成功", 0
 }
 
 // GetGroupMemberList 获取群聊成员列表
 func (g *groupInfoService) GetGroupMemberList(groupId string) (string, []respond.GetGroupMemberListRespond, int) {
-	rspString, err := myredis.GetKeyNilIsErr("group_memberlist_" + groupId)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			var group model.GroupInfo
-			if res := dao.GormDB.First(&group, "uuid = ?", groupId); res.Error != nil {
-				zlog.Error(res.Error.Error())
-				return constants.SYSTEM_ERROR, nil, -1
-			}
-			var members []string
-			if err := json.Unmarshal(group.Members, &members); err != nil {
-				zlog.Error(err.Error())
-				return constants.SYSTEM_ERROR, nil, -1
-			}
-			var rspList []respond.GetGroupMemberListRespond
-			for _, member := range members {
-				var user model.UserInfo
-				if res := dao.GormDB.First(&user, "uuid = ?", member); res.Error != nil {
-					zlog.Error(res.Error.Error())
-					return constants.SYSTEM_ERROR, nil, -1
-				}
-				rspList = append(rspList, respond.GetGroupMemberListRespond{
-					UserId:   user.Uuid,
-					Nickname: user.Nickname,
-					Avatar:   user.Avatar,
-				})
+	var rsp []respond.GetGroupMemberListRespond
+	err := myredis.GetOrLoad(myredis.GroupMemberListCache, myredis.GroupMemberListCache.Key(groupId), &rsp, func() (interface{}, []string, error) {
+		var group model.GroupInfo
+		if res := dao.GormDB.First(&group, "uuid = ?", groupId); res.Error != nil {
+			return nil, nil, res.Error
+		}
+		var members []string
+		if err := json.Unmarshal(group.Members, &members); err != nil {
+			return nil, nil, err
+		}
+		var rspList []respond.GetGroupMemberListRespond
+		// 成员的昵称和头像变化时也要失效
+		tags := []string{myredis.GroupTag(groupId)}
+		for _, member := range members {
+			var user model.UserInfo
+			if res := dao.GormDB.First(&user, "uuid = ?", member); res.Error != nil {
+				return nil, nil, res.Error
 			}
-			//rspString, err := json.Marshal(rspList)
-			//if err != nil {
-			//	zlog.Error(err.Error())
-			//}
-			//if err := myredis.SetKeyEx("group_memberlist_"+groupId, string(rspString), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-			//	zlog.Error(err.Error())
-			//}
-			return "获取群聊成员列表成功", rspList, 0
-		} else {
-			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, nil, -1
+			tags = append(tags, myredis.UserTag(user.Uuid))
+			rspList = append(rspList, respond.GetGroupMemberListRespond{
+				UserId:   user.Uuid,
+				Nickname: user.Nickname,
+				Avatar:   user.Avatar,
+			})
 		}
-	}
-	var rsp []respond.GetGroupMemberListRespond
-	if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
+		return rspList, tags, nil
+	})
+	if err != nil {
 		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
 	}
 	return "获取群聊成员列表成功", rsp, 0
 }
 
 // RemoveGroupMembers 移除群聊成员
-func (g *groupInfoService) RemoveGroupMembers(req request.RemoveGroupMembersRequest) (string, int) {
+func (g *groupInfoService) RemoveGroupMembers(op Operator, req request.RemoveGroupMembersRequest) (string, int) {
 	var group model.GroupInfo
 	if res := dao.GormDB.First(&group, "uuid = ?", req.GroupId); res.Error != nil {
 		zlog.Error(res.Error.Error())
@@ -686,6 +620,7 @@ func (g *groupInfoService) RemoveGroupMembers(req request.RemoveGroupMembersRequ
 		zlog.Error(err.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
+	before := map[string]interface{}{"members": group.Members, "member_cnt": group.MemberCnt}
 	var deletedAt gorm.DeletedAt
 	deletedAt.Time = time.Now()
 	deletedAt.Valid = true
@@ -722,17 +657,23 @@ func (g *groupInfoService) RemoveGroupMembers(req request.RemoveGroupMembersRequ
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
-	//if err := myredis.DelKeysWithPattern("group_info_" + req.GroupId); err != nil {
-	//	zlog.Error(err.Error())
-	//}
-	//if err := myredis.DelKeysWithPattern("groupmember_list_" + req.GroupId); err != nil {
-	//	zlog.Error(err.Error())
-	//}
-	if err := myredis.DelKeysWithPrefix("group_session_list"); err != nil {
-		zlog.Error(err.Error())
-	}
-	if err := myredis.DelKeysWithPrefix("my_joined_group_list"); err != nil {
+	recordAudit(op, audit_action_enum.REMOVE_GROUP_MEMBERS, req.GroupId, before, map[string]interface{}{
+		"members":    group.Members,
+		"member_cnt": group.MemberCnt,
+		"removed":    req.UuidList,
+	})
+	invalidateGroups(req.GroupId)
+	return "移除群聊成员成功", 0
+}
+
+// invalidateGroups 群聊信息或成员变化后，删除打了这些群标签的缓存，
+// 包括群详情、成员列表以及成员的会话列表、加入的群聊列表和群主创建的群聊列表
+func invalidateGroups(groupIds ...string) {
+	tags := make([]string, 0, len(groupIds))
+	for _, groupId := range groupIds {
+		tags = append(tags, myredis.GroupTag(groupId))
+	}
+	if err := myredis.InvalidateTags(tags...); err != nil {
 		zlog.Error(err.Error())
 	}
-	return "移除群聊成员成功", 0
 }
@@ -0,0 +1,85 @@
+package gorm
+
+import (
+	"fmt"
+	"kama_chat_server/internal/dao"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/dto/respond"
+	"kama_chat_server/internal/model"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/enum/audit_log/audit_action_enum"
+	"kama_chat_server/pkg/zlog"
+)
+
+const (
+	hybridModeEventDefaultPageSize = 20
+	hybridModeEventMaxPageSize     = 100
+	hybridModeReasonMaxLen         = 100
+)
+
+type hybridModeService struct {
+}
+
+var HybridModeService = new(hybridModeService)
+
+// RecordModeChange 记录一次模式切换
+func (h *hybridModeService) RecordModeChange(event *model.HybridModeEvent) error {
+	return dao.GormDB.Create(event).Error
+}
+
+// GetModeEventList 分页查询模式切换记录，新的在前 - 管理员
+func (h *hybridModeService) GetModeEventList(req request.GetHybridModeEventListRequest) (string, *respond.GetHybridModeEventListRespond, int) {
+	if req.Page <= 0 {
+		req.Page = 1
+	}
+	if req.PageSize <= 0 {
+		req.PageSize = hybridModeEventDefaultPageSize
+	}
+	if req.PageSize > hybridModeEventMaxPageSize {
+		req.PageSize = hybridModeEventMaxPageSize
+	}
+	var total int64
+	if res := dao.GormDB.Model(&model.HybridModeEvent{}).Count(&total); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	var events []model.HybridModeEvent
+	if res := dao.GormDB.Order("id DESC").Offset((req.Page - 1) * req.PageSize).Limit(req.PageSize).Find(&events); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	list := make([]respond.HybridModeEventRespond, 0, len(events))
+	for _, event := range events {
+		list = append(list, respond.HybridModeEventRespond{
+			Id:         event.Id,
+			Instance:   event.Instance,
+			FromMode:   event.FromMode,
+			ToMode:     event.ToMode,
+			Trigger:    event.Trigger,
+			OperatorId: event.OperatorId,
+			Reason:     event.Reason,
+			LoadRatio:  event.LoadRatio,
+			LatencyMs:  event.LatencyMs,
+			KafkaLag:   event.KafkaLag,
+			CreatedAt:  event.CreatedAt.Format("2006-01-02 15:04:05"),
+		})
+	}
+	return "获取模式切换记录成功", &respond.GetHybridModeEventListRespond{
+		Total: total,
+		List:  list,
+	}, 0
+}
+
+// SetMode 手动指定混合模式，apply由调用方修改当前实例的模式，返回修改前的设置 - 管理员
+func (h *hybridModeService) SetMode(op Operator, mode, reason string, apply func(mode, operatorId, reason string) (string, error)) (string, int) {
+	if len([]rune(reason)) > hybridModeReasonMaxLen {
+		return fmt.Sprintf("原因不能超过%d个字", hybridModeReasonMaxLen), -2
+	}
+	before, err := apply(mode, op.Uuid, reason)
+	if err != nil {
+		return err.Error(), -2
+	}
+	recordAudit(op, audit_action_enum.SET_HYBRID_MODE, "hybrid_mode",
+		map[string]interface{}{"mode": before}, map[string]interface{}{"mode": mode, "reason": reason})
+	return "设置成功", 0
+}
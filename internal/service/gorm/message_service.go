@@ -1,237 +1,195 @@
 package gorm
 
 import (
-	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/go-redis/redis/v8"
-	"github.com/segmentio/kafka-go"
+	"gorm.io/gorm"
 	"io"
 	"kama_chat_server/internal/config"
 	"kama_chat_server/internal/dao"
-	"kama_chat_server/internal/dto/request"
 	"kama_chat_server/internal/dto/respond"
 	"kama_chat_server/internal/model"
-	myKafka "kama_chat_server/internal/service/kafka"
-	myredis "kama_chat_server/internal/service/redis"
+	"kama_chat_server/internal/service/media"
 	"kama_chat_server/pkg/constants"
-	"kama_chat_server/pkg/util/random"
+	"kama_chat_server/pkg/enum/contact/contact_status_enum"
+	"kama_chat_server/pkg/enum/message/message_type_enum"
+	"kama_chat_server/pkg/util/sign"
 	"kama_chat_server/pkg/zlog"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// maxBackfillCount 按序号补拉时单次最多返回的条数
+const maxBackfillCount = 200
+
 type messageService struct {
 }
 
 var MessageService = new(messageService)
 
 // GetMessageList 获取聊天记录
+// 返回中包含当前用户的已听、回应状态，不同用户看到的内容不同，直接查库不缓存
 func (m *messageService) GetMessageList(userOneId, userTwoId string) (string, interface{}, int) {
-	// 检查是否启用异步模式
-	kafkaConfig := config.GetConfig().KafkaConfig
-	if kafkaConfig.MessageMode == "kafka" || kafkaConfig.MessageMode == "hybrid" {
-		return m.asyncLoadMessageList(userOneId, userTwoId)
+	var messageList []model.Message
+	if res := dao.GormDB.Where("(send_id = ? AND receive_id = ?) OR (send_id = ? AND receive_id = ?)", userOneId, userTwoId, userTwoId, userOneId).Order("created_at ASC").Find(&messageList); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	rspList, ret := m.messageListRespond(userOneId, messageList)
+	if ret != 0 {
+		return constants.SYSTEM_ERROR, nil, -1
 	}
-	return m.syncLoadMessageList(userOneId, userTwoId)
+	return "获取聊天记录成功", rspList, 0
 }
 
-// asyncLoadMessageList 异步加载聊天记录
-func (m *messageService) asyncLoadMessageList(userOneId, userTwoId string) (string, interface{}, int) {
-	// 生成任务ID
-	taskId := fmt.Sprintf("ML%s", random.GetNowAndLenRandomString(11))
-	
-	// 创建异步任务
-	taskParams := request.MessageListTaskParams{
-		UserOneId: userOneId,
-		UserTwoId: userTwoId,
-	}
-	
-	asyncTask := request.AsyncTaskRequest{
-		TaskType:   "load_message_list",
-		TaskId:     taskId,
-		ClientId:   userOneId, // 使用userOneId作为客户端ID
-		UserId:     userOneId,
-		Parameters: taskParams,
-	}
-	
-	// 发送任务到Kafka
-	taskData, err := json.Marshal(asyncTask)
-	if err != nil {
-		zlog.Error("序列化异步任务失败: " + err.Error())
-		return m.syncLoadMessageList(userOneId, userTwoId) // 降级到同步处理
-	}
-	
-	err = myKafka.KafkaService.AsyncTaskWriter.WriteMessages(context.Background(), kafka.Message{
-		Key:   []byte(taskId),
-		Value: taskData,
-	})
-	
-	if err != nil {
-		zlog.Error("发送异步任务到Kafka失败: " + err.Error())
-		return m.syncLoadMessageList(userOneId, userTwoId) // 降级到同步处理
-	}
-	
-	// 返回加载中状态
-	loadingResp := respond.AsyncLoadingRespond{
-		Loading: true,
-		TaskId:  taskId,
-		Message: "正在加载聊天记录...",
-	}
-	
-	return "正在加载聊天记录...", loadingResp, 200
+// GetGroupMessageList 获取群聊消息记录
+// ownerId用于标记语音消息是否已听，为空时全部视为未听，和单聊一样不缓存
+func (m *messageService) GetGroupMessageList(groupId, ownerId string) (string, interface{}, int) {
+	var messageList []model.Message
+	if res := dao.GormDB.Where("receive_id = ?", groupId).Order("created_at ASC").Find(&messageList); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	rspList, ret := m.groupMessageListRespond(ownerId, messageList)
+	if ret != 0 {
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	return "获取聊天记录成功", rspList, 0
 }
 
-// syncLoadMessageList 同步加载聊天记录
-func (m *messageService) syncLoadMessageList(userOneId, userTwoId string) (string, interface{}, int) {
-	rspString, err := myredis.GetKeyNilIsErr("message_list_" + userOneId + "_" + userTwoId)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			zlog.Info(err.Error())
-			zlog.Info(fmt.Sprintf("%s %s", userTwoId, userTwoId))
-			var messageList []model.Message
-			if res := dao.GormDB.Where("(send_id = ? AND receive_id = ?) OR (send_id = ? AND receive_id = ?)", userOneId, userTwoId, userTwoId, userOneId).Order("created_at ASC").Find(&messageList); res.Error != nil {
-				zlog.Error(res.Error.Error())
-				return constants.SYSTEM_ERROR, nil, -1
-			}
-			var rspList []respond.GetMessageListRespond
-			for _, message := range messageList {
-				rspList = append(rspList, respond.GetMessageListRespond{
-					SendId:     message.SendId,
-					SendName:   message.SendName,
-					SendAvatar: message.SendAvatar,
-					ReceiveId:  message.ReceiveId,
-					Content:    message.Content,
-					Url:        message.Url,
-					Type:       message.Type,
-					FileType:   message.FileType,
-					FileName:   message.FileName,
-					FileSize:   message.FileSize,
-					CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
-				})
-			}
-			//rspString, err := json.Marshal(rspList)
-			//if err != nil {
-			//	zlog.Error(err.Error())
-			//}
-			//if err := myredis.SetKeyEx("message_list_"+userOneId+"_"+userTwoId, string(rspString), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-			//	zlog.Error(err.Error())
-			//}
-			return "获取聊天记录成功", rspList, 0
-		} else {
-			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, nil, -1
-		}
+// messageListRespond 单聊记录转为返回结构，ownerId用于标记语音已听和自己的回应
+func (m *messageService) messageListRespond(ownerId string, messageList []model.Message) ([]respond.GetMessageListRespond, int) {
+	listened, ret := m.listenedVoiceSet(ownerId, messageList)
+	if ret != 0 {
+		return nil, -1
 	}
-	var rsp []respond.GetMessageListRespond
-	if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
-		zlog.Error(err.Error())
+	reactions, ret := m.reactionCounts(ownerId, messageList)
+	if ret != 0 {
+		return nil, -1
 	}
-	return "获取群聊记录成功", rsp, 0
+	var rspList []respond.GetMessageListRespond
+	for _, message := range messageList {
+		rspList = append(rspList, respond.GetMessageListRespond{
+			Uuid:       message.Uuid,
+			Seq:        message.Seq,
+			SendId:     message.SendId,
+			SendName:   message.SendName,
+			SendAvatar: message.SendAvatar,
+			ReceiveId:  message.ReceiveId,
+			Content:    message.Content,
+			Url:        message.Url,
+			Type:       message.Type,
+			FileType:   message.FileType,
+			FileName:   message.FileName,
+			FileSize:   message.FileSize,
+			Thumbnail:  message.Thumbnail,
+			Width:      message.Width,
+			Height:     message.Height,
+			Duration:   message.Duration,
+			Listened:   listened[message.Uuid],
+			Reactions:  reactions[message.Uuid],
+			Payload:    json.RawMessage(message.Payload),
+			CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
+		})
+	}
+	return rspList, 0
 }
 
-// GetGroupMessageList 获取群聊消息记录
-func (m *messageService) GetGroupMessageList(groupId string) (string, interface{}, int) {
-	// 检查是否启用异步模式
-	kafkaConfig := config.GetConfig().KafkaConfig
-	if kafkaConfig.MessageMode == "kafka" || kafkaConfig.MessageMode == "hybrid" {
-		return m.asyncLoadGroupMessageList(groupId)
+// groupMessageListRespond 群聊记录转为返回结构
+func (m *messageService) groupMessageListRespond(ownerId string, messageList []model.Message) ([]respond.GetGroupMessageListRespond, int) {
+	listened, ret := m.listenedVoiceSet(ownerId, messageList)
+	if ret != 0 {
+		return nil, -1
+	}
+	reactions, ret := m.reactionCounts(ownerId, messageList)
+	if ret != 0 {
+		return nil, -1
+	}
+	var rspList []respond.GetGroupMessageListRespond
+	for _, message := range messageList {
+		rsp := respond.GetGroupMessageListRespond{
+			Uuid:       message.Uuid,
+			Seq:        message.Seq,
+			SendId:     message.SendId,
+			SendName:   message.SendName,
+			SendAvatar: message.SendAvatar,
+			ReceiveId:  message.ReceiveId,
+			Content:    message.Content,
+			Url:        message.Url,
+			Type:       message.Type,
+			FileType:   message.FileType,
+			FileName:   message.FileName,
+			FileSize:   message.FileSize,
+			Thumbnail:  message.Thumbnail,
+			Width:      message.Width,
+			Height:     message.Height,
+			Duration:   message.Duration,
+			Listened:   listened[message.Uuid],
+			Reactions:  reactions[message.Uuid],
+			Payload:    json.RawMessage(message.Payload),
+			CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
+		}
+		rspList = append(rspList, rsp)
 	}
-	return m.syncLoadGroupMessageList(groupId)
+	return rspList, 0
 }
 
-// asyncLoadGroupMessageList 异步加载群聊消息记录
-func (m *messageService) asyncLoadGroupMessageList(groupId string) (string, interface{}, int) {
-	// 生成任务ID
-	taskId := fmt.Sprintf("GML%s", random.GetNowAndLenRandomString(11))
-	
-	// 创建异步任务
-	taskParams := request.GroupMessageListTaskParams{
-		GroupId: groupId,
-	}
-	
-	asyncTask := request.AsyncTaskRequest{
-		TaskType:   "load_group_message_list",
-		TaskId:     taskId,
-		ClientId:   groupId, // 使用groupId作为客户端ID
-		UserId:     groupId,
-		Parameters: taskParams,
-	}
-	
-	// 发送任务到Kafka
-	taskData, err := json.Marshal(asyncTask)
-	if err != nil {
-		zlog.Error("序列化异步任务失败: " + err.Error())
-		return m.syncLoadGroupMessageList(groupId) // 降级到同步处理
-	}
-	
-	err = myKafka.KafkaService.AsyncTaskWriter.WriteMessages(context.Background(), kafka.Message{
-		Key:   []byte(taskId),
-		Value: taskData,
-	})
-	
-	if err != nil {
-		zlog.Error("发送异步任务到Kafka失败: " + err.Error())
-		return m.syncLoadGroupMessageList(groupId) // 降级到同步处理
-	}
-	
-	// 返回加载中状态
-	loadingResp := respond.AsyncLoadingRespond{
-		Loading: true,
-		TaskId:  taskId,
-		Message: "正在加载群聊记录...",
-	}
-	
-	return "正在加载群聊记录...", loadingResp, 200
+// conversationQuery 单聊两个方向的消息或群聊消息
+func conversationQuery(ownerId, receiveId string) *gorm.DB {
+	if receiveId[0] == 'G' {
+		return dao.GormDB.Where("receive_id = ?", receiveId)
+	}
+	return dao.GormDB.Where("(send_id = ? AND receive_id = ?) OR (send_id = ? AND receive_id = ?)", ownerId, receiveId, receiveId, ownerId)
 }
 
-// syncLoadGroupMessageList 同步加载群聊消息记录
-func (m *messageService) syncLoadGroupMessageList(groupId string) (string, interface{}, int) {
-	rspString, err := myredis.GetKeyNilIsErr("group_messagelist_" + groupId)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			var messageList []model.Message
-			if res := dao.GormDB.Where("receive_id = ?", groupId).Order("created_at ASC").Find(&messageList); res.Error != nil {
-				zlog.Error(res.Error.Error())
-				return constants.SYSTEM_ERROR, nil, -1
-			}
-			var rspList []respond.GetGroupMessageListRespond
-			for _, message := range messageList {
-				rsp := respond.GetGroupMessageListRespond{
-					SendId:     message.SendId,
-					SendName:   message.SendName,
-					SendAvatar: message.SendAvatar,
-					ReceiveId:  message.ReceiveId,
-					Content:    message.Content,
-					Url:        message.Url,
-					Type:       message.Type,
-					FileType:   message.FileType,
-					FileName:   message.FileName,
-					FileSize:   message.FileSize,
-					CreatedAt:  message.CreatedAt.Format("2006-01-02 15:04:05"),
-				}
-				rspList = append(rspList, rsp)
-			}
-			//rspString, err := json.Marshal(rspList)
-			//if err != nil {
-			//	zlog.Error(err.Error())
-			//}
-			//if err := myredis.SetKeyEx("group_messagelist_"+groupId, string(rspString), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-			//	zlog.Error(err.Error())
-			//}
-			return "获取聊天记录成功", rspList, 0
-		} else {
-			zlog.Error(err.Error())
+// MaxSeq 会话中已使用的最大序号，序号计数器丢失后用于恢复
+func (m *messageService) MaxSeq(sendId, receiveId string) (int64, error) {
+	var maxSeq int64
+	res := conversationQuery(sendId, receiveId).Model(&model.Message{}).Select("COALESCE(MAX(seq), 0)").Scan(&maxSeq)
+	return maxSeq, res.Error
+}
+
+// GetMessageListBySeq 按序号区间补拉消息，客户端发现序号不连续时调用
+// receiveId为U开头时返回与ownerId的单聊消息，G开头时返回群聊消息，区间包含两端
+func (m *messageService) GetMessageListBySeq(ownerId, receiveId string, fromSeq, toSeq int64) (string, interface{}, int) {
+	if ownerId == "" || receiveId == "" || fromSeq <= 0 || toSeq < fromSeq {
+		return "序号区间错误", nil, -2
+	}
+	if toSeq-fromSeq >= maxBackfillCount {
+		return fmt.Sprintf("单次最多补拉%d条消息", maxBackfillCount), nil, -2
+	}
+	if receiveId[0] == 'G' {
+		if _, status, ret := UserContactService.GetContactStatus(ownerId, receiveId); ret != 0 ||
+			status == contact_status_enum.QUIT_GROUP || status == contact_status_enum.KICK_OUT_GROUP {
+			return "不在该群聊中", nil, -2
+		}
+	}
+	var messageList []model.Message
+	if res := conversationQuery(ownerId, receiveId).Where("seq BETWEEN ? AND ?", fromSeq, toSeq).
+		Order("seq ASC").Find(&messageList); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if receiveId[0] == 'G' {
+		rspList, ret := m.groupMessageListRespond(ownerId, messageList)
+		if ret != 0 {
 			return constants.SYSTEM_ERROR, nil, -1
 		}
+		return "获取聊天记录成功", rspList, 0
 	}
-	var rsp []respond.GetGroupMessageListRespond
-	if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
-		zlog.Error(err.Error())
+	rspList, ret := m.messageListRespond(ownerId, messageList)
+	if ret != 0 {
+		return constants.SYSTEM_ERROR, nil, -1
 	}
-	return "获取聊天记录成功", rsp, 0
+	return "获取聊天记录成功", rspList, 0
 }
 
 // UploadAvatar 上传头像
@@ -269,35 +227,396 @@ func (m *messageService) UploadAvatar(c *gin.Context) (string, int) {
 }
 
 // UploadFile 上传文件
-func (m *messageService) UploadFile(c *gin.Context) (string, int) {
+// 文件按随机名保存并记录上传者，发送文件消息时只能使用自己上传的文件，同名文件不会互相覆盖
+// 图片会生成缩略图并记录宽高，音频会记录时长，元数据随上传结果返回
+func (m *messageService) UploadFile(c *gin.Context) (string, []respond.UploadFileRespond, int) {
 	if err := c.Request.ParseMultipartForm(constants.FILE_MAX_SIZE); err != nil {
 		zlog.Error(err.Error())
-		return constants.SYSTEM_ERROR, -1
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	ownerId := c.PostForm("owner_id")
+	var owner model.UserInfo
+	if res := dao.GormDB.First(&owner, "uuid = ?", ownerId); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "用户不存在", nil, -2
+		}
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
 	}
 	mForm := c.Request.MultipartForm
+	var rspList []respond.UploadFileRespond
 	for key, _ := range mForm.File {
 		file, fileHeader, err := c.Request.FormFile(key)
 		if err != nil {
 			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, -1
+			return constants.SYSTEM_ERROR, nil, -1
 		}
 		defer file.Close()
 		zlog.Info(fmt.Sprintf("文件名：%s，文件大小：%d", fileHeader.Filename, fileHeader.Size))
-		// 原来Filename应该是213451545.xxx，将Filename修改为avatar_ownerId.xxx
-		ext := filepath.Ext(fileHeader.Filename)
-		zlog.Info(ext)
-		localFileName := config.GetConfig().StaticFilePath + "/" + fileHeader.Filename
+		storedName, err := newStoredName(filepath.Ext(fileHeader.Filename))
+		if err != nil {
+			zlog.Error(err.Error())
+			return constants.SYSTEM_ERROR, nil, -1
+		}
+		localFileName := filepath.Join(config.GetConfig().StaticFilePath, storedName)
 		out, err := os.Create(localFileName)
 		if err != nil {
 			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, -1
+			return constants.SYSTEM_ERROR, nil, -1
 		}
 		defer out.Close()
 		if _, err := io.Copy(out, file); err != nil {
 			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, -1
+			return constants.SYSTEM_ERROR, nil, -1
+		}
+		upload := model.FileUpload{
+			StoredName: storedName,
+			OwnerId:    owner.Uuid,
+			FileName:   filepath.Base(fileHeader.Filename),
+			FileSize:   fileHeader.Size,
+			CreatedAt:  time.Now(),
+		}
+		// 元数据提取失败不影响上传结果，发送图片消息时会因为缺少宽高被拒绝
+		if meta, err := media.ExtractFileMeta(localFileName); err != nil {
+			zlog.Error(err.Error())
+		} else {
+			upload.Thumbnail = meta.ThumbnailUrl
+			upload.Width = meta.Width
+			upload.Height = meta.Height
+			upload.Duration = meta.Duration
+		}
+		if res := dao.GormDB.Create(&upload); res.Error != nil {
+			zlog.Error(res.Error.Error())
+			return constants.SYSTEM_ERROR, nil, -1
 		}
 		zlog.Info("完成文件上传")
+		rspList = append(rspList, respond.UploadFileRespond{
+			FileName:  upload.FileName,
+			FileSize:  fileHeader.Size,
+			Url:       "/download/file/" + storedName,
+			Thumbnail: upload.Thumbnail,
+			Width:     upload.Width,
+			Height:    upload.Height,
+			Duration:  upload.Duration,
+		})
 	}
-	return "上传成功", 0
+	return "上传成功", rspList, 0
+}
+
+// newStoredName 生成保存文件用的随机文件名，保留小写的扩展名用于识别文件类型
+func newStoredName(ext string) (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	// 扩展名来自客户端，只接受较短的字母和数字
+	ext = strings.ToLower(ext)
+	invalid := strings.IndexFunc(strings.TrimPrefix(ext, "."), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	}) >= 0
+	if invalid || len(ext) > 10 {
+		ext = ""
+	}
+	return "F" + hex.EncodeToString(raw) + ext, nil
+}
+
+// messageParticipants 返回消息所在会话的参与者，单聊为收发双方，群聊为当前群成员
+func (m *messageService) messageParticipants(message model.Message) ([]string, string, int) {
+	if message.ReceiveId[0] == 'U' {
+		return []string{message.SendId, message.ReceiveId}, "", 0
+	}
+	var group model.GroupInfo
+	if res := dao.GormDB.First(&group, "uuid = ?", message.ReceiveId); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return nil, "群聊不存在", -2
+		}
+		zlog.Error(res.Error.Error())
+		return nil, constants.SYSTEM_ERROR, -1
+	}
+	var members []string
+	if err := json.Unmarshal(group.Members, &members); err != nil {
+		zlog.Error(err.Error())
+		return nil, constants.SYSTEM_ERROR, -1
+	}
+	return members, "", 0
+}
+
+// checkMessageParticipant 检查用户是否为消息所在会话的参与者
+// 单聊要求是收发双方之一，群聊要求当前仍是群成员
+func (m *messageService) checkMessageParticipant(ownerId string, message model.Message) (string, int) {
+	members, msg, ret := m.messageParticipants(message)
+	if ret != 0 {
+		return msg, ret
+	}
+	for _, member := range members {
+		if member == ownerId {
+			return "", 0
+		}
+	}
+	return "无权访问该文件", -2
+}
+
+// GetFileUrl 获取文件的签名下载链接，只有该会话的参与者才能获取
+func (m *messageService) GetFileUrl(ownerId, messageId string) (string, *respond.GetFileUrlRespond, int) {
+	var message model.Message
+	if res := dao.GormDB.First(&message, "uuid = ?", messageId); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "消息不存在", nil, -2
+		}
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if message.Url == "" {
+		return "该消息没有文件", nil, -2
+	}
+	if msg, ret := m.checkMessageParticipant(ownerId, message); ret != 0 {
+		return msg, nil, ret
+	}
+	expiresAt := time.Now().Add(time.Duration(config.GetConfig().FileAccessConfig.UrlTimeout) * time.Second)
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	rsp := &respond.GetFileUrlRespond{
+		Url:       signedFileUrl(filepath.Base(media.LocalFilePath(message.Url)), message.Uuid, ownerId, expires),
+		ExpiresAt: expiresAt.Format("2006-01-02 15:04:05"),
+	}
+	if message.Thumbnail != "" {
+		rsp.ThumbnailUrl = signedFileUrl(filepath.Base(media.LocalThumbnailPath(message.Thumbnail)), message.Uuid, ownerId, expires)
+	}
+	return "获取下载链接成功", rsp, 0
+}
+
+// signedFileUrl 生成带签名的下载链接，文件和缩略图都通过/download/file下载
+func signedFileUrl(fileName, messageId, ownerId, expires string) string {
+	query := url.Values{}
+	query.Set("message_id", messageId)
+	query.Set("owner_id", ownerId)
+	query.Set("expires", expires)
+	query.Set("signature", sign.Sign(config.GetConfig().FileAccessConfig.SignSecret, messageId, ownerId, fileName, expires))
+	return "/download/file/" + url.PathEscape(fileName) + "?" + query.Encode()
+}
+
+// CheckFileDownload 校验下载链接并记录下载日志，返回文件本地路径
+// 链接有效期内如果用户已退群，同样拒绝下载
+func (m *messageService) CheckFileDownload(fileName, messageId, ownerId, expires, signature, ip string) (string, string, int) {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "下载链接无效", "", -2
+	}
+	if time.Now().Unix() > expiresAt {
+		return "下载链接已过期", "", -2
+	}
+	if !sign.Verify(config.GetConfig().FileAccessConfig.SignSecret, signature, messageId, ownerId, fileName, expires) {
+		zlog.Info(fmt.Sprintf("文件下载签名校验失败，用户%s，文件%s", ownerId, fileName))
+		return "下载链接无效", "", -2
+	}
+	var message model.Message
+	if res := dao.GormDB.First(&message, "uuid = ?", messageId); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "消息不存在", "", -2
+		}
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, "", -1
+	}
+	// 签名中的文件名是消息的文件或缩略图
+	localPath := media.LocalFilePath(message.Url)
+	if filepath.Base(localPath) != fileName {
+		if message.Thumbnail == "" || filepath.Base(media.LocalThumbnailPath(message.Thumbnail)) != fileName {
+			return "下载链接无效", "", -2
+		}
+		localPath = media.LocalThumbnailPath(message.Thumbnail)
+	}
+	if msg, ret := m.checkMessageParticipant(ownerId, message); ret != 0 {
+		return msg, "", ret
+	}
+	downloadLog := model.FileDownloadLog{
+		MessageId:    messageId,
+		UserId:       ownerId,
+		FileName:     fileName,
+		Ip:           ip,
+		DownloadedAt: time.Now(),
+	}
+	if res := dao.GormDB.Create(&downloadLog); res.Error != nil {
+		zlog.Error(res.Error.Error())
+	}
+	return "", localPath, 0
+}
+
+// listenedVoiceSet 返回消息列表中ownerId已听过的语音消息uuid，自己发送的语音视为已听
+func (m *messageService) listenedVoiceSet(ownerId string, messageList []model.Message) (map[string]bool, int) {
+	listened := make(map[string]bool)
+	if ownerId == "" {
+		return listened, 0
+	}
+	var voiceIds []string
+	for _, message := range messageList {
+		if message.Type != message_type_enum.Voice {
+			continue
+		}
+		if message.SendId == ownerId {
+			listened[message.Uuid] = true
+		} else {
+			voiceIds = append(voiceIds, message.Uuid)
+		}
+	}
+	if len(voiceIds) == 0 {
+		return listened, 0
+	}
+	var listenList []model.VoiceListen
+	if res := dao.GormDB.Where("user_id = ? AND message_id IN ?", ownerId, voiceIds).Find(&listenList); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return nil, -1
+	}
+	for _, listen := range listenList {
+		listened[listen.MessageId] = true
+	}
+	return listened, 0
+}
+
+// MarkVoiceListened 标记语音消息已听，重复标记不报错
+func (m *messageService) MarkVoiceListened(ownerId, messageId string) (string, int) {
+	var message model.Message
+	if res := dao.GormDB.First(&message, "uuid = ?", messageId); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "消息不存在", -2
+		}
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if message.Type != message_type_enum.Voice {
+		return "该消息不是语音消息", -2
+	}
+	if message.SendId == ownerId {
+		return "标记成功", 0
+	}
+	if msg, ret := m.checkMessageParticipant(ownerId, message); ret != 0 {
+		return msg, ret
+	}
+	listen := model.VoiceListen{
+		MessageId:  messageId,
+		UserId:     ownerId,
+		ListenedAt: time.Now(),
+	}
+	if res := dao.GormDB.Where("message_id = ? AND user_id = ?", messageId, ownerId).FirstOrCreate(&listen); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	return "标记成功", 0
+}
+
+// reactionCounts 按消息聚合表情回应数，保持表情首次出现的顺序
+func (m *messageService) reactionCounts(ownerId string, messageList []model.Message) (map[string][]respond.ReactionCount, int) {
+	counts := make(map[string][]respond.ReactionCount)
+	if len(messageList) == 0 {
+		return counts, 0
+	}
+	var messageIds []string
+	for _, message := range messageList {
+		messageIds = append(messageIds, message.Uuid)
+	}
+	var reactionList []model.MessageReaction
+	if res := dao.GormDB.Where("message_id IN ?", messageIds).Order("id ASC").Find(&reactionList); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return nil, -1
+	}
+	for _, reaction := range reactionList {
+		list := counts[reaction.MessageId]
+		index := -1
+		for i := range list {
+			if list[i].Emoji == reaction.Emoji {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			list = append(list, respond.ReactionCount{Emoji: reaction.Emoji})
+			index = len(list) - 1
+		}
+		list[index].Count++
+		if reaction.UserId == ownerId {
+			list[index].Reacted = true
+		}
+		counts[reaction.MessageId] = list
+	}
+	return counts, 0
+}
+
+// prepareReaction 校验表情和用户权限，返回消息和需要推送的会话成员
+func (m *messageService) prepareReaction(ownerId, messageId, emoji string) (*model.Message, []string, string, int) {
+	if emoji == "" || len(emoji) > constants.REACTION_EMOJI_MAX_LEN {
+		return nil, nil, "表情不合法", -2
+	}
+	var message model.Message
+	if res := dao.GormDB.First(&message, "uuid = ?", messageId); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return nil, nil, "消息不存在", -2
+		}
+		zlog.Error(res.Error.Error())
+		return nil, nil, constants.SYSTEM_ERROR, -1
+	}
+	members, msg, ret := m.messageParticipants(message)
+	if ret != 0 {
+		return nil, nil, msg, ret
+	}
+	for _, member := range members {
+		if member == ownerId {
+			return &message, members, "", 0
+		}
+	}
+	return nil, nil, "不在该会话中，无法回应", -2
+}
+
+// reactionRespond 生成表情回应变化的推送内容
+func (m *messageService) reactionRespond(ownerId string, message *model.Message, emoji, action string) (*respond.MessageReactionRespond, int) {
+	counts, ret := m.reactionCounts("", []model.Message{*message})
+	if ret != 0 {
+		return nil, ret
+	}
+	return &respond.MessageReactionRespond{
+		EventType:  "message_reaction",
+		MessageId:  message.Uuid,
+		ReceiveId:  message.ReceiveId,
+		OperatorId: ownerId,
+		Emoji:      emoji,
+		Action:     action,
+		Reactions:  counts[message.Uuid],
+	}, 0
+}
+
+// AddReaction 添加表情回应，返回最新的回应数和需要推送的会话成员
+func (m *messageService) AddReaction(ownerId, messageId, emoji string) (string, *respond.MessageReactionRespond, []string, int) {
+	message, members, msg, ret := m.prepareReaction(ownerId, messageId, emoji)
+	if ret != 0 {
+		return msg, nil, nil, ret
+	}
+	reaction := model.MessageReaction{
+		MessageId: messageId,
+		UserId:    ownerId,
+		Emoji:     emoji,
+		CreatedAt: time.Now(),
+	}
+	if res := dao.GormDB.Where("message_id = ? AND user_id = ? AND emoji = ?", messageId, ownerId, emoji).FirstOrCreate(&reaction); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, nil, -1
+	}
+	rsp, ret := m.reactionRespond(ownerId, message, emoji, "add")
+	if ret != 0 {
+		return constants.SYSTEM_ERROR, nil, nil, -1
+	}
+	return "回应成功", rsp, members, 0
+}
+
+// RemoveReaction 取消表情回应，返回最新的回应数和需要推送的会话成员
+func (m *messageService) RemoveReaction(ownerId, messageId, emoji string) (string, *respond.MessageReactionRespond, []string, int) {
+	message, members, msg, ret := m.prepareReaction(ownerId, messageId, emoji)
+	if ret != 0 {
+		return msg, nil, nil, ret
+	}
+	if res := dao.GormDB.Where("message_id = ? AND user_id = ? AND emoji = ?", messageId, ownerId, emoji).Delete(&model.MessageReaction{}); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, nil, -1
+	}
+	rsp, ret := m.reactionRespond(ownerId, message, emoji, "remove")
+	if ret != 0 {
+		return constants.SYSTEM_ERROR, nil, nil, -1
+	}
+	return "取消回应成功", rsp, members, 0
 }
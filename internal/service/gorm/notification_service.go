@@ -0,0 +1,127 @@
+package gorm
+
+import (
+	"encoding/json"
+	"errors"
+	"gorm.io/gorm"
+	"kama_chat_server/internal/dao"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/dto/respond"
+	"kama_chat_server/internal/model"
+	"kama_chat_server/internal/service/notify"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/zlog"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type notificationService struct {
+}
+
+var NotificationService = new(notificationService)
+
+// GetNotificationSetting 获取离线通知设置
+func (n *notificationService) GetNotificationSetting(ownerId string) (string, *respond.NotificationSettingRespond, int) {
+	var setting model.NotificationSetting
+	if res := dao.GormDB.First(&setting, "user_id = ?", ownerId); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "获取通知设置成功", &respond.NotificationSettingRespond{}, 0
+		}
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	rsp := &respond.NotificationSettingRespond{
+		Provider:   setting.Provider,
+		Target:     setting.Target,
+		QuietStart: setting.QuietStart,
+		QuietEnd:   setting.QuietEnd,
+	}
+	return "获取通知设置成功", rsp, 0
+}
+
+// UpdateNotificationSetting 更新离线通知设置，provider为空表示关闭离线通知
+func (n *notificationService) UpdateNotificationSetting(req request.UpdateNotificationSettingRequest) (string, int) {
+	switch req.Provider {
+	case "":
+	case notify.ProviderWebPush:
+		var subscription struct {
+			Endpoint string `json:"endpoint"`
+		}
+		if err := json.Unmarshal([]byte(req.Target), &subscription); err != nil || !strings.HasPrefix(subscription.Endpoint, "https://") {
+			return "web push订阅格式错误", -2
+		}
+		if _, err := url.Parse(subscription.Endpoint); err != nil {
+			return "web push订阅格式错误", -2
+		}
+	case notify.ProviderWebhook:
+		if req.Target == "" {
+			return "设备token不能为空", -2
+		}
+	case notify.ProviderEmail:
+		if !strings.Contains(req.Target, "@") {
+			return "邮箱格式错误", -2
+		}
+	default:
+		return "不支持的通知渠道", -2
+	}
+	if (req.QuietStart == "") != (req.QuietEnd == "") {
+		return "免打扰开始和结束时间需同时设置", -2
+	}
+	if req.QuietStart != "" {
+		if _, err := notify.ParseClock(req.QuietStart); err != nil {
+			return "免打扰开始" + err.Error(), -2
+		}
+		if _, err := notify.ParseClock(req.QuietEnd); err != nil {
+			return "免打扰结束" + err.Error(), -2
+		}
+	}
+	var setting model.NotificationSetting
+	if res := dao.GormDB.First(&setting, "user_id = ?", req.OwnerId); res.Error != nil && !errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	setting.UserId = req.OwnerId
+	setting.Provider = req.Provider
+	setting.Target = req.Target
+	setting.QuietStart = req.QuietStart
+	setting.QuietEnd = req.QuietEnd
+	setting.UpdatedAt = time.Now()
+	if res := dao.GormDB.Save(&setting); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	return "更新通知设置成功", 0
+}
+
+// GetSetting 实现notify.SettingStore，供离线通知分发器读取用户设置
+func (n *notificationService) GetSetting(userId string) (*notify.Setting, error) {
+	var setting model.NotificationSetting
+	if res := dao.GormDB.First(&setting, "user_id = ?", userId); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, res.Error
+	}
+	return &notify.Setting{
+		Provider:   setting.Provider,
+		Target:     setting.Target,
+		QuietStart: setting.QuietStart,
+		QuietEnd:   setting.QuietEnd,
+	}, nil
+}
+
+// MutedUntil 实现notify.SettingStore，返回用户对会话的免打扰截止时间
+func (n *notificationService) MutedUntil(userId, targetId string) (time.Time, error) {
+	var session model.Session
+	if res := dao.GormDB.Where("send_id = ? AND receive_id = ?", userId, targetId).First(&session); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, res.Error
+	}
+	if !session.MuteUntil.Valid {
+		return time.Time{}, nil
+	}
+	return session.MuteUntil.Time, nil
+}
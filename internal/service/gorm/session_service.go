@@ -1,11 +1,11 @@
 package gorm
 
 import (
-	"encoding/json"
+	"database/sql"
 	"errors"
 	"fmt"
-	"github.com/go-redis/redis/v8"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"kama_chat_server/internal/dao"
 	"kama_chat_server/internal/dto/request"
 	"kama_chat_server/internal/dto/respond"
@@ -17,6 +17,7 @@ import (
 	"kama_chat_server/pkg/enum/user_info/user_status_enum"
 	"kama_chat_server/pkg/util/random"
 	"kama_chat_server/pkg/zlog"
+	"sort"
 	"time"
 )
 
@@ -25,6 +26,9 @@ type sessionService struct {
 
 var SessionService = new(sessionService)
 
+// muteForever 永久免打扰时使用的截止时间
+var muteForever = time.Date(9999, 12, 31, 23, 59, 59, 0, time.Local)
+
 // CreateSession 创建会话
 func (s *sessionService) CreateSession(req request.CreateSessionRequest) (string, string, int) {
 	var user model.UserInfo
@@ -65,16 +69,22 @@ func (s *sessionService) CreateSession(req request.CreateSessionRequest) (string
 		}
 	}
 
-	if res := dao.GormDB.Create(&session); res.Error != nil {
+	// 同一对象只有一条会话，并发打开或之前删除过时恢复原记录，返回原记录的uuid
+	res := dao.GormDB.Clauses(clause.OnConflict{
+		DoUpdates: append(clause.AssignmentColumns([]string{"receive_name", "avatar"}),
+			clause.Assignment{Column: clause.Column{Name: "deleted_at"}, Value: nil}),
+	}).Create(&session)
+	if res.Error != nil {
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, "", -1
 	}
-	if err := myredis.DelKeysWithPattern("group_session_list_" + req.SendId); err != nil {
-		zlog.Error(err.Error())
-	}
-	if err := myredis.DelKeysWithPattern("session_list_" + req.SendId); err != nil {
-		zlog.Error(err.Error())
+	if res.RowsAffected != 1 {
+		if res := dao.GormDB.Where("send_id = ? AND receive_id = ?", req.SendId, req.ReceiveId).First(&session); res.Error != nil {
+			zlog.Error(res.Error.Error())
+			return constants.SYSTEM_ERROR, "", -1
+		}
 	}
+	invalidateSessionLists(req.SendId)
 	return "会话创建成功", session.Uuid, 0
 }
 
@@ -116,148 +126,110 @@ func (s *sessionService) CheckOpenSessionAllowed(sendId, receiveId string) (stri
 
 // DeleteSession 删除会话
 
-// OpenSession 打开会话
+// OpenSession 打开会话，会话不存在时新建
 func (s *sessionService) OpenSession(req request.OpenSessionRequest) (string, string, int) {
-	rspString, err := myredis.GetKeyWithPrefixNilIsErr("session_" + req.SendId + "_" + req.ReceiveId)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			var session model.Session
-			if res := dao.GormDB.Where("send_id = ? and receive_id = ?", req.SendId, req.ReceiveId).First(&session); res.Error != nil {
-				if errors.Is(res.Error, gorm.ErrRecordNotFound) {
-					zlog.Info("会话没有找到，将新建会话")
-					createReq := request.CreateSessionRequest{
-						SendId:    req.SendId,
-						ReceiveId: req.ReceiveId,
-					}
-					return s.CreateSession(createReq)
-				}
-			}
-			//rspString, err := json.Marshal(session)
-			//if err != nil {
-			//	zlog.Error(err.Error())
-			//}
-			//if err := myredis.SetKeyEx("session_"+req.SendId+"_"+req.ReceiveId+"_"+session.Uuid, string(rspString), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-			//	zlog.Error(err.Error())
-			//}
-			return "会话创建成功", session.Uuid, 0
-		} else {
-			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, "", -1
+	var sessionId string
+	err := myredis.GetOrLoad(myredis.SessionCache, myredis.SessionCache.Key(req.SendId, req.ReceiveId), &sessionId, func() (interface{}, []string, error) {
+		var session model.Session
+		if res := dao.GormDB.Where("send_id = ? and receive_id = ?", req.SendId, req.ReceiveId).First(&session); res.Error != nil {
+			return nil, nil, res.Error
 		}
+		tags := []string{myredis.SessionTag(req.SendId)}
+		// 退群、被踢和解散群聊时按群标签失效
+		if len(req.ReceiveId) > 0 && req.ReceiveId[0] == 'G' {
+			tags = append(tags, myredis.GroupTag(req.ReceiveId))
+		}
+		return session.Uuid, tags, nil
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		zlog.Info("会话没有找到，将新建会话")
+		createReq := request.CreateSessionRequest{
+			SendId:    req.SendId,
+			ReceiveId: req.ReceiveId,
+		}
+		return s.CreateSession(createReq)
 	}
-	var session model.Session
-	if err := json.Unmarshal([]byte(rspString), &session); err != nil {
+	if err != nil {
 		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, "", -1
 	}
-	return "会话创建成功", session.Uuid, 0
+	return "会话创建成功", sessionId, 0
 }
 
 // GetUserSessionList 获取用户会话列表
 func (s *sessionService) GetUserSessionList(ownerId string) (string, []respond.UserSessionListRespond, int) {
-	rspString, err := myredis.GetKeyNilIsErr("session_list_" + ownerId)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			var sessionList []model.Session
-			if res := dao.GormDB.Order("created_at DESC").Where("send_id = ?", ownerId).Find(&sessionList); res.Error != nil {
-				if errors.Is(res.Error, gorm.ErrRecordNotFound) {
-					zlog.Info("未创建用户会话")
-					return "未创建用户会话", nil, 0
-				} else {
-					zlog.Error(res.Error.Error())
-					return constants.SYSTEM_ERROR, nil, -1
-				}
-			}
-			var sessionListRsp []respond.UserSessionListRespond
-			// 使用map进行去重，确保每个用户只保留最新的会话记录
-			userSessionMap := make(map[string]respond.UserSessionListRespond)
-			for i := 0; i < len(sessionList); i++ {
-				if sessionList[i].ReceiveId[0] == 'U' {
-					// 如果该用户还没有会话记录，或者当前会话更新，则更新记录
-					if _, exists := userSessionMap[sessionList[i].ReceiveId]; !exists {
-						userSessionMap[sessionList[i].ReceiveId] = respond.UserSessionListRespond{
-							SessionId: sessionList[i].Uuid,
-							Avatar:    sessionList[i].Avatar,
-							UserId:    sessionList[i].ReceiveId,
-							Username:  sessionList[i].ReceiveName,
-						}
-					}
-				}
-			}
-			// 将map转换为slice
-			for _, session := range userSessionMap {
-				sessionListRsp = append(sessionListRsp, session)
-			}
-			rspString, err := json.Marshal(sessionListRsp)
-			if err != nil {
-				zlog.Error(err.Error())
-			}
-			if err := myredis.SetKeyEx("session_list_"+ownerId, string(rspString), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-				zlog.Error(err.Error())
+	var rsp []respond.UserSessionListRespond
+	err := myredis.GetOrLoad(myredis.SessionListCache, myredis.SessionListCache.Key(ownerId), &rsp, func() (interface{}, []string, error) {
+		var sessionList []model.Session
+		if res := dao.GormDB.Order("created_at DESC").Where("send_id = ?", ownerId).Find(&sessionList); res.Error != nil {
+			return nil, nil, res.Error
+		}
+		var sessionListRsp []respond.UserSessionListRespond
+		// 会话中冗余了对方的昵称和头像，打上对方的标签，对方资料变化时一起失效
+		tags := []string{myredis.UserTag(ownerId)}
+		// 按置顶、最近消息排序后去重，确保每个用户只保留排在最前的会话记录，归档的会话排在最后
+		userSessionSet := make(map[string]bool)
+		for _, session := range sortSessions(sessionList) {
+			if session.ReceiveId[0] == 'U' && !userSessionSet[session.ReceiveId] {
+				userSessionSet[session.ReceiveId] = true
+				tags = append(tags, myredis.UserTag(session.ReceiveId))
+				sessionListRsp = append(sessionListRsp, respond.UserSessionListRespond{
+					SessionId:     session.Uuid,
+					Avatar:        session.Avatar,
+					UserId:        session.ReceiveId,
+					Username:      session.ReceiveName,
+					LastMessage:   session.LastMessage,
+					LastMessageAt: formatLastMessageAt(session),
+					IsPinned:      session.IsPinned == 1,
+					IsArchived:    session.IsArchived == 1,
+					MuteUntil:     formatMuteUntil(session),
+				})
 			}
-			return "获取成功", sessionListRsp, 0
-		} else {
-			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, nil, -1
 		}
-	}
-	var rsp []respond.UserSessionListRespond
-	if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
+		return sessionListRsp, tags, nil
+	})
+	if err != nil {
 		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
 	}
 	return "获取成功", rsp, 0
 }
 
 // GetGroupSessionList 获取群聊会话列表
 func (s *sessionService) GetGroupSessionList(ownerId string) (string, []respond.GroupSessionListRespond, int) {
-	rspString, err := myredis.GetKeyNilIsErr("group_session_list_" + ownerId)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			var sessionList []model.Session
-			if res := dao.GormDB.Order("created_at DESC").Where("send_id = ?", ownerId).Find(&sessionList); res.Error != nil {
-				if errors.Is(res.Error, gorm.ErrRecordNotFound) {
-					zlog.Info("未创建群聊会话")
-					return "未创建群聊会话", nil, 0
-				} else {
-					zlog.Error(res.Error.Error())
-					return constants.SYSTEM_ERROR, nil, -1
-				}
-			}
-			var sessionListRsp []respond.GroupSessionListRespond
-			// 使用map进行去重，确保每个群聊只保留最新的会话记录
-			groupSessionMap := make(map[string]respond.GroupSessionListRespond)
-			for i := 0; i < len(sessionList); i++ {
-				if sessionList[i].ReceiveId[0] == 'G' {
-					// 如果该群聊还没有会话记录，或者当前会话更新，则更新记录
-					if _, exists := groupSessionMap[sessionList[i].ReceiveId]; !exists {
-						groupSessionMap[sessionList[i].ReceiveId] = respond.GroupSessionListRespond{
-							SessionId: sessionList[i].Uuid,
-							Avatar:    sessionList[i].Avatar,
-							GroupId:   sessionList[i].ReceiveId,
-							GroupName: sessionList[i].ReceiveName,
-						}
-					}
-				}
-			}
-			// 将map转换为slice
-			for _, session := range groupSessionMap {
-				sessionListRsp = append(sessionListRsp, session)
-			}
-			rspString, err := json.Marshal(sessionListRsp)
-			if err != nil {
-				zlog.Error(err.Error())
-			}
-			if err := myredis.SetKeyEx("group_session_list_"+ownerId, string(rspString), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-				zlog.Error(err.Error())
+	var rsp []respond.GroupSessionListRespond
+	err := myredis.GetOrLoad(myredis.GroupSessionListCache, myredis.GroupSessionListCache.Key(ownerId), &rsp, func() (interface{}, []string, error) {
+		var sessionList []model.Session
+		if res := dao.GormDB.Order("created_at DESC").Where("send_id = ?", ownerId).Find(&sessionList); res.Error != nil {
+			return nil, nil, res.Error
+		}
+		var sessionListRsp []respond.GroupSessionListRespond
+		// 打上每个群聊的标签，群信息变化或解散时一起失效
+		tags := []string{myredis.UserTag(ownerId)}
+		// 按置顶、最近消息排序后去重，确保每个群聊只保留排在最前的会话记录，归档的会话排在最后
+		groupSessionSet := make(map[string]bool)
+		for _, session := range sortSessions(sessionList) {
+			if session.ReceiveId[0] == 'G' && !groupSessionSet[session.ReceiveId] {
+				groupSessionSet[session.ReceiveId] = true
+				tags = append(tags, myredis.GroupTag(session.ReceiveId))
+				sessionListRsp = append(sessionListRsp, respond.GroupSessionListRespond{
+					SessionId:     session.Uuid,
+					Avatar:        session.Avatar,
+					GroupId:       session.ReceiveId,
+					GroupName:     session.ReceiveName,
+					LastMessage:   session.LastMessage,
+					LastMessageAt: formatLastMessageAt(session),
+					IsPinned:      session.IsPinned == 1,
+					IsArchived:    session.IsArchived == 1,
+					MuteUntil:     formatMuteUntil(session),
+				})
 			}
-			return "获取成功", sessionListRsp, 0
-		} else {
-			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, nil, -1
 		}
-	}
-	var rsp []respond.GroupSessionListRespond
-	if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
+		return sessionListRsp, tags, nil
+	})
+	if err != nil {
 		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
 	}
 	return "获取成功", rsp, 0
 }
@@ -276,14 +248,251 @@ func (s *sessionService) DeleteSession(ownerId, sessionId string) (string, int)
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
-	//if err := myredis.DelKeysWithSuffix(sessionId); err != nil {
-	//	zlog.Error(err.Error())
-	//}
-	if err := myredis.DelKeysWithPattern("group_session_list_" + ownerId); err != nil {
+	invalidateSessionLists(ownerId)
+	return "删除成功", 0
+}
+
+// invalidateSessionLists 会话增删或设置变化后，删除这些用户的单聊和群聊会话列表缓存，以及打开会话时缓存的会话id
+func invalidateSessionLists(userIds ...string) {
+	var keys, tags []string
+	for _, userId := range userIds {
+		keys = append(keys, myredis.SessionListCache.Key(userId), myredis.GroupSessionListCache.Key(userId))
+		tags = append(tags, myredis.SessionTag(userId))
+	}
+	if err := myredis.Invalidate(keys...); err != nil {
 		zlog.Error(err.Error())
 	}
-	if err := myredis.DelKeysWithPattern("session_list_" + ownerId); err != nil {
+	if err := myredis.InvalidateTags(tags...); err != nil {
 		zlog.Error(err.Error())
 	}
-	return "删除成功", 0
+}
+
+// sortSessions 会话排序：未归档在前，置顶在前且按置顶时间倒序，其余按最近消息时间倒序，没有消息的按创建时间倒序
+func sortSessions(sessionList []model.Session) []model.Session {
+	sort.SliceStable(sessionList, func(i, j int) bool {
+		a, b := sessionList[i], sessionList[j]
+		if a.IsArchived != b.IsArchived {
+			return a.IsArchived < b.IsArchived
+		}
+		if a.IsPinned != b.IsPinned {
+			return a.IsPinned > b.IsPinned
+		}
+		if a.IsPinned == 1 && !a.PinnedAt.Time.Equal(b.PinnedAt.Time) {
+			return a.PinnedAt.Time.After(b.PinnedAt.Time)
+		}
+		return sessionActiveAt(a).After(sessionActiveAt(b))
+	})
+	return sessionList
+}
+
+// sessionActiveAt 会话最近活跃时间
+func sessionActiveAt(session model.Session) time.Time {
+	if session.LastMessageAt.Valid {
+		return session.LastMessageAt.Time
+	}
+	return session.CreatedAt
+}
+
+// formatLastMessageAt 格式化最新消息时间，没有消息时为空
+func formatLastMessageAt(session model.Session) string {
+	if !session.LastMessageAt.Valid {
+		return ""
+	}
+	return session.LastMessageAt.Time.Format("2006-01-02 15:04:05")
+}
+
+// formatMuteUntil 格式化免打扰截止时间，已过期的视为未开启
+func formatMuteUntil(session model.Session) string {
+	if !session.MuteUntil.Valid || session.MuteUntil.Time.Before(time.Now()) {
+		return ""
+	}
+	return session.MuteUntil.Time.Format("2006-01-02 15:04:05")
+}
+
+// UpdateSessionPreference 更新会话的免打扰、置顶和归档设置，只能修改自己的会话
+func (s *sessionService) UpdateSessionPreference(req request.UpdateSessionPreferenceRequest) (string, int) {
+	var session model.Session
+	if res := dao.GormDB.First(&session, "uuid = ?", req.SessionId); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "会话不存在", -2
+		}
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if session.SendId != req.OwnerId {
+		return "无权修改该会话", -2
+	}
+	if req.MuteMinutes != nil {
+		switch {
+		case *req.MuteMinutes == 0:
+			session.MuteUntil = sql.NullTime{}
+		case *req.MuteMinutes == -1:
+			session.MuteUntil = sql.NullTime{Time: muteForever, Valid: true}
+		case *req.MuteMinutes > 0:
+			session.MuteUntil = sql.NullTime{Time: time.Now().Add(time.Duration(*req.MuteMinutes) * time.Minute), Valid: true}
+		default:
+			return "免打扰时长不合法", -2
+		}
+	}
+	if req.IsPinned != nil {
+		if *req.IsPinned {
+			if session.IsPinned == 0 {
+				session.IsPinned = 1
+				session.PinnedAt = sql.NullTime{Time: time.Now(), Valid: true}
+			}
+		} else {
+			session.IsPinned = 0
+			session.PinnedAt = sql.NullTime{}
+		}
+	}
+	if req.IsArchived != nil {
+		session.IsArchived = 0
+		if *req.IsArchived {
+			session.IsArchived = 1
+		}
+	}
+	if res := dao.GormDB.Save(&session); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	invalidateSessionLists(req.OwnerId)
+	return "更新会话设置成功", 0
+}
+
+// UpdateLastMessage 新消息到达后更新所有参与者会话的最新消息，接收者还没有会话时自动创建
+// 单聊participants为收发双方，群聊为群成员，返回每个参与者更新后的会话
+func (s *sessionService) UpdateLastMessage(message model.Message, participants []string, lastMessage string) (map[string]model.Session, error) {
+	isGroup := message.ReceiveId[0] == 'G'
+	// 每个参与者会话的对象，单聊是对方，群聊是群
+	targetOf := func(userId string) string {
+		if isGroup {
+			return message.ReceiveId
+		}
+		if userId == message.SendId {
+			return message.ReceiveId
+		}
+		return message.SendId
+	}
+	findSessions := func() (map[string]model.Session, error) {
+		var sessionList []model.Session
+		query := dao.GormDB.Where("receive_id = ? AND send_id IN ?", message.ReceiveId, participants)
+		if !isGroup {
+			query = dao.GormDB.Where("(send_id = ? AND receive_id = ?) OR (send_id = ? AND receive_id = ?)",
+				message.SendId, message.ReceiveId, message.ReceiveId, message.SendId)
+		}
+		if res := query.Find(&sessionList); res.Error != nil {
+			return nil, res.Error
+		}
+		sessions := make(map[string]model.Session)
+		for _, session := range sessionList {
+			sessions[session.SendId] = session
+		}
+		return sessions, nil
+	}
+	sessions, err := findSessions()
+	if err != nil {
+		return nil, err
+	}
+	var sessionIds []int64
+	for _, session := range sessions {
+		sessionIds = append(sessionIds, session.Id)
+	}
+	// 只有比当前记录更新的消息才覆盖，避免并发处理时旧消息覆盖新消息
+	if len(sessionIds) > 0 {
+		if res := dao.GormDB.Model(&model.Session{}).
+			Where("id IN ? AND (last_message_at IS NULL OR last_message_at <= ?)", sessionIds, message.CreatedAt).
+			Updates(map[string]interface{}{
+				"last_message":    lastMessage,
+				"last_message_at": message.CreatedAt,
+			}); res.Error != nil {
+			return nil, res.Error
+		}
+	}
+
+	var missing []string
+	for _, userId := range participants {
+		if _, ok := sessions[userId]; !ok {
+			missing = append(missing, userId)
+		}
+	}
+	if len(missing) > 0 {
+		names, avatars, err := s.sessionTargetInfo(message, isGroup, missing, targetOf)
+		if err != nil {
+			return nil, err
+		}
+		var newSessions []model.Session
+		for _, userId := range missing {
+			target := targetOf(userId)
+			newSessions = append(newSessions, model.Session{
+				Uuid:          fmt.Sprintf("S%s", random.GetNowAndLenRandomString(11)),
+				SendId:        userId,
+				ReceiveId:     target,
+				ReceiveName:   names[target],
+				Avatar:        avatars[target],
+				LastMessage:   lastMessage,
+				LastMessageAt: sql.NullTime{Time: message.CreatedAt, Valid: true},
+				CreatedAt:     time.Now(),
+			})
+		}
+		// 被删除的会话仍占着唯一索引，冲突时恢复原记录，最新消息只在更新时覆盖
+		if res := dao.GormDB.Clauses(clause.OnConflict{
+			DoUpdates: clause.Set{
+				{Column: clause.Column{Name: "deleted_at"}, Value: nil},
+				{Column: clause.Column{Name: "last_message"}, Value: gorm.Expr(
+					"IF(last_message_at IS NULL OR last_message_at <= VALUES(last_message_at), VALUES(last_message), last_message)")},
+				{Column: clause.Column{Name: "last_message_at"}, Value: gorm.Expr(
+					"IF(last_message_at IS NULL OR last_message_at <= VALUES(last_message_at), VALUES(last_message_at), last_message_at)")},
+			},
+		}).Create(&newSessions); res.Error != nil {
+			return nil, res.Error
+		}
+		// 恢复的记录保留原来的uuid，以数据库为准
+		if sessions, err = findSessions(); err != nil {
+			return nil, err
+		}
+	}
+
+	for userId, session := range sessions {
+		if !session.LastMessageAt.Valid || !session.LastMessageAt.Time.After(message.CreatedAt) {
+			session.LastMessage = lastMessage
+			session.LastMessageAt = sql.NullTime{Time: message.CreatedAt, Valid: true}
+			sessions[userId] = session
+		}
+		cacheKey := myredis.SessionListCache.Key(userId)
+		if isGroup {
+			cacheKey = myredis.GroupSessionListCache.Key(userId)
+		}
+		if err := myredis.Invalidate(cacheKey); err != nil {
+			zlog.Error(err.Error())
+		}
+	}
+	return sessions, nil
+}
+
+// sessionTargetInfo 查询新建会话需要的名称和头像，单聊为对方用户，群聊为群
+func (s *sessionService) sessionTargetInfo(message model.Message, isGroup bool, userIds []string, targetOf func(string) string) (map[string]string, map[string]string, error) {
+	names := make(map[string]string)
+	avatars := make(map[string]string)
+	if isGroup {
+		var group model.GroupInfo
+		if res := dao.GormDB.First(&group, "uuid = ?", message.ReceiveId); res.Error != nil {
+			return nil, nil, res.Error
+		}
+		names[group.Uuid] = group.Name
+		avatars[group.Uuid] = group.Avatar
+		return names, avatars, nil
+	}
+	var targetIds []string
+	for _, userId := range userIds {
+		targetIds = append(targetIds, targetOf(userId))
+	}
+	var userList []model.UserInfo
+	if res := dao.GormDB.Where("uuid IN ?", targetIds).Find(&userList); res.Error != nil {
+		return nil, nil, res.Error
+	}
+	for _, user := range userList {
+		names[user.Uuid] = user.Nickname
+		avatars[user.Uuid] = user.Avatar
+	}
+	return names, avatars, nil
 }
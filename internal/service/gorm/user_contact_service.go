@@ -1,21 +1,17 @@
 package gorm
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/go-redis/redis/v8"
-	"github.com/segmentio/kafka-go"
 	"gorm.io/gorm"
-	"kama_chat_server/internal/config"
 	"kama_chat_server/internal/dao"
 	"kama_chat_server/internal/dto/request"
 	"kama_chat_server/internal/dto/respond"
 	"kama_chat_server/internal/model"
 	myredis "kama_chat_server/internal/service/redis"
-	myKafka "kama_chat_server/internal/service/kafka"
 	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/enum/audit_log/audit_action_enum"
 	"kama_chat_server/pkg/enum/contact/contact_status_enum"
 	"kama_chat_server/pkg/enum/contact/contact_type_enum"
 	"kama_chat_server/pkg/enum/contact_apply/contact_apply_status_enum"
@@ -35,205 +31,81 @@ var UserContactService = new(userContactService)
 // GetUserList 获取用户列表
 // 关于用户被禁用的问题，这里查到的是所有联系人，如果被禁用或被拉黑会以弹窗的形式提醒，无法打开会话框；如果被删除，是搜索不到该联系人的。
 func (u *userContactService) GetUserList(ownerId string) (string, []respond.MyUserListRespond, int) {
-	rspString, err := myredis.GetKeyNilIsErr("contact_user_list_" + ownerId)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-
-			// dao
-			var contactList []model.UserContact
-			// 没有被删除
-			if res := dao.GormDB.Order("created_at DESC").Where("user_id = ? AND status != 4", ownerId).Find(&contactList); res.Error != nil {
-				// 不存在不是业务问题，用Info，return 0
-				if errors.Is(res.Error, gorm.ErrRecordNotFound) {
-					message := "目前不存在联系人"
-					zlog.Info(message)
-					return message, nil, 0
-				} else {
-					zlog.Error(res.Error.Error())
-					return constants.SYSTEM_ERROR, nil, -1
-				}
-			}
-			// dto
-			var userListRsp []respond.MyUserListRespond
-			for _, contact := range contactList {
-				// 联系人中是用户的
-				if contact.ContactType == contact_type_enum.USER {
-					// 获取用户信息
-					var user model.UserInfo
-					if res := dao.GormDB.First(&user, "uuid = ?", contact.ContactId); res.Error != nil {
-						// 肯定是存在的，不可能无缘无故删掉，目前不用加notfound的判断
-						zlog.Error(res.Error.Error())
-						return constants.SYSTEM_ERROR, nil, -1
-					}
-					userListRsp = append(userListRsp, respond.MyUserListRespond{
-						UserId:   user.Uuid,
-						UserName: user.Nickname,
-						Avatar:   user.Avatar,
-					})
-				}
-			}
-			rspString, err := json.Marshal(userListRsp)
-			if err != nil {
-				zlog.Error(err.Error())
-			}
-			if err := myredis.SetKeyEx("contact_user_list_"+ownerId, string(rspString), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-				zlog.Error(err.Error())
-			}
-			return "获取用户列表成功", userListRsp, 0
-		} else {
-			zlog.Error(err.Error())
-			// Redis连接失败时，直接从数据库查询
-			var contactList []model.UserContact
-			if res := dao.GormDB.Order("created_at DESC").Where("user_id = ? AND status != 4", ownerId).Find(&contactList); res.Error != nil {
-				if errors.Is(res.Error, gorm.ErrRecordNotFound) {
-					message := "目前不存在联系人"
-					zlog.Info(message)
-					return message, nil, 0
-				} else {
-					zlog.Error(res.Error.Error())
-					return constants.SYSTEM_ERROR, nil, -1
-				}
-			}
-			var userListRsp []respond.MyUserListRespond
-			for _, contact := range contactList {
-				if contact.ContactType == contact_type_enum.USER {
-					var user model.UserInfo
-					if res := dao.GormDB.First(&user, "uuid = ?", contact.ContactId); res.Error != nil {
-						zlog.Error(res.Error.Error())
-						return constants.SYSTEM_ERROR, nil, -1
-					}
-					userListRsp = append(userListRsp, respond.MyUserListRespond{
-						UserId:   user.Uuid,
-						UserName: user.Nickname,
-						Avatar:   user.Avatar,
-					})
+	var rsp []respond.MyUserListRespond
+	err := myredis.GetOrLoad(myredis.ContactUserListCache, myredis.ContactUserListCache.Key(ownerId), &rsp, func() (interface{}, []string, error) {
+		var contactList []model.UserContact
+		// 没有被删除
+		if res := dao.GormDB.Order("created_at DESC").Where("user_id = ? AND status != 4", ownerId).Find(&contactList); res.Error != nil {
+			return nil, nil, res.Error
+		}
+		var userListRsp []respond.MyUserListRespond
+		// 列表中冗余了联系人的昵称和头像，打上联系人的标签，联系人资料变化时一起失效
+		tags := []string{myredis.UserTag(ownerId)}
+		for _, contact := range contactList {
+			// 联系人中是用户的
+			if contact.ContactType == contact_type_enum.USER {
+				// 获取用户信息
+				var user model.UserInfo
+				if res := dao.GormDB.First(&user, "uuid = ?", contact.ContactId); res.Error != nil {
+					// 肯定是存在的，不可能无缘无故删掉，目前不用加notfound的判断
+					return nil, nil, res.Error
 				}
+				tags = append(tags, myredis.UserTag(user.Uuid))
+				userListRsp = append(userListRsp, respond.MyUserListRespond{
+					UserId:   user.Uuid,
+					UserName: user.Nickname,
+					Avatar:   user.Avatar,
+				})
 			}
-			return "获取用户列表成功", userListRsp, 0
 		}
-	}
-	var rsp []respond.MyUserListRespond
-	if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
+		return userListRsp, tags, nil
+	})
+	if err != nil {
 		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
 	}
 	return "获取用户列表成功", rsp, 0
 }
 
 // LoadMyJoinedGroup 获取我加入的群聊
-func (u *userContactService) LoadMyJoinedGroup(ownerId string) (string, interface{}, int) {
-	// 检查是否启用异步模式
-	kafkaConfig := config.GetConfig().KafkaConfig
-	if kafkaConfig.MessageMode == "async" {
-		return u.asyncLoadMyJoinedGroup(ownerId)
-	}
-	return u.syncLoadMyJoinedGroup(ownerId)
-}
-
-// syncLoadMyJoinedGroup 同步加载我加入的群聊
-func (u *userContactService) syncLoadMyJoinedGroup(ownerId string) (string, []respond.LoadMyJoinedGroupRespond, int) {
-	rspString, err := myredis.GetKeyNilIsErr("my_joined_group_list_" + ownerId)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			var contactList []model.UserContact
-			// 没有退群，也没有被踢出群聊
-			if res := dao.GormDB.Order("created_at DESC").Where("user_id = ? AND status != 6 AND status != 7", ownerId).Find(&contactList); res.Error != nil {
-				// 不存在不是业务问题，用Info，return 0
-				if errors.Is(res.Error, gorm.ErrRecordNotFound) {
-					message := "目前不存在加入的群聊"
-					zlog.Info(message)
-					return message, nil, 0
-				} else {
-					zlog.Error(res.Error.Error())
-					return constants.SYSTEM_ERROR, nil, -1
+func (u *userContactService) LoadMyJoinedGroup(ownerId string) (string, []respond.LoadMyJoinedGroupRespond, int) {
+	var rsp []respond.LoadMyJoinedGroupRespond
+	err := myredis.GetOrLoad(myredis.MyJoinedGroupListCache, myredis.MyJoinedGroupListCache.Key(ownerId), &rsp, func() (interface{}, []string, error) {
+		var contactList []model.UserContact
+		// 没有退群，也没有被踢出群聊
+		if res := dao.GormDB.Order("created_at DESC").Where("user_id = ? AND status != 6 AND status != 7", ownerId).Find(&contactList); res.Error != nil {
+			return nil, nil, res.Error
+		}
+		var groupListRsp []respond.LoadMyJoinedGroupRespond
+		tags := []string{myredis.UserTag(ownerId)}
+		for _, contact := range contactList {
+			if contact.ContactId[0] == 'G' {
+				// 获取群聊信息
+				var group model.GroupInfo
+				if res := dao.GormDB.First(&group, "uuid = ?", contact.ContactId); res.Error != nil {
+					return nil, nil, res.Error
 				}
-			}
-			var groupList []model.GroupInfo
-			for _, contact := range contactList {
-				if contact.ContactId[0] == 'G' {
-					// 获取群聊信息
-					var group model.GroupInfo
-					if res := dao.GormDB.First(&group, "uuid = ?", contact.ContactId); res.Error != nil {
-						zlog.Error(res.Error.Error())
-						return constants.SYSTEM_ERROR, nil, -1
-					}
-					// 群没被删除，同时群主不是自己
-					// 群主删除或admin删除群聊，status为7，即被踢出群聊，所以不用判断群是否被删除，删除了到不了这步
-					if group.OwnerId != ownerId {
-						groupList = append(groupList, group)
-					}
+				// 群没被删除，同时群主不是自己
+				// 群主删除或admin删除群聊，status为7，即被踢出群聊，所以不用判断群是否被删除，删除了到不了这步
+				if group.OwnerId != ownerId {
+					tags = append(tags, myredis.GroupTag(group.Uuid))
+					groupListRsp = append(groupListRsp, respond.LoadMyJoinedGroupRespond{
+						GroupId:   group.Uuid,
+						GroupName: group.Name,
+						Avatar:    group.Avatar,
+					})
 				}
 			}
-			var groupListRsp []respond.LoadMyJoinedGroupRespond
-			for _, group := range groupList {
-				groupListRsp = append(groupListRsp, respond.LoadMyJoinedGroupRespond{
-					GroupId:   group.Uuid,
-					GroupName: group.Name,
-					Avatar:    group.Avatar,
-				})
-			}
-			rspString, err := json.Marshal(groupListRsp)
-			if err != nil {
-				zlog.Error(err.Error())
-			}
-			if err := myredis.SetKeyEx("my_joined_group_list_"+ownerId, string(rspString), time.Minute*constants.REDIS_TIMEOUT); err != nil {
-				zlog.Error(err.Error())
-			}
-			return "获取加入群成功", groupListRsp, 0
-		} else {
-			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, nil, -1
 		}
-	}
-	var rsp []respond.LoadMyJoinedGroupRespond
-	if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
+		return groupListRsp, tags, nil
+	})
+	if err != nil {
 		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
 	}
 	return "获取加入群成功", rsp, 0
 }
 
-// asyncLoadMyJoinedGroup 异步加载我加入的群聊
-func (u *userContactService) asyncLoadMyJoinedGroup(ownerId string) (string, interface{}, int) {
-	// 生成唯一任务ID
-	taskId := random.GetNowAndLenRandomString(16)
-	
-	// 创建异步任务请求
-	asyncTask := request.AsyncTaskRequest{
-		TaskType: "load_joined_group_list",
-		TaskId:   taskId,
-		ClientId: ownerId, // 使用ownerId作为clientId
-		UserId:   ownerId,
-		Parameters: request.JoinedGroupListTaskParams{
-			OwnerId: ownerId,
-		},
-	}
-	
-	// 序列化任务请求
-	taskData, err := json.Marshal(asyncTask)
-	if err != nil {
-		zlog.Error("Failed to marshal async task: " + err.Error())
-		// 如果序列化失败，回退到同步处理
-		return u.syncLoadMyJoinedGroup(ownerId)
-	}
-	
-	// 发送到Kafka异步任务队列
-	err = myKafka.KafkaService.AsyncTaskWriter.WriteMessages(context.Background(), kafka.Message{
-		Key:   []byte(taskId),
-		Value: taskData,
-	})
-	if err != nil {
-		zlog.Error("Failed to send async task to Kafka: " + err.Error())
-		// 如果发送失败，回退到同步处理
-		return u.syncLoadMyJoinedGroup(ownerId)
-	}
-	
-	// 返回异步加载响应
-	return "正在加载加入的群聊列表...", respond.AsyncLoadingRespond{
-		Loading: true,
-		TaskId:  taskId,
-		Message: "正在加载加入的群聊列表，请稍候...",
-	}, 0
-}
-
 // GetContactInfo 获取联系人信息
 // 调用这个接口的前提是该联系人没有处在删除或被删除，或者该用户还在群聊中
 // redis todo
@@ -285,8 +157,43 @@ func (u *userContactService) GetContactInfo(contactId string) (string, respond.G
 	}
 }
 
+// GetContactStatus 获取ownerId对contactId的联系状态，消息落库前校验好友关系、拉黑和群成员身份
+// 删除好友、退群、被移出群聊都会软删除联系记录，查不到时返回-2
+func (u *userContactService) GetContactStatus(ownerId, contactId string) (string, int8, int) {
+	var contact model.UserContact
+	if res := dao.GormDB.Select("status").Where("user_id = ? AND contact_id = ?", ownerId, contactId).First(&contact); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "联系人不存在", -1, -2
+		}
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1, -1
+	}
+	return "获取联系状态成功", contact.Status, 0
+}
+
+// contactSnapshot 审计日志中双方联系人关系的快照
+func (u *userContactService) contactSnapshot(ownerId, contactId string) map[string]interface{} {
+	snapshot := make(map[string]interface{})
+	var contactList []model.UserContact
+	if res := dao.GormDB.Where("(user_id = ? AND contact_id = ?) OR (user_id = ? AND contact_id = ?)",
+		ownerId, contactId, contactId, ownerId).Find(&contactList); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return snapshot
+	}
+	for _, contact := range contactList {
+		if contact.UserId == ownerId {
+			snapshot["status"] = contact.Status
+		} else {
+			snapshot["contact_status"] = contact.Status
+		}
+	}
+	return snapshot
+}
+
 // DeleteContact 删除联系人（只包含用户）
-func (u *userContactService) DeleteContact(ownerId, contactId string) (string, int) {
+func (u *userContactService) DeleteContact(op Operator, contactId string) (string, int) {
+	ownerId := op.Uuid
+	before := u.contactSnapshot(ownerId, contactId)
 	// status改变为删除
 	var deletedAt gorm.DeletedAt
 	deletedAt.Time = time.Now()
@@ -325,9 +232,14 @@ func (u *userContactService) DeleteContact(ownerId, contactId string) (string, i
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
-	if err := myredis.DelKeysWithPattern("contact_user_list_" + ownerId); err != nil {
+	if err := myredis.Invalidate(myredis.ContactUserListCache.Key(ownerId), myredis.ContactUserListCache.Key(contactId)); err != nil {
 		zlog.Error(err.Error())
 	}
+	invalidateSessionLists(ownerId, contactId)
+	recordAudit(op, audit_action_enum.DELETE_CONTACT, contactId, before, map[string]interface{}{
+		"status":         contact_status_enum.DELETE,
+		"contact_status": contact_status_enum.BE_DELETE,
+	})
 	return "删除联系人成功", 0
 }
 
@@ -506,13 +418,16 @@ func (u *userContactService) GetAddGroupList(groupId string) (string, []respond.
 }
 
 // PassContactApply 通过联系人申请
-func (u *userContactService) PassContactApply(ownerId string, contactId string) (string, int) {
+func (u *userContactService) PassContactApply(op Operator, contactId string) (string, int) {
 	// ownerId 如果是用户的话就是登录用户，如果是群聊的话就是群聊id
+	ownerId := op.Uuid
 	var contactApply model.ContactApply
 	if res := dao.GormDB.Where("contact_id = ? AND user_id = ?", ownerId, contactId).First(&contactApply); res.Error != nil {
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
+	before := map[string]interface{}{"apply_status": contactApply.Status}
+	after := map[string]interface{}{"apply_status": contact_apply_status_enum.AGREE}
 	if ownerId[0] == 'U' {
 		var user model.UserInfo
 		if res := dao.GormDB.Where("uuid = ?", contactId).Find(&user); res.Error != nil {
@@ -551,9 +466,10 @@ func (u *userContactService) PassContactApply(ownerId string, contactId string)
 			zlog.Error(res.Error.Error())
 			return constants.SYSTEM_ERROR, -1
 		}
-		if err := myredis.DelKeysWithPattern("contact_user_list_" + ownerId); err != nil {
+		if err := myredis.Invalidate(myredis.ContactUserListCache.Key(ownerId), myredis.ContactUserListCache.Key(contactId)); err != nil {
 			zlog.Error(err.Error())
 		}
+		recordAudit(op, audit_action_enum.PASS_CONTACT_APPLY, contactId, before, after)
 		return "已添加该联系人", 0
 	} else {
 		var group model.GroupInfo
@@ -594,26 +510,35 @@ func (u *userContactService) PassContactApply(ownerId string, contactId string)
 			zlog.Error(res.Error.Error())
 			return constants.SYSTEM_ERROR, -1
 		}
-		if err := myredis.DelKeysWithPattern("my_joined_group_list_" + ownerId); err != nil {
+		// ownerId是群聊id，加入的群聊列表属于申请人contactId，群成员变化同时失效群相关缓存
+		if err := myredis.Invalidate(myredis.MyJoinedGroupListCache.Key(contactId)); err != nil {
+			zlog.Error(err.Error())
+		}
+		if err := myredis.InvalidateTags(myredis.GroupTag(ownerId)); err != nil {
 			zlog.Error(err.Error())
 		}
+		recordAudit(op, audit_action_enum.PASS_CONTACT_APPLY, contactId, before, after)
 		return "已通过加群申请", 0
 	}
 }
 
 // RefuseContactApply 拒绝联系人申请
-func (u *userContactService) RefuseContactApply(ownerId string, contactId string) (string, int) {
+func (u *userContactService) RefuseContactApply(op Operator, contactId string) (string, int) {
 	// ownerId 如果是用户的话就是登录用户，如果是群聊的话就是群聊id
+	ownerId := op.Uuid
 	var contactApply model.ContactApply
 	if res := dao.GormDB.Where("contact_id = ? AND user_id = ?", ownerId, contactId).First(&contactApply); res.Error != nil {
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
+	before := contactApply.Status
 	contactApply.Status = contact_apply_status_enum.REFUSE
 	if res := dao.GormDB.Save(&contactApply); res.Error != nil {
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
+	recordAudit(op, audit_action_enum.REFUSE_CONTACT_APPLY, contactId,
+		map[string]interface{}{"apply_status": before}, map[string]interface{}{"apply_status": contactApply.Status})
 	if ownerId[0] == 'U' {
 		return "已拒绝该联系人申请", 0
 	} else {
@@ -623,7 +548,9 @@ func (u *userContactService) RefuseContactApply(ownerId string, contactId string
 }
 
 // BlackContact 拉黑联系人
-func (u *userContactService) BlackContact(ownerId string, contactId string) (string, int) {
+func (u *userContactService) BlackContact(op Operator, contactId string) (string, int) {
+	ownerId := op.Uuid
+	before := u.contactSnapshot(ownerId, contactId)
 	// 拉黑
 	if res := dao.GormDB.Model(&model.UserContact{}).Where("user_id = ? AND contact_id = ?", ownerId, contactId).Updates(map[string]interface{}{
 		"status":    contact_status_enum.BLACK,
@@ -648,11 +575,17 @@ func (u *userContactService) BlackContact(ownerId string, contactId string) (str
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
+	invalidateSessionLists(ownerId)
+	recordAudit(op, audit_action_enum.BLACK_CONTACT, contactId, before, map[string]interface{}{
+		"status":         contact_status_enum.BLACK,
+		"contact_status": contact_status_enum.BE_BLACK,
+	})
 	return "已拉黑该联系人", 0
 }
 
 // CancelBlackContact 取消拉黑联系人
-func (u *userContactService) CancelBlackContact(ownerId string, contactId string) (string, int) {
+func (u *userContactService) CancelBlackContact(op Operator, contactId string) (string, int) {
+	ownerId := op.Uuid
 	// 因为前端的设定，这里需要判断一下ownerId和contactId是不是有拉黑和被拉黑的状态
 	var blackContact model.UserContact
 	if res := dao.GormDB.Where("user_id = ? AND contact_id = ?", ownerId, contactId).First(&blackContact); res.Error != nil {
@@ -682,20 +615,30 @@ func (u *userContactService) CancelBlackContact(ownerId string, contactId string
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
+	recordAudit(op, audit_action_enum.CANCEL_BLACK_CONTACT, contactId, map[string]interface{}{
+		"status":         contact_status_enum.BLACK,
+		"contact_status": contact_status_enum.BE_BLACK,
+	}, map[string]interface{}{
+		"status":         blackContact.Status,
+		"contact_status": beBlackContact.Status,
+	})
 	return "已解除拉黑该联系人", 0
 }
 
 // BlackApply 拉黑申请
-func (u *userContactService) BlackApply(ownerId string, contactId string) (string, int) {
+func (u *userContactService) BlackApply(op Operator, contactId string) (string, int) {
 	var contactApply model.ContactApply
-	if res := dao.GormDB.Where("contact_id = ? AND user_id = ?", ownerId, contactId).First(&contactApply); res.Error != nil {
+	if res := dao.GormDB.Where("contact_id = ? AND user_id = ?", op.Uuid, contactId).First(&contactApply); res.Error != nil {
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
+	before := contactApply.Status
 	contactApply.Status = contact_apply_status_enum.BLACK
 	if res := dao.GormDB.Save(&contactApply); res.Error != nil {
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
+	recordAudit(op, audit_action_enum.BLACK_CONTACT_APPLY, contactId,
+		map[string]interface{}{"apply_status": before}, map[string]interface{}{"apply_status": contactApply.Status})
 	return "已拉黑该申请", 0
 }
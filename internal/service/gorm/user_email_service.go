@@ -0,0 +1,339 @@
+package gorm
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"kama_chat_server/internal/config"
+	"kama_chat_server/internal/dao"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/dto/respond"
+	"kama_chat_server/internal/model"
+	"kama_chat_server/internal/service/email"
+	myredis "kama_chat_server/internal/service/redis"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/util/random"
+	"kama_chat_server/pkg/zlog"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	emailCodePurposeVerify = "verify"
+	emailCodePurposeLogin  = "login"
+	emailSendTimeout       = 10 * time.Second
+	emailMaxLen            = 30 // 与user_info.email列宽一致
+)
+
+// MailSender 账号邮件的发送渠道，测试时可以替换为email.CaptureSender
+var MailSender = newMailSender()
+
+func newMailSender() email.Sender {
+	emailConfig := config.GetConfig().EmailConfig
+	if emailConfig.UseCaptureSender || emailConfig.SmtpHost == "" {
+		return email.NewCaptureSender()
+	}
+	return &email.SmtpSender{
+		Host:     emailConfig.SmtpHost,
+		Port:     emailConfig.SmtpPort,
+		Username: emailConfig.SmtpUsername,
+		Password: emailConfig.SmtpPassword,
+		From:     emailConfig.SmtpFrom,
+	}
+}
+
+var (
+	// emailResendLimit 同一邮箱一分钟内只能发一封
+	emailResendLimit = myredis.RateLimit{Name: "email_resend", Limit: 1, Window: time.Minute}
+	// emailHourLimit 同一邮箱每小时最多发送的邮件数
+	emailHourLimit = myredis.RateLimit{Name: "email_hour", Limit: 10, Window: time.Hour}
+	// emailCodeFailLimit 验证码输错次数达到上限后作废，需要重新获取
+	emailCodeFailLimit = myredis.RateLimit{Name: "email_code_fail", Limit: 5, Window: time.Hour}
+)
+
+func emailCodeKey(purpose, target string) string {
+	return "email_code_" + purpose + "_" + target
+}
+
+func passwordResetKey(tokenHash string) string {
+	return "password_reset_" + tokenHash
+}
+
+func passwordResetUserKey(uuid string) string {
+	return "password_reset_user_" + uuid
+}
+
+// sendMail 发送前检查该邮箱的发送频率
+func (u *userInfoService) sendMail(mail email.Mail) (string, int) {
+	for _, limit := range []myredis.RateLimit{emailResendLimit, emailHourLimit} {
+		allowed, wait, err := limit.Allow(mail.To)
+		if err != nil {
+			zlog.Error(err.Error())
+			return constants.SYSTEM_ERROR, -1
+		}
+		if !allowed {
+			return fmt.Sprintf("邮件发送过于频繁，请%d秒后再试", int(wait.Seconds())+1), -2
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), emailSendTimeout)
+	defer cancel()
+	if err := MailSender.Send(ctx, mail); err != nil {
+		zlog.Error("邮件发送失败: " + err.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if _, ok := MailSender.(*email.CaptureSender); ok {
+		// 只有捕获渠道才把邮件内容打到日志里，方便本地开发
+		zlog.Info("捕获邮件 " + mail.To + ": " + mail.Body)
+	}
+	return "邮件发送成功，请及时查收", 0
+}
+
+// sendEmailCode 生成验证码存入redis并发送，target为验证码归属，邮箱验证用uuid，邮箱登录用邮箱
+func (u *userInfoService) sendEmailCode(purpose, target, address string) (string, int) {
+	codeMinutes := config.GetConfig().EmailConfig.CodeMinutes
+	code := strconv.Itoa(random.GetRandomInt(6))
+	subject := "邮箱验证码"
+	body := fmt.Sprintf("您正在验证邮箱，验证码为%s，%d分钟内有效。如非本人操作请忽略。", code, codeMinutes)
+	if purpose == emailCodePurposeLogin {
+		subject = "登录验证码"
+		body = fmt.Sprintf("您正在使用邮箱登录，验证码为%s，%d分钟内有效。如非本人操作请忽略。", code, codeMinutes)
+	}
+	message, ret := u.sendMail(email.Mail{To: address, Subject: subject, Body: body})
+	if ret != 0 {
+		return message, ret
+	}
+	// 验证邮箱时把邮箱一起存下，发送后又改了邮箱的验证码作废
+	if err := myredis.SetKeyEx(emailCodeKey(purpose, target), address+":"+code, time.Duration(codeMinutes)*time.Minute); err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if err := emailCodeFailLimit.Reset(purpose, target); err != nil {
+		zlog.Error(err.Error())
+	}
+	return "验证码已发送到邮箱，请及时查收", 0
+}
+
+// checkEmailCode 校验验证码，通过后验证码立即作废，输错次数过多时也作废
+func (u *userInfoService) checkEmailCode(purpose, target, address, code string) (string, int) {
+	key := emailCodeKey(purpose, target)
+	stored, err := myredis.GetKey(key)
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if stored == "" {
+		return "验证码已过期或不存在", -2
+	}
+	if stored != address+":"+code {
+		allowed, _, err := emailCodeFailLimit.Allow(purpose, target)
+		if err != nil {
+			zlog.Error(err.Error())
+		}
+		if !allowed {
+			if err := myredis.DelKeyIfExists(key); err != nil {
+				zlog.Error(err.Error())
+			}
+			return "验证码错误次数过多，请重新获取", -2
+		}
+		return "验证码错误", -2
+	}
+	if err := myredis.DelKeyIfExists(key); err != nil {
+		zlog.Error(err.Error())
+	}
+	return "", 0
+}
+
+// checkEmailFormat 校验邮箱格式和长度
+func (u *userInfoService) checkEmailFormat(address string) (string, int) {
+	if !u.checkEmailValid(address) {
+		return "邮箱格式错误", -2
+	}
+	if utf8.RuneCountInString(address) > emailMaxLen {
+		return fmt.Sprintf("邮箱长度不能超过%d个字符", emailMaxLen), -2
+	}
+	return "", 0
+}
+
+// SendEmailVerifyCode 给用户当前填写的邮箱发送验证码
+func (u *userInfoService) SendEmailVerifyCode(uuid string) (string, int) {
+	var user model.UserInfo
+	if res := dao.GormDB.First(&user, "uuid = ?", uuid); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "用户不存在", -2
+		}
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if user.Email == "" {
+		return "请先填写邮箱", -2
+	}
+	if user.EmailVerified == 1 {
+		return "邮箱已验证，无需重复验证", -2
+	}
+	return u.sendEmailCode(emailCodePurposeVerify, user.Uuid, user.Email)
+}
+
+// VerifyEmail 校验邮箱验证码，通过后标记邮箱已验证，同一邮箱只能被一个账号验证
+func (u *userInfoService) VerifyEmail(req request.VerifyEmailRequest) (string, int) {
+	var user model.UserInfo
+	if res := dao.GormDB.First(&user, "uuid = ?", req.Uuid); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "用户不存在", -2
+		}
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if user.Email == "" {
+		return "请先填写邮箱", -2
+	}
+	if message, ret := u.checkEmailCode(emailCodePurposeVerify, user.Uuid, user.Email, req.Code); ret != 0 {
+		return message, ret
+	}
+	var count int64
+	if res := dao.GormDB.Model(&model.UserInfo{}).Where("email = ? AND email_verified = 1 AND uuid != ?", user.Email, user.Uuid).Count(&count); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if count > 0 {
+		return "该邮箱已被其他账号绑定", -2
+	}
+	if res := dao.GormDB.Model(&user).Update("email_verified", 1); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	invalidateUsers(user.Uuid)
+	return "邮箱验证成功", 0
+}
+
+// findUserByVerifiedEmail 按已验证的邮箱查找用户
+func (u *userInfoService) findUserByVerifiedEmail(address string) (*model.UserInfo, error) {
+	var user model.UserInfo
+	if res := dao.GormDB.First(&user, "email = ? AND email_verified = 1", address); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, res.Error
+	}
+	return &user, nil
+}
+
+// SendEmailLoginCode 发送邮箱登录验证码，只支持已验证的邮箱
+func (u *userInfoService) SendEmailLoginCode(address string) (string, int) {
+	user, err := u.findUserByVerifiedEmail(address)
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if user == nil {
+		return "该邮箱未绑定账号或未验证", -2
+	}
+	return u.sendEmailCode(emailCodePurposeLogin, address, address)
+}
+
+// EmailLogin 邮箱验证码登录
+func (u *userInfoService) EmailLogin(req request.EmailLoginRequest) (string, *respond.LoginRespond, int) {
+	user, err := u.findUserByVerifiedEmail(req.Email)
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if user == nil {
+		return "该邮箱未绑定账号或未验证", nil, -2
+	}
+	if message, ret := u.checkEmailCode(emailCodePurposeLogin, req.Email, req.Email, req.Code); ret != 0 {
+		return message, nil, ret
+	}
+	return u.finishLogin(*user)
+}
+
+// RequestPasswordReset 给已验证的邮箱发送重置密码链接
+// 邮箱不存在时同样返回成功，避免被用来探测邮箱是否注册
+func (u *userInfoService) RequestPasswordReset(address string) (string, int) {
+	const message = "如果该邮箱已绑定账号，重置密码邮件已发送，请及时查收"
+	user, err := u.findUserByVerifiedEmail(address)
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if user == nil {
+		zlog.Info("重置密码的邮箱未绑定账号: " + address)
+		return message, 0
+	}
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	token := hex.EncodeToString(tokenBytes)
+	emailConfig := config.GetConfig().EmailConfig
+	link := token
+	if emailConfig.ResetUrl != "" {
+		link = emailConfig.ResetUrl + "?token=" + url.QueryEscape(token)
+	}
+	body := fmt.Sprintf("您正在重置密码，请在%d分钟内打开以下链接完成重置，链接只能使用一次：\r\n%s\r\n如非本人操作请忽略。", emailConfig.ResetTokenMinutes, link)
+	if sendMessage, ret := u.sendMail(email.Mail{To: address, Subject: "重置密码", Body: body}); ret != 0 {
+		return sendMessage, ret
+	}
+	// redis中只保存token的哈希，新的链接发出后旧链接作废
+	hash := sha256.Sum256([]byte(token))
+	tokenHash := hex.EncodeToString(hash[:])
+	timeout := time.Duration(emailConfig.ResetTokenMinutes) * time.Minute
+	if oldHash, err := myredis.GetKey(passwordResetUserKey(user.Uuid)); err != nil {
+		zlog.Error(err.Error())
+	} else if oldHash != "" {
+		if err := myredis.DelKeyIfExists(passwordResetKey(oldHash)); err != nil {
+			zlog.Error(err.Error())
+		}
+	}
+	if err := myredis.SetKeyEx(passwordResetKey(tokenHash), user.Uuid, timeout); err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if err := myredis.SetKeyEx(passwordResetUserKey(user.Uuid), tokenHash, timeout); err != nil {
+		zlog.Error(err.Error())
+	}
+	return message, 0
+}
+
+// ResetPassword 使用重置链接中的token设置新密码，token读取后立即删除，只能使用一次
+func (u *userInfoService) ResetPassword(req request.ResetPasswordRequest) (string, int) {
+	// password列为char(18)
+	if len(req.Password) < 6 || len(req.Password) > 18 {
+		return "密码长度应为6到18位", -2
+	}
+	if req.Token == "" {
+		return "重置链接无效或已过期", -2
+	}
+	hash := sha256.Sum256([]byte(req.Token))
+	uuid, err := myredis.GetDelKey(passwordResetKey(hex.EncodeToString(hash[:])))
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if uuid == "" {
+		return "重置链接无效或已过期", -2
+	}
+	if err := myredis.DelKeyIfExists(passwordResetUserKey(uuid)); err != nil {
+		zlog.Error(err.Error())
+	}
+	var user model.UserInfo
+	if res := dao.GormDB.First(&user, "uuid = ?", uuid); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	if res := dao.GormDB.Model(&user).Update("password", req.Password); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	// 重置成功后解除因密码错误导致的锁定
+	if err := loginFailLimit().Reset(user.Telephone); err != nil {
+		zlog.Error(err.Error())
+	}
+	return "密码重置成功，请使用新密码登录", 0
+}
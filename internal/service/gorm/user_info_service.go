@@ -1,11 +1,10 @@
 package gorm
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	redis "github.com/go-redis/redis/v8"
 	"gorm.io/gorm"
+	"kama_chat_server/internal/config"
 	"kama_chat_server/internal/dao"
 	"kama_chat_server/internal/dto/request"
 	"kama_chat_server/internal/dto/respond"
@@ -13,9 +12,11 @@ import (
 	myredis "kama_chat_server/internal/service/redis"
 	"kama_chat_server/internal/service/sms"
 	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/enum/audit_log/audit_action_enum"
 	"kama_chat_server/pkg/enum/user_info/user_status_enum"
 	"kama_chat_server/pkg/util/random"
 	"kama_chat_server/pkg/zlog"
+	"math"
 	"regexp"
 	"time"
 )
@@ -51,9 +52,86 @@ func (u *userInfoService) checkUserIsAdminOrNot(user model.UserInfo) int8 {
 	return user.IsAdmin
 }
 
+// checkAdminTargets 管理员操作用户前检查，不能操作自己，普通管理员不能操作超级管理员
+func (u *userInfoService) checkAdminTargets(adminId string, users []model.UserInfo) (string, int) {
+	var admin model.UserInfo
+	if res := dao.GormDB.First(&admin, "uuid = ?", adminId); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	for _, user := range users {
+		if user.Uuid == adminId {
+			return "不能对自己执行该操作", -2
+		}
+		if user.IsSuperAdmin == 1 && admin.IsSuperAdmin != 1 {
+			return "普通管理员不能操作超级管理员", -3
+		}
+	}
+	return "", 0
+}
+
+// loginFailLimit 登录失败计数，窗口内失败次数达到上限后锁定，直到最早的一次失败移出窗口
+func loginFailLimit() myredis.RateLimit {
+	limitConfig := config.GetConfig().RateLimitConfig
+	return myredis.RateLimit{
+		Name:   "login_fail",
+		Limit:  limitConfig.LoginMaxFailures,
+		Window: time.Duration(limitConfig.LoginLockMinutes) * time.Minute,
+	}
+}
+
+// checkLoginLocked 检查账号是否因登录失败次数过多被锁定
+func (u *userInfoService) checkLoginLocked(telephone string) (string, bool) {
+	limit := loginFailLimit()
+	if limit.Limit <= 0 {
+		return "", false
+	}
+	count, wait, err := limit.Peek(telephone)
+	if err != nil {
+		// redis异常时不锁定，避免所有用户都无法登录
+		zlog.Error(err.Error())
+		return "", false
+	}
+	if count >= limit.Limit {
+		return fmt.Sprintf("登录失败次数过多，账号已锁定，请%d分钟后再试", int(math.Ceil(wait.Minutes()))), true
+	}
+	return "", false
+}
+
+// recordLoginFailure 记录一次登录失败
+func (u *userInfoService) recordLoginFailure(telephone string) {
+	if _, _, err := loginFailLimit().Allow(telephone); err != nil {
+		zlog.Error(err.Error())
+	}
+}
+
+// buildLoginRespond 各种登录方式成功后返回的用户信息
+func buildLoginRespond(user model.UserInfo) *respond.LoginRespond {
+	loginRsp := &respond.LoginRespond{
+		Uuid:          user.Uuid,
+		Telephone:     user.Telephone,
+		Nickname:      user.Nickname,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified == 1,
+		Avatar:        user.Avatar,
+		Gender:        user.Gender,
+		Birthday:      user.Birthday,
+		Signature:     user.Signature,
+		IsAdmin:       user.IsAdmin,
+		Status:        user.Status,
+	}
+	year, month, day := user.CreatedAt.Date()
+	loginRsp.CreatedAt = fmt.Sprintf("%d.%d.%d", year, month, day)
+	return loginRsp
+}
+
 // Login 登录
 func (u *userInfoService) Login(loginReq request.LoginRequest) (string, *respond.LoginRespond, int) {
 	password := loginReq.Password
+	if message, locked := u.checkLoginLocked(loginReq.Telephone); locked {
+		zlog.Info(message)
+		return message, nil, -2
+	}
 	var user model.UserInfo
 	res := dao.GormDB.First(&user, "telephone = ?", loginReq.Telephone)
 	if res.Error != nil {
@@ -66,27 +144,13 @@ func (u *userInfoService) Login(loginReq request.LoginRequest) (string, *respond
 		return constants.SYSTEM_ERROR, nil, -1
 	}
 	if user.Password != password {
+		u.recordLoginFailure(loginReq.Telephone)
 		message := "密码不正确，请重试"
 		zlog.Error(message)
 		return message, nil, -2
 	}
 
-	loginRsp := &respond.LoginRespond{
-		Uuid:      user.Uuid,
-		Telephone: user.Telephone,
-		Nickname:  user.Nickname,
-		Email:     user.Email,
-		Avatar:    user.Avatar,
-		Gender:    user.Gender,
-		Birthday:  user.Birthday,
-		Signature: user.Signature,
-		IsAdmin:   user.IsAdmin,
-		Status:    user.Status,
-	}
-	year, month, day := user.CreatedAt.Date()
-	loginRsp.CreatedAt = fmt.Sprintf("%d.%d.%d", year, month, day)
-
-	return "登陆成功", loginRsp, 0
+	return u.finishLogin(user)
 }
 
 // SmsLogin 验证码登录
@@ -103,29 +167,22 @@ func (u *userInfoService) SmsLogin(req request.SmsLoginRequest) (string, *respon
 		return constants.SYSTEM_ERROR, nil, -1
 	}
 
+	// 验证码同样计入登录失败次数，防止穷举
+	if message, locked := u.checkLoginLocked(req.Telephone); locked {
+		zlog.Info(message)
+		return message, nil, -2
+	}
 	// 使用统一的验证码校验接口
 	isValid, message := sms.VerifyCode(req.Telephone, req.SmsCode)
 	if !isValid {
+		if message != constants.SYSTEM_ERROR {
+			u.recordLoginFailure(req.Telephone)
+		}
 		zlog.Info("短信验证码校验失败: " + message)
 		return message, nil, -2
 	}
 
-	loginRsp := &respond.LoginRespond{
-		Uuid:      user.Uuid,
-		Telephone: user.Telephone,
-		Nickname:  user.Nickname,
-		Email:     user.Email,
-		Avatar:    user.Avatar,
-		Gender:    user.Gender,
-		Birthday:  user.Birthday,
-		Signature: user.Signature,
-		IsAdmin:   user.IsAdmin,
-		Status:    user.Status,
-	}
-	year, month, day := user.CreatedAt.Date()
-	loginRsp.CreatedAt = fmt.Sprintf("%d.%d.%d", year, month, day)
-
-	return "登陆成功", loginRsp, 0
+	return u.finishLogin(user)
 }
 
 // SendSmsCode 发送短信验证码 - 验证码登录
@@ -163,11 +220,18 @@ func (u *userInfoService) Register(registerReq request.RegisterRequest) (string,
 	if ret != 0 {
 		return message, nil, ret
 	}
+	// 邮箱选填，注册时只保存，验证后才能用于登录和找回密码
+	if registerReq.Email != "" {
+		if message, ret := u.checkEmailFormat(registerReq.Email); ret != 0 {
+			return message, nil, ret
+		}
+	}
 	var newUser model.UserInfo
 	newUser.Uuid = "U" + random.GetNowAndLenRandomString(11)
 	newUser.Telephone = registerReq.Telephone
 	newUser.Password = registerReq.Password
 	newUser.Nickname = registerReq.Nickname
+	newUser.Email = registerReq.Email
 	newUser.Avatar = "https://cube.elemecdn.com/0/88/03b0d39583f48206768a7534e55bcpng.png"
 	newUser.CreatedAt = time.Now()
 	newUser.IsAdmin = u.checkUserIsAdminOrNot(newUser)
@@ -202,21 +266,32 @@ func (u *userInfoService) Register(registerReq request.RegisterRequest) (string,
 	}
 	year, month, day := newUser.CreatedAt.Date()
 	registerRsp.CreatedAt = fmt.Sprintf("%d.%d.%d", year, month, day)
+	if newUser.Email != "" {
+		// 验证码发送失败不影响注册，用户可以稍后重新获取
+		if message, ret := u.sendEmailCode(emailCodePurposeVerify, newUser.Uuid, newUser.Email); ret != 0 {
+			zlog.Info("注册时发送邮箱验证码失败: " + message)
+		}
+	}
 
 	return "注册成功", registerRsp, 0
 }
 
 // UpdateUserInfo 修改用户信息
-// 某用户修改了信息，可能会影响contact_user_list，不需要删除redis的contact_user_list，timeout之后会自己更新
-// 但是需要更新redis的user_info，因为可能影响用户搜索
+// 联系人列表、群成员列表中冗余了昵称和头像，都打了该用户的标签，和user_info一起失效
 func (u *userInfoService) UpdateUserInfo(updateReq request.UpdateUserInfoRequest) (string, int) {
 	var user model.UserInfo
 	if res := dao.GormDB.First(&user, "uuid = ?", updateReq.Uuid); res.Error != nil {
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
-	if updateReq.Email != "" {
+	emailChanged := updateReq.Email != "" && updateReq.Email != user.Email
+	if emailChanged {
+		if message, ret := u.checkEmailFormat(updateReq.Email); ret != 0 {
+			return message, ret
+		}
+		// 更换邮箱后需要重新验证
 		user.Email = updateReq.Email
+		user.EmailVerified = 0
 	}
 	if updateReq.Nickname != "" {
 		user.Nickname = updateReq.Nickname
@@ -234,9 +309,12 @@ func (u *userInfoService) UpdateUserInfo(updateReq request.UpdateUserInfoRequest
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
-	//if err := myredis.DelKeysWithPattern("user_info_" + updateReq.Uuid); err != nil {
-	//	zlog.Error(err.Error())
-	//}
+	invalidateUsers(updateReq.Uuid)
+	if emailChanged {
+		if message, ret := u.sendEmailCode(emailCodePurposeVerify, user.Uuid, user.Email); ret != 0 {
+			zlog.Info("修改邮箱后发送验证码失败: " + message)
+		}
+	}
 	return "修改用户信息成功", 0
 }
 
@@ -253,11 +331,12 @@ func (u *userInfoService) GetUserInfoList(ownerId string) (string, []respond.Get
 	var rsp []respond.GetUserListRespond
 	for _, user := range users {
 		rp := respond.GetUserListRespond{
-			Uuid:      user.Uuid,
-			Telephone: user.Telephone,
-			Nickname:  user.Nickname,
-			Status:    user.Status,
-			IsAdmin:   user.IsAdmin,
+			Uuid:         user.Uuid,
+			Telephone:    user.Telephone,
+			Nickname:     user.Nickname,
+			Status:       user.Status,
+			IsAdmin:      user.IsAdmin,
+			IsSuperAdmin: user.IsSuperAdmin == 1,
 		}
 		if user.DeletedAt.Valid {
 			rp.IsDeleted = true
@@ -270,41 +349,50 @@ func (u *userInfoService) GetUserInfoList(ownerId string) (string, []respond.Get
 }
 
 // AbleUsers 启用用户
-// 用户是否启用禁用需要实时更新contact_user_list状态，所以redis的contact_user_list需要删除
-func (u *userInfoService) AbleUsers(uuidList []string) (string, int) {
+// 用户是否启用禁用需要实时更新contact_user_list状态，所以打了该用户标签的缓存需要删除
+func (u *userInfoService) AbleUsers(op Operator, uuidList []string) (string, int) {
 	var users []model.UserInfo
 	if res := dao.GormDB.Model(model.UserInfo{}).Where("uuid in (?)", uuidList).Find(&users); res.Error != nil {
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
+	if message, ret := u.checkAdminTargets(op.Uuid, users); ret != 0 {
+		return message, ret
+	}
 	for _, user := range users {
+		before := user.Status
 		user.Status = user_status_enum.NORMAL
 		if res := dao.GormDB.Save(&user); res.Error != nil {
 			zlog.Error(res.Error.Error())
 			return constants.SYSTEM_ERROR, -1
 		}
+		recordAudit(op, audit_action_enum.ABLE_USER, user.Uuid,
+			map[string]interface{}{"status": before}, map[string]interface{}{"status": user.Status})
 	}
-	// 删除所有"contact_user_list"开头的key
-	//if err := myredis.DelKeysWithPrefix("contact_user_list"); err != nil {
-	//	zlog.Error(err.Error())
-	//}
+	invalidateUsers(uuidList...)
 	return "启用用户成功", 0
 }
 
 // DisableUsers 禁用用户
-// 用户是否启用禁用需要实时更新contact_user_list状态，所以redis的contact_user_list需要删除
-func (u *userInfoService) DisableUsers(uuidList []string) (string, int) {
+// 用户是否启用禁用需要实时更新contact_user_list状态，所以打了该用户标签的缓存需要删除
+func (u *userInfoService) DisableUsers(op Operator, uuidList []string) (string, int) {
 	var users []model.UserInfo
 	if res := dao.GormDB.Model(model.UserInfo{}).Where("uuid in (?)", uuidList).Find(&users); res.Error != nil {
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
+	if message, ret := u.checkAdminTargets(op.Uuid, users); ret != 0 {
+		return message, ret
+	}
 	for _, user := range users {
+		before := user.Status
 		user.Status = user_status_enum.DISABLE
 		if res := dao.GormDB.Save(&user); res.Error != nil {
 			zlog.Error(res.Error.Error())
 			return constants.SYSTEM_ERROR, -1
 		}
+		recordAudit(op, audit_action_enum.DISABLE_USER, user.Uuid,
+			map[string]interface{}{"status": before}, map[string]interface{}{"status": user.Status})
 		var sessionList []model.Session
 		if res := dao.GormDB.Where("send_id = ? or receive_id = ?", user.Uuid, user.Uuid).Find(&sessionList); res.Error != nil {
 			zlog.Error(res.Error.Error())
@@ -321,21 +409,21 @@ func (u *userInfoService) DisableUsers(uuidList []string) (string, int) {
 			}
 		}
 	}
-	// 删除所有"contact_user_list"开头的key
-	//if err := myredis.DelKeysWithPrefix("contact_user_list"); err != nil {
-	//	zlog.Error(err.Error())
-	//}
+	invalidateUsers(uuidList...)
 	return "禁用用户成功", 0
 }
 
 // DeleteUsers 删除用户
-// 用户是否启用禁用需要实时更新contact_user_list状态，所以redis的contact_user_list需要删除
-func (u *userInfoService) DeleteUsers(uuidList []string) (string, int) {
+// 用户是否启用禁用需要实时更新contact_user_list状态，所以打了该用户标签的缓存需要删除
+func (u *userInfoService) DeleteUsers(op Operator, uuidList []string) (string, int) {
 	var users []model.UserInfo
 	if res := dao.GormDB.Model(model.UserInfo{}).Where("uuid in (?)", uuidList).Find(&users); res.Error != nil {
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
+	if message, ret := u.checkAdminTargets(op.Uuid, users); ret != 0 {
+		return message, ret
+	}
 	for _, user := range users {
 		user.DeletedAt.Valid = true
 		user.DeletedAt.Time = time.Now()
@@ -343,6 +431,7 @@ func (u *userInfoService) DeleteUsers(uuidList []string) (string, int) {
 			zlog.Error(res.Error.Error())
 			return constants.SYSTEM_ERROR, -1
 		}
+		recordAudit(op, audit_action_enum.DELETE_USER, user.Uuid, userSnapshot(user), nil)
 
 		// 删除会话
 		var sessionList []model.Session
@@ -408,72 +497,100 @@ func (u *userInfoService) DeleteUsers(uuidList []string) (string, int) {
 		}
 
 	}
-	// 删除所有"contact_user_list"开头的key
-	//if err := myredis.DelKeysWithPrefix("contact_user_list"); err != nil {
-	//	zlog.Error(err.Error())
-	//}
+	invalidateUsers(uuidList...)
 	return "删除用户成功", 0
 }
 
 // GetUserInfo 获取用户信息
 func (u *userInfoService) GetUserInfo(uuid string) (string, *respond.GetUserInfoRespond, int) {
-	// redis
-	zlog.Info(uuid)
-	rspString, err := myredis.GetKeyNilIsErr("user_info_" + uuid)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			zlog.Info(err.Error())
-			var user model.UserInfo
-			if res := dao.GormDB.Where("uuid = ?", uuid).Find(&user); res.Error != nil {
-				zlog.Error(res.Error.Error())
-				return constants.SYSTEM_ERROR, nil, -1
-			}
-			rsp := respond.GetUserInfoRespond{
-				Uuid:      user.Uuid,
-				Telephone: user.Telephone,
-				Nickname:  user.Nickname,
-				Avatar:    user.Avatar,
-				Birthday:  user.Birthday,
-				Email:     user.Email,
-				Gender:    user.Gender,
-				Signature: user.Signature,
-				CreatedAt: user.CreatedAt.Format("2006-01-02 15:04:05"),
-				IsAdmin:   user.IsAdmin,
-				Status:    user.Status,
-			}
-			//rspString, err := json.Marshal(rsp)
-			//if err != nil {
-			//	zlog.Error(err.Error())
-			//}
-			//if err := myredis.SetKeyEx("user_info_"+uuid, string(rspString), constants.REDIS_TIMEOUT*time.Minute); err != nil {
-			//	zlog.Error(err.Error())
-			//}
-			return "获取用户信息成功", &rsp, 0
-		} else {
-			zlog.Error(err.Error())
-			return constants.SYSTEM_ERROR, nil, -1
-		}
-	}
 	var rsp respond.GetUserInfoRespond
-	if err := json.Unmarshal([]byte(rspString), &rsp); err != nil {
+	err := myredis.GetOrLoad(myredis.UserInfoCache, myredis.UserInfoCache.Key(uuid), &rsp, func() (interface{}, []string, error) {
+		var user model.UserInfo
+		if res := dao.GormDB.Where("uuid = ?", uuid).Find(&user); res.Error != nil {
+			return nil, nil, res.Error
+		}
+		totpEnabled, err := u.isTotpEnabled(uuid)
+		if err != nil {
+			return nil, nil, err
+		}
+		return respond.GetUserInfoRespond{
+			Uuid:             user.Uuid,
+			Telephone:        user.Telephone,
+			Nickname:         user.Nickname,
+			Avatar:           user.Avatar,
+			Birthday:         user.Birthday,
+			Email:            user.Email,
+			EmailVerified:    user.EmailVerified == 1,
+			Gender:           user.Gender,
+			Signature:        user.Signature,
+			CreatedAt:        user.CreatedAt.Format("2006-01-02 15:04:05"),
+			IsAdmin:          user.IsAdmin,
+			Status:           user.Status,
+			TwoFactorEnabled: totpEnabled,
+		}, []string{myredis.UserTag(uuid)}, nil
+	})
+	if err != nil {
 		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
 	}
 	return "获取用户信息成功", &rsp, 0
 }
 
+// CheckUserStatus 检查用户存在且未被禁用，建立ws连接前调用
+// 走用户信息缓存，禁用、删除用户时会清掉缓存，所以状态是实时的
+func (u *userInfoService) CheckUserStatus(uuid string) (string, int) {
+	message, rsp, ret := u.GetUserInfo(uuid)
+	if ret != 0 {
+		return message, ret
+	}
+	if rsp.Uuid == "" {
+		return "用户不存在", -2
+	}
+	if rsp.Status != user_status_enum.NORMAL {
+		return "用户已被禁用", -2
+	}
+	return "用户状态正常", 0
+}
+
 // SetAdmin 设置管理员
-func (u *userInfoService) SetAdmin(uuidList []string, isAdmin int8) (string, int) {
+// 取消管理员时同时取消超级管理员，只有超级管理员能取消超级管理员
+func (u *userInfoService) SetAdmin(op Operator, uuidList []string, isAdmin int8) (string, int) {
+	if isAdmin != 0 && isAdmin != 1 {
+		return "参数错误", -2
+	}
 	var users []model.UserInfo
-	if res := dao.GormDB.Where("uuid = (?)", uuidList).Find(&users); res.Error != nil {
+	if res := dao.GormDB.Where("uuid in (?)", uuidList).Find(&users); res.Error != nil {
 		zlog.Error(res.Error.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
+	if message, ret := u.checkAdminTargets(op.Uuid, users); ret != 0 {
+		return message, ret
+	}
 	for _, user := range users {
+		before := map[string]interface{}{"is_admin": user.IsAdmin, "is_super_admin": user.IsSuperAdmin}
 		user.IsAdmin = isAdmin
+		if isAdmin == 0 {
+			user.IsSuperAdmin = 0
+		}
 		if res := dao.GormDB.Save(&user); res.Error != nil {
 			zlog.Error(res.Error.Error())
 			return constants.SYSTEM_ERROR, -1
 		}
+		recordAudit(op, audit_action_enum.SET_ADMIN, user.Uuid, before,
+			map[string]interface{}{"is_admin": user.IsAdmin, "is_super_admin": user.IsSuperAdmin})
 	}
+	invalidateUsers(uuidList...)
 	return "设置管理员成功", 0
 }
+
+// invalidateUsers 用户信息或状态变化后，删除打了这些用户标签的缓存，
+// 包括user_info以及其他用户的联系人列表、会话列表和群成员列表
+func invalidateUsers(uuidList ...string) {
+	tags := make([]string, 0, len(uuidList))
+	for _, uuid := range uuidList {
+		tags = append(tags, myredis.UserTag(uuid))
+	}
+	if err := myredis.InvalidateTags(tags...); err != nil {
+		zlog.Error(err.Error())
+	}
+}
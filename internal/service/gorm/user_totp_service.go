@@ -0,0 +1,430 @@
+package gorm
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"gorm.io/gorm"
+	"kama_chat_server/internal/config"
+	"kama_chat_server/internal/dao"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/dto/respond"
+	"kama_chat_server/internal/model"
+	myredis "kama_chat_server/internal/service/redis"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/enum/user_info/user_status_enum"
+	"kama_chat_server/pkg/enum/user_totp/totp_status_enum"
+	"kama_chat_server/pkg/util/totp"
+	"kama_chat_server/pkg/zlog"
+	"time"
+)
+
+const (
+	recoveryCodeCount = 10
+	totpSkew          = 1 // 允许前后一个时间步的时钟误差
+)
+
+func totpChallengeKey(token string) string {
+	return "totp_challenge_" + token
+}
+
+func adminSessionKey(tokenHash string) string {
+	return "admin_session_" + tokenHash
+}
+
+// newToken 生成32字节随机token，返回token和它的sha256，redis中只保存哈希
+func newToken() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(raw)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// getUserTotp 查询用户的二次验证设置，没有记录时返回nil
+func (u *userInfoService) getUserTotp(uuid string) (*model.UserTotp, error) {
+	var userTotp model.UserTotp
+	if res := dao.GormDB.First(&userTotp, "user_id = ?", uuid); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, res.Error
+	}
+	return &userTotp, nil
+}
+
+// isTotpEnabled 用户是否已开启二次验证
+func (u *userInfoService) isTotpEnabled(uuid string) (bool, error) {
+	userTotp, err := u.getUserTotp(uuid)
+	if err != nil {
+		return false, err
+	}
+	return userTotp != nil && userTotp.Status == totp_status_enum.ENABLED, nil
+}
+
+// checkSecondFactor 校验验证码或恢复码，验证码同一时间步只能用一次，恢复码用后作废
+func (u *userInfoService) checkSecondFactor(userTotp *model.UserTotp, code string) (bool, error) {
+	ok, step, err := totp.Validate(userTotp.Secret, code, time.Now(), totpSkew)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		if step <= userTotp.LastStep {
+			return false, nil
+		}
+		// 条件更新，并发提交同一个验证码时只有一个成功
+		res := dao.GormDB.Model(&model.UserTotp{}).
+			Where("id = ? AND last_step < ?", userTotp.Id, step).
+			Update("last_step", step)
+		if res.Error != nil {
+			return false, res.Error
+		}
+		userTotp.LastStep = step
+		return res.RowsAffected == 1, nil
+	}
+
+	var hashes []string
+	if userTotp.RecoveryCodes != "" {
+		if err := json.Unmarshal([]byte(userTotp.RecoveryCodes), &hashes); err != nil {
+			return false, err
+		}
+	}
+	target := hashToken(totp.NormalizeRecoveryCode(code))
+	for i, hash := range hashes {
+		if hash != target {
+			continue
+		}
+		remaining := append(hashes[:i:i], hashes[i+1:]...)
+		data, err := json.Marshal(remaining)
+		if err != nil {
+			return false, err
+		}
+		res := dao.GormDB.Model(&model.UserTotp{}).
+			Where("id = ? AND recovery_codes = ?", userTotp.Id, userTotp.RecoveryCodes).
+			Update("recovery_codes", string(data))
+		if res.Error != nil {
+			return false, res.Error
+		}
+		userTotp.RecoveryCodes = string(data)
+		return res.RowsAffected == 1, nil
+	}
+	return false, nil
+}
+
+// newRecoveryCodes 生成恢复码，返回明文和要保存的哈希json
+func newRecoveryCodes() ([]string, string, error) {
+	codes, err := totp.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, "", err
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, hashToken(totp.NormalizeRecoveryCode(code)))
+	}
+	data, err := json.Marshal(hashes)
+	if err != nil {
+		return nil, "", err
+	}
+	return codes, string(data), nil
+}
+
+// finishLogin 第一步登录成功后调用，开启了二次验证的用户先返回challenge_token
+// 登录失败计数在整个登录完成后才清除，否则第一步成功就能重置二次验证码的失败次数
+func (u *userInfoService) finishLogin(user model.UserInfo) (string, *respond.LoginRespond, int) {
+	enabled, err := u.isTotpEnabled(user.Uuid)
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if !enabled {
+		if err := loginFailLimit().Reset(user.Telephone); err != nil {
+			zlog.Error(err.Error())
+		}
+		return "登陆成功", buildLoginRespond(user), 0
+	}
+	token, _, err := newToken()
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	timeout := time.Duration(config.GetConfig().TotpConfig.ChallengeMinutes) * time.Minute
+	if err := myredis.SetKeyEx(totpChallengeKey(token), user.Uuid, timeout); err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	return "请输入二次验证码", &respond.LoginRespond{
+		Uuid:              user.Uuid,
+		TwoFactorRequired: true,
+		ChallengeToken:    token,
+	}, 0
+}
+
+// TotpLogin 登录第二步，校验验证码或恢复码，管理员同时颁发管理令牌
+func (u *userInfoService) TotpLogin(req request.TotpLoginRequest) (string, *respond.LoginRespond, int) {
+	if req.ChallengeToken == "" {
+		return "登录已过期，请重新登录", nil, -2
+	}
+	uuid, err := myredis.GetKey(totpChallengeKey(req.ChallengeToken))
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if uuid == "" {
+		return "登录已过期，请重新登录", nil, -2
+	}
+	var user model.UserInfo
+	if res := dao.GormDB.First(&user, "uuid = ?", uuid); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	// 二次验证码同样计入登录失败次数
+	if message, locked := u.checkLoginLocked(user.Telephone); locked {
+		zlog.Info(message)
+		return message, nil, -2
+	}
+	userTotp, err := u.getUserTotp(uuid)
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if userTotp == nil || userTotp.Status != totp_status_enum.ENABLED {
+		return "登录已过期，请重新登录", nil, -2
+	}
+	ok, err := u.checkSecondFactor(userTotp, req.Code)
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if !ok {
+		u.recordLoginFailure(user.Telephone)
+		return "二次验证码错误", nil, -2
+	}
+	if err := myredis.DelKeyIfExists(totpChallengeKey(req.ChallengeToken)); err != nil {
+		zlog.Error(err.Error())
+	}
+	if err := loginFailLimit().Reset(user.Telephone); err != nil {
+		zlog.Error(err.Error())
+	}
+	loginRsp := buildLoginRespond(user)
+	if user.IsAdmin == 1 {
+		token, tokenHash, err := newToken()
+		if err != nil {
+			zlog.Error(err.Error())
+			return constants.SYSTEM_ERROR, nil, -1
+		}
+		timeout := time.Duration(config.GetConfig().TotpConfig.AdminSessionHours) * time.Hour
+		if err := myredis.SetKeyEx(adminSessionKey(tokenHash), user.Uuid, timeout); err != nil {
+			zlog.Error(err.Error())
+			return constants.SYSTEM_ERROR, nil, -1
+		}
+		loginRsp.AdminToken = token
+	}
+	return "登陆成功", loginRsp, 0
+}
+
+// SetupTotp 生成新的密钥，需要校验密码，调用EnableTotp验证通过后才生效
+func (u *userInfoService) SetupTotp(req request.TotpSetupRequest) (string, *respond.TotpSetupRespond, int) {
+	var user model.UserInfo
+	if res := dao.GormDB.First(&user, "uuid = ?", req.Uuid); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "用户不存在", nil, -2
+		}
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	// 和登录共用失败计数，避免绕过登录锁定猜测密码
+	if message, locked := u.checkLoginLocked(user.Telephone); locked {
+		zlog.Info(message)
+		return message, nil, -2
+	}
+	if user.Password != req.Password {
+		u.recordLoginFailure(user.Telephone)
+		return "密码不正确，请重试", nil, -2
+	}
+	userTotp, err := u.getUserTotp(req.Uuid)
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if userTotp != nil && userTotp.Status == totp_status_enum.ENABLED {
+		return "已开启二次验证，如需更换请先关闭", nil, -2
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if userTotp == nil {
+		userTotp = &model.UserTotp{UserId: req.Uuid, CreatedAt: time.Now()}
+	}
+	userTotp.Secret = secret
+	userTotp.Status = totp_status_enum.PENDING
+	userTotp.RecoveryCodes = ""
+	userTotp.LastStep = 0
+	userTotp.UpdatedAt = time.Now()
+	if res := dao.GormDB.Save(userTotp); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	account := user.Telephone
+	if account == "" {
+		account = user.Uuid
+	}
+	return "请使用验证器App扫描二维码", &respond.TotpSetupRespond{
+		Secret:     secret,
+		OtpauthUri: totp.URI(config.GetConfig().TotpConfig.Issuer, account, secret),
+	}, 0
+}
+
+// EnableTotp 用验证器App生成的验证码确认开启，返回恢复码，恢复码只展示这一次
+func (u *userInfoService) EnableTotp(req request.TotpCodeRequest) (string, *respond.TotpRecoveryCodesRespond, int) {
+	userTotp, err := u.getUserTotp(req.Uuid)
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if userTotp == nil {
+		return "请先生成二次验证密钥", nil, -2
+	}
+	if userTotp.Status == totp_status_enum.ENABLED {
+		return "已开启二次验证", nil, -2
+	}
+	ok, _, err := totp.Validate(userTotp.Secret, req.Code, time.Now(), totpSkew)
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if !ok {
+		return "二次验证码错误", nil, -2
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	userTotp.Status = totp_status_enum.ENABLED
+	userTotp.RecoveryCodes = hashes
+	userTotp.LastStep = totp.Step(time.Now()) + totpSkew
+	userTotp.UpdatedAt = time.Now()
+	if res := dao.GormDB.Save(userTotp); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	invalidateUsers(req.Uuid)
+	return "二次验证已开启，请妥善保存恢复码", &respond.TotpRecoveryCodesRespond{RecoveryCodes: codes}, 0
+}
+
+// checkTotpOwner 关闭二次验证和重新生成恢复码前校验密码和验证码，失败同样计入登录失败次数
+func (u *userInfoService) checkTotpOwner(req request.TotpCodeRequest) (*model.UserTotp, string, int) {
+	var user model.UserInfo
+	if res := dao.GormDB.First(&user, "uuid = ?", req.Uuid); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return nil, "用户不存在", -2
+		}
+		zlog.Error(res.Error.Error())
+		return nil, constants.SYSTEM_ERROR, -1
+	}
+	if message, locked := u.checkLoginLocked(user.Telephone); locked {
+		zlog.Info(message)
+		return nil, message, -2
+	}
+	if user.Password != req.Password {
+		u.recordLoginFailure(user.Telephone)
+		return nil, "密码不正确，请重试", -2
+	}
+	userTotp, err := u.getUserTotp(req.Uuid)
+	if err != nil {
+		zlog.Error(err.Error())
+		return nil, constants.SYSTEM_ERROR, -1
+	}
+	if userTotp == nil || userTotp.Status != totp_status_enum.ENABLED {
+		return nil, "未开启二次验证", -2
+	}
+	ok, err := u.checkSecondFactor(userTotp, req.Code)
+	if err != nil {
+		zlog.Error(err.Error())
+		return nil, constants.SYSTEM_ERROR, -1
+	}
+	if !ok {
+		u.recordLoginFailure(user.Telephone)
+		return nil, "二次验证码错误", -2
+	}
+	return userTotp, "", 0
+}
+
+// DisableTotp 关闭二次验证，需要密码和验证码或恢复码
+func (u *userInfoService) DisableTotp(req request.TotpCodeRequest) (string, int) {
+	userTotp, message, ret := u.checkTotpOwner(req)
+	if ret != 0 {
+		return message, ret
+	}
+	if res := dao.GormDB.Delete(userTotp); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, -1
+	}
+	invalidateUsers(req.Uuid)
+	return "二次验证已关闭", 0
+}
+
+// RegenerateRecoveryCodes 重新生成恢复码，旧的恢复码全部作废，需要密码和验证码或恢复码
+func (u *userInfoService) RegenerateRecoveryCodes(req request.TotpCodeRequest) (string, *respond.TotpRecoveryCodesRespond, int) {
+	userTotp, message, ret := u.checkTotpOwner(req)
+	if ret != 0 {
+		return message, nil, ret
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if res := dao.GormDB.Model(userTotp).Update("recovery_codes", hashes); res.Error != nil {
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	return "恢复码已重新生成，请妥善保存", &respond.TotpRecoveryCodesRespond{RecoveryCodes: codes}, 0
+}
+
+// CheckAdminToken 校验管理令牌，返回管理员uuid
+// 令牌缺失或过期返回-2，不是管理员或未开启二次验证返回-3
+// 令牌颁发后管理员被取消、禁用或关闭了二次验证，令牌都随之失效
+func (u *userInfoService) CheckAdminToken(token string) (string, string, int) {
+	if token == "" {
+		return "请先完成二次验证登录", "", -2
+	}
+	uuid, err := myredis.GetKey(adminSessionKey(hashToken(token)))
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, "", -1
+	}
+	if uuid == "" {
+		return "管理令牌无效或已过期，请重新登录", "", -2
+	}
+	var user model.UserInfo
+	if res := dao.GormDB.First(&user, "uuid = ?", uuid); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "管理令牌无效或已过期，请重新登录", "", -2
+		}
+		zlog.Error(res.Error.Error())
+		return constants.SYSTEM_ERROR, "", -1
+	}
+	if user.IsAdmin != 1 || user.Status != user_status_enum.NORMAL {
+		return "没有管理权限", "", -3
+	}
+	enabled, err := u.isTotpEnabled(uuid)
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, "", -1
+	}
+	if !enabled {
+		return "管理员需要先开启二次验证", "", -3
+	}
+	return "", uuid, 0
+}
@@ -0,0 +1,205 @@
+package job
+
+import (
+	"encoding/json"
+	"fmt"
+	"kama_chat_server/internal/config"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/dto/respond"
+	"kama_chat_server/internal/service/chat"
+	myredis "kama_chat_server/internal/service/redis"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/enum/async_job/async_job_status_enum"
+	"kama_chat_server/pkg/util/random"
+	"kama_chat_server/pkg/zlog"
+	"time"
+)
+
+// Handler 执行一类任务，userId为发起任务的用户，返回值与service方法相同
+// 返回-1视为可重试的错误，其他非0值直接失败
+type Handler func(userId string, params json.RawMessage) (string, interface{}, int)
+
+var handlers = make(map[string]Handler)
+
+// Register 注册任务类型，只在init中调用
+func Register(taskType string, handler Handler) {
+	handlers[taskType] = handler
+}
+
+// asyncJob 保存在redis中的任务状态
+type asyncJob struct {
+	JobId     string          `json:"job_id"`
+	TaskType  string          `json:"task_type"`
+	UserId    string          `json:"user_id"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	Message   string          `json:"message"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+func (j *asyncJob) finished() bool {
+	return j.Status == async_job_status_enum.SUCCEEDED ||
+		j.Status == async_job_status_enum.FAILED ||
+		j.Status == async_job_status_enum.TIMEOUT
+}
+
+// expired 超过所有重试加起来的最长时间仍未结束，说明任务在队列中积压或执行的实例已退出
+func (j *asyncJob) expired() bool {
+	jobConfig := getJobConfig()
+	deadline := time.Duration(jobConfig.MaxAttempts) * time.Duration(jobConfig.TimeoutSeconds) * time.Second
+	for attempt := 1; attempt < jobConfig.MaxAttempts; attempt++ {
+		deadline += retryBackoff(attempt)
+	}
+	return time.Since(j.CreatedAt) > deadline
+}
+
+// getJobConfig 读取异步任务配置，没有配置的项使用默认值
+func getJobConfig() config.AsyncJobConfig {
+	jobConfig := config.GetConfig().AsyncJobConfig
+	if jobConfig.Workers <= 0 {
+		jobConfig.Workers = 8
+	}
+	if jobConfig.TimeoutSeconds <= 0 {
+		jobConfig.TimeoutSeconds = 10
+	}
+	if jobConfig.MaxAttempts <= 0 {
+		jobConfig.MaxAttempts = 3
+	}
+	if jobConfig.RetryBackoffMs <= 0 {
+		jobConfig.RetryBackoffMs = 500
+	}
+	if jobConfig.ResultTtlMinutes <= 0 {
+		jobConfig.ResultTtlMinutes = 10
+	}
+	return jobConfig
+}
+
+// retryBackoff 第attempt次执行失败后等待的时长，每次翻倍
+func retryBackoff(attempt int) time.Duration {
+	return time.Duration(getJobConfig().RetryBackoffMs) * time.Millisecond << (attempt - 1)
+}
+
+// asyncEnabled kafka和hybrid模式下任务写入kafka由任意实例执行，channel模式保持同步返回
+func asyncEnabled() bool {
+	messageMode := config.GetConfig().KafkaConfig.MessageMode
+	return messageMode == "kafka" || messageMode == "hybrid"
+}
+
+func saveJob(job *asyncJob) error {
+	job.UpdatedAt = time.Now()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(getJobConfig().ResultTtlMinutes) * time.Minute
+	return myredis.SetKeyEx(myredis.AsyncJobCache.Key(job.JobId), string(data), ttl)
+}
+
+// loadJob 读取任务状态，不存在或已过期时返回nil
+func loadJob(jobId string) (*asyncJob, error) {
+	data, err := myredis.GetKey(myredis.AsyncJobCache.Key(jobId))
+	if err != nil {
+		return nil, err
+	}
+	if data == "" {
+		return nil, nil
+	}
+	var job asyncJob
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Submit 提交任务，异步模式下返回AsyncLoadingRespond，执行结束后结果通过websocket推送给userId，也可以轮询GetJob
+// channel模式、没有发起用户或redis不可用时直接同步执行，返回值与同步接口相同
+func Submit(userId, taskType string, params interface{}, loadingMessage string) (string, interface{}, int) {
+	handler, ok := handlers[taskType]
+	if !ok {
+		zlog.Error("未注册的任务类型: " + taskType)
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if !asyncEnabled() || userId == "" {
+		return handler(userId, rawParams)
+	}
+
+	job := &asyncJob{
+		JobId:     fmt.Sprintf("J%s", random.GetNowAndLenRandomString(11)),
+		TaskType:  taskType,
+		UserId:    userId,
+		Status:    async_job_status_enum.PENDING,
+		CreatedAt: time.Now(),
+	}
+	if err := saveJob(job); err != nil {
+		zlog.Error("保存异步任务失败，改为同步执行: " + err.Error())
+		return handler(userId, rawParams)
+	}
+	dispatch(request.AsyncTaskRequest{
+		TaskType:   taskType,
+		TaskId:     job.JobId,
+		UserId:     userId,
+		Parameters: rawParams,
+		Attempt:    1,
+	})
+	return loadingMessage, respond.AsyncLoadingRespond{
+		Loading: true,
+		TaskId:  job.JobId,
+		Message: loadingMessage,
+	}, 0
+}
+
+// GetJob 查询任务状态，只有发起任务的用户能查到
+func GetJob(userId, jobId string) (string, *respond.AsyncJobRespond, int) {
+	job, err := loadJob(jobId)
+	if err != nil {
+		zlog.Error(err.Error())
+		return constants.SYSTEM_ERROR, nil, -1
+	}
+	if job == nil || job.UserId != userId {
+		return "任务不存在或已过期", nil, -2
+	}
+	if !job.finished() && job.expired() {
+		finish(job, async_job_status_enum.TIMEOUT, "任务执行超时", nil)
+	}
+	return "获取任务状态成功", &respond.AsyncJobRespond{
+		JobId:     job.JobId,
+		TaskType:  job.TaskType,
+		Status:    job.Status,
+		Attempts:  job.Attempts,
+		Message:   job.Message,
+		Result:    job.Result,
+		CreatedAt: job.CreatedAt.Format("2006-01-02 15:04:05"),
+		UpdatedAt: job.UpdatedAt.Format("2006-01-02 15:04:05"),
+	}, 0
+}
+
+// finish 记录最终状态并把结果推送给发起任务的用户
+func finish(job *asyncJob, status, message string, data interface{}) {
+	job.Status = status
+	job.Message = message
+	if data != nil {
+		result, err := json.Marshal(data)
+		if err != nil {
+			zlog.Error(err.Error())
+		} else {
+			job.Result = result
+		}
+	}
+	if err := saveJob(job); err != nil {
+		zlog.Error(err.Error())
+	}
+	chat.PushAsyncResult(job.UserId, respond.AsyncTaskRespond{
+		TaskType: job.TaskType,
+		TaskId:   job.JobId,
+		Success:  status == async_job_status_enum.SUCCEEDED,
+		Message:  message,
+		Data:     data,
+	})
+}
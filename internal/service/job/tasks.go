@@ -0,0 +1,39 @@
+package job
+
+import (
+	"encoding/json"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/service/gorm"
+)
+
+// 任务类型
+const (
+	TaskLoadMessageList      = "load_message_list"
+	TaskLoadGroupMessageList = "load_group_message_list"
+	TaskLoadJoinedGroupList  = "load_joined_group_list"
+)
+
+func init() {
+	Register(TaskLoadMessageList, func(userId string, params json.RawMessage) (string, interface{}, int) {
+		var taskParams request.MessageListTaskParams
+		if err := json.Unmarshal(params, &taskParams); err != nil {
+			return "任务参数错误", nil, -2
+		}
+		return gorm.MessageService.GetMessageList(taskParams.UserOneId, taskParams.UserTwoId)
+	})
+	Register(TaskLoadGroupMessageList, func(userId string, params json.RawMessage) (string, interface{}, int) {
+		var taskParams request.GroupMessageListTaskParams
+		if err := json.Unmarshal(params, &taskParams); err != nil {
+			return "任务参数错误", nil, -2
+		}
+		return gorm.MessageService.GetGroupMessageList(taskParams.GroupId, taskParams.OwnerId)
+	})
+	Register(TaskLoadJoinedGroupList, func(userId string, params json.RawMessage) (string, interface{}, int) {
+		var taskParams request.JoinedGroupListTaskParams
+		if err := json.Unmarshal(params, &taskParams); err != nil {
+			return "任务参数错误", nil, -2
+		}
+		message, groupList, ret := gorm.UserContactService.LoadMyJoinedGroup(taskParams.OwnerId)
+		return message, groupList, ret
+	})
+}
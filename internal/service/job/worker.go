@@ -0,0 +1,160 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	kafkaGo "github.com/segmentio/kafka-go"
+	"io"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/service/kafka"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/enum/async_job/async_job_status_enum"
+	"kama_chat_server/pkg/zlog"
+	"time"
+)
+
+var ctx = context.Background()
+
+// slots 限制本实例同时执行的任务数
+var slots = make(chan struct{}, getJobConfig().Workers)
+
+// Start 消费kafka中的异步任务，kafka和hybrid模式下由main启动，reader关闭后返回
+func Start() {
+	for {
+		kafkaMessage, err := kafka.KafkaService.AsyncTaskReader.ReadMessage(ctx)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			zlog.Error(err.Error())
+			continue
+		}
+		var task request.AsyncTaskRequest
+		if err := json.Unmarshal(kafkaMessage.Value, &task); err != nil {
+			zlog.Error(fmt.Sprintf("异步任务反序列化失败: %v", err))
+			continue
+		}
+		runInSlot(task)
+	}
+}
+
+// dispatch 把任务写入kafka，写入失败时在本实例执行
+func dispatch(task request.AsyncTaskRequest) {
+	data, err := json.Marshal(task)
+	if err != nil {
+		zlog.Error(err.Error())
+		return
+	}
+	// 按用户分区，同一用户的任务按提交顺序执行
+	if err := kafka.KafkaService.AsyncTaskWriter.WriteMessages(ctx, kafkaGo.Message{
+		Key:   []byte(task.UserId),
+		Value: data,
+	}); err != nil {
+		zlog.Error("异步任务写入kafka失败，在本实例执行: " + err.Error())
+		go runInSlot(task)
+	}
+}
+
+func runInSlot(task request.AsyncTaskRequest) {
+	slots <- struct{}{}
+	go func() {
+		defer func() { <-slots }()
+		execute(task)
+	}()
+}
+
+// execute 执行一次任务，kafka重复投递已结束的任务时直接跳过
+func execute(task request.AsyncTaskRequest) {
+	job, err := loadJob(task.TaskId)
+	if err != nil {
+		zlog.Error(err.Error())
+		return
+	}
+	if job == nil {
+		zlog.Info(fmt.Sprintf("异步任务%s已过期，不再执行", task.TaskId))
+		return
+	}
+	if job.finished() {
+		return
+	}
+	if job.expired() {
+		finish(job, async_job_status_enum.TIMEOUT, "任务排队超时", nil)
+		return
+	}
+	handler, ok := handlers[task.TaskType]
+	if !ok {
+		finish(job, async_job_status_enum.FAILED, "未知的任务类型", nil)
+		return
+	}
+
+	job.Status = async_job_status_enum.RUNNING
+	job.Attempts = task.Attempt
+	if err := saveJob(job); err != nil {
+		zlog.Error(err.Error())
+	}
+	message, data, ret, timedOut := runWithTimeout(handler, task)
+	switch {
+	case timedOut:
+		if !retry(job, task, "任务执行超时") {
+			finish(job, async_job_status_enum.TIMEOUT, "任务执行超时", nil)
+		}
+	case ret == 0:
+		finish(job, async_job_status_enum.SUCCEEDED, message, data)
+	case ret == -1:
+		if !retry(job, task, message) {
+			finish(job, async_job_status_enum.FAILED, message, nil)
+		}
+	default:
+		// 参数错误、无权限等重试也不会成功
+		finish(job, async_job_status_enum.FAILED, message, nil)
+	}
+}
+
+type handlerResult struct {
+	message string
+	data    interface{}
+	ret     int
+}
+
+// runWithTimeout 超时后不再等待，handler所在的协程执行完后结果被丢弃
+func runWithTimeout(handler Handler, task request.AsyncTaskRequest) (string, interface{}, int, bool) {
+	done := make(chan handlerResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				zlog.Error(fmt.Sprintf("异步任务%s panic: %v", task.TaskId, r))
+				done <- handlerResult{message: constants.SYSTEM_ERROR, ret: -1}
+			}
+		}()
+		message, data, ret := handler(task.UserId, task.Parameters)
+		done <- handlerResult{message: message, data: data, ret: ret}
+	}()
+	timer := time.NewTimer(time.Duration(getJobConfig().TimeoutSeconds) * time.Second)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		return result.message, result.data, result.ret, false
+	case <-timer.C:
+		return "", nil, 0, true
+	}
+}
+
+// retry 还有剩余次数时等待退避时间后重新提交，返回是否已安排重试
+func retry(job *asyncJob, task request.AsyncTaskRequest, reason string) bool {
+	if task.Attempt >= getJobConfig().MaxAttempts {
+		return false
+	}
+	job.Status = async_job_status_enum.PENDING
+	job.Message = reason + "，等待重试"
+	if err := saveJob(job); err != nil {
+		zlog.Error(err.Error())
+	}
+	next := task
+	next.Attempt++
+	time.AfterFunc(retryBackoff(task.Attempt), func() {
+		dispatch(next)
+	})
+	return true
+}
@@ -0,0 +1,117 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	myconfig "kama_chat_server/internal/config"
+	"os"
+	"strings"
+	"time"
+)
+
+// brokers hostPort中用逗号分隔多个节点
+func brokers(kafkaConfig myconfig.KafkaConfig) []string {
+	var list []string
+	for _, broker := range strings.Split(kafkaConfig.HostPort, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			list = append(list, broker)
+		}
+	}
+	return list
+}
+
+// asyncTaskTopic 异步任务topic，没有配置时沿用原来的名称
+func asyncTaskTopic() string {
+	if topic := myconfig.GetConfig().KafkaConfig.AsyncTaskTopic; topic != "" {
+		return topic
+	}
+	return "async_tasks"
+}
+
+// requiredAcks 生产者确认级别，没有配置时等待leader确认
+func requiredAcks(acks string) kafka.RequiredAcks {
+	switch acks {
+	case "none":
+		return kafka.RequireNone
+	case "all":
+		return kafka.RequireAll
+	}
+	return kafka.RequireOne
+}
+
+// batchTimeout kafka-go默认凑批等待1秒，同步发送时会直接体现为消息延迟，没有配置时使用10毫秒
+func batchTimeout(kafkaConfig myconfig.KafkaConfig) time.Duration {
+	if kafkaConfig.BatchTimeoutMs <= 0 {
+		return 10 * time.Millisecond
+	}
+	return time.Duration(kafkaConfig.BatchTimeoutMs) * time.Millisecond
+}
+
+// newConnection 按配置生成reader和建topic使用的Dialer、writer使用的Transport，两者的认证和TLS配置相同
+func newConnection(kafkaConfig myconfig.KafkaConfig) (*kafka.Dialer, *kafka.Transport, error) {
+	mechanism, err := saslMechanism(kafkaConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig, err := tlsConfig(kafkaConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	timeout := kafkaConfig.Timeout * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	dialer := &kafka.Dialer{
+		Timeout:       timeout,
+		DualStack:     true,
+		TLS:           tlsConfig,
+		SASLMechanism: mechanism,
+	}
+	transport := &kafka.Transport{
+		DialTimeout: timeout,
+		TLS:         tlsConfig,
+		SASL:        mechanism,
+	}
+	return dialer, transport, nil
+}
+
+// saslMechanism 目前只支持PLAIN，PLAIN会明文传输密码，需要同时开启TLS
+func saslMechanism(kafkaConfig myconfig.KafkaConfig) (sasl.Mechanism, error) {
+	switch strings.ToLower(kafkaConfig.SaslMechanism) {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{
+			Username: kafkaConfig.SaslUsername,
+			Password: kafkaConfig.SaslPassword,
+		}, nil
+	}
+	return nil, fmt.Errorf("不支持的kafka SASL认证方式: %s", kafkaConfig.SaslMechanism)
+}
+
+func tlsConfig(kafkaConfig myconfig.KafkaConfig) (*tls.Config, error) {
+	if !kafkaConfig.TlsEnable {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: kafkaConfig.TlsInsecureSkipVerify,
+	}
+	if kafkaConfig.TlsCaFile != "" {
+		caCert, err := os.ReadFile(kafkaConfig.TlsCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("kafka CA证书格式错误: " + kafkaConfig.TlsCaFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
@@ -2,9 +2,13 @@ package kafka
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/segmentio/kafka-go"
 	myconfig "kama_chat_server/internal/config"
 	"kama_chat_server/pkg/zlog"
+	"net"
+	"strconv"
 	"time"
 )
 
@@ -15,46 +19,62 @@ type kafkaService struct {
 	ChatReader      *kafka.Reader
 	AsyncTaskWriter *kafka.Writer
 	AsyncTaskReader *kafka.Reader
-	KafkaConn       *kafka.Conn
+	// 死信topic，聊天消息处理失败后写入，由死信消费者落表
+	DeadLetterWriter *kafka.Writer
+	DeadLetterReader *kafka.Reader
+	dialer           *kafka.Dialer
+	transport        *kafka.Transport
 }
 
 var KafkaService = new(kafkaService)
 
-// KafkaInit 初始化kafka
-func (k *kafkaService) KafkaInit() {
-	//k.CreateTopic()
+// KafkaInit 初始化kafka，先创建需要的topic，认证或TLS配置错误时返回错误
+func (k *kafkaService) KafkaInit() error {
 	kafkaConfig := myconfig.GetConfig().KafkaConfig
-	k.ChatWriter = &kafka.Writer{
-		Addr:                   kafka.TCP(kafkaConfig.HostPort),
-		Topic:                  kafkaConfig.ChatTopic,
-		Balancer:               &kafka.Hash{},
-		WriteTimeout:           kafkaConfig.Timeout * time.Second,
-		RequiredAcks:           kafka.RequireNone,
-		AllowAutoTopicCreation: false,
+	var err error
+	if k.dialer, k.transport, err = newConnection(kafkaConfig); err != nil {
+		return err
 	}
-	k.ChatReader = kafka.NewReader(kafka.ReaderConfig{
-		Brokers:        []string{kafkaConfig.HostPort},
-		Topic:          kafkaConfig.ChatTopic,
-		CommitInterval: kafkaConfig.Timeout * time.Second,
-		GroupID:        "chat",
-		StartOffset:    kafka.LastOffset,
-	})
-	
-	// 初始化异步任务相关的Writer和Reader
-	k.AsyncTaskWriter = &kafka.Writer{
-		Addr:                   kafka.TCP(kafkaConfig.HostPort),
-		Topic:                  "async_tasks",
+	if err := k.CreateTopic(); err != nil {
+		// 生产环境可能没有建topic的权限，由运维提前创建，这里只记录
+		zlog.Error("创建kafka topic失败: " + err.Error())
+	}
+
+	k.ChatWriter = k.newWriter(kafkaConfig.ChatTopic)
+	k.ChatReader = k.newReader(kafkaConfig.ChatTopic, "chat", kafka.LastOffset)
+	k.AsyncTaskWriter = k.newWriter(asyncTaskTopic())
+	k.AsyncTaskReader = k.newReader(asyncTaskTopic(), "async_task_workers", kafka.LastOffset)
+	k.DeadLetterWriter = k.newWriter(myconfig.GetConfig().DeadLetterConfig.Topic)
+	// 死信不能丢，从最早的未提交位置开始消费
+	k.DeadLetterReader = k.newReader(myconfig.GetConfig().DeadLetterConfig.Topic, "dead_letter", kafka.FirstOffset)
+	return nil
+}
+
+func (k *kafkaService) newWriter(topic string) *kafka.Writer {
+	kafkaConfig := myconfig.GetConfig().KafkaConfig
+	return &kafka.Writer{
+		Addr:                   kafka.TCP(brokers(kafkaConfig)...),
+		Topic:                  topic,
 		Balancer:               &kafka.Hash{},
 		WriteTimeout:           kafkaConfig.Timeout * time.Second,
-		RequiredAcks:           kafka.RequireNone,
+		RequiredAcks:           requiredAcks(kafkaConfig.RequiredAcks),
+		BatchSize:              kafkaConfig.BatchSize,
+		BatchBytes:             kafkaConfig.BatchBytes,
+		BatchTimeout:           batchTimeout(kafkaConfig),
+		Transport:              k.transport,
 		AllowAutoTopicCreation: false,
 	}
-	k.AsyncTaskReader = kafka.NewReader(kafka.ReaderConfig{
-		Brokers:        []string{kafkaConfig.HostPort},
-		Topic:          "async_tasks",
+}
+
+func (k *kafkaService) newReader(topic, groupId string, startOffset int64) *kafka.Reader {
+	kafkaConfig := myconfig.GetConfig().KafkaConfig
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:        brokers(kafkaConfig),
+		Topic:          topic,
 		CommitInterval: kafkaConfig.Timeout * time.Second,
-		GroupID:        "async_task_workers",
-		StartOffset:    kafka.LastOffset,
+		GroupID:        groupId,
+		StartOffset:    startOffset,
+		Dialer:         k.dialer,
 	})
 }
 
@@ -71,38 +91,58 @@ func (k *kafkaService) KafkaClose() {
 	if err := k.AsyncTaskReader.Close(); err != nil {
 		zlog.Error(err.Error())
 	}
+	if err := k.DeadLetterWriter.Close(); err != nil {
+		zlog.Error(err.Error())
+	}
+	if err := k.DeadLetterReader.Close(); err != nil {
+		zlog.Error(err.Error())
+	}
 }
 
-// CreateTopic 创建topic
-func (k *kafkaService) CreateTopic() {
-	// 如果已经有topic了，就不创建了
+// CreateTopic 创建用到的topic，已存在的topic不受影响
+// 建topic的请求需要发给controller节点，先通过任意节点查到controller
+func (k *kafkaService) CreateTopic() error {
 	kafkaConfig := myconfig.GetConfig().KafkaConfig
-
-	chatTopic := kafkaConfig.ChatTopic
-
-	// 连接至任意kafka节点
+	var conn *kafka.Conn
 	var err error
-	k.KafkaConn, err = kafka.Dial("tcp", kafkaConfig.HostPort)
+	for _, broker := range brokers(kafkaConfig) {
+		if conn, err = k.dialer.Dial("tcp", broker); err == nil {
+			break
+		}
+		zlog.Error(fmt.Sprintf("连接kafka节点%s失败: %v", broker, err))
+	}
+	if conn == nil {
+		if err == nil {
+			err = errors.New("没有配置kafka节点")
+		}
+		return err
+	}
+	defer conn.Close()
+	controller, err := conn.Controller()
 	if err != nil {
-		zlog.Error(err.Error())
+		return err
 	}
-
-	topicConfigs := []kafka.TopicConfig{
-		{
-			Topic:             chatTopic,
-			NumPartitions:     kafkaConfig.Partition,
-			ReplicationFactor: 1,
-		},
-		{
-			Topic:             "async_tasks",
-			NumPartitions:     kafkaConfig.Partition,
-			ReplicationFactor: 1,
-		},
+	controllerConn, err := k.dialer.Dial("tcp", net.JoinHostPort(controller.Host, strconv.Itoa(controller.Port)))
+	if err != nil {
+		return err
 	}
+	defer controllerConn.Close()
 
-	// 创建topic
-	if err = k.KafkaConn.CreateTopics(topicConfigs...); err != nil {
-		zlog.Error(err.Error())
+	numPartitions := kafkaConfig.Partition
+	if numPartitions <= 0 {
+		numPartitions = 1
 	}
-
+	replicationFactor := kafkaConfig.ReplicationFactor
+	if replicationFactor <= 0 {
+		replicationFactor = 1
+	}
+	var topicConfigs []kafka.TopicConfig
+	for _, topic := range []string{kafkaConfig.ChatTopic, asyncTaskTopic(), myconfig.GetConfig().DeadLetterConfig.Topic} {
+		topicConfigs = append(topicConfigs, kafka.TopicConfig{
+			Topic:             topic,
+			NumPartitions:     numPartitions,
+			ReplicationFactor: replicationFactor,
+		})
+	}
+	return controllerConn.CreateTopics(topicConfigs...)
 }
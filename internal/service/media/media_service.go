@@ -0,0 +1,228 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"kama_chat_server/internal/config"
+	"kama_chat_server/pkg/constants"
+	"kama_chat_server/pkg/util/mediainfo"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileMeta 媒体文件元数据
+type FileMeta struct {
+	ThumbnailUrl string // 缩略图url，仅图片，需要签名后才能下载
+	Width        int    // 宽度，仅图片
+	Height       int    // 高度，仅图片
+	Duration     int    // 时长，单位秒，仅音频
+}
+
+var imageExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+var audioExts = map[string]bool{
+	".mp3":  true,
+	".wav":  true,
+	".ogg":  true,
+	".webm": true,
+	".m4a":  true,
+	".aac":  true,
+	".amr":  true,
+}
+
+// voiceMagics 语音支持的编码及对应的文件头
+var voiceMagics = map[string][]string{
+	".wav":  {"RIFF"},
+	".mp3":  {"ID3", "\xff\xfb", "\xff\xf3", "\xff\xf2"},
+	".ogg":  {"OggS"},
+	".webm": {"\x1a\x45\xdf\xa3"},
+	".amr":  {"#!AMR"},
+	".aac":  {"\xff\xf1", "\xff\xf9"},
+}
+
+// IsImage 根据扩展名判断是否为图片
+func IsImage(fileName string) bool {
+	return imageExts[strings.ToLower(filepath.Ext(fileName))]
+}
+
+// IsAudio 根据扩展名判断是否为音频
+func IsAudio(fileName string) bool {
+	return audioExts[strings.ToLower(filepath.Ext(fileName))]
+}
+
+// CheckVoice 校验语音文件的编码和时长，返回最终时长（秒）
+// parsed为上传时解析出的时长，wav/mp3以它为准，其他格式无法解析时使用前端上报的时长
+// 这里只读取文件头，不再解析整个文件
+func CheckVoice(fileUrl string, parsed, duration int) (int, error) {
+	localPath := LocalFilePath(fileUrl)
+	ext := strings.ToLower(filepath.Ext(localPath))
+	magics, ok := voiceMagics[ext]
+	if !ok {
+		return 0, fmt.Errorf("不支持的语音格式%s", ext)
+	}
+	file, err := os.Open(localPath)
+	if err != nil {
+		return 0, errors.New("语音文件不存在")
+	}
+	header := make([]byte, 8)
+	n, _ := io.ReadFull(file, header)
+	file.Close()
+	matched := false
+	for _, magic := range magics {
+		if strings.HasPrefix(string(header[:n]), magic) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return 0, fmt.Errorf("语音文件内容与格式%s不符", ext)
+	}
+	if parsed > 0 {
+		duration = parsed
+	}
+	if duration <= 0 || duration > constants.VOICE_MAX_DURATION {
+		return 0, fmt.Errorf("语音时长需在1到%d秒之间", constants.VOICE_MAX_DURATION)
+	}
+	return duration, nil
+}
+
+// LocalFilePath 将消息中的文件url转为本地存储路径
+// 例如https://127.0.0.1:8000/static/files/xxx.png 转为 ./static/files/xxx.png
+func LocalFilePath(fileUrl string) string {
+	fileName := fileUrl
+	if decoded, err := url.QueryUnescape(fileUrl); err == nil {
+		fileName = decoded
+	}
+	// 去掉查询参数
+	if index := strings.Index(fileName, "?"); index >= 0 {
+		fileName = fileName[:index]
+	}
+	return filepath.Join(config.GetConfig().StaticFilePath, filepath.Base(fileName))
+}
+
+// LocalThumbnailPath 将消息中的缩略图url转为本地存储路径
+func LocalThumbnailPath(thumbnailUrl string) string {
+	fileName := thumbnailUrl
+	if decoded, err := url.QueryUnescape(thumbnailUrl); err == nil {
+		fileName = decoded
+	}
+	return filepath.Join(config.GetConfig().StaticThumbnailPath, filepath.Base(fileName))
+}
+
+// ExtractFileMeta 提取本地文件的元数据，图片会生成缩略图，音频会解析时长
+// 需要解码图片和读取整个音频文件，只在上传时调用，结果保存在上传记录中
+func ExtractFileMeta(localPath string) (*FileMeta, error) {
+	meta := &FileMeta{}
+	if IsImage(localPath) {
+		width, height, thumbnailUrl, err := makeThumbnail(localPath)
+		if err != nil {
+			return meta, err
+		}
+		meta.Width = width
+		meta.Height = height
+		meta.ThumbnailUrl = thumbnailUrl
+	} else if IsAudio(localPath) {
+		duration, err := audioDuration(localPath)
+		if err != nil {
+			return meta, err
+		}
+		meta.Duration = duration
+	}
+	return meta, nil
+}
+
+// makeThumbnail 生成缩略图，原图没有更新时直接复用，返回原图宽高和缩略图url
+// 先只解析图片头，像素数超过上限的图片不解码，避免解压后占用大量内存
+func makeThumbnail(localPath string) (int, int, string, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer file.Close()
+	imgConfig, err := mediainfo.ImageConfig(file, imageMaxPixels())
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	// 缩略图名包含原图扩展名，a.png和a.jpg不会共用一张缩略图
+	baseName := filepath.Base(localPath)
+	thumbnailName := "thumb_" + strings.TrimSuffix(baseName, filepath.Ext(baseName)) + "_" +
+		strings.TrimPrefix(strings.ToLower(filepath.Ext(baseName)), ".") + ".jpg"
+	thumbnailPath := filepath.Join(config.GetConfig().StaticThumbnailPath, thumbnailName)
+	thumbnailUrl := "/download/file/" + url.PathEscape(thumbnailName)
+	// 同名文件重新上传会覆盖原图，缩略图比原图旧时重新生成
+	if thumbInfo, err := os.Stat(thumbnailPath); err == nil {
+		if srcInfo, err := file.Stat(); err == nil && !thumbInfo.ModTime().Before(srcInfo.ModTime()) {
+			return imgConfig.Width, imgConfig.Height, thumbnailUrl, nil
+		}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, "", err
+	}
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("解码图片失败: %w", err)
+	}
+	if err := os.MkdirAll(config.GetConfig().StaticThumbnailPath, 0755); err != nil {
+		return 0, 0, "", err
+	}
+	out, err := os.Create(thumbnailPath)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer out.Close()
+	if err := jpeg.Encode(out, mediainfo.Resize(src, constants.THUMBNAIL_MAX_EDGE), &jpeg.Options{Quality: 80}); err != nil {
+		return 0, 0, "", err
+	}
+	return imgConfig.Width, imgConfig.Height, thumbnailUrl, nil
+}
+
+// imageMaxPixels 解析图片允许的最大像素数
+func imageMaxPixels() int64 {
+	if maxPixels := config.GetConfig().ImageMaxPixels; maxPixels > 0 {
+		return maxPixels
+	}
+	return constants.IMAGE_MAX_PIXELS
+}
+
+// audioDuration 解析音频时长（秒），目前支持wav和mp3，其他格式返回0
+func audioDuration(localPath string) (int, error) {
+	switch strings.ToLower(filepath.Ext(localPath)) {
+	case ".wav":
+		return wavDuration(localPath)
+	case ".mp3":
+		return mp3Duration(localPath)
+	default:
+		return 0, nil
+	}
+}
+
+// wavDuration 解析wav文件时长
+func wavDuration(localPath string) (int, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return mediainfo.WavDuration(file)
+}
+
+// mp3Duration 解析mp3文件时长
+func mp3Duration(localPath string) (int, error) {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return 0, err
+	}
+	return mediainfo.Mp3Duration(data)
+}
@@ -0,0 +1,195 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const maxItems = 20 // 一次通知最多携带的消息摘要数
+
+// Options 通知分发配置
+type Options struct {
+	CoalesceWindow time.Duration    // 普通推送的合并窗口，窗口内的消息合并为一次通知
+	DigestWindow   time.Duration    // 邮件摘要的合并窗口
+	SendTimeout    time.Duration    // 单次发送超时
+	ErrorLog       func(msg string) // 错误日志，为空时丢弃
+	Now            func() time.Time // 当前时间，测试时可替换
+}
+
+type pendingBatch struct {
+	setting Setting
+	count   int
+	items   []Item
+}
+
+// Dispatcher 离线通知分发器，按用户合并短时间内的消息，
+// 跳过免打扰的会话，免打扰时段内的通知延后到时段结束再发
+type Dispatcher struct {
+	store     SettingStore
+	providers map[string]Provider
+	options   Options
+	mutex     sync.Mutex
+	pending   map[string]*pendingBatch
+}
+
+// NewDispatcher 创建分发器，providers按Name()注册
+func NewDispatcher(store SettingStore, providers []Provider, options Options) *Dispatcher {
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	if options.ErrorLog == nil {
+		options.ErrorLog = func(string) {}
+	}
+	if options.SendTimeout == 0 {
+		options.SendTimeout = 10 * time.Second
+	}
+	d := &Dispatcher{
+		store:     store,
+		providers: make(map[string]Provider),
+		options:   options,
+		pending:   make(map[string]*pendingBatch),
+	}
+	for _, provider := range providers {
+		d.providers[provider.Name()] = provider
+	}
+	return d
+}
+
+// Enqueue 为离线用户加入一条待通知的消息
+func (d *Dispatcher) Enqueue(userId string, item Item) {
+	setting, err := d.store.GetSetting(userId)
+	if err != nil {
+		d.options.ErrorLog(fmt.Sprintf("获取用户%s通知设置失败: %v", userId, err))
+		return
+	}
+	if setting == nil || setting.Provider == "" {
+		return
+	}
+	if _, ok := d.providers[setting.Provider]; !ok {
+		d.options.ErrorLog(fmt.Sprintf("通知渠道%s未启用", setting.Provider))
+		return
+	}
+	mutedUntil, err := d.store.MutedUntil(userId, item.TargetId)
+	if err != nil {
+		d.options.ErrorLog(fmt.Sprintf("获取用户%s会话免打扰状态失败: %v", userId, err))
+		return
+	}
+	now := d.options.Now()
+	if now.Before(mutedUntil) {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if batch, ok := d.pending[userId]; ok {
+		// 窗口内已有待发通知，直接合并
+		batch.count++
+		batch.items = append(batch.items, item)
+		if len(batch.items) > maxItems {
+			batch.items = batch.items[len(batch.items)-maxItems:]
+		}
+		return
+	}
+	delay := d.options.CoalesceWindow
+	if setting.Provider == ProviderEmail {
+		delay = d.options.DigestWindow
+	}
+	if quiet := QuietDelay(now, setting.QuietStart, setting.QuietEnd); quiet > delay {
+		delay = quiet
+	}
+	d.pending[userId] = &pendingBatch{
+		setting: *setting,
+		count:   1,
+		items:   []Item{item},
+	}
+	time.AfterFunc(delay, func() {
+		d.flush(userId)
+	})
+}
+
+// Flush 立即发送所有待发通知，用于关闭服务前
+func (d *Dispatcher) Flush() {
+	d.mutex.Lock()
+	userIds := make([]string, 0, len(d.pending))
+	for userId := range d.pending {
+		userIds = append(userIds, userId)
+	}
+	d.mutex.Unlock()
+	for _, userId := range userIds {
+		d.flush(userId)
+	}
+}
+
+// flush 发送某个用户合并后的通知
+func (d *Dispatcher) flush(userId string) {
+	d.mutex.Lock()
+	batch, ok := d.pending[userId]
+	delete(d.pending, userId)
+	d.mutex.Unlock()
+	if !ok {
+		return
+	}
+	provider := d.providers[batch.setting.Provider]
+	notification := Notification{
+		UserId: userId,
+		Target: batch.setting.Target,
+		Title:  "新消息",
+		Count:  batch.count,
+		Items:  batch.items,
+	}
+	last := batch.items[len(batch.items)-1]
+	if batch.count == 1 {
+		notification.Title = last.SendName
+		notification.Body = last.Preview
+	} else {
+		notification.Body = fmt.Sprintf("%s等发来%d条新消息", last.SendName, batch.count)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.options.SendTimeout)
+	defer cancel()
+	if err := provider.Send(ctx, notification); err != nil {
+		d.options.ErrorLog(fmt.Sprintf("通过%s给用户%s发送通知失败: %v", provider.Name(), userId, err))
+	}
+}
+
+// QuietDelay 计算距离免打扰时段结束的时长，不在免打扰时段内返回0
+// 支持跨零点的时段，例如22:00到08:00
+func QuietDelay(now time.Time, quietStart, quietEnd string) time.Duration {
+	if quietStart == "" || quietEnd == "" {
+		return 0
+	}
+	start, err := ParseClock(quietStart)
+	if err != nil {
+		return 0
+	}
+	end, err := ParseClock(quietEnd)
+	if err != nil || start == end {
+		return 0
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	current := now.Sub(midnight)
+	if start < end {
+		if current >= start && current < end {
+			return end - current
+		}
+		return 0
+	}
+	if current >= start {
+		return 24*time.Hour - current + end
+	}
+	if current < end {
+		return end - current
+	}
+	return 0
+}
+
+// ParseClock 解析HH:MM格式的时间，返回距零点的时长
+func ParseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, errors.New("时间格式应为HH:MM")
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,44 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"kama_chat_server/internal/service/email"
+	"strings"
+)
+
+// EmailDigestProvider 以邮件摘要的形式发送合并后的离线消息
+type EmailDigestProvider struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (e *EmailDigestProvider) Name() string {
+	return ProviderEmail
+}
+
+func (e *EmailDigestProvider) Send(ctx context.Context, notification Notification) error {
+	var body strings.Builder
+	body.WriteString(fmt.Sprintf("您有%d条未读消息：\r\n\r\n", notification.Count))
+	for _, item := range notification.Items {
+		body.WriteString(fmt.Sprintf("[%s] %s：%s\r\n", item.CreatedAt.Format("2006-01-02 15:04"), item.SendName, item.Preview))
+	}
+	if notification.Count > len(notification.Items) {
+		body.WriteString(fmt.Sprintf("\r\n……其余%d条请登录查看\r\n", notification.Count-len(notification.Items)))
+	}
+	sender := &email.SmtpSender{
+		Host:     e.Host,
+		Port:     e.Port,
+		Username: e.Username,
+		Password: e.Password,
+		From:     e.From,
+	}
+	return sender.Send(ctx, email.Mail{
+		To:      notification.Target,
+		Subject: fmt.Sprintf("%d条未读消息", notification.Count),
+		Body:    body.String(),
+	})
+}
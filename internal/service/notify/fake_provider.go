@@ -0,0 +1,41 @@
+package notify
+
+import (
+	"context"
+	"sync"
+)
+
+// FakeProvider 本地假渠道，只记录通知不真正发送，用于测试和本地开发
+type FakeProvider struct {
+	name  string
+	mutex sync.Mutex
+	sent  []Notification
+}
+
+// NewFakeProvider 创建假渠道，name为空时注册为fake，也可以用来替换真实渠道
+func NewFakeProvider(name string) *FakeProvider {
+	if name == "" {
+		name = ProviderFake
+	}
+	return &FakeProvider{name: name}
+}
+
+func (f *FakeProvider) Name() string {
+	return f.name
+}
+
+func (f *FakeProvider) Send(ctx context.Context, notification Notification) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.sent = append(f.sent, notification)
+	return nil
+}
+
+// Sent 返回已记录的通知
+func (f *FakeProvider) Sent() []Notification {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	sent := make([]Notification, len(f.sent))
+	copy(sent, f.sent)
+	return sent
+}
@@ -0,0 +1,54 @@
+package notify
+
+import (
+	"context"
+	"time"
+)
+
+// 通知渠道名称，与NotificationSetting.Provider一致
+const (
+	ProviderWebPush = "webpush"
+	ProviderWebhook = "webhook"
+	ProviderEmail   = "email"
+	ProviderFake    = "fake"
+)
+
+// Item 一条待通知的消息摘要
+type Item struct {
+	TargetId  string    // 会话对象，单聊为发送者uuid，群聊为群聊uuid
+	SendName  string    // 发送者昵称
+	Preview   string    // 消息摘要
+	CreatedAt time.Time // 消息时间
+}
+
+// Notification 合并后发给渠道的一次通知
+type Notification struct {
+	UserId string // 接收通知的用户
+	Target string // 推送目标，web push为订阅json，webhook为设备token，邮件为邮箱
+	Title  string
+	Body   string
+	Count  int    // 合并的消息总数
+	Items  []Item // 合并的消息摘要，最多保留maxItems条
+}
+
+// Setting 用户的通知设置，Provider为空表示不接收离线通知
+type Setting struct {
+	Provider   string
+	Target     string
+	QuietStart string // 免打扰开始时间，HH:MM，为空表示不设置
+	QuietEnd   string // 免打扰结束时间，HH:MM
+}
+
+// Provider 推送渠道
+type Provider interface {
+	Name() string
+	Send(ctx context.Context, notification Notification) error
+}
+
+// SettingStore 读取用户通知设置和会话免打扰状态
+type SettingStore interface {
+	// GetSetting 获取用户的通知设置，未设置时返回nil
+	GetSetting(userId string) (*Setting, error)
+	// MutedUntil 获取用户对某个会话的免打扰截止时间，未设置时返回零值
+	MutedUntil(userId, targetId string) (time.Time, error)
+}
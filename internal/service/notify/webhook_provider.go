@@ -0,0 +1,74 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"kama_chat_server/pkg/util/sign"
+	"net/http"
+)
+
+// WebhookProvider 将通知POST给推送网关，请求体兼容FCM的to/notification/data格式，
+// 网关再转发给APNs或FCM，请求头X-Kama-Signature为请求体的HMAC签名
+type WebhookProvider struct {
+	Url    string
+	Secret string
+	Client *http.Client
+}
+
+type webhookNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Badge int    `json:"badge"`
+}
+
+type webhookPayload struct {
+	To           string              `json:"to"`
+	Notification webhookNotification `json:"notification"`
+	Data         map[string]string   `json:"data"`
+}
+
+func (w *WebhookProvider) Name() string {
+	return ProviderWebhook
+}
+
+func (w *WebhookProvider) Send(ctx context.Context, notification Notification) error {
+	last := notification.Items[len(notification.Items)-1]
+	body, err := json.Marshal(webhookPayload{
+		To: notification.Target,
+		Notification: webhookNotification{
+			Title: notification.Title,
+			Body:  notification.Body,
+			Badge: notification.Count,
+		},
+		Data: map[string]string{
+			"user_id":   notification.UserId,
+			"target_id": last.TargetId,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		req.Header.Set("X-Kama-Signature", sign.Sign(w.Secret, string(body)))
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 300 {
+		return fmt.Errorf("推送网关返回%d", rsp.StatusCode)
+	}
+	return nil
+}
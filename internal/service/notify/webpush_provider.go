@@ -0,0 +1,118 @@
+package notify
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrSubscriptionExpired 浏览器订阅已失效，需要前端重新订阅
+var ErrSubscriptionExpired = errors.New("web push订阅已失效")
+
+// WebPushProvider 通过VAPID认证发送Web Push
+// 推送不携带加密负载，浏览器service worker收到后再调用接口拉取未读消息，
+// Target为前端PushSubscription.toJSON()的结果
+type WebPushProvider struct {
+	Subject    string // VAPID联系方式，mailto:或https:开头
+	PublicKey  string // base64url编码的P-256公钥
+	PrivateKey string // base64url编码的P-256私钥
+	TTL        int    // 推送服务保留时长(秒)
+	Client     *http.Client
+}
+
+type webPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+}
+
+func (w *WebPushProvider) Name() string {
+	return ProviderWebPush
+}
+
+func (w *WebPushProvider) Send(ctx context.Context, notification Notification) error {
+	var subscription webPushSubscription
+	if err := json.Unmarshal([]byte(notification.Target), &subscription); err != nil || subscription.Endpoint == "" {
+		return errors.New("web push订阅格式错误")
+	}
+	endpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil {
+		return err
+	}
+	token, err := w.vapidToken(endpoint.Scheme + "://" + endpoint.Host)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.Endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("TTL", strconv.Itoa(w.TTL))
+	req.Header.Set("Urgency", "normal")
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", token, w.PublicKey))
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound || rsp.StatusCode == http.StatusGone {
+		return ErrSubscriptionExpired
+	}
+	if rsp.StatusCode >= 300 {
+		return fmt.Errorf("web push服务返回%d", rsp.StatusCode)
+	}
+	return nil
+}
+
+// vapidToken 生成ES256签名的VAPID JWT
+func (w *WebPushProvider) vapidToken(audience string) (string, error) {
+	privateKey, err := w.privateKey()
+	if err != nil {
+		return "", err
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": w.Subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, privateKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWT的ES256签名为定长32字节的r和s拼接
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (w *WebPushProvider) privateKey() (*ecdsa.PrivateKey, error) {
+	d, err := base64.RawURLEncoding.DecodeString(w.PrivateKey)
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("VAPID私钥格式错误")
+	}
+	curve := elliptic.P256()
+	privateKey := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	privateKey.PublicKey.Curve = curve
+	privateKey.PublicKey.X, privateKey.PublicKey.Y = curve.ScalarBaseMult(d)
+	return privateKey, nil
+}
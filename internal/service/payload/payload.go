@@ -0,0 +1,143 @@
+package payload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/model"
+	"kama_chat_server/pkg/enum/message/message_type_enum"
+	"unicode/utf8"
+)
+
+const previewLen = 50 // 消息摘要最大字数
+
+// Store 补全结构化消息时需要查询的数据，chat包中由数据库和本地文件实现
+type Store interface {
+	// Image 解析图片的宽高和缩略图，图片格式不支持或解析失败时返回错误
+	Image(url string) (*model.ImagePayload, error)
+	// ContactCard 查询名片对应的用户或群聊
+	ContactCard(uuid string) (*model.ContactCardPayload, error)
+	// Message 按uuid查询消息，不存在时返回nil, nil
+	Message(uuid string) (*model.Message, error)
+}
+
+// IsPayloadType 判断消息类型是否携带结构化内容
+func IsPayloadType(messageType int8) bool {
+	return messageType == message_type_enum.Image || messageType == message_type_enum.Location ||
+		messageType == message_type_enum.ContactCard || messageType == message_type_enum.Reply
+}
+
+// Build 解析前端传来的payload，校验后由服务端补全展示所需的数据
+// 权限按message.SendId校验，调用前必须已经替换为连接的用户id
+func Build(store Store, message request.ChatMessageRequest) (*model.MessagePayload, error) {
+	var payload model.MessagePayload
+	if len(message.Payload) > 0 {
+		if err := json.Unmarshal(message.Payload, &payload); err != nil {
+			return nil, errors.New("消息内容格式错误")
+		}
+	}
+	if payload.Version > model.MessagePayloadVersion {
+		return nil, fmt.Errorf("不支持的消息内容版本%d", payload.Version)
+	}
+	payload.Version = model.MessagePayloadVersion
+	switch message.Type {
+	case message_type_enum.Image:
+		// 只保留本类型字段，其余字段丢弃
+		image, err := store.Image(message.Url)
+		if err != nil {
+			return nil, err
+		}
+		payload = model.MessagePayload{Version: payload.Version, Image: image}
+	case message_type_enum.Location:
+		location := payload.Location
+		if location == nil {
+			return nil, errors.New("缺少位置信息")
+		}
+		if location.Latitude < -90 || location.Latitude > 90 || location.Longitude < -180 || location.Longitude > 180 {
+			return nil, errors.New("经纬度不合法")
+		}
+		if utf8.RuneCountInString(location.Name) > 50 || utf8.RuneCountInString(location.Address) > 100 {
+			return nil, errors.New("位置名称或地址过长")
+		}
+		payload = model.MessagePayload{Version: payload.Version, Location: location}
+	case message_type_enum.ContactCard:
+		if payload.Contact == nil {
+			return nil, errors.New("缺少名片信息")
+		}
+		if payload.Contact.Uuid == "" {
+			return nil, errors.New("名片uuid不能为空")
+		}
+		contact, err := store.ContactCard(payload.Contact.Uuid)
+		if err != nil {
+			return nil, err
+		}
+		payload = model.MessagePayload{Version: payload.Version, Contact: contact}
+	case message_type_enum.Reply:
+		if payload.Reply == nil {
+			return nil, errors.New("缺少引用的消息")
+		}
+		if message.Content == "" {
+			return nil, errors.New("回复内容不能为空")
+		}
+		reply, err := buildReply(store, payload.Reply.MessageId, message.SendId, message.ReceiveId)
+		if err != nil {
+			return nil, err
+		}
+		payload = model.MessagePayload{Version: payload.Version, Reply: reply}
+	default:
+		return nil, errors.New("该消息类型不支持结构化内容")
+	}
+	return &payload, nil
+}
+
+// buildReply 校验被引用消息属于当前会话，并生成摘要
+func buildReply(store Store, messageId, sendId, receiveId string) (*model.ReplyPayload, error) {
+	quoted, err := store.Message(messageId)
+	if err != nil {
+		return nil, err
+	}
+	if quoted == nil {
+		return nil, errors.New("引用的消息不存在")
+	}
+	inSession := false
+	if receiveId != "" && receiveId[0] == 'G' {
+		inSession = quoted.ReceiveId == receiveId
+	} else {
+		inSession = (quoted.SendId == sendId && quoted.ReceiveId == receiveId) ||
+			(quoted.SendId == receiveId && quoted.ReceiveId == sendId)
+	}
+	if !inSession {
+		return nil, errors.New("只能引用当前会话中的消息")
+	}
+	return &model.ReplyPayload{
+		MessageId: quoted.Uuid,
+		SendId:    quoted.SendId,
+		SendName:  quoted.SendName,
+		Type:      quoted.Type,
+		Preview:   Preview(*quoted),
+	}, nil
+}
+
+// Preview 生成消息的文字摘要，用于引用回复、会话列表和离线通知
+func Preview(message model.Message) string {
+	switch message.Type {
+	case message_type_enum.Voice:
+		return "[语音]"
+	case message_type_enum.File:
+		return "[文件]" + message.FileName
+	case message_type_enum.AudioOrVideo:
+		return "[通话]"
+	case message_type_enum.Image:
+		return "[图片]"
+	case message_type_enum.Location:
+		return "[位置]"
+	case message_type_enum.ContactCard:
+		return "[名片]"
+	}
+	runes := []rune(message.Content)
+	if len(runes) > previewLen {
+		return string(runes[:previewLen]) + "..."
+	}
+	return string(runes)
+}
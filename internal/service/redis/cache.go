@@ -0,0 +1,271 @@
+package redis
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"kama_chat_server/pkg/zlog"
+)
+
+// cacheVersion 缓存结构变化时递增，旧版本的键自然过期
+const cacheVersion = "v1"
+
+const (
+	keyPrefix   = "kama:" + cacheVersion + ":"
+	tagPrefix   = keyPrefix + "tag:"
+	lockPrefix  = keyPrefix + "lock:"
+	genPrefix   = keyPrefix + "gen:"
+	tagGenKey   = genPrefix + "tags"    // 按标签或类别失效时递增，加载前还不知道结果会打哪些标签
+	genTTL      = time.Minute           // 版本号只需要比一次加载活得久
+	lockTimeout = 5 * time.Second       // 加载锁超时，防止加载方崩溃后一直持有
+	lockWait    = 1 * time.Second       // 未抢到加载锁时最多等待的时长
+	lockPoll    = 50 * time.Millisecond // 等待加载结果的轮询间隔
+)
+
+// CacheKind 一类缓存，键由Name和参数拼接，TTL会加上随机抖动避免同时过期
+type CacheKind struct {
+	Name string
+	TTL  time.Duration
+}
+
+// 所有缓存在这里声明，业务代码只通过Key()生成键，不再手写字符串
+var (
+	SessionListCache       = CacheKind{Name: "session_list", TTL: 10 * time.Minute}
+	GroupSessionListCache  = CacheKind{Name: "group_session_list", TTL: 10 * time.Minute}
+	ContactUserListCache   = CacheKind{Name: "contact_user_list", TTL: 10 * time.Minute}
+	MyGroupListCache       = CacheKind{Name: "contact_mygroup_list", TTL: 10 * time.Minute}
+	MyJoinedGroupListCache = CacheKind{Name: "my_joined_group_list", TTL: 10 * time.Minute}
+	GroupInfoCache         = CacheKind{Name: "group_info", TTL: 30 * time.Minute}
+	GroupMemberListCache   = CacheKind{Name: "group_memberlist", TTL: 10 * time.Minute}
+	UserInfoCache          = CacheKind{Name: "user_info", TTL: 30 * time.Minute}
+	SessionCache           = CacheKind{Name: "session", TTL: 10 * time.Minute}
+	// 异步任务的状态和结果，不走GetOrLoad，过期时间由asyncJobConfig决定
+	AsyncJobCache = CacheKind{Name: "async_job", TTL: 10 * time.Minute}
+)
+
+// Key 生成缓存键，例如kama:v1:session_list:U123
+func (k CacheKind) Key(parts ...string) string {
+	return keyPrefix + k.Name + ":" + strings.Join(parts, ":")
+}
+
+// Pattern 该类缓存所有键的匹配模式
+func (k CacheKind) Pattern() string {
+	return keyPrefix + k.Name + ":*"
+}
+
+// ttl 在TTL基础上加最多10%的随机抖动
+func (k CacheKind) ttl() time.Duration {
+	jitter := int64(k.TTL) / 10
+	if jitter <= 0 {
+		return k.TTL
+	}
+	return k.TTL + time.Duration(rand.Int63n(jitter))
+}
+
+// UserTag 与某个用户相关的缓存标签，用户信息变化时失效
+func UserTag(userId string) string {
+	return "user:" + userId
+}
+
+// GroupTag 与某个群聊相关的缓存标签，群信息或成员变化时失效
+func GroupTag(groupId string) string {
+	return "group:" + groupId
+}
+
+// SessionTag 某个用户的会话缓存标签，会话新建、删除或设置变化时失效
+func SessionTag(userId string) string {
+	return "session:" + userId
+}
+
+// Loader 缓存未命中时从数据库加载，返回值会被json序列化，tags用于后续按标签失效
+type Loader func() (value interface{}, tags []string, err error)
+
+// loadCall 进程内同一个键的并发加载只执行一次
+type loadCall struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+var (
+	loadMutex sync.Mutex
+	loadCalls = make(map[string]*loadCall)
+)
+
+// GetOrLoad 读穿缓存：命中时反序列化到dst，未命中时调用loader加载并写入缓存
+// 进程内同键只加载一次，跨进程通过SETNX加载锁避免缓存击穿，redis异常时直接走loader
+func GetOrLoad(kind CacheKind, key string, dst interface{}, loader Loader) error {
+	value, err := redisClient.Get(ctx, key).Result()
+	if err == nil {
+		if err := json.Unmarshal([]byte(value), dst); err == nil {
+			return nil
+		}
+		zlog.Error("缓存内容反序列化失败，重新加载: " + key)
+	} else if !errors.Is(err, redis.Nil) {
+		zlog.Error(err.Error())
+	}
+
+	loadMutex.Lock()
+	if call, ok := loadCalls[key]; ok {
+		loadMutex.Unlock()
+		call.wg.Wait()
+		if call.err != nil {
+			return call.err
+		}
+		return json.Unmarshal(call.data, dst)
+	}
+	call := &loadCall{}
+	call.wg.Add(1)
+	loadCalls[key] = call
+	loadMutex.Unlock()
+
+	call.data, call.err = load(kind, key, loader)
+	call.wg.Done()
+	loadMutex.Lock()
+	delete(loadCalls, key)
+	loadMutex.Unlock()
+
+	if call.err != nil {
+		return call.err
+	}
+	return json.Unmarshal(call.data, dst)
+}
+
+// load 抢到加载锁的实例负责加载并回填，其余实例短暂等待回填结果，超时后自行加载但不回填
+// 加载前记下版本号，加载期间发生过失效时不回填，避免把失效前读到的旧数据写回缓存
+func load(kind CacheKind, key string, loader Loader) ([]byte, error) {
+	lockKey := lockPrefix + key
+	locked, err := redisClient.SetNX(ctx, lockKey, 1, lockTimeout).Result()
+	if err != nil {
+		zlog.Error(err.Error())
+	}
+	if !locked && err == nil {
+		deadline := time.Now().Add(lockWait)
+		for time.Now().Before(deadline) {
+			time.Sleep(lockPoll)
+			if value, err := redisClient.Get(ctx, key).Result(); err == nil {
+				return []byte(value), nil
+			}
+		}
+	}
+
+	var gens []interface{}
+	if locked {
+		if gens, err = redisClient.MGet(ctx, genPrefix+key, tagGenKey).Result(); err != nil {
+			zlog.Error(err.Error())
+			redisClient.Del(ctx, lockKey)
+			locked = false
+		}
+	}
+	value, tags, err := loader()
+	if err != nil {
+		if locked {
+			redisClient.Del(ctx, lockKey)
+		}
+		return nil, err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if locked {
+		if err := setIfCurrent(kind, key, data, tags, gens); err != nil {
+			zlog.Error(err.Error())
+		}
+		redisClient.Del(ctx, lockKey)
+	}
+	return data, nil
+}
+
+// setIfCurrentScript 版本号和加载前一致时写入缓存并登记到标签集合，否则放弃
+// KEYS: 缓存键, 键版本, 标签版本, 标签集合...  ARGV: 键版本, 标签版本, 内容, ttl毫秒
+var setIfCurrentScript = redis.NewScript(`
+if (redis.call('GET', KEYS[2]) or '') ~= ARGV[1] or (redis.call('GET', KEYS[3]) or '') ~= ARGV[2] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[3], 'PX', ARGV[4])
+for i = 4, #KEYS do
+	redis.call('SADD', KEYS[i], KEYS[1])
+	redis.call('PEXPIRE', KEYS[i], ARGV[4] * 2)
+end
+return 1
+`)
+
+// setIfCurrent 写入缓存并登记到标签集合，gens为加载前读到的键版本和标签版本
+// 标签集合比其中的键活得久即可，键过期后残留的成员在失效时删除不存在的键无副作用
+func setIfCurrent(kind CacheKind, key string, data []byte, tags []string, gens []interface{}) error {
+	keys := []string{key, genPrefix + key, tagGenKey}
+	for _, tag := range tags {
+		keys = append(keys, tagPrefix+tag)
+	}
+	args := []interface{}{genString(gens[0]), genString(gens[1]), data, kind.ttl().Milliseconds()}
+	return setIfCurrentScript.Run(ctx, redisClient, keys, args...).Err()
+}
+
+// genString 版本号不存在时为空串，和脚本中GET返回false时的处理一致
+func genString(gen interface{}) string {
+	if value, ok := gen.(string); ok {
+		return value
+	}
+	return ""
+}
+
+// bumpGen 失效前递增版本号，正在进行的加载不再回填
+func bumpGen(genKeys ...string) error {
+	pipe := redisClient.TxPipeline()
+	for _, genKey := range genKeys {
+		pipe.Incr(ctx, genKey)
+		pipe.Expire(ctx, genKey, genTTL)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Invalidate 删除指定的缓存键
+func Invalidate(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	genKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		genKeys = append(genKeys, genPrefix+key)
+	}
+	if err := bumpGen(genKeys...); err != nil {
+		return err
+	}
+	return redisClient.Del(ctx, keys...).Err()
+}
+
+// InvalidateTags 删除打了这些标签的所有缓存
+func InvalidateTags(tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	if err := bumpGen(tagGenKey); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		keys, err := redisClient.SMembers(ctx, tagPrefix+tag).Result()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, tagPrefix+tag)
+		if err := redisClient.Del(ctx, keys...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InvalidateKind 删除某一类的全部缓存，使用SCAN遍历
+func InvalidateKind(kind CacheKind) error {
+	if err := bumpGen(tagGenKey); err != nil {
+		return err
+	}
+	return scanDelete(kind.Pattern())
+}
@@ -0,0 +1,187 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"kama_chat_server/pkg/util/random"
+)
+
+const limitPrefix = keyPrefix + "limit:"
+
+// slidingWindowScript 先清理窗口外的记录，未超限时记录本次请求
+// 返回{是否允许, 超限时需要等待的毫秒数}
+var slidingWindowScript = redis.NewScript(`
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', key, 0, now - window)
+local count = redis.call('ZCARD', key)
+if count >= limit then
+	local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+	return {0, tonumber(oldest[2]) + window - now}
+end
+redis.call('ZADD', key, now, ARGV[4])
+redis.call('PEXPIRE', key, window)
+return {1, 0}
+`)
+
+// slidingWindowAllScript 多个窗口同时检查，全部未超限时才在每个窗口中记录本次请求
+// ARGV为now、member，之后每个key依次对应window、limit
+// 返回{是否允许, 超限时需要等待的最长毫秒数}
+var slidingWindowAllScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local allowed = 1
+local wait = 0
+for i = 1, #KEYS do
+	local window = tonumber(ARGV[i * 2 + 1])
+	local limit = tonumber(ARGV[i * 2 + 2])
+	redis.call('ZREMRANGEBYSCORE', KEYS[i], 0, now - window)
+	if redis.call('ZCARD', KEYS[i]) >= limit then
+		allowed = 0
+		local oldest = redis.call('ZRANGE', KEYS[i], 0, 0, 'WITHSCORES')
+		wait = math.max(wait, tonumber(oldest[2]) + window - now)
+	end
+end
+if allowed == 0 then
+	return {0, wait}
+end
+for i = 1, #KEYS do
+	redis.call('ZADD', KEYS[i], now, ARGV[2])
+	redis.call('PEXPIRE', KEYS[i], tonumber(ARGV[i * 2 + 1]))
+end
+return {1, 0}
+`)
+
+// slidingWindowPeekScript 只查询窗口内的次数，不记录
+// 返回{次数, 最早一条记录移出窗口还需的毫秒数}
+var slidingWindowPeekScript = redis.NewScript(`
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call('ZREMRANGEBYSCORE', key, 0, now - window)
+local count = redis.call('ZCARD', key)
+if count == 0 then
+	return {0, 0}
+end
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+return {count, tonumber(oldest[2]) + window - now}
+`)
+
+// tokenBucketScript 按流逝的时间补充令牌，有令牌时取走一个
+// 返回{是否允许, 没有令牌时需要等待的毫秒数}
+var tokenBucketScript = redis.NewScript(`
+local key = KEYS[1]
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', key, 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', key, 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', key, math.ceil(burst / rate) + 1000)
+return {allowed, wait}
+`)
+
+// RateLimit 滑动窗口限流，Window内最多Limit次，适合配额和失败计数这类需要精确计数的场景
+type RateLimit struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+// Key 生成限流键，例如kama:v1:limit:sms_hour:13800000000
+func (r RateLimit) Key(parts ...string) string {
+	return limitPrefix + r.Name + ":" + strings.Join(parts, ":")
+}
+
+// Allow 记录一次请求，超限时不记录并返回还需等待的时长，Limit为0时不限制
+func (r RateLimit) Allow(parts ...string) (bool, time.Duration, error) {
+	if r.Limit <= 0 {
+		return true, 0, nil
+	}
+	now := time.Now().UnixMilli()
+	member := strconv.FormatInt(now, 10) + "-" + random.GetNowAndLenRandomString(6)
+	res, err := slidingWindowScript.Run(ctx, redisClient, []string{r.Key(parts...)},
+		now, r.Window.Milliseconds(), r.Limit, member).Int64Slice()
+	if err != nil {
+		return true, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+// AllowAll 在一个脚本中检查多个窗口，全部未超限时才同时记录，例如每小时和每天的配额
+// 超限时返回最长的等待时长，Limit为0的窗口不限制；出错时返回false，由调用方决定是否放行
+func AllowAll(limits []RateLimit, parts ...string) (bool, time.Duration, error) {
+	now := time.Now().UnixMilli()
+	keys := make([]string, 0, len(limits))
+	args := []interface{}{now, strconv.FormatInt(now, 10) + "-" + random.GetNowAndLenRandomString(6)}
+	for _, limit := range limits {
+		if limit.Limit <= 0 {
+			continue
+		}
+		keys = append(keys, limit.Key(parts...))
+		args = append(args, limit.Window.Milliseconds(), limit.Limit)
+	}
+	if len(keys) == 0 {
+		return true, 0, nil
+	}
+	res, err := slidingWindowAllScript.Run(ctx, redisClient, keys, args...).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+// Peek 查询窗口内已记录的次数，以及最早的记录移出窗口还需的时长
+func (r RateLimit) Peek(parts ...string) (int, time.Duration, error) {
+	res, err := slidingWindowPeekScript.Run(ctx, redisClient, []string{r.Key(parts...)},
+		time.Now().UnixMilli(), r.Window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(res[0]), time.Duration(res[1]) * time.Millisecond, nil
+}
+
+// Reset 清空计数，例如登录成功后清空失败次数
+func (r RateLimit) Reset(parts ...string) error {
+	return redisClient.Del(ctx, r.Key(parts...)).Err()
+}
+
+// TokenBucket 令牌桶限流，每秒补充Rate个令牌，最多积攒Burst个，适合接口访问频率限制
+type TokenBucket struct {
+	Name  string
+	Rate  float64
+	Burst int
+}
+
+// Key 生成令牌桶键，例如kama:v1:limit:ip:127.0.0.1
+func (t TokenBucket) Key(parts ...string) string {
+	return limitPrefix + t.Name + ":" + strings.Join(parts, ":")
+}
+
+// Take 取一个令牌，没有令牌时返回还需等待的时长，Rate为0时不限制
+func (t TokenBucket) Take(parts ...string) (bool, time.Duration, error) {
+	if t.Rate <= 0 || t.Burst <= 0 {
+		return true, 0, nil
+	}
+	// 脚本里按毫秒计算
+	res, err := tokenBucketScript.Run(ctx, redisClient, []string{t.Key(parts...)},
+		t.Rate/1000, t.Burst, time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return true, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
@@ -50,6 +50,18 @@ func GetKey(key string) (string, error) {
 	return value, nil
 }
 
+// GetDelKey 读取后立即删除，用于一次性的token，不存在时返回空
+func GetDelKey(key string) (string, error) {
+	value, err := redisClient.GetDel(ctx, key).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", nil
+		}
+		return "", err
+	}
+	return value, nil
+}
+
 func GetKeyNilIsErr(key string) (string, error) {
 	value, err := redisClient.Get(ctx, key).Result()
 	if err != nil {
@@ -59,57 +71,37 @@ func GetKeyNilIsErr(key string) (string, error) {
 }
 
 func GetKeyWithPrefixNilIsErr(prefix string) (string, error) {
-	var keys []string
-	var err error
-
-	for {
-		// 使用 Keys 命令迭代匹配的键
-		keys, err = redisClient.Keys(ctx, prefix+"*").Result()
-		if err != nil {
-			return "", err
-		}
-
-		if len(keys) == 0 {
-			zlog.Info("没有找到相关前缀key")
-			return "", redis.Nil
-		}
-
-		if len(keys) == 1 {
-			zlog.Info(fmt.Sprintln("成功找到了相关前缀key", keys))
-			return keys[0], nil
-		} else {
-			zlog.Error("找到了数量大于1的key，查找异常")
-			return "", errors.New("找到了数量大于1的key，查找异常")
-		}
+	keys, err := scanKeys(prefix + "*")
+	if err != nil {
+		return "", err
 	}
-
+	if len(keys) == 0 {
+		zlog.Info("没有找到相关前缀key")
+		return "", redis.Nil
+	}
+	if len(keys) == 1 {
+		zlog.Info(fmt.Sprintln("成功找到了相关前缀key", keys))
+		return keys[0], nil
+	}
+	zlog.Error("找到了数量大于1的key，查找异常")
+	return "", errors.New("找到了数量大于1的key，查找异常")
 }
 
 func GetKeyWithSuffixNilIsErr(suffix string) (string, error) {
-	var keys []string
-	var err error
-
-	for {
-		// 使用 Keys 命令迭代匹配的键
-		keys, err = redisClient.Keys(ctx, "*"+suffix).Result()
-		if err != nil {
-			return "", err
-		}
-
-		if len(keys) == 0 {
-			zlog.Info("没有找到相关后缀key")
-			return "", redis.Nil
-		}
-
-		if len(keys) == 1 {
-			zlog.Info(fmt.Sprintln("成功找到了相关后缀key", keys))
-			return keys[0], nil
-		} else {
-			zlog.Error("找到了数量大于1的key，查找异常")
-			return "", errors.New("找到了数量大于1的key，查找异常")
-		}
+	keys, err := scanKeys("*" + suffix)
+	if err != nil {
+		return "", err
 	}
-
+	if len(keys) == 0 {
+		zlog.Info("没有找到相关后缀key")
+		return "", redis.Nil
+	}
+	if len(keys) == 1 {
+		zlog.Info(fmt.Sprintln("成功找到了相关后缀key", keys))
+		return keys[0], nil
+	}
+	zlog.Error("找到了数量大于1的key，查找异常")
+	return "", errors.New("找到了数量大于1的key，查找异常")
 }
 
 func DelKeyIfExists(key string) error {
@@ -128,95 +120,53 @@ func DelKeyIfExists(key string) error {
 }
 
 func DelKeysWithPattern(pattern string) error {
-	var keys []string
-	var err error
-
-	for {
-		// 使用 Keys 命令迭代匹配的键
-		keys, err = redisClient.Keys(ctx, pattern).Result()
-		if err != nil {
-			return err
-		}
-
-		// 如果没有更多的键，则跳出循环
-		if len(keys) == 0 {
-			log.Println("没有找到对应key")
-			break
-		}
-
-		// 删除找到的键
-		if len(keys) > 0 {
-			_, err = redisClient.Del(ctx, keys...).Result()
-			if err != nil {
-				return err
-			}
-			log.Println("成功删除相关对应key", keys)
-		}
-	}
-
-	return nil
+	return scanDelete(pattern)
 }
 
 func DelKeysWithPrefix(prefix string) error {
-	//var cursor uint64 = 0
-	var keys []string
-	var err error
+	return scanDelete(prefix + "*")
+}
 
+func DelKeysWithSuffix(suffix string) error {
+	return scanDelete("*" + suffix)
+}
+
+// scanKeys 用SCAN遍历匹配的键，避免KEYS阻塞redis
+func scanKeys(match string) ([]string, error) {
+	var result []string
+	var cursor uint64 = 0
 	for {
-		// 使用 Keys 命令迭代匹配的键
-		keys, err = redisClient.Keys(ctx, prefix+"*").Result()
+		keys, nextCursor, err := redisClient.Scan(ctx, cursor, match, 100).Result()
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		// 如果没有更多的键，则跳出循环
-		if len(keys) == 0 {
-			log.Println("没有找到相关前缀key")
-			break
-		}
-
-		// 删除找到的键
-		if len(keys) > 0 {
-			_, err = redisClient.Del(ctx, keys...).Result()
-			if err != nil {
-				return err
-			}
-			log.Println("成功删除相关前缀key", keys)
+		result = append(result, keys...)
+		cursor = nextCursor
+		if cursor == 0 {
+			return result, nil
 		}
 	}
-
-	return nil
 }
 
-func DelKeysWithSuffix(suffix string) error {
-	//var cursor uint64 = 0
-	var keys []string
-	var err error
-
+// scanDelete 用SCAN分批删除匹配的键
+func scanDelete(match string) error {
+	var cursor uint64 = 0
 	for {
-		// 使用 Keys 命令迭代匹配的键
-		keys, err = redisClient.Keys(ctx, "*"+suffix).Result()
+		keys, nextCursor, err := redisClient.Scan(ctx, cursor, match, 100).Result()
 		if err != nil {
 			return err
 		}
-
-		// 如果没有更多的键，则跳出循环
-		if len(keys) == 0 {
-			log.Println("没有找到相关后缀key")
-			break
-		}
-
-		// 删除找到的键
 		if len(keys) > 0 {
-			_, err = redisClient.Del(ctx, keys...).Result()
-			if err != nil {
+			if err := redisClient.Del(ctx, keys...).Err(); err != nil {
 				return err
 			}
-			log.Println("成功删除相关后缀key", keys)
+			log.Println("成功删除相关key", keys)
+		}
+		cursor = nextCursor
+		if cursor == 0 {
+			return nil
 		}
 	}
-
-	return nil
 }
 
 func DeleteAllRedisKeys() error {
@@ -0,0 +1,46 @@
+package redis
+
+import (
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	seqPrefix = keyPrefix + "seq:"
+	seqTTL    = 24 * time.Hour // 长时间没有新消息的会话释放计数器，下次从数据库恢复
+)
+
+// incrIfExistsScript 计数器存在时加一并续期，不存在时返回-1，由调用方从数据库恢复
+var incrIfExistsScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+local seq = redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return seq
+`)
+
+// SeqSeeder 计数器不存在时返回已经使用过的最大序号
+type SeqSeeder func() (int64, error)
+
+// NextSeq 分配会话内的下一个序号，计数器不存在时（过期或重启后被清空）用seeder的结果恢复
+// 多个实例同时恢复时只有一个SETNX生效，之后都在同一个计数器上递增
+func NextSeq(conversation string, seeder SeqSeeder) (int64, error) {
+	key := seqPrefix + conversation
+	seq, err := incrIfExistsScript.Run(ctx, redisClient, []string{key}, seqTTL.Milliseconds()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if seq > 0 {
+		return seq, nil
+	}
+	maxSeq, err := seeder()
+	if err != nil {
+		return 0, err
+	}
+	if err := redisClient.SetNX(ctx, key, maxSeq, seqTTL).Err(); err != nil {
+		return 0, err
+	}
+	return redisClient.Incr(ctx, key).Result()
+}
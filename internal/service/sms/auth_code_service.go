@@ -1,64 +1,109 @@
 package sms
 
 import (
+	"context"
 	"fmt"
-	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
-	dysmsapi20170525 "github.com/alibabacloud-go/dysmsapi-20170525/v4/client"
-	util "github.com/alibabacloud-go/tea-utils/v2/service"
-	"github.com/alibabacloud-go/tea/tea"
 	"kama_chat_server/internal/config"
 	"kama_chat_server/internal/service/redis"
+	"kama_chat_server/internal/service/sms/provider"
 	"kama_chat_server/pkg/constants"
 	"kama_chat_server/pkg/util/random"
 	"kama_chat_server/pkg/zlog"
+	"math"
 	"strconv"
 	"time"
 )
 
-var smsClient *dysmsapi20170525.Client
+const sendTimeout = 10 * time.Second // 调用短信渠道的超时
 
-// createClient 使用AK&SK初始化账号Client
-func createClient() (result *dysmsapi20170525.Client, err error) {
-	// 工程代码泄露可能会导致 AccessKey 泄露，并威胁账号下所有资源的安全性。以下代码示例仅供参考。
-	// 建议使用更安全的 STS 方式，更多鉴权访问方式请参见：https://help.aliyun.com/document_detail/378661.html。
-	accessKeyID := config.GetConfig().AuthCodeConfig.AccessKeyID
-	accessKeySecret := config.GetConfig().AuthCodeConfig.AccessKeySecret
-	if smsClient == nil {
-		config := &openapi.Config{
-			// 必填，请确保代码运行环境设置了环境变量 ALIBABA_CLOUD_ACCESS_KEY_ID。
-			AccessKeyId: tea.String(accessKeyID),
-			// 必填，请确保代码运行环境设置了环境变量 ALIBABA_CLOUD_ACCESS_KEY_SECRET。
-			AccessKeySecret: tea.String(accessKeySecret),
-		}
-		// Endpoint 请参考 https://api.aliyun.com/product/Dysmsapi
-		config.Endpoint = tea.String("dysmsapi.aliyuncs.com")
-		smsClient, err = dysmsapi20170525.NewClient(config)
+// SmsProvider 当前使用的短信渠道，测试时可以替换为provider.FakeProvider
+var SmsProvider provider.SmsProvider
+
+func init() {
+	smsProvider, err := newProvider()
+	if err != nil {
+		zlog.Fatal(err.Error())
 	}
-	return smsClient, err
+	SmsProvider = smsProvider
 }
 
-// VerificationCode 统一的验证码发送接口，根据配置选择服务
-func VerificationCode(telephone string) (string, int) {
+// newProvider 根据配置选择短信渠道，provider为空时按useNewService兼容旧配置，不认识的渠道名返回错误，启动失败
+func newProvider() (provider.SmsProvider, error) {
 	cfg := config.GetConfig()
-	
-	// 检查是否使用新的号码认证服务
-	if cfg.SmsAuthConfig.UseNewService {
-		zlog.Info("使用号码认证服务发送验证码")
-		return SendSmsVerifyCode(telephone)
-	}
-	
-	// 使用传统短信服务
-	zlog.Info("使用传统短信服务发送验证码")
-	return sendTraditionalSms(telephone)
+	name := cfg.SmsAuthConfig.Provider
+	if name == "" {
+		name = provider.ProviderAliyunSms
+		if cfg.SmsAuthConfig.UseNewService {
+			name = provider.ProviderAliyunAuth
+		}
+	}
+	switch name {
+	case provider.ProviderAliyunSms:
+		return &provider.AliyunSmsProvider{
+			AccessKeyID:     cfg.AuthCodeConfig.AccessKeyID,
+			AccessKeySecret: cfg.AuthCodeConfig.AccessKeySecret,
+			SignName:        cfg.AuthCodeConfig.SignName,
+			TemplateCode:    cfg.AuthCodeConfig.TemplateCode,
+		}, nil
+	case provider.ProviderAliyunAuth:
+		return &provider.AliyunAuthProvider{
+			AccessKeyID:     cfg.SmsAuthConfig.AccessKeyID,
+			AccessKeySecret: cfg.SmsAuthConfig.AccessKeySecret,
+		}, nil
+	case provider.ProviderWebhook:
+		return &provider.WebhookProvider{
+			Url:          cfg.SmsAuthConfig.WebhookUrl,
+			Secret:       cfg.SmsAuthConfig.WebhookSecret,
+			TemplateCode: cfg.AuthCodeConfig.TemplateCode,
+		}, nil
+	case provider.ProviderFake:
+		return provider.NewFakeProvider(), nil
+	}
+	return nil, fmt.Errorf("不支持的短信渠道%s，smsAuthConfig.provider可选%s、%s、%s、%s", name,
+		provider.ProviderAliyunSms, provider.ProviderAliyunAuth, provider.ProviderWebhook, provider.ProviderFake)
 }
 
-// sendTraditionalSms 传统短信服务实现（保持原有逻辑）
-func sendTraditionalSms(telephone string) (string, int) {
-	client, err := createClient()
+// checkSmsQuota 每个手机号每小时、每天的验证码条数限制，两个窗口都通过才记录
+// 检查和记录在同一个脚本中完成，并发请求不会超发；redis异常时不发送
+func checkSmsQuota(telephone string) (string, int) {
+	limitConfig := config.GetConfig().RateLimitConfig
+	quotas := []redis.RateLimit{
+		{Name: "sms_hour", Limit: limitConfig.SmsPerHour, Window: time.Hour},
+		{Name: "sms_day", Limit: limitConfig.SmsPerDay, Window: 24 * time.Hour},
+	}
+	allowed, wait, err := redis.AllowAll(quotas, telephone)
 	if err != nil {
 		zlog.Error(err.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
+	if !allowed {
+		message := fmt.Sprintf("该手机号验证码发送次数过多，请%d分钟后再试", int(math.Ceil(wait.Minutes())))
+		zlog.Info(message)
+		return message, -2
+	}
+	return "", 0
+}
+
+// VerificationCode 统一的验证码发送接口，验证码由渠道管理时直接转发，否则本地生成后通过渠道发送
+func VerificationCode(telephone string) (string, int) {
+	if message, ret := checkSmsQuota(telephone); ret != 0 {
+		return message, ret
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if _, ok := SmsProvider.(provider.CodeVerifier); ok {
+		zlog.Info("使用" + SmsProvider.Name() + "渠道发送验证码，验证码由渠道生成")
+		if err := SmsProvider.SendCode(ctx, telephone, ""); err != nil {
+			zlog.Error("发送短信验证码失败: " + err.Error())
+			return constants.SYSTEM_ERROR, -1
+		}
+		return "验证码发送成功，请及时查收短信", 0
+	}
+	return sendLocalCode(ctx, telephone)
+}
+
+// sendLocalCode 本地生成验证码存入redis，再通过渠道发送
+func sendLocalCode(ctx context.Context, telephone string) (string, int) {
 	key := "auth_code_" + telephone
 	code, err := redis.GetKey(key)
 	if err != nil {
@@ -74,47 +119,41 @@ func sendTraditionalSms(telephone string) (string, int) {
 	}
 	// 验证码过期，重新生成
 	code = strconv.Itoa(random.GetRandomInt(6))
-	fmt.Println(code)
 	err = redis.SetKeyEx(key, code, time.Minute) // 1分钟有效
 	if err != nil {
 		zlog.Error(err.Error())
 		return constants.SYSTEM_ERROR, -1
 	}
-	sendSmsRequest := &dysmsapi20170525.SendSmsRequest{
-		SignName:      tea.String("阿里云短信测试"),
-		TemplateCode:  tea.String("SMS_154950909"), // 短信模板
-		PhoneNumbers:  tea.String(telephone),
-		TemplateParam: tea.String("{\"code\":\"" + code + "\"}"),
-	}
-
-	runtime := &util.RuntimeOptions{}
-	// 目前使用的是测试专用签名，签名必须是"阿里云短信测试"，模板code为"SMS_154950909"
-	rsp, err := client.SendSmsWithOptions(sendSmsRequest, runtime)
-	if err != nil {
-		zlog.Error(err.Error())
+	if err := SmsProvider.SendCode(ctx, telephone, code); err != nil {
+		zlog.Error("通过" + SmsProvider.Name() + "渠道发送验证码失败: " + err.Error())
+		// 发送失败时删除验证码，允许立即重试
+		redis.DelKeyIfExists(key)
 		return constants.SYSTEM_ERROR, -1
 	}
-	zlog.Info(*util.ToJSONString(rsp))
+	if SmsProvider.Name() == provider.ProviderFake {
+		// 只有假渠道才把验证码打到日志里，方便本地开发
+		zlog.Info(fmt.Sprintf("fake短信渠道记录验证码 %s: %s", telephone, code))
+	}
 	return "验证码发送成功，请及时在对应电话查收短信", 0
 }
 
 // VerifyCode 统一的验证码校验接口
 func VerifyCode(telephone, inputCode string) (bool, string) {
-	cfg := config.GetConfig()
-	
-	// 使用号码认证服务时，调用阿里云API验证
-	if cfg.SmsAuthConfig.UseNewService {
-		zlog.Info("使用号码认证服务校验验证码")
-		return CheckSmsVerifyCode(telephone, inputCode)
-	}
-	
-	// 使用传统验证方式（仅检查Redis）
-	zlog.Info("使用传统方式校验验证码")
-	return verifyTraditionalCode(telephone, inputCode)
+	if verifier, ok := SmsProvider.(provider.CodeVerifier); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		defer cancel()
+		isValid, message, err := verifier.VerifyCode(ctx, telephone, inputCode)
+		if err != nil {
+			zlog.Error("验证码校验失败: " + err.Error())
+			return false, constants.SYSTEM_ERROR
+		}
+		return isValid, message
+	}
+	return verifyLocalCode(telephone, inputCode)
 }
 
-// verifyTraditionalCode 传统验证码校验（仅检查Redis）
-func verifyTraditionalCode(telephone, inputCode string) (bool, string) {
+// verifyLocalCode 本地验证码校验（仅检查Redis）
+func verifyLocalCode(telephone, inputCode string) (bool, string) {
 	key := "auth_code_" + telephone
 	storedCode, err := redis.GetKey(key)
 	if err != nil {
@@ -0,0 +1,108 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	dypnsapi20170525 "github.com/alibabacloud-go/dypnsapi-20170525/v3/client"
+	"github.com/alibabacloud-go/tea/tea"
+)
+
+// AliyunAuthProvider 阿里云号码认证服务，验证码由阿里云生成和校验，无需企业资质
+type AliyunAuthProvider struct {
+	AccessKeyID     string
+	AccessKeySecret string
+
+	once   sync.Once
+	client *dypnsapi20170525.Client
+	err    error
+}
+
+func (a *AliyunAuthProvider) Name() string {
+	return ProviderAliyunAuth
+}
+
+// getClient 创建号码认证服务客户端，只初始化一次
+func (a *AliyunAuthProvider) getClient() (*dypnsapi20170525.Client, error) {
+	a.once.Do(func() {
+		config := &openapi.Config{
+			AccessKeyId:     tea.String(a.AccessKeyID),
+			AccessKeySecret: tea.String(a.AccessKeySecret),
+		}
+		// 号码认证服务的endpoint
+		config.Endpoint = tea.String("dypnsapi.aliyuncs.com")
+		a.client, a.err = dypnsapi20170525.NewClient(config)
+	})
+	return a.client, a.err
+}
+
+// SendCode 验证码由阿里云生成，code参数不使用
+func (a *AliyunAuthProvider) SendCode(ctx context.Context, telephone, code string) error {
+	client, err := a.getClient()
+	if err != nil {
+		return err
+	}
+	sendSmsRequest := &dypnsapi20170525.SendSmsVerifyCodeRequest{
+		PhoneNumber:      tea.String(telephone),
+		SignName:         tea.String("速通互联验证码"), // 使用系统赠送签名
+		TemplateCode:     tea.String("100001"),  // 使用系统赠送模板
+		TemplateParam:    tea.String("{\"code\":\"##code##\",\"min\":\"5\"}"),
+		CodeLength:       tea.Int64(6),   // 验证码长度
+		ValidTime:        tea.Int64(300), // 有效时间5分钟
+		DuplicatePolicy:  tea.Int64(1),   // 覆盖处理
+		Interval:         tea.Int64(60),  // 间隔60秒
+		CodeType:         tea.Int64(1),   // 纯数字
+		ReturnVerifyCode: tea.Bool(true), // 返回验证码
+	}
+	runtime, err := runtimeOptions(ctx)
+	if err != nil {
+		return err
+	}
+	rsp, err := client.SendSmsVerifyCodeWithOptions(sendSmsRequest, runtime)
+	if err != nil {
+		return err
+	}
+	if rsp.Body == nil || rsp.Body.Code == nil || *rsp.Body.Code != "OK" {
+		message := "短信发送失败"
+		if rsp.Body != nil && rsp.Body.Message != nil {
+			message = *rsp.Body.Message
+		}
+		return errors.New(message)
+	}
+	return nil
+}
+
+// VerifyCode 直接调用阿里云号码认证服务校验验证码
+func (a *AliyunAuthProvider) VerifyCode(ctx context.Context, telephone, code string) (bool, string, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return false, "", err
+	}
+	checkRequest := &dypnsapi20170525.CheckSmsVerifyCodeRequest{
+		PhoneNumber: tea.String(telephone),
+		VerifyCode:  tea.String(code),
+		OutId:       tea.String(""),
+	}
+	runtime, err := runtimeOptions(ctx)
+	if err != nil {
+		return false, "", err
+	}
+	rsp, err := client.CheckSmsVerifyCodeWithOptions(checkRequest, runtime)
+	if err != nil {
+		return false, "", err
+	}
+	if rsp.Body == nil || rsp.Body.Code == nil || *rsp.Body.Code != "OK" {
+		message := "验证码校验失败"
+		if rsp.Body != nil && rsp.Body.Message != nil {
+			message = *rsp.Body.Message
+		}
+		return false, "", errors.New(message)
+	}
+	// Code为OK只表示接口调用成功，校验结果在VerifyResult中
+	if rsp.Body.Model == nil || rsp.Body.Model.VerifyResult == nil || *rsp.Body.Model.VerifyResult != "PASS" {
+		return false, "验证码错误", nil
+	}
+	return true, "验证码校验成功", nil
+}
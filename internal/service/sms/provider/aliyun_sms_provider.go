@@ -0,0 +1,92 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	dysmsapi20170525 "github.com/alibabacloud-go/dysmsapi-20170525/v4/client"
+	util "github.com/alibabacloud-go/tea-utils/v2/service"
+	"github.com/alibabacloud-go/tea/tea"
+)
+
+// AliyunSmsProvider 阿里云短信服务，验证码由本地生成，通过短信模板发送
+// 测试签名必须是"阿里云短信测试"，模板code为"SMS_154950909"
+type AliyunSmsProvider struct {
+	AccessKeyID     string
+	AccessKeySecret string
+	SignName        string
+	TemplateCode    string
+
+	once   sync.Once
+	client *dysmsapi20170525.Client
+	err    error
+}
+
+func (a *AliyunSmsProvider) Name() string {
+	return ProviderAliyunSms
+}
+
+// getClient 使用AK&SK初始化账号Client，只初始化一次
+func (a *AliyunSmsProvider) getClient() (*dysmsapi20170525.Client, error) {
+	a.once.Do(func() {
+		// 工程代码泄露可能会导致 AccessKey 泄露，并威胁账号下所有资源的安全性。
+		// 建议使用更安全的 STS 方式，更多鉴权访问方式请参见：https://help.aliyun.com/document_detail/378661.html。
+		config := &openapi.Config{
+			AccessKeyId:     tea.String(a.AccessKeyID),
+			AccessKeySecret: tea.String(a.AccessKeySecret),
+		}
+		// Endpoint 请参考 https://api.aliyun.com/product/Dysmsapi
+		config.Endpoint = tea.String("dysmsapi.aliyuncs.com")
+		a.client, a.err = dysmsapi20170525.NewClient(config)
+	})
+	return a.client, a.err
+}
+
+func (a *AliyunSmsProvider) SendCode(ctx context.Context, telephone, code string) error {
+	client, err := a.getClient()
+	if err != nil {
+		return err
+	}
+	sendSmsRequest := &dysmsapi20170525.SendSmsRequest{
+		SignName:      tea.String(a.SignName),
+		TemplateCode:  tea.String(a.TemplateCode),
+		PhoneNumbers:  tea.String(telephone),
+		TemplateParam: tea.String("{\"code\":\"" + code + "\"}"),
+	}
+	runtime, err := runtimeOptions(ctx)
+	if err != nil {
+		return err
+	}
+	rsp, err := client.SendSmsWithOptions(sendSmsRequest, runtime)
+	if err != nil {
+		return err
+	}
+	if rsp.Body == nil || rsp.Body.Code == nil || *rsp.Body.Code != "OK" {
+		message := "短信发送失败"
+		if rsp.Body != nil && rsp.Body.Message != nil {
+			message = *rsp.Body.Message
+		}
+		return errors.New(message)
+	}
+	return nil
+}
+
+// runtimeOptions 阿里云SDK不接收ctx，把ctx剩余的时间作为连接和读取超时(毫秒)，ctx已经结束时不再发起请求
+// 两个阿里云渠道共用
+func runtimeOptions(ctx context.Context) (*util.RuntimeOptions, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	runtime := &util.RuntimeOptions{}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := int(time.Until(deadline).Milliseconds())
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		runtime.SetConnectTimeout(timeout).SetReadTimeout(timeout)
+	}
+	return runtime, nil
+}
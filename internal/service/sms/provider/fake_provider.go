@@ -0,0 +1,54 @@
+package provider
+
+import (
+	"context"
+	"sync"
+)
+
+// SentCode 假渠道记录的一次发送
+type SentCode struct {
+	Telephone string
+	Code      string
+}
+
+// FakeProvider 本地假渠道，只记录验证码不真正发送，用于测试、CI和本地开发
+type FakeProvider struct {
+	mutex sync.Mutex
+	sent  []SentCode
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{}
+}
+
+func (f *FakeProvider) Name() string {
+	return ProviderFake
+}
+
+func (f *FakeProvider) SendCode(ctx context.Context, telephone, code string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.sent = append(f.sent, SentCode{Telephone: telephone, Code: code})
+	return nil
+}
+
+// LastCode 返回最近一次发给该手机号的验证码，没有时返回空
+func (f *FakeProvider) LastCode(telephone string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for i := len(f.sent) - 1; i >= 0; i-- {
+		if f.sent[i].Telephone == telephone {
+			return f.sent[i].Code
+		}
+	}
+	return ""
+}
+
+// Sent 返回已记录的发送
+func (f *FakeProvider) Sent() []SentCode {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	sent := make([]SentCode, len(f.sent))
+	copy(sent, f.sent)
+	return sent
+}
@@ -0,0 +1,26 @@
+package provider
+
+import (
+	"context"
+)
+
+// 短信渠道名称，与配置中的smsAuthConfig.provider一致
+const (
+	ProviderAliyunSms  = "aliyun_sms"  // 阿里云短信服务，验证码由本地生成和校验
+	ProviderAliyunAuth = "aliyun_auth" // 阿里云号码认证服务，验证码由阿里云生成和校验
+	ProviderWebhook    = "webhook"     // 通用http网关，适合私有化部署对接自有短信平台
+	ProviderFake       = "fake"        // 本地假渠道，只记录验证码不发送
+)
+
+// SmsProvider 短信渠道，负责把验证码发到手机
+type SmsProvider interface {
+	Name() string
+	// SendCode 发送验证码，实现了CodeVerifier的渠道自己生成验证码，code为空
+	SendCode(ctx context.Context, telephone, code string) error
+}
+
+// CodeVerifier 自己生成并校验验证码的渠道，本地不再保存验证码
+type CodeVerifier interface {
+	// VerifyCode 校验验证码，未通过时返回给用户的提示
+	VerifyCode(ctx context.Context, telephone, code string) (bool, string, error)
+}
@@ -0,0 +1,61 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"kama_chat_server/pkg/util/sign"
+	"net/http"
+)
+
+// WebhookProvider 将验证码POST给自有短信网关，请求头X-Kama-Signature为请求体的HMAC签名，
+// 网关返回2xx即视为发送成功
+type WebhookProvider struct {
+	Url          string
+	Secret       string
+	TemplateCode string
+	Client       *http.Client
+}
+
+type webhookPayload struct {
+	Telephone    string            `json:"telephone"`
+	TemplateCode string            `json:"template_code,omitempty"`
+	Params       map[string]string `json:"params"`
+}
+
+func (w *WebhookProvider) Name() string {
+	return ProviderWebhook
+}
+
+func (w *WebhookProvider) SendCode(ctx context.Context, telephone, code string) error {
+	body, err := json.Marshal(webhookPayload{
+		Telephone:    telephone,
+		TemplateCode: w.TemplateCode,
+		Params:       map[string]string{"code": code},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		req.Header.Set("X-Kama-Signature", sign.Sign(w.Secret, string(body)))
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 300 {
+		return fmt.Errorf("短信网关返回%d", rsp.StatusCode)
+	}
+	return nil
+}
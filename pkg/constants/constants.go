@@ -1,8 +1,12 @@
 package constants
 
 const (
-	CHANNEL_SIZE  = 100            // 通道大小
-	SYSTEM_ERROR  = "系统错误，请联系工作人员" // 系统错误
-	FILE_MAX_SIZE = 50000          // 文件最大大小
-	REDIS_TIMEOUT = 1              // redis timeout
+	CHANNEL_SIZE           = 100            // 通道大小
+	SYSTEM_ERROR           = "系统错误，请联系工作人员" // 系统错误
+	FILE_MAX_SIZE          = 50000          // 文件最大大小
+	REDIS_TIMEOUT          = 1              // redis timeout
+	THUMBNAIL_MAX_EDGE     = 200            // 缩略图最长边像素
+	IMAGE_MAX_PIXELS       = 40000000       // 解析图片默认允许的最大像素数
+	VOICE_MAX_DURATION     = 60             // 语音最长时长(秒)
+	REACTION_EMOJI_MAX_LEN = 32             // 表情回应最大字节数
 )
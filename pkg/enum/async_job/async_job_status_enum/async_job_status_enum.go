@@ -0,0 +1,15 @@
+package async_job_status_enum
+
+// 异步任务状态，随轮询接口返回
+const (
+	// 已提交，等待执行或等待重试
+	PENDING = "pending"
+	// 执行中
+	RUNNING = "running"
+	// 执行成功，结果可通过轮询接口获取
+	SUCCEEDED = "succeeded"
+	// 执行失败，不再重试
+	FAILED = "failed"
+	// 最后一次执行超时
+	TIMEOUT = "timeout"
+)
@@ -0,0 +1,21 @@
+package audit_action_enum
+
+// 审计日志的操作类型，写入数据库后不能修改取值
+const (
+	ABLE_USER            = "able_user"
+	DISABLE_USER         = "disable_user"
+	DELETE_USER          = "delete_user"
+	SET_ADMIN            = "set_admin"
+	DELETE_GROUP         = "delete_group"
+	SET_GROUP_STATUS     = "set_group_status"
+	DISMISS_GROUP        = "dismiss_group"
+	REMOVE_GROUP_MEMBERS = "remove_group_members"
+	DELETE_CONTACT       = "delete_contact"
+	BLACK_CONTACT        = "black_contact"
+	CANCEL_BLACK_CONTACT = "cancel_black_contact"
+	PASS_CONTACT_APPLY   = "pass_contact_apply"
+	REFUSE_CONTACT_APPLY = "refuse_contact_apply"
+	BLACK_CONTACT_APPLY  = "black_contact_apply"
+	REPLAY_DEAD_LETTER   = "replay_dead_letter"
+	SET_HYBRID_MODE      = "set_hybrid_mode"
+)
@@ -0,0 +1,6 @@
+package dead_letter_status_enum
+
+const (
+	PENDING  = iota // 等待处理
+	REPLAYED        // 已重新投递
+)
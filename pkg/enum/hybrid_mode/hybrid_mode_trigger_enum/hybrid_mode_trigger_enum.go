@@ -0,0 +1,7 @@
+package hybrid_mode_trigger_enum
+
+// 混合模式切换的触发方式
+const (
+	AUTO   = "auto"   // 监控自动切换
+	MANUAL = "manual" // 管理员手动切换
+)
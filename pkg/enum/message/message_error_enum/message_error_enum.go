@@ -0,0 +1,29 @@
+package message_error_enum
+
+// 消息被服务端拒绝的原因，随错误帧返回给发送者，前端据此提示
+const (
+	// 消息格式错误
+	InvalidMessage = "INVALID_MESSAGE"
+	// 发送者不存在或已被禁用
+	SenderDisabled = "SENDER_DISABLED"
+	// 群聊不存在、已解散或已被禁用
+	GroupUnavailable = "GROUP_UNAVAILABLE"
+	// 不是好友
+	NotContact = "NOT_CONTACT"
+	// 发送者拉黑了对方
+	Black = "BLACK"
+	// 发送者被对方拉黑
+	BeBlack = "BE_BLACK"
+	// 不在群聊中
+	NotGroupMember = "NOT_GROUP_MEMBER"
+	// 在群聊中被禁言
+	Silence = "SILENCE"
+	// 不支持的帧类型
+	UnknownFrame = "UNKNOWN_FRAME"
+	// 发送过于频繁
+	RateLimited = "RATE_LIMITED"
+	// 服务端繁忙，消息未被接收
+	ServerBusy = "SERVER_BUSY"
+	// 服务端错误
+	SystemError = "SYSTEM_ERROR"
+)
@@ -8,4 +8,12 @@ const (
 	File
 	// 通话
 	AudioOrVideo
+	// 图片，带宽高
+	Image
+	// 位置
+	Location
+	// 名片，用户或群聊
+	ContactCard
+	// 引用回复
+	Reply
 )
@@ -0,0 +1,6 @@
+package totp_status_enum
+
+const (
+	PENDING = iota // 已生成密钥，等待首次验证
+	ENABLED
+)
@@ -0,0 +1,179 @@
+package mediainfo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // 注册gif解码器
+	_ "image/jpeg" // 注册jpeg解码器
+	_ "image/png"  // 注册png解码器
+	"io"
+)
+
+const wavFmtMaxSize = 64 // fmt块的最大长度，标准格式为16、18或40字节
+
+// ImageConfig 只解析图片头中的宽高，像素数超过maxPixels时返回错误，调用方不应再解码整张图片
+// maxPixels不大于0时不限制
+func ImageConfig(r io.Reader, maxPixels int64) (image.Config, error) {
+	imgConfig, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return imgConfig, fmt.Errorf("解析图片尺寸失败: %w", err)
+	}
+	if imgConfig.Width <= 0 || imgConfig.Height <= 0 {
+		return imgConfig, errors.New("图片尺寸不合法")
+	}
+	if maxPixels > 0 && int64(imgConfig.Width)*int64(imgConfig.Height) > maxPixels {
+		return imgConfig, fmt.Errorf("图片尺寸%dx%d超过上限", imgConfig.Width, imgConfig.Height)
+	}
+	return imgConfig, nil
+}
+
+// Resize 按最长边等比缩放，使用最近邻采样，小图不放大
+func Resize(src image.Image, maxEdge int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxEdge && height <= maxEdge {
+		maxEdge = width
+		if height > width {
+			maxEdge = height
+		}
+	}
+	dstWidth, dstHeight := maxEdge, maxEdge
+	if width > height {
+		dstHeight = height * maxEdge / width
+	} else {
+		dstWidth = width * maxEdge / height
+	}
+	if dstWidth < 1 {
+		dstWidth = 1
+	}
+	if dstHeight < 1 {
+		dstHeight = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		srcY := bounds.Min.Y + y*height/dstHeight
+		for x := 0; x < dstWidth; x++ {
+			srcX := bounds.Min.X + x*width/dstWidth
+			dst.Set(x, y, src.At(srcX, srcY))
+		}
+	}
+	return dst
+}
+
+// WavDuration 通过RIFF头中的fmt和data块计算时长（秒）
+// 块大小来自文件内容，不可信：fmt块超过wavFmtMaxSize直接拒绝，其他块只Seek跳过，不读入内存
+func WavDuration(r io.ReadSeeker) (int, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, errors.New("wav文件头不完整")
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return 0, errors.New("不是有效的wav文件")
+	}
+	var byteRate uint32
+	chunkHeader := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, chunkHeader); err != nil {
+			return 0, errors.New("wav文件缺少data块")
+		}
+		chunkId := string(chunkHeader[0:4])
+		chunkSize := binary.LittleEndian.Uint32(chunkHeader[4:8])
+		if chunkId == "fmt " {
+			if chunkSize < 16 || chunkSize > wavFmtMaxSize {
+				return 0, fmt.Errorf("wav文件fmt块长度%d不合法", chunkSize)
+			}
+			fmtChunk := make([]byte, chunkSize+chunkSize%2)
+			if _, err := io.ReadFull(r, fmtChunk); err != nil {
+				return 0, errors.New("wav文件fmt块不完整")
+			}
+			byteRate = binary.LittleEndian.Uint32(fmtChunk[8:12])
+			continue
+		}
+		if chunkId == "data" {
+			if byteRate == 0 {
+				return 0, errors.New("wav文件码率为0")
+			}
+			return int(chunkSize / byteRate), nil
+		}
+		// 块大小为奇数时有一个填充字节
+		if _, err := r.Seek(int64(chunkSize)+int64(chunkSize%2), io.SeekCurrent); err != nil {
+			return 0, err
+		}
+	}
+}
+
+var mp3Bitrates = [2][3][16]int{
+	// MPEG1，Layer1/2/3
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	},
+	// MPEG2/2.5，Layer1/2/3
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	},
+}
+
+var mp3SampleRates = map[byte][3]int{
+	3: {44100, 48000, 32000}, // MPEG1
+	2: {22050, 24000, 16000}, // MPEG2
+	0: {11025, 12000, 8000},  // MPEG2.5
+}
+
+// Mp3Duration 解析第一帧，有Xing/Info头时按帧数计算，否则按固定码率估算
+func Mp3Duration(data []byte) (int, error) {
+	offset := 0
+	// 跳过ID3v2标签
+	if len(data) >= 10 && string(data[0:3]) == "ID3" {
+		offset = 10 + (int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9]))
+	}
+	for ; offset+4 <= len(data); offset++ {
+		if data[offset] != 0xFF || data[offset+1]&0xE0 != 0xE0 {
+			continue
+		}
+		version := (data[offset+1] >> 3) & 0x03
+		layer := (data[offset+1] >> 1) & 0x03
+		bitrateIndex := data[offset+2] >> 4
+		sampleRateIndex := (data[offset+2] >> 2) & 0x03
+		if version == 1 || layer == 0 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+			continue
+		}
+		versionIndex := 1
+		if version == 3 {
+			versionIndex = 0
+		}
+		bitrate := mp3Bitrates[versionIndex][3-layer][bitrateIndex] * 1000
+		sampleRate := mp3SampleRates[version][sampleRateIndex]
+		samplesPerFrame := 1152
+		if layer == 3 {
+			samplesPerFrame = 384
+		} else if layer == 1 && version != 3 {
+			samplesPerFrame = 576
+		}
+		// Xing/Info头位置取决于版本和声道
+		sideInfo := 32
+		mono := data[offset+3]>>6 == 3
+		if version == 3 && mono {
+			sideInfo = 17
+		} else if version != 3 && !mono {
+			sideInfo = 17
+		} else if version != 3 && mono {
+			sideInfo = 9
+		}
+		xing := offset + 4 + sideInfo
+		if xing+12 <= len(data) {
+			tag := string(data[xing : xing+4])
+			if (tag == "Xing" || tag == "Info") && data[xing+7]&0x01 == 1 {
+				frames := int(binary.BigEndian.Uint32(data[xing+8 : xing+12]))
+				return frames * samplesPerFrame / sampleRate, nil
+			}
+		}
+		return (len(data) - offset) * 8 / bitrate, nil
+	}
+	return 0, errors.New("未找到mp3帧头")
+}
@@ -0,0 +1,20 @@
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Sign 使用HMAC-SHA256对字段签名，字段之间用|拼接
+func Sign(secret string, fields ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(fields, "|")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify 校验签名，使用常量时间比较防止时序攻击
+func Verify(secret, signature string, fields ...string) bool {
+	return hmac.Equal([]byte(Sign(secret, fields...)), []byte(signature))
+}
@@ -0,0 +1,129 @@
+package wire
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/ugorji/go/codec"
+)
+
+// websocket子协议，客户端在Sec-WebSocket-Protocol中声明，声明了子协议的连接使用新协议信封
+const (
+	SubprotocolJSON    = "kama.v1.json"
+	SubprotocolMsgPack = "kama.v1.msgpack"
+)
+
+// 编码名称，用于配置
+const (
+	NameJSON    = "json"
+	NameMsgPack = "msgpack"
+)
+
+// Codec 帧和kafka消息的编码方式
+// 两种编码共用dto上的json tag作为字段名，msgpack下json.RawMessage类型的字段按bin类型传输，内容仍是json文本
+type Codec interface {
+	Name() string
+	Binary() bool // 是否以websocket二进制消息发送
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSON    Codec = jsonCodec{}
+	MsgPack Codec = newMsgPackCodec()
+)
+
+// ByName 按配置的名称获取编码，未知的名称返回json
+func ByName(name string) Codec {
+	if name == NameMsgPack {
+		return MsgPack
+	}
+	return JSON
+}
+
+// BySubprotocol 按协商出的子协议获取编码，没有协商子协议时返回nil
+func BySubprotocol(subprotocol string) Codec {
+	switch subprotocol {
+	case SubprotocolJSON:
+		return JSON
+	case SubprotocolMsgPack:
+		return MsgPack
+	}
+	return nil
+}
+
+// Detect 根据首字节判断数据的编码，滚动升级期间kafka中两种编码的消息会同时存在
+// json对象以'{'开头（允许前导空白），msgpack的map以fixmap(0x80-0x8f)、map16(0xde)或map32(0xdf)开头
+func Detect(data []byte) (Codec, error) {
+	for _, b := range data {
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			continue
+		}
+		if b == '{' {
+			return JSON, nil
+		}
+		if (b >= 0x80 && b <= 0x8f) || b == 0xde || b == 0xdf {
+			return MsgPack, nil
+		}
+		break
+	}
+	return nil, errors.New("无法识别的消息编码")
+}
+
+// Unmarshal 自动识别编码后解析
+func Unmarshal(data []byte, v interface{}) error {
+	c, err := Detect(data)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(data, v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return NameJSON
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgPackCodec struct {
+	handle *codec.MsgpackHandle
+}
+
+func newMsgPackCodec() msgPackCodec {
+	handle := &codec.MsgpackHandle{}
+	// 使用新版规范，[]byte编码为bin，string编码为str
+	handle.WriteExt = true
+	handle.RawToString = true
+	return msgPackCodec{handle: handle}
+}
+
+func (msgPackCodec) Name() string {
+	return NameMsgPack
+}
+
+func (msgPackCodec) Binary() bool {
+	return true
+}
+
+func (m msgPackCodec) Marshal(v interface{}) ([]byte, error) {
+	var data []byte
+	if err := codec.NewEncoderBytes(&data, m.handle).Encode(v); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (m msgPackCodec) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, m.handle).Decode(v)
+}
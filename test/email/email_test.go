@@ -0,0 +1,45 @@
+package email
+
+import (
+	"context"
+	"kama_chat_server/internal/service/email"
+	"testing"
+	"time"
+)
+
+func TestCaptureSenderRecordsMails(t *testing.T) {
+	capture := email.NewCaptureSender()
+	var sender email.Sender = capture
+	_ = sender.Send(context.Background(), email.Mail{To: "a@example.com", Subject: "验证码", Body: "111111"})
+	_ = sender.Send(context.Background(), email.Mail{To: "b@example.com", Subject: "验证码", Body: "222222"})
+	_ = sender.Send(context.Background(), email.Mail{To: "a@example.com", Subject: "重置密码", Body: "333333"})
+	mail, ok := capture.Last("a@example.com")
+	if !ok || mail.Body != "333333" {
+		t.Fatalf("最近的邮件内容应为333333，实际为%+v", mail)
+	}
+	if _, ok := capture.Last("c@example.com"); ok {
+		t.Fatal("未发送的地址不应有邮件")
+	}
+	sent := capture.Sent()
+	if len(sent) != 3 {
+		t.Fatalf("应记录3封，实际为%d", len(sent))
+	}
+	sent[0].Body = "changed"
+	if capture.Sent()[0].Body != "111111" {
+		t.Fatal("Sent应返回副本")
+	}
+}
+
+func TestSmtpSenderHonorsContext(t *testing.T) {
+	// 不可路由的地址会一直连不上，依靠context超时返回
+	sender := &email.SmtpSender{Host: "10.255.255.1", Port: 25, From: "noreply@example.com"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := sender.Send(ctx, email.Mail{To: "a@example.com", Subject: "s", Body: "b"}); err == nil {
+		t.Fatal("超时后应返回错误")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("应在context超时后立即返回")
+	}
+}
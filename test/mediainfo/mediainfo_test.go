@@ -0,0 +1,153 @@
+package mediainfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"kama_chat_server/pkg/util/mediainfo"
+	"testing"
+)
+
+// wavChunk 拼接一个RIFF块，size为头中声明的长度，可以和实际内容不一致
+func wavChunk(id string, size uint32, body []byte) []byte {
+	chunk := make([]byte, 8, 8+len(body))
+	copy(chunk, id)
+	binary.LittleEndian.PutUint32(chunk[4:8], size)
+	return append(chunk, body...)
+}
+
+func wavFmt(byteRate uint32) []byte {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint16(body[0:2], 1)
+	binary.LittleEndian.PutUint16(body[2:4], 1)
+	binary.LittleEndian.PutUint32(body[4:8], byteRate)
+	binary.LittleEndian.PutUint32(body[8:12], byteRate)
+	return wavChunk("fmt ", 16, body)
+}
+
+func wavFile(chunks ...[]byte) []byte {
+	data := []byte("RIFF\x00\x00\x00\x00WAVE")
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	return data
+}
+
+func TestWavDuration(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     []byte
+		duration int
+		wantErr  bool
+	}{
+		{"正常", wavFile(wavFmt(8000), wavChunk("data", 24000, nil)), 3, false},
+		{"跳过奇数长度的其他块", wavFile(wavChunk("LIST", 3, []byte("abc\x00")), wavFmt(8000), wavChunk("data", 16000, nil)), 2, false},
+		{"文件头截断", []byte("RIFF\x00\x00"), 0, true},
+		{"不是wav", []byte("RIFF\x00\x00\x00\x00AVI "), 0, true},
+		{"fmt块截断", wavFile(wavChunk("fmt ", 16, make([]byte, 6))), 0, true},
+		{"fmt块声明长度过大", wavFile(wavChunk("fmt ", 0xFFFFFFF0, make([]byte, 16))), 0, true},
+		{"fmt块长度过小", wavFile(wavChunk("fmt ", 8, make([]byte, 8)), wavChunk("data", 16000, nil)), 0, true},
+		{"其他块声明长度超出文件", wavFile(wavFmt(8000), wavChunk("LIST", 0xFFFFFFFF, nil)), 0, true},
+		{"缺少data块", wavFile(wavFmt(8000)), 0, true},
+		{"码率为0", wavFile(wavFmt(0), wavChunk("data", 16000, nil)), 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			duration, err := mediainfo.WavDuration(bytes.NewReader(c.data))
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("应返回错误，实际时长%d", duration)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if duration != c.duration {
+				t.Fatalf("时长应为%d，实际为%d", c.duration, duration)
+			}
+		})
+	}
+}
+
+func encodePng(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withPngSize 改写IHDR中声明的宽高并重新计算校验和，图片数据不变
+func withPngSize(data []byte, width, height uint32) []byte {
+	patched := append([]byte(nil), data...)
+	// 8字节签名之后是IHDR块：长度(4) 类型(4) 宽(4) 高(4) ... CRC
+	binary.BigEndian.PutUint32(patched[16:20], width)
+	binary.BigEndian.PutUint32(patched[20:24], height)
+	binary.BigEndian.PutUint32(patched[29:33], crc32.ChecksumIEEE(patched[12:29]))
+	return patched
+}
+
+func TestImageConfig(t *testing.T) {
+	valid := encodePng(t, 40, 20)
+	cases := []struct {
+		name      string
+		data      []byte
+		maxPixels int64
+		width     int
+		height    int
+		wantErr   bool
+	}{
+		{"正常", valid, 10000, 40, 20, false},
+		{"不限制像素数", withPngSize(valid, 100000, 100000), 0, 100000, 100000, false},
+		{"文件头截断", valid[:12], 10000, 0, 0, true},
+		{"IHDR截断", valid[:20], 10000, 0, 0, true},
+		{"声明的尺寸超过上限", withPngSize(valid, 100000, 100000), 40000000, 0, 0, true},
+		{"刚好超过上限", valid, 799, 0, 0, true},
+		{"不是图片", []byte("not an image"), 10000, 0, 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			imgConfig, err := mediainfo.ImageConfig(bytes.NewReader(c.data), c.maxPixels)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("应返回错误，实际尺寸%dx%d", imgConfig.Width, imgConfig.Height)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imgConfig.Width != c.width || imgConfig.Height != c.height {
+				t.Fatalf("尺寸应为%dx%d，实际为%dx%d", c.width, c.height, imgConfig.Width, imgConfig.Height)
+			}
+		})
+	}
+}
+
+func TestResize(t *testing.T) {
+	cases := []struct {
+		name          string
+		width, height int
+		maxEdge       int
+		dstW, dstH    int
+	}{
+		{"横图缩小", 400, 100, 200, 200, 50},
+		{"竖图缩小", 100, 400, 200, 50, 200},
+		{"小图不放大", 40, 20, 200, 40, 20},
+		{"极窄的图至少1像素", 1000, 1, 200, 200, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dst := mediainfo.Resize(image.NewRGBA(image.Rect(0, 0, c.width, c.height)), c.maxEdge)
+			if dst.Bounds().Dx() != c.dstW || dst.Bounds().Dy() != c.dstH {
+				t.Fatalf("缩略图应为%dx%d，实际为%dx%d", c.dstW, c.dstH, dst.Bounds().Dx(), dst.Bounds().Dy())
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package notify
+
+import (
+	"kama_chat_server/internal/service/notify"
+	"testing"
+	"time"
+)
+
+type fakeStore struct {
+	settings map[string]*notify.Setting
+	muted    map[string]time.Time
+}
+
+func (f *fakeStore) GetSetting(userId string) (*notify.Setting, error) {
+	return f.settings[userId], nil
+}
+
+func (f *fakeStore) MutedUntil(userId, targetId string) (time.Time, error) {
+	return f.muted[userId+"_"+targetId], nil
+}
+
+func TestDispatcherCoalesceAndMute(t *testing.T) {
+	store := &fakeStore{
+		settings: map[string]*notify.Setting{
+			"U1": {Provider: notify.ProviderFake, Target: "token1"},
+			"U2": {Provider: notify.ProviderFake, Target: "token2"},
+		},
+		muted: map[string]time.Time{
+			"U2_G1": time.Now().Add(time.Hour),
+		},
+	}
+	fake := notify.NewFakeProvider("")
+	dispatcher := notify.NewDispatcher(store, []notify.Provider{fake}, notify.Options{
+		CoalesceWindow: time.Hour,
+	})
+	for i := 0; i < 3; i++ {
+		dispatcher.Enqueue("U1", notify.Item{TargetId: "U3", SendName: "张三", Preview: "你好"})
+	}
+	dispatcher.Enqueue("U2", notify.Item{TargetId: "G1", SendName: "张三", Preview: "你好"})
+	dispatcher.Enqueue("U4", notify.Item{TargetId: "U3", SendName: "张三", Preview: "你好"})
+	dispatcher.Flush()
+
+	sent := fake.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("应只发送1条合并通知，实际%d条", len(sent))
+	}
+	if sent[0].UserId != "U1" || sent[0].Count != 3 || sent[0].Target != "token1" {
+		t.Fatalf("合并通知内容错误: %+v", sent[0])
+	}
+}
+
+func TestQuietDelay(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	cases := []struct {
+		now   time.Time
+		start string
+		end   string
+		delay time.Duration
+	}{
+		{day.Add(23 * time.Hour), "22:00", "08:00", 9 * time.Hour},
+		{day.Add(7 * time.Hour), "22:00", "08:00", time.Hour},
+		{day.Add(12 * time.Hour), "22:00", "08:00", 0},
+		{day.Add(13 * time.Hour), "12:00", "14:00", time.Hour},
+		{day.Add(13 * time.Hour), "", "", 0},
+	}
+	for _, c := range cases {
+		if delay := notify.QuietDelay(c.now, c.start, c.end); delay != c.delay {
+			t.Fatalf("%s %s-%s 期望%v，实际%v", c.now.Format("15:04"), c.start, c.end, c.delay, delay)
+		}
+	}
+}
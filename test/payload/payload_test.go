@@ -0,0 +1,72 @@
+package payload
+
+import (
+	"encoding/json"
+	"errors"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/internal/model"
+	"kama_chat_server/internal/service/payload"
+	"kama_chat_server/pkg/enum/message/message_type_enum"
+	"testing"
+)
+
+type fakeStore struct {
+	messages map[string]*model.Message
+}
+
+func (f *fakeStore) Image(url string) (*model.ImagePayload, error) {
+	return nil, errors.New("图片格式不支持")
+}
+
+func (f *fakeStore) ContactCard(uuid string) (*model.ContactCardPayload, error) {
+	return &model.ContactCardPayload{Uuid: uuid, Name: "名片"}, nil
+}
+
+func (f *fakeStore) Message(uuid string) (*model.Message, error) {
+	return f.messages[uuid], nil
+}
+
+func newStore() *fakeStore {
+	return &fakeStore{messages: map[string]*model.Message{
+		// U2和U3之间的私聊
+		"M1": {Uuid: "M1", SendId: "U2", ReceiveId: "U3", SendName: "李四", Type: message_type_enum.Text, Content: "私密内容"},
+		// U1和U3之间的私聊
+		"M2": {Uuid: "M2", SendId: "U3", ReceiveId: "U1", SendName: "王五", Type: message_type_enum.Text, Content: "你好"},
+	}}
+}
+
+func replyMessage(sendId, receiveId, messageId string) request.ChatMessageRequest {
+	return request.ChatMessageRequest{
+		Type:      message_type_enum.Reply,
+		Content:   "回复",
+		SendId:    sendId,
+		ReceiveId: receiveId,
+		Payload:   json.RawMessage(`{"reply":{"message_id":"` + messageId + `"}}`),
+	}
+}
+
+// TestReplyForgedSendId 客户端伪造send_id引用别人私聊中的消息，按连接的用户id校验后应被拒绝
+func TestReplyForgedSendId(t *testing.T) {
+	store := newStore()
+	// U1连接上发来的帧，send_id伪造成U2，想引用U2和U3之间的M1
+	message := replyMessage("U2", "U3", "M1")
+	// Read在校验前把send_id替换为连接的用户id
+	message.SendId = "U1"
+	if _, err := payload.Build(store, message); err == nil {
+		t.Fatal("伪造send_id引用其他会话的消息应被拒绝")
+	}
+
+	reply, err := payload.Build(store, replyMessage("U1", "U3", "M2"))
+	if err != nil {
+		t.Fatalf("引用自己会话中的消息应通过: %v", err)
+	}
+	if reply.Reply == nil || reply.Reply.Preview != "你好" || reply.Reply.SendId != "U3" {
+		t.Fatalf("引用摘要错误: %+v", reply.Reply)
+	}
+}
+
+func TestReplyMissingMessage(t *testing.T) {
+	if _, err := payload.Build(newStore(), replyMessage("U1", "U3", "M404")); err == nil {
+		t.Fatal("引用不存在的消息应被拒绝")
+	}
+}
@@ -0,0 +1,19 @@
+package sign
+
+import (
+	"kama_chat_server/pkg/util/sign"
+	"testing"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	signature := sign.Sign("secret", "M2024010112345678901", "U2024010112345678901", "a.png", "1700000000")
+	if !sign.Verify("secret", signature, "M2024010112345678901", "U2024010112345678901", "a.png", "1700000000") {
+		t.Fatal("签名校验失败")
+	}
+	if sign.Verify("secret", signature, "M2024010112345678901", "U2024010112345678902", "a.png", "1700000000") {
+		t.Fatal("篡改字段后签名不应通过")
+	}
+	if sign.Verify("other", signature, "M2024010112345678901", "U2024010112345678901", "a.png", "1700000000") {
+		t.Fatal("密钥不同签名不应通过")
+	}
+}
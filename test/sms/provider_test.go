@@ -0,0 +1,60 @@
+package sms
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"kama_chat_server/internal/service/sms/provider"
+	"kama_chat_server/pkg/util/sign"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFakeProviderRecordsCodes(t *testing.T) {
+	fake := provider.NewFakeProvider()
+	var smsProvider provider.SmsProvider = fake
+	if _, ok := smsProvider.(provider.CodeVerifier); ok {
+		t.Fatal("假渠道不应自己校验验证码")
+	}
+	_ = smsProvider.SendCode(context.Background(), "13800000000", "111111")
+	_ = smsProvider.SendCode(context.Background(), "13900000000", "222222")
+	_ = smsProvider.SendCode(context.Background(), "13800000000", "333333")
+	if code := fake.LastCode("13800000000"); code != "333333" {
+		t.Fatalf("最近的验证码应为333333，实际为%s", code)
+	}
+	if code := fake.LastCode("13700000000"); code != "" {
+		t.Fatalf("未发送的手机号不应有验证码，实际为%s", code)
+	}
+	if len(fake.Sent()) != 3 {
+		t.Fatalf("应记录3条，实际为%d", len(fake.Sent()))
+	}
+}
+
+func TestWebhookProviderSignsPayload(t *testing.T) {
+	var got struct {
+		Telephone string            `json:"telephone"`
+		Params    map[string]string `json:"params"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !sign.Verify("secret", r.Header.Get("X-Kama-Signature"), string(body)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.Unmarshal(body, &got)
+	}))
+	defer server.Close()
+
+	webhook := &provider.WebhookProvider{Url: server.URL, Secret: "secret"}
+	if err := webhook.SendCode(context.Background(), "13800000000", "123456"); err != nil {
+		t.Fatal(err)
+	}
+	if got.Telephone != "13800000000" || got.Params["code"] != "123456" {
+		t.Fatalf("网关收到的内容不正确: %+v", got)
+	}
+	webhook.Secret = "other"
+	if err := webhook.SendCode(context.Background(), "13800000000", "123456"); err == nil {
+		t.Fatal("签名错误时网关返回401，应返回错误")
+	}
+}
@@ -0,0 +1,81 @@
+package totp
+
+import (
+	"encoding/base32"
+	"kama_chat_server/pkg/util/totp"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238附录B的SHA1测试向量，取后6位
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeMatchesRfcVectors(t *testing.T) {
+	cases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range cases {
+		code, err := totp.CodeAt(rfcSecret, totp.Step(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != want {
+			t.Fatalf("时间%d的验证码应为%s，实际为%s", unix, want, code)
+		}
+	}
+}
+
+func TestValidateAllowsSkew(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	previous, _ := totp.CodeAt(secret, totp.Step(now)-1)
+	ok, step, err := totp.Validate(secret, previous, now, 1)
+	if err != nil || !ok || step != totp.Step(now)-1 {
+		t.Fatalf("上一个时间步的验证码应通过，ok=%v step=%d err=%v", ok, step, err)
+	}
+	old, _ := totp.CodeAt(secret, totp.Step(now)-3)
+	if ok, _, _ := totp.Validate(secret, old, now, 1); ok {
+		t.Fatal("超出误差范围的验证码不应通过")
+	}
+	if ok, _, _ := totp.Validate(secret, "12345", now, 1); ok {
+		t.Fatal("位数不对的验证码不应通过")
+	}
+}
+
+func TestUriAndRecoveryCodes(t *testing.T) {
+	uri := totp.URI("KamaChat", "13800000000", "JBSWY3DPEHPK3PXP")
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Scheme != "otpauth" || parsed.Host != "totp" || parsed.Path != "/KamaChat:13800000000" {
+		t.Fatalf("otpauth地址格式错误: %s", uri)
+	}
+	if parsed.Query().Get("secret") != "JBSWY3DPEHPK3PXP" || parsed.Query().Get("issuer") != "KamaChat" {
+		t.Fatalf("otpauth参数错误: %s", uri)
+	}
+
+	codes, err := totp.GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' || seen[code] {
+			t.Fatalf("恢复码格式错误或重复: %s", code)
+		}
+		seen[code] = true
+	}
+	if totp.NormalizeRecoveryCode(" "+strings.ToUpper(codes[0])+" ") != strings.Replace(codes[0], "-", "", 1) {
+		t.Fatal("恢复码规范化后应忽略大小写、空格和连字符")
+	}
+}
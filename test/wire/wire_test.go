@@ -0,0 +1,144 @@
+package wire
+
+import (
+	"encoding/json"
+	"kama_chat_server/internal/dto/request"
+	"kama_chat_server/pkg/util/wire"
+	"testing"
+)
+
+func newChatMessage() request.ChatMessageRequest {
+	return request.ChatMessageRequest{
+		SessionId: "S20240101123456",
+		Type:      4,
+		Content:   "",
+		SendId:    "U20240101123456",
+		ReceiveId: "G20240101654321",
+		Payload:   json.RawMessage(`{"width":640,"height":480}`),
+		FrameId:   "f-1",
+	}
+}
+
+func TestMsgPackRoundTrip(t *testing.T) {
+	message := newChatMessage()
+	data, err := wire.MsgPack.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded request.ChatMessageRequest
+	if err := wire.MsgPack.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.SessionId != message.SessionId || decoded.Type != message.Type ||
+		decoded.SendId != message.SendId || decoded.ReceiveId != message.ReceiveId || decoded.FrameId != message.FrameId {
+		t.Fatalf("解码结果不一致: %+v", decoded)
+	}
+	if string(decoded.Payload) != string(message.Payload) {
+		t.Fatalf("payload应保持原始json，实际为%s", decoded.Payload)
+	}
+}
+
+func TestMsgPackUsesJsonFieldNames(t *testing.T) {
+	data, err := wire.MsgPack.Marshal(newChatMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := wire.MsgPack.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"session_id", "send_id", "receive_id", "payload", "frame_id"} {
+		if _, ok := fields[key]; !ok {
+			t.Fatalf("缺少字段%s: %v", key, fields)
+		}
+	}
+	if _, ok := fields["SendId"]; ok {
+		t.Fatal("字段名应与json tag一致")
+	}
+}
+
+func TestMsgPackSmallerThanJSON(t *testing.T) {
+	message := newChatMessage()
+	jsonData, _ := wire.JSON.Marshal(message)
+	msgpackData, _ := wire.MsgPack.Marshal(message)
+	if len(msgpackData) >= len(jsonData) {
+		t.Fatalf("msgpack编码(%d字节)应小于json编码(%d字节)", len(msgpackData), len(jsonData))
+	}
+}
+
+func TestDetect(t *testing.T) {
+	message := newChatMessage()
+	jsonData, _ := wire.JSON.Marshal(message)
+	msgpackData, _ := wire.MsgPack.Marshal(message)
+	if codec, err := wire.Detect(jsonData); err != nil || codec.Name() != wire.NameJSON {
+		t.Fatalf("应识别为json: %v", err)
+	}
+	if codec, err := wire.Detect(append([]byte(" \n"), jsonData...)); err != nil || codec.Name() != wire.NameJSON {
+		t.Fatalf("带前导空白的json应识别为json: %v", err)
+	}
+	if codec, err := wire.Detect(msgpackData); err != nil || codec.Name() != wire.NameMsgPack {
+		t.Fatalf("应识别为msgpack: %v", err)
+	}
+	if _, err := wire.Detect([]byte("hello")); err == nil {
+		t.Fatal("无法识别的内容应返回错误")
+	}
+	if _, err := wire.Detect(nil); err == nil {
+		t.Fatal("空内容应返回错误")
+	}
+	for _, data := range [][]byte{jsonData, msgpackData} {
+		var decoded request.ChatMessageRequest
+		if err := wire.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.SendId != message.SendId {
+			t.Fatalf("自动识别编码后解码结果不一致: %+v", decoded)
+		}
+	}
+}
+
+func TestBinaryClientFrame(t *testing.T) {
+	message := newChatMessage()
+	data, err := wire.MsgPack.Marshal(map[string]interface{}{
+		"v":       1,
+		"type":    "chat_message",
+		"id":      "f-2",
+		"payload": message,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frame request.BinaryClientFrame
+	if err := wire.MsgPack.Unmarshal(data, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Version != 1 || frame.Type != "chat_message" || frame.Id != "f-2" {
+		t.Fatalf("帧头解码错误: %+v", frame)
+	}
+	if frame.Payload == nil || frame.Payload.ReceiveId != message.ReceiveId {
+		t.Fatalf("payload解码错误: %+v", frame.Payload)
+	}
+
+	ping, _ := wire.MsgPack.Marshal(map[string]interface{}{"v": 1, "type": "ping", "id": "f-3"})
+	var pingFrame request.BinaryClientFrame
+	if err := wire.MsgPack.Unmarshal(ping, &pingFrame); err != nil {
+		t.Fatal(err)
+	}
+	if pingFrame.Type != "ping" || pingFrame.Payload != nil {
+		t.Fatalf("ping帧不应有payload: %+v", pingFrame)
+	}
+}
+
+func TestSubprotocol(t *testing.T) {
+	if wire.BySubprotocol(wire.SubprotocolMsgPack) != wire.MsgPack {
+		t.Fatal("msgpack子协议应使用msgpack编码")
+	}
+	if wire.BySubprotocol(wire.SubprotocolJSON) != wire.JSON {
+		t.Fatal("json子协议应使用json编码")
+	}
+	if wire.BySubprotocol("") != nil {
+		t.Fatal("未协商子协议时应返回nil")
+	}
+	if wire.ByName("unknown") != wire.JSON {
+		t.Fatal("未知的编码名称应使用json")
+	}
+}